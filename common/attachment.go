@@ -0,0 +1,116 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+// Walks the database and maps "<entry path>-<file name>" keys to attachments and entry paths to entries
+func AttachmentPaths(db *gokeepasslib.Database) (map[string]gokeepasslib.BinaryReference, map[string]gokeepasslib.Entry) {
+	attachmentsMap := map[string]gokeepasslib.BinaryReference{}
+	entryMap := map[string]gokeepasslib.Entry{}
+	entryCallback := func(entryPath string, entry gokeepasslib.Entry, depth int) {
+		entryMap[entryPath] = entry
+		for _, attachment := range entry.Binaries {
+			// attachment names are guaranteed by keepass to be unique
+			entryAttachmentPath := fmt.Sprintf("%s-%s", entryPath, attachment.Name)
+			// titles and file names may both contain dashes, keep the first attachment as for entry paths
+			if _, keyExists := attachmentsMap[entryAttachmentPath]; keyExists {
+				log.Println(fmt.Sprintf("[WARNING] Ambiguous path for attachment: %s", entryAttachmentPath))
+				continue
+			}
+			attachmentsMap[entryAttachmentPath] = attachment
+		}
+	}
+	// the limits are checked when the database is opened
+	WalkDatabase(db, nil, entryCallback)
+	return attachmentsMap, entryMap
+}
+
+// Returns the entry of an attachment found in the attachments map by its attachment path
+func AttachmentEntry(entryMap map[string]gokeepasslib.Entry, attachmentPath string, attachment gokeepasslib.BinaryReference) gokeepasslib.Entry {
+	return entryMap[strings.TrimSuffix(attachmentPath, "-"+attachment.Name)]
+}
+
+// Retrieves a copy of the contents of a file attachment, which the caller may clear with ZeroBytes after use
+func ReadAttachment(db *gokeepasslib.Database, attachment gokeepasslib.BinaryReference) ([]byte, error) {
+	attachmentBinary := attachment.Find(db)
+	if attachmentBinary == nil {
+		return nil, fmt.Errorf("Could not find attachment binary for file: %s", attachment.Name)
+	}
+	if !db.Header.IsKdbx4() && !attachmentBinary.Compressed.Bool {
+		// gokeepasslib pads uncompressed base64 binaries with zero bytes up to the decoded length estimate
+		return base64.StdEncoding.DecodeString(string(attachmentBinary.Content))
+	}
+	if db.Header.IsKdbx4() && !attachmentBinary.Compressed.Bool {
+		// GetContentBytes would decode kdbx 4 contents which happen to be valid base64
+		return append([]byte{}, attachmentBinary.Content...), nil
+	}
+	return attachmentBinary.GetContentBytes()
+}
+
+// Returned by ReadAttachmentLimited for attachments larger than the limit
+var ErrAttachmentTooLarge = errors.New("attachment exceeds the size limit")
+
+// Retrieves a copy of the contents of a file attachment like ReadAttachment, failing with ErrAttachmentTooLarge
+// before uncompressed contents are decoded, and while compressed contents are decompressed, if the attachment
+// is larger than maxSize bytes
+func ReadAttachmentLimited(db *gokeepasslib.Database, attachment gokeepasslib.BinaryReference, maxSize int64) ([]byte, error) {
+	attachmentBinary := attachment.Find(db)
+	if attachmentBinary == nil {
+		return nil, fmt.Errorf("Could not find attachment binary for file: %s", attachment.Name)
+	}
+	content := attachmentBinary.Content
+	if !attachmentBinary.Compressed.Bool {
+		size := int64(len(content))
+		if !db.Header.IsKdbx4() {
+			size = base64DecodedSize(content)
+		}
+		if size > maxSize {
+			return nil, ErrAttachmentTooLarge
+		}
+		return ReadAttachment(db, attachment)
+	}
+	if !db.Header.IsKdbx4() {
+		// only the compressed contents are decoded, they are at most as large as the stored binary
+		decoded, err := base64.StdEncoding.DecodeString(string(content))
+		if err != nil {
+			return nil, err
+		}
+		content = decoded
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	contents, err := io.ReadAll(io.LimitReader(reader, maxSize+1))
+	if err != nil && err != io.ErrUnexpectedEOF {
+		ZeroBytes(contents)
+		return nil, err
+	}
+	if int64(len(contents)) > maxSize {
+		ZeroBytes(contents)
+		return nil, ErrAttachmentTooLarge
+	}
+	return contents, nil
+}
+
+// Size of base64 encoded contents once decoded, without decoding them
+func base64DecodedSize(content []byte) int64 {
+	characters := int64(0)
+	for _, c := range content {
+		if c != '=' && c != '\r' && c != '\n' {
+			characters++
+		}
+	}
+	return characters * 6 / 8
+}
@@ -0,0 +1,61 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"testing"
+
+	"github.com/tobischo/gokeepasslib/v3"
+	w "github.com/tobischo/gokeepasslib/v3/wrappers"
+)
+
+func gzipTestContents(t *testing.T, contents []byte) []byte {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestReadAttachmentLimited(t *testing.T) {
+	contents := bytes.Repeat([]byte("0123456789"), 100)
+	compressed := gzipTestContents(t, contents)
+	testCases := []struct {
+		name       string
+		version    gokeepasslib.DatabaseOption
+		compressed bool
+		content    []byte
+	}{
+		{"kdbx 4", gokeepasslib.WithDatabaseKDBXVersion4(), false, contents},
+		{"kdbx 4 compressed", gokeepasslib.WithDatabaseKDBXVersion4(), true, compressed},
+		{"kdbx 3.1", gokeepasslib.WithDatabaseKDBXVersion3(), false, []byte(base64.StdEncoding.EncodeToString(contents))},
+		{"kdbx 3.1 compressed", gokeepasslib.WithDatabaseKDBXVersion3(), true, []byte(base64.StdEncoding.EncodeToString(compressed))},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			db := gokeepasslib.NewDatabase(testCase.version)
+			binary := gokeepasslib.Binary{Content: testCase.content, Compressed: w.NewBoolWrapper(testCase.compressed)}
+			if db.Header.IsKdbx4() {
+				db.Content.InnerHeader.Binaries = append(db.Content.InnerHeader.Binaries, binary)
+			} else {
+				db.Content.Meta.Binaries = append(db.Content.Meta.Binaries, binary)
+			}
+			attachment := gokeepasslib.NewBinaryReference("digits.txt", 0)
+			read, err := ReadAttachmentLimited(db, attachment, int64(len(contents)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(read, contents) {
+				t.Errorf("unexpected contents %q", read)
+			}
+			if _, err := ReadAttachmentLimited(db, attachment, int64(len(contents)-1)); err != ErrAttachmentTooLarge {
+				t.Errorf("expected the attachment to be too large, got %v", err)
+			}
+		})
+	}
+}
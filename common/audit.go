@@ -0,0 +1,133 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+// A single access to a value or attachment, the value itself is never recorded
+type AuditRecord struct {
+	Time           string `json:"time"`
+	Action         string `json:"action"`
+	Database       string `json:"database"`
+	DatabaseSha256 string `json:"database_sha256"`
+	EntryUUID      string `json:"entry_uuid"`
+	EntryPath      string `json:"entry_path"`
+	Field          string `json:"field,omitempty"`
+	Attachment     string `json:"attachment,omitempty"`
+	Component      string `json:"component"`
+	BuildName      string `json:"build_name,omitempty"`
+}
+
+// Collects audit records and appends them to the audit log file as json lines.
+// A nil audit log records nothing so that callers do not need to check whether it is enabled.
+type AuditLog struct {
+	path      string
+	database  string
+	sha256    string
+	component string
+	buildName string
+	entries   map[gokeepasslib.UUID]string
+	records   []AuditRecord
+}
+
+// Creates an audit log for the database file, returns nil if no audit log path is given. The digest
+// is that of the contents the database was opened from, as returned by OpenDatabase, the file is not
+// read again as it may have been replaced since.
+func NewAuditLog(auditLog string, keepassFile string, databaseSha256 string, component string, buildName string) (*AuditLog, error) {
+	if auditLog == "" {
+		return nil, nil
+	}
+	database, err := filepath.Abs(keepassFile)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{
+		path:      auditLog,
+		database:  database,
+		sha256:    databaseSha256,
+		component: component,
+		buildName: buildName,
+	}, nil
+}
+
+// Records that a field or attachment of an entry was read
+func (a *AuditLog) Read(db *gokeepasslib.Database, entry gokeepasslib.Entry, field string, attachment string) {
+	if a == nil {
+		return
+	}
+	if a.entries == nil {
+		// index the entry paths once, keyed by uuid as callers may have looked the entry up by either
+		a.entries = map[gokeepasslib.UUID]string{}
+		WalkDatabase(db, nil, func(entryPath string, entry gokeepasslib.Entry, depth int) {
+			if _, keyExists := a.entries[entry.UUID]; !keyExists && strings.HasPrefix(entryPath, "/") {
+				a.entries[entry.UUID] = entryPath
+			}
+		})
+	}
+	a.record("read", a.entries[entry.UUID], entry.UUID, field, attachment)
+}
+
+// Records that an attachment of an entry was written
+func (a *AuditLog) Write(entryPath string, entryUUID gokeepasslib.UUID, attachment string) {
+	if a == nil {
+		return
+	}
+	a.record("write", entryPath, entryUUID, "", attachment)
+}
+
+func (a *AuditLog) record(action string, entryPath string, entryUUID gokeepasslib.UUID, field string, attachment string) {
+	uuidString, _ := FormatUUID(entryUUID)
+	a.records = append(a.records, AuditRecord{
+		Time:           time.Now().UTC().Format(time.RFC3339Nano),
+		Action:         action,
+		Database:       a.database,
+		DatabaseSha256: a.sha256,
+		EntryUUID:      uuidString,
+		EntryPath:      entryPath,
+		Field:          field,
+		Attachment:     attachment,
+		Component:      a.component,
+		BuildName:      a.buildName,
+	})
+}
+
+// Appends the collected records to the audit log file
+func (a *AuditLog) Flush() error {
+	if a == nil || len(a.records) == 0 {
+		return nil
+	}
+	var lines []byte
+	for _, record := range a.records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+	file, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	// a single write keeps the records of concurrent builds from interleaving
+	if _, err := file.Write(lines); err != nil {
+		file.Close()
+		return err
+	}
+	a.records = nil
+	return file.Close()
+}
+
+// Flushes the audit log when deferred by a provisioner, so that the values read before a later
+// step failed are recorded as well. A flush error is returned through err unless it is already set.
+func (a *AuditLog) FlushOnReturn(err *error) {
+	if flushErr := a.Flush(); flushErr != nil && *err == nil {
+		*err = fmt.Errorf("Unable to write audit log: %s", flushErr)
+	}
+}
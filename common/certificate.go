@@ -0,0 +1,119 @@
+package common
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Certificates and unencrypted private keys found in a PEM or DER attachment
+type CertificateBundle struct {
+	Certificates []*x509.Certificate
+	PrivateKeys  []crypto.Signer
+}
+
+// Parses the certificates and private keys of an attachment, returns nil if it contains no certificate
+func ParseCertificateBundle(data []byte) *CertificateBundle {
+	bundle := &CertificateBundle{}
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		switch {
+		case block.Type == "CERTIFICATE":
+			if certificate, err := x509.ParseCertificate(block.Bytes); err == nil {
+				bundle.Certificates = append(bundle.Certificates, certificate)
+			}
+		case strings.HasSuffix(block.Type, "PRIVATE KEY"):
+			if key := ParsePrivateKey(block.Bytes); key != nil {
+				bundle.PrivateKeys = append(bundle.PrivateKeys, key)
+			}
+		}
+	}
+	if len(bundle.Certificates) == 0 {
+		// not pem encoded, try der encoded certificates
+		if certificates, err := x509.ParseCertificates(data); err == nil {
+			bundle.Certificates = certificates
+		}
+	}
+	if len(bundle.Certificates) == 0 {
+		return nil
+	}
+	return bundle
+}
+
+// Parses a PKCS#8, PKCS#1 or SEC 1 DER encoded private key, returns nil if it is none of them
+func ParsePrivateKey(der []byte) crypto.Signer {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer
+		}
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key
+	}
+	return nil
+}
+
+// Checks that every certificate is valid now and does not expire within the validity window, and that
+// each private key matches a certificate of the bundle, the leaf, which need not be the first certificate
+func (b *CertificateBundle) Check(minValidity time.Duration, now time.Time) error {
+	for _, certificate := range b.Certificates {
+		if certificate.NotBefore.After(now) {
+			return fmt.Errorf("Certificate \"%s\" is not valid before %s", certificate.Subject, certificate.NotBefore.Format(time.RFC3339))
+		}
+		if certificate.NotAfter.Before(now.Add(minValidity)) {
+			return fmt.Errorf("Certificate \"%s\" expires at %s which is within %s", certificate.Subject, certificate.NotAfter.Format(time.RFC3339), minValidity)
+		}
+	}
+	for _, key := range b.PrivateKeys {
+		if b.Leaf(key) == nil {
+			subjects := []string{}
+			for _, certificate := range b.Certificates {
+				subjects = append(subjects, fmt.Sprintf("\"%s\"", certificate.Subject))
+			}
+			return fmt.Errorf("Private key does not match any certificate of %s", strings.Join(subjects, ", "))
+		}
+	}
+	return nil
+}
+
+// Returns the certificate of the bundle holding the public key of the private key, nil if there is none
+func (b *CertificateBundle) Leaf(key crypto.Signer) *x509.Certificate {
+	publicKey, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok {
+		return nil
+	}
+	for _, certificate := range b.Certificates {
+		if publicKey.Equal(certificate.PublicKey) {
+			return certificate
+		}
+	}
+	return nil
+}
+
+// Summarises a certificate for display
+func DescribeCertificate(certificate *x509.Certificate) string {
+	sans := append([]string{}, certificate.DNSNames...)
+	for _, ip := range certificate.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	sans = append(sans, certificate.EmailAddresses...)
+	for _, uri := range certificate.URIs {
+		sans = append(sans, uri.String())
+	}
+	description := fmt.Sprintf("subject: %s; issuer: %s", certificate.Subject, certificate.Issuer)
+	if len(sans) > 0 {
+		description += fmt.Sprintf("; sans: %s", strings.Join(sans, ", "))
+	}
+	return description + fmt.Sprintf("; not after: %s", certificate.NotAfter.Format(time.RFC3339))
+}
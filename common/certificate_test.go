@@ -0,0 +1,181 @@
+package common
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+var certificateTestNow = time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+func certificateTestKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// Creates a certificate valid between the times, self-signed unless a parent is given
+func certificateTestCertificate(t *testing.T, template *x509.Certificate, key crypto.Signer, parent *x509.Certificate, parentKey crypto.Signer) *x509.Certificate {
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	if template.NotBefore.IsZero() {
+		template.NotBefore = certificateTestNow.AddDate(0, -1, 0)
+	}
+	if template.NotAfter.IsZero() {
+		template.NotAfter = certificateTestNow.AddDate(1, 0, 0)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate
+}
+
+// A ca and a leaf certificate signed by it, with their keys
+func certificateTestChain(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey, *x509.Certificate, *ecdsa.PrivateKey) {
+	caKey := certificateTestKey(t)
+	ca := certificateTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "Example CA"}, IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}, caKey, nil, nil)
+	leafKey := certificateTestKey(t)
+	leaf := certificateTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "www.example.com"}, DNSNames: []string{"www.example.com"}}, leafKey, ca, caKey)
+	return ca, caKey, leaf, leafKey
+}
+
+func certificateTestPEM(t *testing.T, certificates []*x509.Certificate, keys ...crypto.Signer) []byte {
+	var data []byte
+	for _, certificate := range certificates {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw})...)
+	}
+	for _, key := range keys {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})...)
+	}
+	return data
+}
+
+func TestParseCertificateBundle(t *testing.T) {
+	ca, _, leaf, leafKey := certificateTestChain(t)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDER, err := x509.MarshalECPrivateKey(leafKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name         string
+		data         []byte
+		certificates int
+		keys         int
+	}{
+		{"pem chain and pkcs8 key", certificateTestPEM(t, []*x509.Certificate{leaf, ca}, leafKey), 2, 1},
+		{"pem sec1 key", append(certificateTestPEM(t, []*x509.Certificate{leaf}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER})...), 1, 1},
+		{"pem pkcs1 key", append(certificateTestPEM(t, []*x509.Certificate{leaf}), pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})...), 1, 1},
+		// keys which cannot be parsed, such as encrypted keys, are skipped
+		{"pem unknown key", append(certificateTestPEM(t, []*x509.Certificate{leaf}), pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: []byte("encrypted")})...), 1, 0},
+		{"der", leaf.Raw, 1, 0},
+		{"der chain", append(append([]byte{}, leaf.Raw...), ca.Raw...), 2, 0},
+		{"text", []byte("not a certificate\n"), 0, 0},
+		{"pem key only", certificateTestPEM(t, nil, leafKey), 0, 0},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			bundle := ParseCertificateBundle(testCase.data)
+			if testCase.certificates == 0 {
+				if bundle != nil {
+					t.Fatalf("expected no bundle, got %d certificates", len(bundle.Certificates))
+				}
+				return
+			}
+			if bundle == nil {
+				t.Fatal("expected a bundle")
+			}
+			if len(bundle.Certificates) != testCase.certificates || len(bundle.PrivateKeys) != testCase.keys {
+				t.Errorf("expected %d certificates and %d keys, got %d and %d", testCase.certificates, testCase.keys, len(bundle.Certificates), len(bundle.PrivateKeys))
+			}
+			if !bundle.Certificates[0].Equal(leaf) {
+				t.Errorf("expected the leaf first, got %s", bundle.Certificates[0].Subject)
+			}
+		})
+	}
+}
+
+func TestCertificateBundleCheck(t *testing.T) {
+	ca, caKey, leaf, leafKey := certificateTestChain(t)
+	expired := certificateTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "expired"}, NotBefore: certificateTestNow.AddDate(-1, 0, 0), NotAfter: certificateTestNow.AddDate(0, 0, -1)}, leafKey, ca, caKey)
+	notYetValid := certificateTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "not yet valid"}, NotBefore: certificateTestNow.AddDate(0, 0, 1)}, leafKey, ca, caKey)
+	expiring := certificateTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "expiring"}, NotAfter: certificateTestNow.AddDate(0, 0, 10)}, leafKey, ca, caKey)
+	testCases := []struct {
+		name        string
+		data        []byte
+		minValidity time.Duration
+		expected    string
+	}{
+		{"valid", certificateTestPEM(t, []*x509.Certificate{leaf, ca}, leafKey), 720 * time.Hour, ""},
+		// the leaf is found by its private key
+		{"leaf not first", certificateTestPEM(t, []*x509.Certificate{ca, leaf}, leafKey), 720 * time.Hour, ""},
+		{"expired", certificateTestPEM(t, []*x509.Certificate{expired}), 0, "Certificate \"CN=expired\" expires at"},
+		{"not yet valid", certificateTestPEM(t, []*x509.Certificate{notYetValid}), 0, "Certificate \"CN=not yet valid\" is not valid before"},
+		{"within min validity", certificateTestPEM(t, []*x509.Certificate{expiring, ca}, leafKey), 720 * time.Hour, "Certificate \"CN=expiring\" expires at " + certificateTestNow.AddDate(0, 0, 10).Format(time.RFC3339) + " which is within 720h0m0s"},
+		{"outside min validity", certificateTestPEM(t, []*x509.Certificate{expiring, ca}, leafKey), 24 * time.Hour, ""},
+		{"mismatched key", certificateTestPEM(t, []*x509.Certificate{leaf, ca}, certificateTestKey(t)), 0, "Private key does not match any certificate of \"CN=www.example.com\", \"CN=Example CA\""},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			bundle := ParseCertificateBundle(testCase.data)
+			err := bundle.Check(testCase.minValidity, certificateTestNow)
+			if testCase.expected == "" && err != nil {
+				t.Errorf("unexpected error %s", err)
+			}
+			if testCase.expected != "" && (err == nil || !strings.Contains(err.Error(), testCase.expected)) {
+				t.Errorf("expected an error containing %q, got %v", testCase.expected, err)
+			}
+		})
+	}
+	bundle := ParseCertificateBundle(certificateTestPEM(t, []*x509.Certificate{ca, leaf}, leafKey))
+	if found := bundle.Leaf(bundle.PrivateKeys[0]); found == nil || !found.Equal(leaf) {
+		t.Errorf("expected the leaf certificate, got %v", found)
+	}
+}
+
+func TestDescribeCertificate(t *testing.T) {
+	ca, caKey, _, _ := certificateTestChain(t)
+	uri, _ := url.Parse("spiffe://example.com/web")
+	certificate := certificateTestCertificate(t, &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "www.example.com", Organization: []string{"Example"}},
+		NotAfter:       time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+		DNSNames:       []string{"www.example.com", "example.com"},
+		IPAddresses:    []net.IP{net.ParseIP("192.0.2.1")},
+		EmailAddresses: []string{"admin@example.com"},
+		URIs:           []*url.URL{uri},
+	}, certificateTestKey(t), ca, caKey)
+	expected := "subject: CN=www.example.com,O=Example; issuer: CN=Example CA; sans: www.example.com, example.com, 192.0.2.1, admin@example.com, spiffe://example.com/web; not after: 2025-01-02T03:04:05Z"
+	if description := DescribeCertificate(certificate); description != expected {
+		t.Errorf("expected %q, got %q", expected, description)
+	}
+	if description := DescribeCertificate(ca); strings.Contains(description, "sans") {
+		t.Errorf("expected no sans, got %q", description)
+	}
+}
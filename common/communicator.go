@@ -0,0 +1,79 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// File info for in-memory contents, communicators use the mode for the uploaded file
+type memoryFileInfo struct {
+	name string
+	size int64
+	mode os.FileMode
+}
+
+func (fi memoryFileInfo) Name() string       { return fi.name }
+func (fi memoryFileInfo) Size() int64        { return fi.size }
+func (fi memoryFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi memoryFileInfo) ModTime() time.Time { return time.Now() }
+func (fi memoryFileInfo) IsDir() bool        { return false }
+func (fi memoryFileInfo) Sys() interface{}   { return nil }
+
+// Uploads in-memory contents to the destination path with the given file mode
+func UploadBytes(communicator packer.Communicator, destination string, contents []byte, mode os.FileMode) error {
+	var fileInfo os.FileInfo = memoryFileInfo{
+		name: destination[strings.LastIndex(destination, "/")+1:],
+		size: int64(len(contents)),
+		mode: mode,
+	}
+	return communicator.Upload(destination, bytes.NewReader(contents), &fileInfo)
+}
+
+// Runs a command on the guest, streaming its output to the ui, and fails on a non-zero exit status
+func RunCommand(ctx context.Context, ui packer.Ui, communicator packer.Communicator, command string) error {
+	cmd := &packer.RemoteCmd{Command: command}
+	if err := cmd.RunWithUi(ctx, communicator, ui); err != nil {
+		return err
+	}
+	if exitStatus := cmd.ExitStatus(); exitStatus != 0 {
+		return fmt.Errorf("Command exited with non-zero exit status %d: %s", exitStatus, command)
+	}
+	return nil
+}
+
+// Runs a command on the guest and returns its standard output, failing on a non-zero exit status
+func RunCommandOutput(ctx context.Context, communicator packer.Communicator, command string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := &packer.RemoteCmd{Command: command, Stdout: &stdout, Stderr: &stderr}
+	if err := communicator.Start(ctx, cmd); err != nil {
+		return "", err
+	}
+	if exitStatus := cmd.Wait(); exitStatus != 0 {
+		return "", fmt.Errorf("Command exited with non-zero exit status %d: %s: %s", exitStatus, command, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// Quotes a string for use as a single argument in a posix shell command
+func ShellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'"'"'`) + "'"
+}
+
+// Powershell also ends single quoted strings at the typographic single quotes, each is escaped by doubling it
+var powershellReplacer = strings.NewReplacer("'", "''", "\u2018", "\u2018\u2018", "\u2019", "\u2019\u2019", "\u201a", "\u201a\u201a", "\u201b", "\u201b\u201b")
+
+// Quotes a string in single quotes, powershell takes everything up to the closing quote literally
+func PowershellQuote(value string) string {
+	return "'" + powershellReplacer.Replace(value) + "'"
+}
+
+// Runs a powershell script from a windows command line, the script must not contain double quotes
+func PowershellCommand(script string) string {
+	return fmt.Sprintf(`powershell -NoProfile -NonInteractive -Command "%s"`, script)
+}
@@ -0,0 +1,73 @@
+package common
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// Manifest on the guest listing the files uploaded with ephemeral, kept outside of /tmp so that it survives reboots
+const (
+	DefaultEphemeralManifest        = "/var/tmp/packer-keepass-ephemeral"
+	DefaultWindowsEphemeralManifest = "C:/Windows/Temp/packer-keepass-ephemeral"
+)
+
+// Returns the manifest path, the default of the guest os type if it is not set
+func EphemeralManifest(manifest string, guestOSType string) string {
+	if manifest != "" {
+		return manifest
+	}
+	if guestOSType == "windows" {
+		return DefaultWindowsEphemeralManifest
+	}
+	return DefaultEphemeralManifest
+}
+
+// Appends the paths to the manifest on the guest. Each path is written base64 encoded on its own line,
+// so that no path needs quoting within the commands and paths containing newlines are kept.
+func RecordEphemeral(ctx context.Context, ui packer.Ui, communicator packer.Communicator, manifest string, guestOSType string, paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	encoded := []string{}
+	for _, path := range paths {
+		encoded = append(encoded, "'"+base64.StdEncoding.EncodeToString([]byte(path))+"'")
+	}
+	command := fmt.Sprintf("printf '%%s\\n' %s >> %s && chmod 600 %s", strings.Join(encoded, " "), ShellQuote(manifest), ShellQuote(manifest))
+	if guestOSType == "windows" {
+		command = PowershellCommand(fmt.Sprintf("Add-Content -LiteralPath %s -Value %s", PowershellQuote(manifest), strings.Join(encoded, ",")))
+	}
+	return RunCommand(ctx, ui, communicator, command)
+}
+
+// Reads the paths of the manifest on the guest, a missing manifest has no paths
+func ReadEphemeral(ctx context.Context, communicator packer.Communicator, manifest string, guestOSType string) ([]string, error) {
+	command := fmt.Sprintf("if [ -e %[1]s ]; then cat %[1]s; fi", ShellQuote(manifest))
+	if guestOSType == "windows" {
+		command = PowershellCommand(fmt.Sprintf("if (Test-Path -LiteralPath %[1]s) { Get-Content -LiteralPath %[1]s }", PowershellQuote(manifest)))
+	}
+	output, err := RunCommandOutput(ctx, communicator, command)
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	recorded := map[string]bool{}
+	for _, line := range strings.Split(output, "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		path, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid line in ephemeral manifest %s: %q", manifest, line)
+		}
+		// files uploaded more than once are removed once
+		if !recorded[string(path)] {
+			recorded[string(path)] = true
+			paths = append(paths, string(path))
+		}
+	}
+	return paths, nil
+}
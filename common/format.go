@@ -0,0 +1,270 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+// Signatures at the start of a keepass database file
+const (
+	keepassBaseSignature    uint32 = 0x9aa2d903
+	kdbxSecondarySignature  uint32 = 0xb54bfb67
+	kdbxPreReleaseSignature uint32 = 0xb54bfb66
+	kdbSecondarySignature   uint32 = 0xb54bfb65
+)
+
+// Outer header field ids
+const (
+	headerEndOfHeader       = 0
+	headerCipherID          = 2
+	headerCompressionFlags  = 3
+	headerMasterSeed        = 4
+	headerEncryptionIV      = 7
+	headerInnerRandomStream = 10
+	headerKdfParameters     = 11
+)
+
+// KDF ids which gokeepasslib does not define
+var (
+	kdfArgon2d  = gokeepasslib.KdfArgon2
+	KdfArgon2id = []byte{0x9e, 0x29, 0x8b, 0x19, 0x56, 0xdb, 0x47, 0x73, 0xb2, 0x3d, 0xfc, 0x3e, 0xc6, 0xf0, 0xa1, 0xe6}
+)
+
+// Argon2 version 1.3, the only one implemented by the argon2 package
+const argon2Version = 0x13
+
+// The version, cipher and key derivation function of a database file, used to report what is not supported
+type DatabaseFormat struct {
+	Version string
+	Cipher  string
+	KDF     string
+}
+
+func (f DatabaseFormat) String() string {
+	return fmt.Sprintf("%s (cipher %s, KDF %s)", f.Version, f.Cipher, f.KDF)
+}
+
+type headerField struct {
+	id   byte
+	data []byte
+}
+
+// The outer header of a kdbx file, parsed without the credentials
+type kdbxHeader struct {
+	major  uint16
+	minor  uint16
+	fields []headerField
+	// offset of the first byte after the header
+	end int
+}
+
+// Parses the signature and outer header fields of a kdbx file
+func readKdbxHeader(data []byte) (*kdbxHeader, error) {
+	if len(data) < 12 || binary.LittleEndian.Uint32(data[0:4]) != keepassBaseSignature {
+		return nil, fmt.Errorf("Not a KeePass database file")
+	}
+	switch binary.LittleEndian.Uint32(data[4:8]) {
+	case kdbxSecondarySignature:
+	case kdbSecondarySignature:
+		return nil, fmt.Errorf("Unsupported KeePass database format KDB (KeePass 1.x)")
+	case kdbxPreReleaseSignature:
+		return nil, fmt.Errorf("Unsupported KeePass database format KDBX pre-release (KeePass 2.0 beta)")
+	default:
+		return nil, fmt.Errorf("Not a KeePass database file")
+	}
+	header := &kdbxHeader{
+		minor: binary.LittleEndian.Uint16(data[8:10]),
+		major: binary.LittleEndian.Uint16(data[10:12]),
+	}
+	// kdbx 4 widened the field length from 2 to 4 bytes
+	lengthSize := 2
+	if header.major >= 4 {
+		lengthSize = 4
+	}
+	offset := 12
+	for {
+		if offset+1+lengthSize > len(data) {
+			return nil, fmt.Errorf("Truncated %s header", header.version())
+		}
+		id := data[offset]
+		length := int(binary.LittleEndian.Uint16(data[offset+1 : offset+3]))
+		if lengthSize == 4 {
+			length = int(binary.LittleEndian.Uint32(data[offset+1 : offset+5]))
+		}
+		offset += 1 + lengthSize
+		if length < 0 || offset+length > len(data) {
+			return nil, fmt.Errorf("Truncated %s header", header.version())
+		}
+		header.fields = append(header.fields, headerField{id: id, data: data[offset : offset+length]})
+		offset += length
+		if id == headerEndOfHeader {
+			break
+		}
+	}
+	header.end = offset
+	return header, nil
+}
+
+func (h *kdbxHeader) version() string {
+	return fmt.Sprintf("KDBX %d.%d", h.major, h.minor)
+}
+
+func (h *kdbxHeader) field(id byte) []byte {
+	for _, field := range h.fields {
+		if field.id == id {
+			return field.data
+		}
+	}
+	return nil
+}
+
+// Returns a copy of the header with the field replaced
+func (h *kdbxHeader) withField(id byte, data []byte) *kdbxHeader {
+	copied := &kdbxHeader{major: h.major, minor: h.minor}
+	for _, field := range h.fields {
+		if field.id == id {
+			field = headerField{id: id, data: data}
+		}
+		copied.fields = append(copied.fields, field)
+	}
+	return copied
+}
+
+// Serializes the signature and header fields
+func (h *kdbxHeader) bytes() []byte {
+	var buffer bytes.Buffer
+	binary.Write(&buffer, binary.LittleEndian, keepassBaseSignature)
+	binary.Write(&buffer, binary.LittleEndian, kdbxSecondarySignature)
+	binary.Write(&buffer, binary.LittleEndian, h.minor)
+	binary.Write(&buffer, binary.LittleEndian, h.major)
+	for _, field := range h.fields {
+		buffer.WriteByte(field.id)
+		if h.major >= 4 {
+			binary.Write(&buffer, binary.LittleEndian, uint32(len(field.data)))
+		} else {
+			binary.Write(&buffer, binary.LittleEndian, uint16(len(field.data)))
+		}
+		buffer.Write(field.data)
+	}
+	return buffer.Bytes()
+}
+
+// Parses the kdf parameters of a kdbx 4 header, kdbx 3 always uses aes-kdf
+func (h *kdbxHeader) kdfParameters() (*gokeepasslib.KdfParameters, error) {
+	if h.major < 4 {
+		return nil, nil
+	}
+	data := h.field(headerKdfParameters)
+	if data == nil {
+		return nil, fmt.Errorf("%s header has no KDF parameters", h.version())
+	}
+	return readKdfParameters(data)
+}
+
+// Describes the format of the database for error messages
+func (h *kdbxHeader) format() DatabaseFormat {
+	format := DatabaseFormat{Version: h.version(), Cipher: cipherName(h.field(headerCipherID)), KDF: "AES-KDF"}
+	if h.major >= 4 {
+		format.KDF = "unknown"
+		if parameters, err := h.kdfParameters(); err == nil {
+			format.KDF = kdfName(parameters.UUID)
+		}
+	}
+	return format
+}
+
+// Returns an error naming the format if the database cannot be read
+func (h *kdbxHeader) checkSupported() error {
+	format := h.format()
+	unsupported := func(reason string, args ...interface{}) error {
+		return fmt.Errorf("Unsupported KeePass database format %s: %s", format, fmt.Sprintf(reason, args...))
+	}
+	switch {
+	case h.major == 3 && h.minor <= 1:
+	case h.major == 4 && h.minor <= 1:
+	default:
+		return unsupported("only KDBX 3.1, 4.0 and 4.1 are supported")
+	}
+	cipherID := h.field(headerCipherID)
+	if !bytes.Equal(cipherID, gokeepasslib.CipherAES) && !bytes.Equal(cipherID, gokeepasslib.CipherChaCha20) {
+		return unsupported("only the AES-256 and ChaCha20 ciphers are supported")
+	}
+	if compression := h.field(headerCompressionFlags); len(compression) != 4 || binary.LittleEndian.Uint32(compression) > gokeepasslib.GzipCompressionFlag {
+		return unsupported("unknown compression")
+	}
+	if h.major < 4 {
+		if stream := h.field(headerInnerRandomStream); len(stream) != 4 || !supportedInnerStream(binary.LittleEndian.Uint32(stream)) {
+			return unsupported("only the Salsa20 and ChaCha20 inner random streams are supported")
+		}
+		return nil
+	}
+	parameters, err := h.kdfParameters()
+	if err != nil {
+		return unsupported("%s", err)
+	}
+	switch {
+	case isAesKdf(parameters.UUID):
+	case bytes.Equal(parameters.UUID, kdfArgon2d) || bytes.Equal(parameters.UUID, KdfArgon2id):
+		if parameters.Version != argon2Version {
+			return unsupported("only Argon2 version 1.3 is supported, found version 0x%x", parameters.Version)
+		}
+		if len(parameters.SecretKey) > 0 || len(parameters.AssocData) > 0 {
+			return unsupported("Argon2 secret keys and associated data are not supported")
+		}
+	default:
+		return unsupported("only the AES-KDF, Argon2d and Argon2id key derivation functions are supported")
+	}
+	return nil
+}
+
+func supportedInnerStream(streamID uint32) bool {
+	return streamID == gokeepasslib.SalsaStreamID || streamID == gokeepasslib.ChaChaStreamID
+}
+
+func isAesKdf(uuid []byte) bool {
+	return bytes.Equal(uuid, gokeepasslib.KdfAES3) || bytes.Equal(uuid, gokeepasslib.KdfAES4)
+}
+
+func cipherName(cipherID []byte) string {
+	switch {
+	case bytes.Equal(cipherID, gokeepasslib.CipherAES):
+		return "AES-256"
+	case bytes.Equal(cipherID, gokeepasslib.CipherChaCha20):
+		return "ChaCha20"
+	case bytes.Equal(cipherID, gokeepasslib.CipherTwoFish):
+		return "Twofish"
+	}
+	return "unknown " + hex.EncodeToString(cipherID)
+}
+
+func kdfName(uuid []byte) string {
+	switch {
+	case isAesKdf(uuid):
+		return "AES-KDF"
+	case bytes.Equal(uuid, kdfArgon2d):
+		return "Argon2d"
+	case bytes.Equal(uuid, KdfArgon2id):
+		return "Argon2id"
+	}
+	return "unknown " + hex.EncodeToString(uuid)
+}
+
+// Detects the format of the database file without decrypting it
+func ReadDatabaseFormat(data []byte) (DatabaseFormat, error) {
+	if isKdbDatabase(data) {
+		header, err := readKdbHeader(data)
+		if err != nil {
+			return DatabaseFormat{}, err
+		}
+		return header.format(), nil
+	}
+	header, err := readKdbxHeader(data)
+	if err != nil {
+		return DatabaseFormat{}, err
+	}
+	return header.format(), nil
+}
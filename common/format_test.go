@@ -0,0 +1,286 @@
+package common
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tobischo/gokeepasslib/v3"
+	w "github.com/tobischo/gokeepasslib/v3/wrappers"
+)
+
+const formatTestPassword = "password"
+
+// Creates a database with a single protected entry, options adjust the header before it is encoded
+func newFormatTestDatabase(version gokeepasslib.DatabaseOption, options ...func(*gokeepasslib.DBHeader)) *gokeepasslib.Database {
+	db := gokeepasslib.NewDatabase(version)
+	db.Credentials = gokeepasslib.NewPasswordCredentials(formatTestPassword)
+	entry := gokeepasslib.NewEntry()
+	entry.Values = []gokeepasslib.ValueData{
+		{Key: "Title", Value: gokeepasslib.V{Content: "Entry"}},
+		{Key: "Password", Value: gokeepasslib.V{Content: "secret", Protected: w.NewBoolWrapper(true)}},
+	}
+	group := gokeepasslib.NewGroup()
+	group.Name = "root"
+	group.Entries = []gokeepasslib.Entry{entry}
+	db.Content.Root.Groups = []gokeepasslib.Group{group}
+	if db.Header.IsKdbx4() {
+		// keep the tests fast
+		db.Header.FileHeaders.KdfParameters.Memory = 1024 * 1024
+		db.Header.FileHeaders.KdfParameters.Iterations = 1
+	}
+	for _, option := range options {
+		option(db.Header)
+	}
+	return db
+}
+
+func encodeFormatTestDatabase(t *testing.T, db *gokeepasslib.Database) []byte {
+	if err := db.LockProtectedEntries(); err != nil {
+		t.Fatal(err)
+	}
+	var buffer bytes.Buffer
+	if err := EncodeDatabase(db, &buffer); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func withAesCipher(header *gokeepasslib.DBHeader) {
+	header.FileHeaders.CipherID = gokeepasslib.CipherAES
+	header.FileHeaders.EncryptionIV = make([]byte, 16)
+	rand.Read(header.FileHeaders.EncryptionIV)
+}
+
+func withAesKdf(header *gokeepasslib.DBHeader) {
+	header.FileHeaders.KdfParameters = &gokeepasslib.KdfParameters{UUID: gokeepasslib.KdfAES4, Rounds: 1000}
+	rand.Read(header.FileHeaders.KdfParameters.Salt[:])
+}
+
+func withArgon2id(header *gokeepasslib.DBHeader) {
+	header.FileHeaders.KdfParameters.UUID = KdfArgon2id
+}
+
+func withChaChaInnerStream(header *gokeepasslib.DBHeader) {
+	header.FileHeaders.InnerRandomStreamID = gokeepasslib.ChaChaStreamID
+}
+
+func withMinorVersion(minor uint16) func(*gokeepasslib.DBHeader) {
+	return func(header *gokeepasslib.DBHeader) {
+		signature := *header.Signature
+		signature.MinorVersion = minor
+		header.Signature = &signature
+	}
+}
+
+func withoutCompression(header *gokeepasslib.DBHeader) {
+	header.FileHeaders.CompressionFlags = gokeepasslib.NoCompressionFlag
+}
+
+func TestDecodeDatabaseFormats(t *testing.T) {
+	testCases := []struct {
+		format  string
+		version gokeepasslib.DatabaseOption
+		options []func(*gokeepasslib.DBHeader)
+	}{
+		{"KDBX 3.1 (cipher AES-256, KDF AES-KDF)", gokeepasslib.WithDatabaseKDBXVersion3(), nil},
+		{"KDBX 3.1 (cipher AES-256, KDF AES-KDF)", gokeepasslib.WithDatabaseKDBXVersion3(), []func(*gokeepasslib.DBHeader){withChaChaInnerStream}},
+		{"KDBX 4.0 (cipher ChaCha20, KDF Argon2d)", gokeepasslib.WithDatabaseKDBXVersion4(), nil},
+		{"KDBX 4.0 (cipher ChaCha20, KDF Argon2id)", gokeepasslib.WithDatabaseKDBXVersion4(), []func(*gokeepasslib.DBHeader){withArgon2id}},
+		{"KDBX 4.0 (cipher AES-256, KDF AES-KDF)", gokeepasslib.WithDatabaseKDBXVersion4(), []func(*gokeepasslib.DBHeader){withAesCipher, withAesKdf}},
+		{"KDBX 4.0 (cipher AES-256, KDF Argon2id)", gokeepasslib.WithDatabaseKDBXVersion4(), []func(*gokeepasslib.DBHeader){withAesCipher, withArgon2id}},
+		{"KDBX 4.1 (cipher ChaCha20, KDF Argon2id)", gokeepasslib.WithDatabaseKDBXVersion4(), []func(*gokeepasslib.DBHeader){withMinorVersion(1), withArgon2id}},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.format, func(t *testing.T) {
+			encoded := encodeFormatTestDatabase(t, newFormatTestDatabase(testCase.version, testCase.options...))
+			format, err := ReadDatabaseFormat(encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format.String() != testCase.format {
+				t.Fatalf("expected format %s, got %s", testCase.format, format)
+			}
+			db, err := decodeDatabase(bytes.NewReader(encoded), formatTestPassword)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := indexProtectedValues(db); err != nil {
+				t.Fatal(err)
+			}
+			entry := db.Content.Root.Groups[0].Entries[0]
+			password, err := RevealField(db, entry, "Password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry.GetTitle() != "Entry" || string(password) != "secret" {
+				t.Fatalf("unexpected entry %q with password %q", entry.GetTitle(), password)
+			}
+			// encoding the decoded database again keeps the format
+			reopened, err := decodeDatabase(bytes.NewReader(encoded), formatTestPassword)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var reencoded bytes.Buffer
+			if err := EncodeDatabase(reopened, &reencoded); err != nil {
+				t.Fatal(err)
+			}
+			if format, err := ReadDatabaseFormat(reencoded.Bytes()); err != nil || format.String() != testCase.format {
+				t.Fatalf("expected format %s after encoding again, got %s (%v)", testCase.format, format, err)
+			}
+			if _, err := decodeDatabase(bytes.NewReader(reencoded.Bytes()), formatTestPassword); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestEncodeDatabaseAesPadding(t *testing.T) {
+	for _, kdf := range []func(*gokeepasslib.DBHeader){withAesKdf, withArgon2id} {
+		// one of the payload lengths is a multiple of the aes block size
+		for length := 0; length < 16; length++ {
+			db := newFormatTestDatabase(gokeepasslib.WithDatabaseKDBXVersion4(), withAesCipher, kdf, withoutCompression)
+			db.Content.Root.Groups[0].Name = strings.Repeat("x", length)
+			encoded := encodeFormatTestDatabase(t, db)
+			if _, err := decodeDatabase(bytes.NewReader(encoded), formatTestPassword); err != nil {
+				t.Fatalf("group name length %d: %s", length, err)
+			}
+		}
+	}
+}
+
+func TestEncodeDatabaseKeepsFormat(t *testing.T) {
+	testCases := []struct {
+		kdf      func(*gokeepasslib.DBHeader)
+		expected string
+	}{
+		{withAesKdf, "KDBX 4.0 (cipher AES-256, KDF AES-KDF)"},
+		{withArgon2id, "KDBX 4.0 (cipher AES-256, KDF Argon2id)"},
+	}
+	for _, testCase := range testCases {
+		db := newFormatTestDatabase(gokeepasslib.WithDatabaseKDBXVersion4(), withAesCipher, testCase.kdf)
+		encryptionIV := append([]byte{}, db.Header.FileHeaders.EncryptionIV...)
+		encoded := encodeFormatTestDatabase(t, db)
+		// aes databases are encoded with chacha20 in between, the file and the database keep the aes cipher and iv
+		header, err := readKdbxHeader(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if format := header.format().String(); format != testCase.expected {
+			t.Errorf("expected %s, got %s", testCase.expected, format)
+		}
+		if !bytes.Equal(header.field(headerEncryptionIV), encryptionIV) || !bytes.Equal(db.Header.FileHeaders.EncryptionIV, encryptionIV) {
+			t.Errorf("expected the encryption iv to be kept")
+		}
+		if !bytes.Equal(db.Header.FileHeaders.CipherID, gokeepasslib.CipherAES) {
+			t.Errorf("expected the database to keep the aes cipher")
+		}
+	}
+}
+
+func TestDecodeDatabaseWrongPassword(t *testing.T) {
+	encoded := encodeFormatTestDatabase(t, newFormatTestDatabase(gokeepasslib.WithDatabaseKDBXVersion4(), withArgon2id))
+	_, err := decodeDatabase(bytes.NewReader(encoded), "wrong")
+	if err == nil || !strings.Contains(err.Error(), "KDBX 4.0 (cipher ChaCha20, KDF Argon2id)") || !strings.Contains(err.Error(), "Wrong password") {
+		t.Fatalf("expected a wrong password error naming the format, got %v", err)
+	}
+}
+
+func TestDecodeDatabaseUnsupportedFormats(t *testing.T) {
+	encoded := encodeFormatTestDatabase(t, newFormatTestDatabase(gokeepasslib.WithDatabaseKDBXVersion4()))
+	header, err := readKdbxHeader(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest := encoded[header.end:]
+	twofish := append(header.withField(headerCipherID, gokeepasslib.CipherTwoFish).bytes(), rest...)
+	future := header.withField(headerCipherID, gokeepasslib.CipherChaCha20)
+	future.major = 5
+	preRelease := append([]byte{}, encoded...)
+	copy(preRelease[4:8], []byte{0x66, 0xfb, 0x4b, 0xb5})
+	testCases := []struct {
+		name     string
+		data     []byte
+		contains []string
+	}{
+		{"twofish", twofish, []string{"KDBX 4.0", "cipher Twofish", "KDF Argon2d"}},
+		{"future version", append(future.bytes(), rest...), []string{"KDBX 5.0", "cipher ChaCha20"}},
+		{"pre-release", preRelease, []string{"KDBX pre-release"}},
+		{"not a database", []byte("not a database"), []string{"Not a KeePass database file"}},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			_, err := decodeDatabase(bytes.NewReader(testCase.data), formatTestPassword)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			for _, contains := range testCase.contains {
+				if !strings.Contains(err.Error(), contains) {
+					t.Errorf("expected %q in error: %s", contains, err)
+				}
+			}
+		})
+	}
+}
+
+func TestReadKdbx41Details(t *testing.T) {
+	db := newFormatTestDatabase(gokeepasslib.WithDatabaseKDBXVersion4(), withMinorVersion(1), withoutCompression, withArgon2id)
+	icon := gokeepasslib.CustomIcon{UUID: gokeepasslib.NewUUID(), Data: base64.StdEncoding.EncodeToString([]byte("png"))}
+	db.Content.Meta.CustomIcons = []gokeepasslib.CustomIcon{icon}
+	previousParent := gokeepasslib.NewUUID()
+	previousParentText, _ := previousParent.MarshalText()
+	groupUUID := db.Content.Root.Groups[0].UUID
+	entryUUID := db.Content.Root.Groups[0].Entries[0].UUID
+	encoded := encodeFormatTestDatabase(t, db)
+	// gokeepasslib cannot write the kdbx 4.1 elements, add them to the xml of the payload
+	header, payload, err := readKdbx4Payload(encoded, db.Credentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, insert := range []struct{ after, element string }{
+		{"<Name>root</Name>", "<Tags>infra;prod</Tags><PreviousParentGroup>" + string(previousParentText) + "</PreviousParentGroup>"},
+		{"<Entry>", "<PreviousParentGroup>" + string(previousParentText) + "</PreviousParentGroup>"},
+		{"<Data>cG5n</Data>", "<Name>Server</Name>"},
+	} {
+		if !bytes.Contains(payload, []byte(insert.after)) {
+			t.Fatalf("payload does not contain %s", insert.after)
+		}
+		payload = bytes.Replace(payload, []byte(insert.after), []byte(insert.after+insert.element), 1)
+	}
+	encoded, err = writeKdbx4Payload(header, payload, db.Credentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keepassFile := filepath.Join(t.TempDir(), "kdbx41.kdbx")
+	if err := os.WriteFile(keepassFile, encoded, 0600); err != nil {
+		t.Fatal(err)
+	}
+	opened, _, err := OpenDatabase(keepassFile, formatTestPassword, "", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if title := opened.Content.Root.Groups[0].Entries[0].GetTitle(); title != "Entry" {
+		t.Fatalf("unexpected entry title %q", title)
+	}
+	details, err := ReadKdbx41Details(opened)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags := details.GroupTags[groupUUID]; strings.Join(tags, ",") != "infra,prod" {
+		t.Errorf("unexpected group tags %v", tags)
+	}
+	if details.PreviousParentGroups[groupUUID] != previousParent || details.PreviousParentGroups[entryUUID] != previousParent {
+		t.Errorf("unexpected previous parent groups %v", details.PreviousParentGroups)
+	}
+	if name := details.CustomIconNames[icon.UUID]; name != "Server" {
+		t.Errorf("unexpected custom icon name %q", name)
+	}
+	// saving through gokeepasslib would drop the kdbx 4.1 elements
+	if _, _, err := OpenDatabaseForWrite(keepassFile, formatTestPassword); err == nil || !strings.Contains(err.Error(), "KDBX 4.1") {
+		t.Errorf("expected writing to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+//go:build go1.18
+// +build go1.18
+
+package common
+
+import (
+	"io"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+// Run with: go test ./common -fuzz FuzzDecodeXMLDatabase
+func FuzzDecodeXMLDatabase(f *testing.F) {
+	f.Add([]byte(xmlTestExport))
+	f.Add([]byte(nestedXMLTestExport(4)))
+	f.Add([]byte(strings.Replace(xmlTestExport, "<Name>ci</Name>", "<Name>c/i-</Name>", 1)))
+	log.SetOutput(io.Discard)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		db, err := decodeXMLDatabase(data)
+		if err != nil {
+			return
+		}
+		if err := checkWalkLimits(db); err != nil {
+			return
+		}
+		if _, err := indexProtectedValues(db); err != nil {
+			return
+		}
+		checkAttachmentKeys(t, db)
+	})
+}
+
+// Run with: go test ./common -fuzz FuzzWalkDatabase
+func FuzzWalkDatabase(f *testing.F) {
+	f.Add([]byte("g/e-"), 4)
+	f.Add([]byte("ggggggggge"), 8)
+	f.Add([]byte{'g', 0xff, '/', 'e', '-', 'e', '-'}, 2)
+	log.SetOutput(io.Discard)
+	f.Fuzz(func(t *testing.T, shape []byte, depthLimit int) {
+		if depthLimit < 1 || depthLimit > 64 {
+			return
+		}
+		defer func(depth, length int) { maxWalkDepth, maxPathLength = depth, length }(maxWalkDepth, maxPathLength)
+		// only the depth limit is exercised, paths are never longer than twice the shape
+		maxWalkDepth, maxPathLength = depthLimit, 2*len(shape)+2
+		db, depth := fuzzDatabase(shape)
+		err := WalkDatabase(db, nil, func(entryPath string, entry gokeepasslib.Entry, depth int) {})
+		if depth > depthLimit && err == nil {
+			t.Fatalf("expected groups nested %d levels deep to exceed the limit of %d", depth, depthLimit)
+		}
+		if depth <= depthLimit && err != nil {
+			t.Fatalf("groups nested %d levels deep are within the limit of %d: %s", depth, depthLimit, err)
+		}
+		if err == nil {
+			checkAttachmentKeys(t, db)
+		}
+	})
+}
+
+// Builds a database from the shape, 'g' opens a group, 'e' adds an entry with an attachment, '/' closes
+// the group and any other byte is appended to the name of the last group or entry. Returns the depth.
+func fuzzDatabase(shape []byte) (*gokeepasslib.Database, int) {
+	db := gokeepasslib.NewDatabase()
+	binaryID := AddBinary(db, []byte("attachment"))
+	root, depth := gokeepasslib.NewGroup(), 0
+	fuzzGroup(&root, shape, 0, 0, &depth, binaryID)
+	db.Content.Root.Groups = root.Groups
+	return db, depth
+}
+
+// Fills the group from the shape until it is closed, returns the position after the group
+func fuzzGroup(group *gokeepasslib.Group, shape []byte, position int, level int, depth *int, binaryID int) int {
+	name := &group.Name
+	for position < len(shape) {
+		b := shape[position]
+		position++
+		switch b {
+		case 'g':
+			child := gokeepasslib.NewGroup()
+			child.Name = ""
+			if level+1 > *depth {
+				*depth = level + 1
+			}
+			position = fuzzGroup(&child, shape, position, level+1, depth, binaryID)
+			group.Groups = append(group.Groups, child)
+			name = nil
+		case '/':
+			return position
+		case 'e':
+			entry := gokeepasslib.NewEntry()
+			entry.Values = append(entry.Values, gokeepasslib.ValueData{Key: "Title", Value: gokeepasslib.V{Content: ""}})
+			entry.Binaries = append(entry.Binaries, gokeepasslib.NewBinaryReference("-", binaryID))
+			group.Entries = append(group.Entries, entry)
+			name = &group.Entries[len(group.Entries)-1].Values[0].Value.Content
+		default:
+			if name != nil {
+				*name += string(b)
+			}
+		}
+	}
+	return position
+}
+
+// Checks that every attachment key resolves to an entry holding the attachment
+func checkAttachmentKeys(t *testing.T, db *gokeepasslib.Database) {
+	attachmentsMap, entryMap := AttachmentPaths(db)
+	for attachmentPath, attachment := range attachmentsMap {
+		entry := AttachmentEntry(entryMap, attachmentPath, attachment)
+		found := false
+		for _, binary := range entry.Binaries {
+			found = found || (binary.Name == attachment.Name && binary.Value.ID == attachment.Value.ID)
+		}
+		if !found {
+			t.Fatalf("attachment key %q does not resolve to the entry holding the attachment", attachmentPath)
+		}
+		// malformed binaries fail with an error
+		ReadAttachment(db, attachment)
+	}
+}
@@ -0,0 +1,52 @@
+package common
+
+import (
+	"sort"
+	"time"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+// Returns all versions of an entry ordered from oldest to newest, the last being the entry itself
+func EntryVersions(entry gokeepasslib.Entry) []gokeepasslib.Entry {
+	versions := []gokeepasslib.Entry{}
+	for _, history := range entry.Histories {
+		versions = append(versions, history.Entries...)
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		return modificationTime(versions[i]).Before(modificationTime(versions[j]))
+	})
+	return append(versions, entry)
+}
+
+// Returns the nth previous version of an entry, 1 being the version before the current one
+func EntryPreviousVersion(entry gokeepasslib.Entry, n int) (gokeepasslib.Entry, bool) {
+	versions := EntryVersions(entry)
+	index := len(versions) - 1 - n
+	if n < 1 || index < 0 {
+		return gokeepasslib.Entry{}, false
+	}
+	return versions[index], true
+}
+
+// Returns the version of an entry that was valid at the given time
+func EntryVersionAt(entry gokeepasslib.Entry, at time.Time) (gokeepasslib.Entry, bool) {
+	if entry.Times.CreationTime != nil && entry.Times.CreationTime.Time.After(at) {
+		// entry did not exist yet
+		return gokeepasslib.Entry{}, false
+	}
+	versions := EntryVersions(entry)
+	for i := len(versions) - 1; i >= 0; i-- {
+		if !modificationTime(versions[i]).After(at) {
+			return versions[i], true
+		}
+	}
+	return gokeepasslib.Entry{}, false
+}
+
+func modificationTime(entry gokeepasslib.Entry) time.Time {
+	if entry.Times.LastModificationTime == nil {
+		return time.Time{}
+	}
+	return entry.Times.LastModificationTime.Time
+}
@@ -0,0 +1,400 @@
+package common
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tobischo/gokeepasslib/v3"
+	w "github.com/tobischo/gokeepasslib/v3/wrappers"
+	"golang.org/x/crypto/twofish"
+)
+
+// KeePass 1.x databases are decrypted and mapped to the gokeepasslib model of a kdbx 3.1 database,
+// top level groups become the root groups so that paths are the same as in KeePass 1.x.
+
+// Size of the fixed kdb header
+const kdbHeaderSize = 124
+
+// Cipher flags of the kdb header
+const (
+	kdbFlagRijndael uint32 = 2
+	kdbFlagTwofish  uint32 = 8
+)
+
+// Major and minor file version supported, the last byte is the revision
+const kdbVersion uint32 = 0x00030000
+
+// Expiry time KeePass 1.x uses for entries which never expire
+var kdbNever = time.Date(2999, 12, 28, 23, 59, 59, 0, time.UTC)
+
+type kdbHeader struct {
+	flags           uint32
+	version         uint32
+	masterSeed      []byte
+	encryptionIV    []byte
+	groups          uint32
+	entries         uint32
+	contentsHash    []byte
+	transformSeed   []byte
+	transformRounds uint32
+}
+
+type kdbGroup struct {
+	id    uint32
+	level uint16
+	group gokeepasslib.Group
+}
+
+// Checks for the signature of a KeePass 1.x database
+func isKdbDatabase(data []byte) bool {
+	return len(data) >= 8 && binary.LittleEndian.Uint32(data[0:4]) == keepassBaseSignature &&
+		binary.LittleEndian.Uint32(data[4:8]) == kdbSecondarySignature
+}
+
+func readKdbHeader(data []byte) (*kdbHeader, error) {
+	if len(data) < kdbHeaderSize {
+		return nil, fmt.Errorf("Truncated KDB header")
+	}
+	return &kdbHeader{
+		flags:           binary.LittleEndian.Uint32(data[8:12]),
+		version:         binary.LittleEndian.Uint32(data[12:16]),
+		masterSeed:      data[16:32],
+		encryptionIV:    data[32:48],
+		groups:          binary.LittleEndian.Uint32(data[48:52]),
+		entries:         binary.LittleEndian.Uint32(data[52:56]),
+		contentsHash:    data[56:88],
+		transformSeed:   data[88:120],
+		transformRounds: binary.LittleEndian.Uint32(data[120:124]),
+	}, nil
+}
+
+func (h *kdbHeader) format() DatabaseFormat {
+	format := DatabaseFormat{Version: "KDB 1.x", Cipher: "unknown", KDF: "AES-KDF"}
+	if h.flags&kdbFlagRijndael != 0 {
+		format.Cipher = "AES-256"
+	} else if h.flags&kdbFlagTwofish != 0 {
+		format.Cipher = "Twofish"
+	}
+	return format
+}
+
+// Decrypts a KeePass 1.x database and maps its groups and entries to a kdbx 3.1 database
+func decodeKdbDatabase(data []byte, keepassPassword string) (*gokeepasslib.Database, error) {
+	header, err := readKdbHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	format := header.format()
+	if header.version&0xffffff00 != kdbVersion {
+		return nil, fmt.Errorf("Unsupported KeePass database format %s: file version 0x%08x is not supported", format, header.version)
+	}
+	if header.flags&(kdbFlagRijndael|kdbFlagTwofish) == 0 {
+		return nil, fmt.Errorf("Unsupported KeePass database format %s: only the AES-256 and Twofish ciphers are supported", format)
+	}
+	// keepass 1.x hashes the password in the ansi code page, try it if the utf-8 password does not match
+	passwords := [][]byte{[]byte(keepassPassword)}
+	if latin1, ok := latin1Bytes(keepassPassword); ok && !bytes.Equal(latin1, passwords[0]) {
+		passwords = append(passwords, latin1)
+	}
+	var content []byte
+	for _, password := range passwords {
+		if content, err = header.decrypt(data[kdbHeaderSize:], password); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open %s database: %s", format, err)
+	}
+	db, err := header.parseContent(content)
+	ZeroBytes(content)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open %s database: %s", format, err)
+	}
+	return db, nil
+}
+
+// Decrypts the contents following the header and verifies their hash
+func (h *kdbHeader) decrypt(ciphertext []byte, password []byte) ([]byte, error) {
+	passwordHash := sha256.Sum256(password)
+	transformCipher, err := aes.NewCipher(h.transformSeed)
+	if err != nil {
+		return nil, err
+	}
+	key := passwordHash[:]
+	for i := uint32(0); i < h.transformRounds; i++ {
+		transformCipher.Encrypt(key[:16], key[:16])
+		transformCipher.Encrypt(key[16:], key[16:])
+	}
+	transformedKey := sha256.Sum256(key)
+	finalKey := sha256.Sum256(append(append([]byte{}, h.masterSeed...), transformedKey[:]...))
+	var block cipher.Block
+	if h.flags&kdbFlagRijndael != 0 {
+		block, err = aes.NewCipher(finalKey[:])
+	} else {
+		block, err = twofish.NewCipher(finalKey[:])
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%block.BlockSize() != 0 {
+		return nil, fmt.Errorf("Invalid payload length")
+	}
+	content := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, h.encryptionIV).CryptBlocks(content, ciphertext)
+	padding := int(content[len(content)-1])
+	contentsHash := []byte{}
+	if padding > 0 && padding <= block.BlockSize() {
+		hash := sha256.Sum256(content[:len(content)-padding])
+		contentsHash = hash[:]
+	}
+	if !bytes.Equal(contentsHash, h.contentsHash) {
+		ZeroBytes(content)
+		return nil, fmt.Errorf("Wrong password? Contents hash mismatching")
+	}
+	return content[:len(content)-padding], nil
+}
+
+// Reads the group and entry records and builds the database tree
+func (h *kdbHeader) parseContent(content []byte) (*gokeepasslib.Database, error) {
+	db := gokeepasslib.NewDatabase(gokeepasslib.WithDatabaseKDBXVersion3())
+	reader := &kdbReader{data: content}
+	groups := []*kdbGroup{}
+	groupsByID := map[uint32]*kdbGroup{}
+	for i := uint32(0); i < h.groups; i++ {
+		group, err := reader.readGroup()
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+		groupsByID[group.id] = group
+	}
+	for i := uint32(0); i < h.entries; i++ {
+		entry, groupID, attachment, err := reader.readEntry()
+		if err != nil {
+			return nil, err
+		}
+		if isKdbMetaStream(entry, attachment) {
+			// keepass 1.x stores its ui state and custom icons in hidden entries
+			continue
+		}
+		group, keyExists := groupsByID[groupID]
+		if !keyExists {
+			return nil, fmt.Errorf("Entry %s refers to missing group %d", entry.GetTitle(), groupID)
+		}
+		if attachment != nil {
+			id := AddBinary(db, attachment.contents)
+			entry.Binaries = append(entry.Binaries, gokeepasslib.NewBinaryReference(attachment.name, id))
+		}
+		group.group.Entries = append(group.group.Entries, entry)
+	}
+	// groups are stored depth first with their level, a group belongs to the closest preceding group one level up
+	root, err := buildKdbTree(groups)
+	if err != nil {
+		return nil, err
+	}
+	db.Content.Root.Groups = root
+	// protect the passwords in memory like those of a kdbx database, with the random stream key of the new header
+	if err := db.LockProtectedEntries(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func buildKdbTree(groups []*kdbGroup) ([]gokeepasslib.Group, error) {
+	var build func(index int, level uint16) ([]gokeepasslib.Group, int, error)
+	build = func(index int, level uint16) ([]gokeepasslib.Group, int, error) {
+		siblings := []gokeepasslib.Group{}
+		for index < len(groups) && groups[index].level >= level {
+			if groups[index].level > level {
+				return nil, 0, fmt.Errorf("Group %s skips a level", groups[index].group.Name)
+			}
+			group := groups[index].group
+			children, next, err := build(index+1, level+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			group.Groups = children
+			siblings = append(siblings, group)
+			index = next
+		}
+		return siblings, index, nil
+	}
+	root, _, err := build(0, 0)
+	return root, err
+}
+
+type kdbAttachment struct {
+	name     string
+	contents []byte
+}
+
+func isKdbMetaStream(entry gokeepasslib.Entry, attachment *kdbAttachment) bool {
+	return attachment != nil && attachment.name == "bin-stream" && entry.GetTitle() == "Meta-Info" &&
+		entry.GetContent("UserName") == "SYSTEM" && entry.GetContent("URL") == "$"
+}
+
+type kdbReader struct {
+	data   []byte
+	offset int
+}
+
+// Reads the next field, a 2 byte type followed by a 4 byte length and data
+func (r *kdbReader) readField() (uint16, []byte, error) {
+	if r.offset+6 > len(r.data) {
+		return 0, nil, fmt.Errorf("Truncated KDB contents")
+	}
+	fieldType := binary.LittleEndian.Uint16(r.data[r.offset : r.offset+2])
+	length := int(binary.LittleEndian.Uint32(r.data[r.offset+2 : r.offset+6]))
+	r.offset += 6
+	if length < 0 || r.offset+length > len(r.data) {
+		return 0, nil, fmt.Errorf("Truncated KDB contents")
+	}
+	data := r.data[r.offset : r.offset+length]
+	r.offset += length
+	return fieldType, data, nil
+}
+
+func (r *kdbReader) readGroup() (*kdbGroup, error) {
+	group := &kdbGroup{group: gokeepasslib.NewGroup()}
+	for {
+		fieldType, data, err := r.readField()
+		if err != nil {
+			return nil, err
+		}
+		switch fieldType {
+		case 0x0001:
+			if len(data) != 4 {
+				return nil, fmt.Errorf("Invalid KDB group id")
+			}
+			group.id = binary.LittleEndian.Uint32(data)
+			// kdb groups have numeric ids, derive a stable uuid from it
+			group.group.UUID = gokeepasslib.UUID{}
+			copy(group.group.UUID[:], data)
+		case 0x0002:
+			group.group.Name = kdbString(data)
+		case 0x0003:
+			group.group.Times.CreationTime = kdbTime(data)
+		case 0x0004:
+			group.group.Times.LastModificationTime = kdbTime(data)
+		case 0x0005:
+			group.group.Times.LastAccessTime = kdbTime(data)
+		case 0x0006:
+			group.group.Times.ExpiryTime = kdbTime(data)
+			group.group.Times.Expires = w.NewBoolWrapper(group.group.Times.ExpiryTime != nil && !group.group.Times.ExpiryTime.Time.Equal(kdbNever))
+		case 0x0007:
+			if len(data) == 4 {
+				group.group.IconID = int64(binary.LittleEndian.Uint32(data))
+			}
+		case 0x0008:
+			if len(data) != 2 {
+				return nil, fmt.Errorf("Invalid KDB group level")
+			}
+			group.level = binary.LittleEndian.Uint16(data)
+		case 0xffff:
+			return group, nil
+		}
+	}
+}
+
+func (r *kdbReader) readEntry() (gokeepasslib.Entry, uint32, *kdbAttachment, error) {
+	entry := gokeepasslib.NewEntry()
+	var groupID uint32
+	var attachmentName string
+	var attachmentContents []byte
+	value := func(key string, data []byte, protected bool) {
+		valueData := gokeepasslib.ValueData{Key: key, Value: gokeepasslib.V{Content: kdbString(data)}}
+		if protected {
+			valueData.Value.Protected = w.NewBoolWrapper(true)
+		}
+		entry.Values = append(entry.Values, valueData)
+	}
+	for {
+		fieldType, data, err := r.readField()
+		if err != nil {
+			return entry, 0, nil, err
+		}
+		switch fieldType {
+		case 0x0001:
+			if len(data) != 16 {
+				return entry, 0, nil, fmt.Errorf("Invalid KDB entry uuid")
+			}
+			copy(entry.UUID[:], data)
+		case 0x0002:
+			if len(data) != 4 {
+				return entry, 0, nil, fmt.Errorf("Invalid KDB entry group id")
+			}
+			groupID = binary.LittleEndian.Uint32(data)
+		case 0x0003:
+			if len(data) == 4 {
+				entry.IconID = int64(binary.LittleEndian.Uint32(data))
+			}
+		case 0x0004:
+			value("Title", data, false)
+		case 0x0005:
+			value("URL", data, false)
+		case 0x0006:
+			value("UserName", data, false)
+		case 0x0007:
+			value("Password", data, true)
+		case 0x0008:
+			value("Notes", data, false)
+		case 0x0009:
+			entry.Times.CreationTime = kdbTime(data)
+		case 0x000a:
+			entry.Times.LastModificationTime = kdbTime(data)
+		case 0x000b:
+			entry.Times.LastAccessTime = kdbTime(data)
+		case 0x000c:
+			entry.Times.ExpiryTime = kdbTime(data)
+			entry.Times.Expires = w.NewBoolWrapper(entry.Times.ExpiryTime != nil && !entry.Times.ExpiryTime.Time.Equal(kdbNever))
+		case 0x000d:
+			attachmentName = kdbString(data)
+		case 0x000e:
+			attachmentContents = append([]byte{}, data...)
+		case 0xffff:
+			var attachment *kdbAttachment
+			if attachmentName != "" {
+				attachment = &kdbAttachment{name: attachmentName, contents: attachmentContents}
+			}
+			return entry, groupID, attachment, nil
+		}
+	}
+}
+
+// Strings are utf-8 and null terminated
+func kdbString(data []byte) string {
+	return strings.TrimRight(string(data), "\x00")
+}
+
+// Unpacks the 5 byte kdb time, which has no time zone and is treated as utc
+func kdbTime(data []byte) *w.TimeWrapper {
+	if len(data) != 5 {
+		return nil
+	}
+	year := int(data[0])<<6 | int(data[1])>>2
+	month := int(data[1]&0x03)<<2 | int(data[2])>>6
+	day := int(data[2]>>1) & 0x1f
+	hour := int(data[2]&0x01)<<4 | int(data[3])>>4
+	minute := int(data[3]&0x0f)<<2 | int(data[4])>>6
+	second := int(data[4] & 0x3f)
+	return &w.TimeWrapper{Formatted: true, Time: time.Date(year, time.Month(month), day, hour, minute, second, 0, time.UTC)}
+}
+
+// Encodes the password in latin-1, which matches the ansi code page for the common characters
+func latin1Bytes(value string) ([]byte, bool) {
+	encoded := make([]byte, 0, len(value))
+	for _, r := range value {
+		if r == utf8.RuneError || r > 0xff {
+			return nil, false
+		}
+		encoded = append(encoded, byte(r))
+	}
+	return encoded, true
+}
@@ -0,0 +1,245 @@
+package common
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tobischo/gokeepasslib/v3"
+	"golang.org/x/crypto/twofish"
+)
+
+// Builds the field records of a kdb database
+type kdbTestWriter struct {
+	buffer bytes.Buffer
+}
+
+func (w *kdbTestWriter) field(fieldType uint16, data []byte) {
+	binary.Write(&w.buffer, binary.LittleEndian, fieldType)
+	binary.Write(&w.buffer, binary.LittleEndian, uint32(len(data)))
+	w.buffer.Write(data)
+}
+
+func (w *kdbTestWriter) uint32Field(fieldType uint16, value uint32) {
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint32(data, value)
+	w.field(fieldType, data)
+}
+
+func (w *kdbTestWriter) stringField(fieldType uint16, value string) {
+	w.field(fieldType, append([]byte(value), 0))
+}
+
+func (w *kdbTestWriter) timeField(fieldType uint16, t time.Time) {
+	w.field(fieldType, []byte{
+		byte(t.Year() >> 6),
+		byte(t.Year()&0x3f)<<2 | byte(t.Month())>>2,
+		byte(t.Month()&0x03)<<6 | byte(t.Day())<<1 | byte(t.Hour())>>4,
+		byte(t.Hour()&0x0f)<<4 | byte(t.Minute())>>2,
+		byte(t.Minute()&0x03)<<6 | byte(t.Second()),
+	})
+}
+
+func (w *kdbTestWriter) group(id uint32, name string, level uint16) {
+	w.uint32Field(0x0001, id)
+	w.stringField(0x0002, name)
+	w.timeField(0x0003, time.Date(2020, 5, 17, 13, 45, 30, 0, time.UTC))
+	w.timeField(0x0006, kdbNever)
+	levelData := make([]byte, 2)
+	binary.LittleEndian.PutUint16(levelData, level)
+	w.field(0x0008, levelData)
+	w.field(0xffff, nil)
+}
+
+func (w *kdbTestWriter) entry(groupID uint32, title string, userName string, url string, password string, attachmentName string, attachment []byte) {
+	entryUUID := gokeepasslib.NewUUID()
+	w.field(0x0001, entryUUID[:])
+	w.uint32Field(0x0002, groupID)
+	w.stringField(0x0004, title)
+	w.stringField(0x0005, url)
+	w.stringField(0x0006, userName)
+	w.stringField(0x0007, password)
+	w.stringField(0x0008, "")
+	w.timeField(0x000c, kdbNever)
+	if attachmentName != "" {
+		w.stringField(0x000d, attachmentName)
+		w.field(0x000e, attachment)
+	}
+	w.field(0xffff, nil)
+}
+
+// Encrypts the records the way keepass 1.x does and prepends the header
+func encodeKdbTestDatabase(t *testing.T, flags uint32, password []byte, groups uint32, entries uint32, content []byte) []byte {
+	header := make([]byte, kdbHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:4], keepassBaseSignature)
+	binary.LittleEndian.PutUint32(header[4:8], kdbSecondarySignature)
+	binary.LittleEndian.PutUint32(header[8:12], flags|1)
+	binary.LittleEndian.PutUint32(header[12:16], kdbVersion|4)
+	rand.Read(header[16:48])
+	binary.LittleEndian.PutUint32(header[48:52], groups)
+	binary.LittleEndian.PutUint32(header[52:56], entries)
+	contentsHash := sha256.Sum256(content)
+	copy(header[56:88], contentsHash[:])
+	rand.Read(header[88:120])
+	binary.LittleEndian.PutUint32(header[120:124], 100)
+	key := sha256.Sum256(password)
+	transformCipher, err := aes.NewCipher(header[88:120])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		transformCipher.Encrypt(key[:16], key[:16])
+		transformCipher.Encrypt(key[16:], key[16:])
+	}
+	transformedKey := sha256.Sum256(key[:])
+	finalKey := sha256.Sum256(append(append([]byte{}, header[16:32]...), transformedKey[:]...))
+	var block cipher.Block
+	if flags == kdbFlagRijndael {
+		block, err = aes.NewCipher(finalKey[:])
+	} else {
+		block, err = twofish.NewCipher(finalKey[:])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	padding := block.BlockSize() - len(content)%block.BlockSize()
+	padded := append(append([]byte{}, content...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, header[32:48]).CryptBlocks(padded, padded)
+	return append(header, padded...)
+}
+
+func kdbTestContent() []byte {
+	writer := &kdbTestWriter{}
+	writer.group(1, "Internet", 0)
+	writer.group(2, "Servers", 1)
+	writer.group(3, "Linux", 2)
+	writer.group(4, "eMail", 0)
+	writer.entry(3, "Web", "admin", "https://web.example.com", "web-password", "id_rsa", []byte("private key"))
+	writer.entry(4, "Mail", "user", "", "mail-password", "", nil)
+	// keepass 1.x stores its ui state in meta-stream entries
+	writer.entry(1, "Meta-Info", "SYSTEM", "$", "", "bin-stream", []byte("ui state"))
+	return writer.buffer.Bytes()
+}
+
+func TestDecodeKdbDatabase(t *testing.T) {
+	for _, flags := range []uint32{kdbFlagRijndael, kdbFlagTwofish} {
+		encoded := encodeKdbTestDatabase(t, flags, []byte("pässword"), 4, 3, kdbTestContent())
+		format, err := ReadDatabaseFormat(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Run(format.String(), func(t *testing.T) {
+			keepassFile := filepath.Join(t.TempDir(), "legacy.kdb")
+			if err := os.WriteFile(keepassFile, encoded, 0600); err != nil {
+				t.Fatal(err)
+			}
+			db, _, err := OpenDatabase(keepassFile, "pässword", "", false, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries := map[string]gokeepasslib.Entry{}
+			groupPaths := []string{}
+			WalkDatabase(db, func(groupPath string, group gokeepasslib.Group, depth int) {
+				groupPaths = append(groupPaths, groupPath)
+			}, func(entryPath string, entry gokeepasslib.Entry, depth int) {
+				if strings.HasPrefix(entryPath, "/") {
+					entries[entryPath] = entry
+				}
+			})
+			if paths := strings.Join(groupPaths, ","); paths != "/Internet,/Internet/Servers,/Internet/Servers/Linux,/eMail" {
+				t.Fatalf("unexpected groups %s", paths)
+			}
+			if len(entries) != 2 {
+				t.Fatalf("expected 2 entries without the meta-stream, got %d", len(entries))
+			}
+			web, keyExists := entries["/Internet/Servers/Linux/Web"]
+			if !keyExists {
+				t.Fatal("missing entry /Internet/Servers/Linux/Web")
+			}
+			if web.GetContent("UserName") != "admin" || web.GetContent("URL") != "https://web.example.com" {
+				t.Errorf("unexpected values %v", web.Values)
+			}
+			if web.Times.Expires.Bool {
+				t.Error("expected the entry to never expire")
+			}
+			if strings.Contains(web.GetContent("Password"), "web-password") {
+				t.Error("password is held as plain text")
+			}
+			password, err := RevealField(db, web, "Password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(password) != "web-password" {
+				t.Errorf("unexpected password %q", password)
+			}
+			if len(web.Binaries) != 1 || web.Binaries[0].Name != "id_rsa" {
+				t.Fatalf("unexpected attachments %v", web.Binaries)
+			}
+			attachment, err := ReadAttachment(db, web.Binaries[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(attachment) != "private key" {
+				t.Errorf("unexpected attachment %q", attachment)
+			}
+			if password, err := RevealField(db, entries["/eMail/Mail"], "Password"); err != nil || string(password) != "mail-password" {
+				t.Errorf("unexpected password %q, %v", password, err)
+			}
+			// keepass 1.x databases are read only
+			if _, _, err := OpenDatabaseForWrite(keepassFile, "pässword"); err == nil || !strings.Contains(err.Error(), "read only") {
+				t.Errorf("expected writing to be refused, got %v", err)
+			}
+		})
+	}
+}
+
+func TestDecodeKdbDatabaseLatin1Password(t *testing.T) {
+	latin1, _ := latin1Bytes("pässword")
+	encoded := encodeKdbTestDatabase(t, kdbFlagRijndael, latin1, 4, 3, kdbTestContent())
+	if _, err := decodeDatabase(bytes.NewReader(encoded), "pässword"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecodeKdbDatabaseErrors(t *testing.T) {
+	content := kdbTestContent()
+	unknownGroup := &kdbTestWriter{}
+	unknownGroup.group(1, "Internet", 0)
+	unknownGroup.entry(7, "Web", "admin", "", "web-password", "", nil)
+	skippedLevel := &kdbTestWriter{}
+	skippedLevel.group(1, "Internet", 0)
+	skippedLevel.group(2, "Linux", 2)
+	testCases := []struct {
+		name     string
+		data     []byte
+		password string
+		contains []string
+	}{
+		{"wrong password", encodeKdbTestDatabase(t, kdbFlagTwofish, []byte("password"), 4, 3, content), "wrong", []string{"KDB 1.x (cipher Twofish, KDF AES-KDF)", "Wrong password"}},
+		{"truncated", encodeKdbTestDatabase(t, kdbFlagRijndael, []byte("password"), 4, 4, content), "password", []string{"Truncated KDB contents"}},
+		{"missing group", encodeKdbTestDatabase(t, kdbFlagRijndael, []byte("password"), 1, 1, unknownGroup.buffer.Bytes()), "password", []string{"missing group 7"}},
+		{"skipped level", encodeKdbTestDatabase(t, kdbFlagRijndael, []byte("password"), 2, 0, skippedLevel.buffer.Bytes()), "password", []string{"Linux skips a level"}},
+		{"truncated header", encodeKdbTestDatabase(t, kdbFlagRijndael, []byte("password"), 4, 3, content)[:64], "password", []string{"Truncated KDB header"}},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			_, err := decodeDatabase(bytes.NewReader(testCase.data), testCase.password)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			for _, contains := range testCase.contains {
+				if !strings.Contains(err.Error(), contains) {
+					t.Errorf("expected %q in error: %s", contains, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,409 @@
+package common
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/aead/argon2"
+	"github.com/tobischo/gokeepasslib/v3"
+	"golang.org/x/crypto/chacha20"
+)
+
+// gokeepasslib derives the key of every kdbx 4 database not using argon2d with aes-kdf, so databases
+// using argon2id are re-keyed in memory: the payload is decrypted with the argon2id key and encrypted
+// again with a zero round aes-kdf key, which gokeepasslib can derive, and the other way around on save.
+
+// Size of the hmac blocks written by KeePass
+const kdbx4BlockSize = 1024 * 1024
+
+// Variant dictionary value types used by the kdf parameters
+const (
+	variantUInt32 byte = 0x04
+	variantUInt64 byte = 0x05
+	variantBytes  byte = 0x42
+)
+
+// Decrypts a database using argon2id and restores its kdf parameters after decoding
+func decodeArgon2idDatabase(db *gokeepasslib.Database, data []byte) error {
+	header, err := readKdbxHeader(data)
+	if err != nil {
+		return err
+	}
+	parameters, err := header.kdfParameters()
+	if err != nil {
+		return err
+	}
+	zeroRound, err := zeroRoundAesKdf()
+	if err != nil {
+		return err
+	}
+	rekeyed, err := rekeyKdbx4(data, db.Credentials, zeroRound)
+	if err != nil {
+		return err
+	}
+	if err := gokeepasslib.NewDecoder(bytes.NewReader(rekeyed)).Decode(db); err != nil {
+		return err
+	}
+	db.Header.FileHeaders.KdfParameters = parameters
+	return nil
+}
+
+// Encodes the database, including kdbx 4 databases using argon2id. gokeepasslib does not pad aes
+// payloads whose length is a multiple of the block size, so kdbx 4 databases using aes are encoded
+// with chacha20 and encrypted again with aes, as for argon2id.
+func EncodeDatabase(db *gokeepasslib.Database, writer io.Writer) error {
+	headers := db.Header.FileHeaders
+	parameters, cipherID, encryptionIV := headers.KdfParameters, headers.CipherID, headers.EncryptionIV
+	argon2id := parameters != nil && bytes.Equal(parameters.UUID, KdfArgon2id)
+	if !db.Header.IsKdbx4() || parameters == nil || (!argon2id && !bytes.Equal(cipherID, gokeepasslib.CipherAES)) {
+		return gokeepasslib.NewEncoder(writer).Encode(db)
+	}
+	zeroRound, err := zeroRoundAesKdf()
+	if err != nil {
+		return err
+	}
+	chachaIV := make([]byte, 12)
+	if _, err := rand.Read(chachaIV); err != nil {
+		return err
+	}
+	headers.KdfParameters, headers.CipherID, headers.EncryptionIV = zeroRound, gokeepasslib.CipherChaCha20, chachaIV
+	var encoded bytes.Buffer
+	err = gokeepasslib.NewEncoder(&encoded).Encode(db)
+	headers.KdfParameters, headers.CipherID, headers.EncryptionIV = parameters, cipherID, encryptionIV
+	if err != nil {
+		return err
+	}
+	rekeyed, err := rekeyKdbx4(encoded.Bytes(), db.Credentials, parameters,
+		headerField{headerCipherID, cipherID}, headerField{headerEncryptionIV, encryptionIV})
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(rekeyed)
+	return err
+}
+
+// Aes-kdf parameters which derive the key without any rounds
+func zeroRoundAesKdf() (*gokeepasslib.KdfParameters, error) {
+	parameters := &gokeepasslib.KdfParameters{UUID: gokeepasslib.KdfAES4}
+	if _, err := rand.Read(parameters.Salt[:]); err != nil {
+		return nil, err
+	}
+	return parameters, nil
+}
+
+// Re-encrypts a kdbx 4 file with other kdf parameters and header fields, the payload itself is left untouched
+func rekeyKdbx4(data []byte, credentials *gokeepasslib.DBCredentials, parameters *gokeepasslib.KdfParameters, fields ...headerField) ([]byte, error) {
+	header, payload, err := readKdbx4Payload(data, credentials)
+	if err != nil {
+		return nil, err
+	}
+	header = header.withField(headerKdfParameters, writeKdfParameters(parameters))
+	for _, field := range fields {
+		header = header.withField(field.id, field.data)
+	}
+	return writeKdbx4Payload(header, payload, credentials)
+}
+
+// Verifies and decrypts the payload of a kdbx 4 file, the payload holds the inner header and xml and may be compressed
+func readKdbx4Payload(data []byte, credentials *gokeepasslib.DBCredentials) (*kdbxHeader, []byte, error) {
+	header, err := readKdbxHeader(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if header.major < 4 {
+		return nil, nil, fmt.Errorf("%s is not a KDBX 4 database", header.version())
+	}
+	transformedKey, err := header.transformedKey(credentials)
+	if err != nil {
+		return nil, nil, err
+	}
+	masterSeed := header.field(headerMasterSeed)
+	offset := header.end
+	if offset+64 > len(data) {
+		return nil, nil, fmt.Errorf("Truncated %s database", header.version())
+	}
+	headerHash := sha256.Sum256(data[:header.end])
+	if !bytes.Equal(headerHash[:], data[offset:offset+32]) {
+		return nil, nil, fmt.Errorf("%s header is corrupted, SHA-256 mismatch", header.version())
+	}
+	if !hmac.Equal(headerHmac(data[:header.end], masterSeed, transformedKey), data[offset+32:offset+64]) {
+		return nil, nil, fmt.Errorf("Wrong password? HMAC-SHA256 of header mismatching")
+	}
+	offset += 64
+	var ciphertext []byte
+	for index := uint64(0); ; index++ {
+		if offset+36 > len(data) {
+			return nil, nil, fmt.Errorf("Truncated %s database", header.version())
+		}
+		blockHmac := data[offset : offset+32]
+		size := int(binary.LittleEndian.Uint32(data[offset+32 : offset+36]))
+		if size < 0 || offset+36+size > len(data) {
+			return nil, nil, fmt.Errorf("Truncated %s database", header.version())
+		}
+		block := data[offset+36 : offset+36+size]
+		if !hmac.Equal(blockHmac, payloadBlockHmac(index, block, masterSeed, transformedKey)) {
+			return nil, nil, fmt.Errorf("%s database is corrupted, HMAC-SHA256 of block %d mismatching", header.version(), index)
+		}
+		offset += 36 + size
+		if size == 0 {
+			break
+		}
+		ciphertext = append(ciphertext, block...)
+	}
+	payload, err := header.crypt(ciphertext, transformedKey, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return header, payload, nil
+}
+
+// Encrypts the payload and writes it with the header in hmac blocks
+func writeKdbx4Payload(header *kdbxHeader, payload []byte, credentials *gokeepasslib.DBCredentials) ([]byte, error) {
+	transformedKey, err := header.transformedKey(credentials)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := header.crypt(payload, transformedKey, true)
+	if err != nil {
+		return nil, err
+	}
+	masterSeed := header.field(headerMasterSeed)
+	headerBytes := header.bytes()
+	headerHash := sha256.Sum256(headerBytes)
+	var buffer bytes.Buffer
+	buffer.Write(headerBytes)
+	buffer.Write(headerHash[:])
+	buffer.Write(headerHmac(headerBytes, masterSeed, transformedKey))
+	for index := uint64(0); ; index++ {
+		size := len(ciphertext)
+		if size > kdbx4BlockSize {
+			size = kdbx4BlockSize
+		}
+		block := ciphertext[:size]
+		ciphertext = ciphertext[size:]
+		buffer.Write(payloadBlockHmac(index, block, masterSeed, transformedKey))
+		binary.Write(&buffer, binary.LittleEndian, uint32(size))
+		buffer.Write(block)
+		if size == 0 {
+			break
+		}
+	}
+	return buffer.Bytes(), nil
+}
+
+// Derives the transformed key from the composite key of the credentials with the kdf of the header
+func (h *kdbxHeader) transformedKey(credentials *gokeepasslib.DBCredentials) ([]byte, error) {
+	parameters, err := h.kdfParameters()
+	if err != nil {
+		return nil, err
+	}
+	if parameters == nil {
+		return nil, fmt.Errorf("%s does not store KDF parameters", h.version())
+	}
+	compositeKey := sha256.New()
+	for _, part := range [][]byte{credentials.Passphrase, credentials.Key, credentials.Windows} {
+		if part != nil {
+			compositeKey.Write(part)
+		}
+	}
+	key := compositeKey.Sum(nil)
+	switch {
+	case isAesKdf(parameters.UUID):
+		block, err := aes.NewCipher(parameters.Salt[:])
+		if err != nil {
+			return nil, err
+		}
+		for i := uint64(0); i < parameters.Rounds; i++ {
+			block.Encrypt(key[:16], key[:16])
+			block.Encrypt(key[16:], key[16:])
+		}
+		transformed := sha256.Sum256(key)
+		return transformed[:], nil
+	case bytes.Equal(parameters.UUID, kdfArgon2d):
+		return argon2.Key2d(key, parameters.Salt[:], uint32(parameters.Iterations), uint32(parameters.Memory/1024), uint8(parameters.Parallelism), 32), nil
+	case bytes.Equal(parameters.UUID, KdfArgon2id):
+		return argon2.Key2id(key, parameters.Salt[:], uint32(parameters.Iterations), uint32(parameters.Memory/1024), uint8(parameters.Parallelism), 32), nil
+	}
+	return nil, fmt.Errorf("Unsupported KDF %s", kdfName(parameters.UUID))
+}
+
+// Encrypts or decrypts the payload with the cipher of the header
+func (h *kdbxHeader) crypt(data []byte, transformedKey []byte, encrypt bool) ([]byte, error) {
+	masterKey := sha256.Sum256(append(append([]byte{}, h.field(headerMasterSeed)...), transformedKey...))
+	iv := h.field(headerEncryptionIV)
+	cipherID := h.field(headerCipherID)
+	switch {
+	case bytes.Equal(cipherID, gokeepasslib.CipherChaCha20):
+		stream, err := chacha20.NewUnauthenticatedCipher(masterKey[:], iv)
+		if err != nil {
+			return nil, err
+		}
+		output := make([]byte, len(data))
+		stream.XORKeyStream(output, data)
+		return output, nil
+	case bytes.Equal(cipherID, gokeepasslib.CipherAES):
+		block, err := aes.NewCipher(masterKey[:])
+		if err != nil {
+			return nil, err
+		}
+		if len(iv) != aes.BlockSize {
+			return nil, fmt.Errorf("Invalid AES-256 encryption IV")
+		}
+		if encrypt {
+			// pkcs#7 padding
+			padding := aes.BlockSize - len(data)%aes.BlockSize
+			output := append(append([]byte{}, data...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+			cipher.NewCBCEncrypter(block, iv).CryptBlocks(output, output)
+			return output, nil
+		}
+		if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+			return nil, fmt.Errorf("Invalid AES-256 payload length")
+		}
+		output := make([]byte, len(data))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(output, data)
+		padding := int(output[len(output)-1])
+		if padding == 0 || padding > aes.BlockSize {
+			return nil, fmt.Errorf("Invalid AES-256 payload padding")
+		}
+		return output[:len(output)-padding], nil
+	}
+	return nil, fmt.Errorf("Unsupported cipher %s", cipherName(cipherID))
+}
+
+func headerHmac(header []byte, masterSeed []byte, transformedKey []byte) []byte {
+	mac := hmac.New(sha256.New, blockHmacKey(^uint64(0), masterSeed, transformedKey))
+	mac.Write(header)
+	return mac.Sum(nil)
+}
+
+func payloadBlockHmac(index uint64, block []byte, masterSeed []byte, transformedKey []byte) []byte {
+	mac := hmac.New(sha256.New, blockHmacKey(index, masterSeed, transformedKey))
+	binary.Write(mac, binary.LittleEndian, index)
+	binary.Write(mac, binary.LittleEndian, uint32(len(block)))
+	mac.Write(block)
+	return mac.Sum(nil)
+}
+
+func blockHmacKey(index uint64, masterSeed []byte, transformedKey []byte) []byte {
+	baseKey := sha512.New()
+	baseKey.Write(masterSeed)
+	baseKey.Write(transformedKey)
+	baseKey.Write([]byte{0x01})
+	key := sha512.New()
+	binary.Write(key, binary.LittleEndian, index)
+	key.Write(baseKey.Sum(nil))
+	return key.Sum(nil)
+}
+
+// Parses the variant dictionary of the kdf parameters header field
+func readKdfParameters(data []byte) (*gokeepasslib.KdfParameters, error) {
+	parameters := &gokeepasslib.KdfParameters{RawData: &gokeepasslib.VariantDictionary{}}
+	if len(data) < 2 {
+		return nil, fmt.Errorf("Invalid KDF parameters")
+	}
+	parameters.RawData.Version = binary.LittleEndian.Uint16(data[0:2])
+	offset := 2
+	for {
+		if offset >= len(data) {
+			return nil, fmt.Errorf("Invalid KDF parameters")
+		}
+		valueType := data[offset]
+		if valueType == 0 {
+			break
+		}
+		if offset+5 > len(data) {
+			return nil, fmt.Errorf("Invalid KDF parameters")
+		}
+		nameLength := int(binary.LittleEndian.Uint32(data[offset+1 : offset+5]))
+		offset += 5
+		if nameLength < 0 || offset+nameLength+4 > len(data) {
+			return nil, fmt.Errorf("Invalid KDF parameters")
+		}
+		name := string(data[offset : offset+nameLength])
+		offset += nameLength
+		valueLength := int(binary.LittleEndian.Uint32(data[offset : offset+4]))
+		offset += 4
+		if valueLength < 0 || offset+valueLength > len(data) {
+			return nil, fmt.Errorf("Invalid KDF parameters")
+		}
+		value := data[offset : offset+valueLength]
+		offset += valueLength
+		parameters.RawData.Items = append(parameters.RawData.Items, &gokeepasslib.VariantDictionaryItem{
+			Type:        valueType,
+			NameLength:  int32(nameLength),
+			Name:        []byte(name),
+			ValueLength: int32(valueLength),
+			Value:       value,
+		})
+		integer := func() uint64 {
+			padded := make([]byte, 8)
+			copy(padded, value)
+			return binary.LittleEndian.Uint64(padded)
+		}
+		switch name {
+		case "$UUID":
+			parameters.UUID = value
+		case "R":
+			parameters.Rounds = integer()
+		case "S":
+			copy(parameters.Salt[:], value)
+		case "P":
+			parameters.Parallelism = uint32(integer())
+		case "M":
+			parameters.Memory = integer()
+		case "I":
+			parameters.Iterations = integer()
+		case "V":
+			parameters.Version = uint32(integer())
+		case "K":
+			parameters.SecretKey = value
+		case "A":
+			parameters.AssocData = value
+		}
+	}
+	return parameters, nil
+}
+
+// Serializes the kdf parameters as a variant dictionary
+func writeKdfParameters(parameters *gokeepasslib.KdfParameters) []byte {
+	var buffer bytes.Buffer
+	binary.Write(&buffer, binary.LittleEndian, uint16(0x0100))
+	item := func(valueType byte, name string, value []byte) {
+		buffer.WriteByte(valueType)
+		binary.Write(&buffer, binary.LittleEndian, uint32(len(name)))
+		buffer.WriteString(name)
+		binary.Write(&buffer, binary.LittleEndian, uint32(len(value)))
+		buffer.Write(value)
+	}
+	uint32Value := func(value uint32) []byte {
+		encoded := make([]byte, 4)
+		binary.LittleEndian.PutUint32(encoded, value)
+		return encoded
+	}
+	uint64Value := func(value uint64) []byte {
+		encoded := make([]byte, 8)
+		binary.LittleEndian.PutUint64(encoded, value)
+		return encoded
+	}
+	item(variantBytes, "$UUID", parameters.UUID)
+	if isAesKdf(parameters.UUID) {
+		item(variantUInt64, "R", uint64Value(parameters.Rounds))
+		item(variantBytes, "S", parameters.Salt[:])
+	} else {
+		item(variantBytes, "S", parameters.Salt[:])
+		item(variantUInt32, "P", uint32Value(parameters.Parallelism))
+		item(variantUInt64, "M", uint64Value(parameters.Memory))
+		item(variantUInt64, "I", uint64Value(parameters.Iterations))
+		item(variantUInt32, "V", uint32Value(parameters.Version))
+	}
+	buffer.WriteByte(0)
+	return buffer.Bytes()
+}
@@ -0,0 +1,97 @@
+package common
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+// Elements added by kdbx 4.1, which gokeepasslib skips when decoding the database
+type Kdbx41Details struct {
+	GroupTags map[gokeepasslib.UUID][]string
+	// groups and entries keyed by their uuid, the group they were moved from
+	PreviousParentGroups map[gokeepasslib.UUID]gokeepasslib.UUID
+	CustomIconNames      map[gokeepasslib.UUID]string
+}
+
+type rawKdbx41Entry struct {
+	UUID                gokeepasslib.UUID `xml:"UUID"`
+	PreviousParentGroup string            `xml:"PreviousParentGroup"`
+}
+
+type rawKdbx41Group struct {
+	UUID                gokeepasslib.UUID `xml:"UUID"`
+	Tags                string            `xml:"Tags"`
+	PreviousParentGroup string            `xml:"PreviousParentGroup"`
+	Entries             []rawKdbx41Entry  `xml:"Entry"`
+	Groups              []rawKdbx41Group  `xml:"Group"`
+}
+
+type rawKdbx41Icon struct {
+	UUID gokeepasslib.UUID `xml:"UUID"`
+	Name string            `xml:"Name"`
+}
+
+type rawKdbx41Content struct {
+	CustomIcons []rawKdbx41Icon  `xml:"Meta>CustomIcons>Icon"`
+	Groups      []rawKdbx41Group `xml:"Root>Group"`
+}
+
+// Reads the kdbx 4.1 group tags, previous parent groups and custom icon names from the xml of the database
+func ReadKdbx41Details(db *gokeepasslib.Database) (*Kdbx41Details, error) {
+	details := &Kdbx41Details{
+		GroupTags:            map[gokeepasslib.UUID][]string{},
+		PreviousParentGroups: map[gokeepasslib.UUID]gokeepasslib.UUID{},
+		CustomIconNames:      map[gokeepasslib.UUID]string{},
+	}
+	if !db.Header.IsKdbx4() {
+		return details, nil
+	}
+	content, err := contentXML(db)
+	if err != nil {
+		return nil, err
+	}
+	raw := rawKdbx41Content{}
+	if err := xml.Unmarshal(content, &raw); err != nil {
+		return nil, err
+	}
+	for _, icon := range raw.CustomIcons {
+		if icon.Name != "" {
+			details.CustomIconNames[icon.UUID] = icon.Name
+		}
+	}
+	var collect func(groups []rawKdbx41Group)
+	collect = func(groups []rawKdbx41Group) {
+		for _, group := range groups {
+			if tags := splitTags(group.Tags); len(tags) > 0 {
+				details.GroupTags[group.UUID] = tags
+			}
+			details.addPreviousParentGroup(group.UUID, group.PreviousParentGroup)
+			for _, entry := range group.Entries {
+				details.addPreviousParentGroup(entry.UUID, entry.PreviousParentGroup)
+			}
+			collect(group.Groups)
+		}
+	}
+	collect(raw.Groups)
+	return details, nil
+}
+
+func (d *Kdbx41Details) addPreviousParentGroup(uuid gokeepasslib.UUID, previousParentGroup string) {
+	// decoded here as gokeepasslib replaces an empty uuid with a random one
+	decoded, err := base64.StdEncoding.DecodeString(previousParentGroup)
+	if err != nil || len(decoded) != 16 {
+		return
+	}
+	var parent gokeepasslib.UUID
+	copy(parent[:], decoded)
+	if parent != (gokeepasslib.UUID{}) {
+		d.PreviousParentGroups[uuid] = parent
+	}
+}
+
+// Checks whether the database uses none of the kdbx 4.1 elements
+func (d *Kdbx41Details) Empty() bool {
+	return len(d.GroupTags) == 0 && len(d.PreviousParentGroups) == 0 && len(d.CustomIconNames) == 0
+}
@@ -1,7 +1,11 @@
 package common
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"strings"
@@ -11,77 +15,216 @@ import (
 	"github.com/tobischo/gokeepasslib/v3"
 )
 
-// Opens the keepass database file and decrypt with password
-func OpenDatabase(keepassFile string, keepassPassword string) (*gokeepasslib.Database, error) {
-	file, err := os.Open(keepassFile)
+// Opens the keepass database file and decrypt with password, protected values stay encrypted.
+// Unencrypted xml exports are only read with allowPlaintext. Signed keeshare containers are only
+// imported from the trusted signers. Also returns the hex encoded SHA-256 digest of the file
+// contents that were read, for the audit log.
+func OpenDatabase(keepassFile string, keepassPassword string, keepassFormat string, allowPlaintext bool, trustedSigners []string) (*gokeepasslib.Database, string, error) {
+	data, err := os.ReadFile(keepassFile)
 	if err != nil {
 		// file does not exist
+		return nil, "", err
+	}
+	digest := sha256.Sum256(data)
+	db, err := openDatabase(data, keepassFile, keepassPassword, keepassFormat, allowPlaintext, trustedSigners)
+	if err != nil {
+		return nil, "", err
+	}
+	return db, hex.EncodeToString(digest[:]), nil
+}
+
+// Decodes the contents of the database file read by OpenDatabase
+func openDatabase(data []byte, keepassFile string, keepassPassword string, keepassFormat string, allowPlaintext bool, trustedSigners []string) (*gokeepasslib.Database, error) {
+	var err error
+	var db *gokeepasslib.Database
+	if keepassFormat == FormatXML || (keepassFormat == "" && isXMLDatabase(data)) {
+		if !allowPlaintext {
+			return nil, fmt.Errorf("The database file %s is an unencrypted KeePass XML export, set `allow_plaintext = true` to read it", keepassFile)
+		}
+		log.Println(fmt.Sprintf("[WARNING] Reading unencrypted KeePass XML export %s", keepassFile))
+		db, err = decodeXMLDatabase(data)
+	} else if keepassPassword == "" {
+		return nil, fmt.Errorf("The database file %s is not an unencrypted KeePass XML export, the `keepass_password` must be provided.", keepassFile)
+	} else {
+		db, err = decodeDatabase(bytes.NewReader(data), keepassPassword)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := checkWalkLimits(db); err != nil {
+		return nil, err
+	}
+	// protected values are decrypted one at a time with RevealValue
+	streamEnd, err := indexProtectedValues(db)
+	if err != nil {
+		return nil, err
+	}
+	// splice in the contents of any keeshare containers imported by the database
+	if err := resolveKeeShares(db, streamEnd, keepassFile, trustedSigners, map[string]bool{}); err != nil {
+		return nil, err
+	}
+	if err := checkWalkLimits(db); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Walks the database once so that later walks of the database stay within the limits
+func checkWalkLimits(db *gokeepasslib.Database) error {
+	return WalkDatabase(db, nil, func(string, gokeepasslib.Entry, int) {})
+}
+
+// Decrypts a keepass database from the reader with password
+func decodeDatabase(reader io.Reader, keepassPassword string) (*gokeepasslib.Database, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if isKdbDatabase(data) {
+		return decodeKdbDatabase(data, keepassPassword)
+	}
+	// check the format before decrypting, gokeepasslib reports unsupported formats as a wrong password
+	header, err := readKdbxHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := header.checkSupported(); err != nil {
 		return nil, err
 	}
 	db := gokeepasslib.NewDatabase()
 	db.Credentials = gokeepasslib.NewPasswordCredentials(keepassPassword)
-	err = gokeepasslib.NewDecoder(file).Decode(db)
+	if parameters, _ := header.kdfParameters(); parameters != nil && bytes.Equal(parameters.UUID, KdfArgon2id) {
+		err = decodeArgon2idDatabase(db, data)
+	} else {
+		err = gokeepasslib.NewDecoder(bytes.NewReader(data)).Decode(db)
+	}
 	if err != nil {
 		// incorrect password
-		return nil, err
+		return nil, fmt.Errorf("Unable to open %s database: %s", header.format(), err)
 	}
 	return db, nil
 }
 
-// Walks the keepass database and constructs path keys for each entry
+// Limits of the walked database, so that a crafted database fails with an error instead of exhausting the build
+var (
+	maxWalkDepth   = 256
+	maxWalkEntries = 1000000
+	maxPathLength  = 4096
+)
+
+// Walks the keepass database and constructs path keys for each entry, entries are passed by
+// path and by uuid. Fails if the database exceeds the depth or size limits of the walker.
 func WalkDatabase(db *gokeepasslib.Database,
 	groupCallback func(string, gokeepasslib.Group, int),
-	entryCallback func(string, gokeepasslib.Entry, int)) {
-	pathMap := map[string]string{}
+	entryCallback func(string, gokeepasslib.Entry, int)) error {
+	walker := &walker{pathMap: map[string]string{}, groupCallback: groupCallback, entryCallback: entryCallback}
 	for i := range db.Content.Root.Groups {
-		walk("", 0, pathMap, db.Content.Root.Groups[i], groupCallback, entryCallback)
+		if err := walker.walk("", 0, db.Content.Root.Groups[i]); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func walk(path string, depth int, pathMap map[string]string, group gokeepasslib.Group,
-	groupCallback func(string, gokeepasslib.Group, int),
-	entryCallback func(string, gokeepasslib.Entry, int)) {
+type walker struct {
+	pathMap       map[string]string
+	entries       int
+	groupCallback func(string, gokeepasslib.Group, int)
+	entryCallback func(string, gokeepasslib.Entry, int)
+}
+
+func (w *walker) walk(path string, depth int, group gokeepasslib.Group) error {
 	// construct path for group
 	groupPath := path + "/" + group.Name
-	if groupCallback != nil {
-		groupCallback(groupPath, group, depth)
+	if depth >= maxWalkDepth {
+		return fmt.Errorf("Database groups are nested deeper than %d levels at %s", maxWalkDepth, truncatePath(groupPath))
+	}
+	if len(groupPath) > maxPathLength {
+		return fmt.Errorf("Database group path exceeds %d bytes: %s", maxPathLength, truncatePath(groupPath))
+	}
+	if w.groupCallback != nil {
+		w.groupCallback(groupPath, group, depth)
 	}
 	for i := range group.Entries {
 		entry := group.Entries[i]
 		entryPath := fmt.Sprintf("%s/%s", groupPath, entry.GetTitle())
-		// check for existence of entry path key
-		if _, keyExists := pathMap[entryPath]; keyExists {
-			// warn in log that an ambiguous path is encountered
-			log.Println(fmt.Sprintf("[WARNING] Ambiguous path for entry: %s", entryPath))
-			log.Println("[WARNING] Only the first entry with this path will be accessible")
-		} else {
-			// add entry path key to map and call callback function
-			pathMap[entryPath] = ""
-			entryCallback(entryPath, entry, depth)
+		if len(entryPath) > maxPathLength {
+			return fmt.Errorf("Database entry path exceeds %d bytes: %s", maxPathLength, truncatePath(entryPath))
+		}
+		if w.entries++; w.entries > maxWalkEntries {
+			return fmt.Errorf("Database contains more than %d entries", maxWalkEntries)
 		}
-		// parse uuid bytes and convert to keepass UI format - no dashes and uppercase
-		entryUUID, err := uuid.FromBytes(entry.UUID[:])
+		w.visit(entryPath, entry, depth)
+		entryUUIDString, err := FormatUUID(entry.UUID)
 		if err == nil {
-			entryUUIDString := strings.ReplaceAll(strings.ToUpper(entryUUID.String()), "-", "")
-			entryCallback(entryUUIDString, entry, depth)
+			w.visit(entryUUIDString, entry, depth)
 		} else {
 			log.Println("[ERROR] Unable to parse UUID bytes for entry, the output map may be incomplete")
 		}
 	}
 	// iterate through subgroups
 	for i := range group.Groups {
-		walk(groupPath, depth+1, pathMap, group.Groups[i], groupCallback, entryCallback)
+		if err := w.walk(groupPath, depth+1, group.Groups[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Passes the entry to the callback unless an earlier entry has the same path or uuid key
+func (w *walker) visit(key string, entry gokeepasslib.Entry, depth int) {
+	// check for existence of entry path key
+	if _, keyExists := w.pathMap[key]; keyExists {
+		// warn in log that an ambiguous path is encountered
+		log.Println(fmt.Sprintf("[WARNING] Ambiguous path for entry: %s", key))
+		log.Println("[WARNING] Only the first entry with this path will be accessible")
+		return
+	}
+	// add entry path key to map and call callback function
+	w.pathMap[key] = ""
+	w.entryCallback(key, entry, depth)
+}
+
+// Shortens a path for an error message
+func truncatePath(path string) string {
+	if len(path) <= 256 {
+		return path
 	}
+	return path[:128] + "..." + path[len(path)-125:]
 }
 
-func CheckConfig(keepassFile string, keepassPassword string) *packer.MultiError {
+// Parses uuid bytes and converts to keepass UI format - no dashes and uppercase
+func FormatUUID(entryUUID gokeepasslib.UUID) (string, error) {
+	parsed, err := uuid.FromBytes(entryUUID[:])
+	if err != nil {
+		return "", err
+	}
+	return strings.ReplaceAll(strings.ToUpper(parsed.String()), "-", ""), nil
+}
+
+func CheckConfig(keepassFile string, keepassPassword string, keepassFormat string, allowPlaintext bool) *packer.MultiError {
 	// check that keepass_file and keepass_password are provided
 	var errs *packer.MultiError
 	if keepassFile == "" {
 		errs = packer.MultiErrorAppend(errs, fmt.Errorf("The `keepass_file` must be provided."))
 	}
-	if keepassPassword == "" {
-		errs = packer.MultiErrorAppend(errs, fmt.Errorf("The `keepass_password` must be provided."))
+	switch keepassFormat {
+	case "":
+		// the format is detected when the database is opened, xml exports need no password
+		if keepassPassword == "" && !allowPlaintext {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("The `keepass_password` must be provided."))
+		}
+	case FormatKdbx:
+		if keepassPassword == "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("The `keepass_password` must be provided."))
+		}
+	case FormatXML:
+		// xml exports are not encrypted and must never be read by accident
+		if !allowPlaintext {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("The `allow_plaintext` must be set to true to read the unencrypted `keepass_format` %s.", FormatXML))
+		}
+	default:
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("The `keepass_format` must be one of %s or %s.", FormatKdbx, FormatXML))
 	}
 	return errs
 }
@@ -0,0 +1,101 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+// Export with the groups nested depth levels deep and an entry in the innermost group
+func nestedXMLTestExport(depth int) string {
+	var builder strings.Builder
+	builder.WriteString("<?xml version=\"1.0\" encoding=\"utf-8\"?>\n<KeePassFile><Root>")
+	for i := 0; i < depth; i++ {
+		builder.WriteString("<Group><Name>g</Name>")
+	}
+	builder.WriteString("<Entry><String><Key>Title</Key><Value>deep</Value></String></Entry>")
+	for i := 0; i < depth; i++ {
+		builder.WriteString("</Group>")
+	}
+	builder.WriteString("</Root></KeePassFile>\n")
+	return builder.String()
+}
+
+func walkTestDatabase(groups ...gokeepasslib.Group) *gokeepasslib.Database {
+	db := gokeepasslib.NewDatabase()
+	db.Content.Root.Groups = groups
+	return db
+}
+
+func walkTestGroup(name string, entryTitles ...string) gokeepasslib.Group {
+	group := gokeepasslib.NewGroup()
+	group.Name = name
+	for _, title := range entryTitles {
+		entry := gokeepasslib.NewEntry()
+		entry.Values = append(entry.Values, gokeepasslib.ValueData{Key: "Title", Value: gokeepasslib.V{Content: title}})
+		group.Entries = append(group.Entries, entry)
+	}
+	return group
+}
+
+func TestOpenDatabaseDepthLimit(t *testing.T) {
+	for _, testCase := range []struct {
+		depth    int
+		expected string
+	}{
+		{maxWalkDepth, ""},
+		{maxWalkDepth + 1, "nested deeper than 256 levels"},
+	} {
+		keepassFile := filepath.Join(t.TempDir(), "nested.xml")
+		if err := os.WriteFile(keepassFile, []byte(nestedXMLTestExport(testCase.depth)), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, _, err := OpenDatabase(keepassFile, "", FormatXML, true, nil)
+		if testCase.expected == "" && err != nil {
+			t.Errorf("depth %d: %s", testCase.depth, err)
+		}
+		if testCase.expected != "" && (err == nil || !strings.Contains(err.Error(), testCase.expected)) {
+			t.Errorf("depth %d: expected an error containing %q, got %v", testCase.depth, testCase.expected, err)
+		}
+	}
+}
+
+func TestWalkDatabaseLimits(t *testing.T) {
+	defer func(entries, length int) { maxWalkEntries, maxPathLength = entries, length }(maxWalkEntries, maxPathLength)
+	maxWalkEntries, maxPathLength = 3, 16
+	noop := func(string, gokeepasslib.Entry, int) {}
+	if err := WalkDatabase(walkTestDatabase(walkTestGroup("a", "1", "2", "3")), nil, noop); err != nil {
+		t.Errorf("expected the entries to be within the limits: %s", err)
+	}
+	if err := WalkDatabase(walkTestDatabase(walkTestGroup("a", "1", "2"), walkTestGroup("b", "3", "4")), nil, noop); err == nil || !strings.Contains(err.Error(), "more than 3 entries") {
+		t.Errorf("expected the entry limit to be exceeded, got %v", err)
+	}
+	if err := WalkDatabase(walkTestDatabase(walkTestGroup("a", strings.Repeat("x", 15))), nil, noop); err == nil || !strings.Contains(err.Error(), "entry path exceeds 16 bytes") {
+		t.Errorf("expected the path limit to be exceeded, got %v", err)
+	}
+	if err := WalkDatabase(walkTestDatabase(walkTestGroup(strings.Repeat("x", 16))), nil, noop); err == nil || !strings.Contains(err.Error(), "group path exceeds 16 bytes") {
+		t.Errorf("expected the path limit to be exceeded, got %v", err)
+	}
+}
+
+func TestAttachmentPathsAmbiguous(t *testing.T) {
+	db := gokeepasslib.NewDatabase()
+	// "/a/b-c" with attachment "d" and "/a/b" with attachment "c-d" share the key "/a/b-c-d"
+	group := walkTestGroup("a", "b-c", "b", "b-c")
+	group.Entries[0].Binaries = append(group.Entries[0].Binaries, gokeepasslib.NewBinaryReference("d", AddBinary(db, []byte("first"))))
+	group.Entries[1].Binaries = append(group.Entries[1].Binaries, gokeepasslib.NewBinaryReference("c-d", AddBinary(db, []byte("second"))))
+	group.Entries[2].Binaries = append(group.Entries[2].Binaries, gokeepasslib.NewBinaryReference("d", AddBinary(db, []byte("third"))))
+	db.Content.Root.Groups = []gokeepasslib.Group{group}
+	attachmentsMap, entryMap := AttachmentPaths(db)
+	attachment := attachmentsMap["/a/b-c-d"]
+	contents, err := ReadAttachment(db, attachment)
+	if err != nil || string(contents) != "first" {
+		t.Errorf("expected the attachment of the first entry, got %q %v", contents, err)
+	}
+	if entry := AttachmentEntry(entryMap, "/a/b-c-d", attachment); entry.UUID != group.Entries[0].UUID {
+		t.Errorf("expected the first entry, got %s", entry.GetTitle())
+	}
+}
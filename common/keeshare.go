@@ -0,0 +1,445 @@
+package common
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tobischo/gokeepasslib/v3"
+	"golang.org/x/crypto/ssh"
+)
+
+// KeeShare custom data key and signed container member names used by KeePassXC
+const (
+	keeShareReferenceKey  = "KeeShare/Reference"
+	keeShareContainerName = "container.share.kdbx"
+	keeShareSignatureName = "container.share.signature"
+)
+
+// Decoded KeeShare reference stored (base64 encoded) in a group's custom data
+type keeShareReference struct {
+	Import   *struct{} `xml:"Type>Import"`
+	Path     string    `xml:"Path"`
+	Password string    `xml:"Password"`
+}
+
+// Decoded contents of the signature file within a signed .share container
+type keeShareSignature struct {
+	Signature string `xml:"Signature"`
+	Signer    string `xml:"Certificate>Signer"`
+	Key       string `xml:"Certificate>Key"`
+}
+
+// Minimal view of the database xml used to read group fields not parsed by gokeepasslib
+type rawGroup struct {
+	UUID       gokeepasslib.UUID         `xml:"UUID"`
+	CustomData []gokeepasslib.CustomData `xml:"CustomData>Item"`
+	Groups     []rawGroup                `xml:"Group"`
+}
+
+type rawContent struct {
+	Groups []rawGroup `xml:"Root>Group"`
+}
+
+// Follows KeeShare import groups and splices the referenced containers into the database. The protected values
+// of the containers are moved into the inner random stream of the database after streamEnd, the offset following
+// its own values. Signed containers are verified and, when trusted signers are given as SHA256 fingerprints of
+// their keys, only accepted from them.
+func resolveKeeShares(db *gokeepasslib.Database, streamEnd int64, keepassFile string, trustedSigners []string, visited map[string]bool) error {
+	references, err := readKeeShareReferences(db)
+	if err != nil {
+		return err
+	}
+	if len(references) == 0 {
+		return nil
+	}
+	absPath, err := filepath.Abs(keepassFile)
+	if err != nil {
+		return err
+	}
+	visited[absPath] = true
+	for groupUUID, reference := range references {
+		group := findGroup(db.Content.Root.Groups, groupUUID)
+		if group == nil {
+			continue
+		}
+		containerFile := reference.Path
+		if !filepath.IsAbs(containerFile) {
+			containerFile = filepath.Join(filepath.Dir(keepassFile), containerFile)
+		}
+		containerAbsPath, err := filepath.Abs(containerFile)
+		if err != nil {
+			return err
+		}
+		if visited[containerAbsPath] {
+			log.Println(fmt.Sprintf("[WARNING] Skipping recursive KeeShare import of %s", containerFile))
+			continue
+		}
+		container, err := openKeeShareContainer(containerFile, reference.Password, trustedSigners)
+		if err != nil {
+			return fmt.Errorf("Error importing KeeShare container %s into group %s: %s", containerFile, group.Name, err)
+		}
+		containerStreamEnd, err := indexProtectedValues(container)
+		if err != nil {
+			return fmt.Errorf("Error importing KeeShare container %s into group %s: %s", containerFile, group.Name, err)
+		}
+		if err := resolveKeeShares(container, containerStreamEnd, containerFile, trustedSigners, visited); err != nil {
+			return err
+		}
+		streamEnd, err = spliceContainer(db, streamEnd, group, container)
+		if err != nil {
+			return fmt.Errorf("Error importing KeeShare container %s into group %s: %s", containerFile, group.Name, err)
+		}
+		log.Println(fmt.Sprintf("Imported KeeShare container %s into group %s", containerFile, group.Name))
+	}
+	delete(visited, absPath)
+	return nil
+}
+
+// Reads the KeeShare import references of all groups keyed by group UUID
+func readKeeShareReferences(db *gokeepasslib.Database) (map[gokeepasslib.UUID]keeShareReference, error) {
+	content, err := contentXML(db)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Contains(content, []byte(keeShareReferenceKey)) {
+		return nil, nil
+	}
+	raw := rawContent{}
+	if err := xml.Unmarshal(content, &raw); err != nil {
+		return nil, err
+	}
+	references := map[gokeepasslib.UUID]keeShareReference{}
+	var collect func(groups []rawGroup) error
+	collect = func(groups []rawGroup) error {
+		for _, group := range groups {
+			for _, item := range group.CustomData {
+				if item.Key != keeShareReferenceKey {
+					continue
+				}
+				reference, err := decodeKeeShareReference(item.Value)
+				if err != nil {
+					return err
+				}
+				if reference.Import != nil && reference.Path != "" {
+					references[group.UUID] = reference
+				}
+			}
+			if err := collect(group.Groups); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return references, collect(raw.Groups)
+}
+
+// Decodes a base64 encoded KeeShare reference, the path and password are themselves base64 encoded
+func decodeKeeShareReference(value string) (keeShareReference, error) {
+	reference := keeShareReference{}
+	referenceXML, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return reference, fmt.Errorf("Invalid KeeShare reference: %s", err)
+	}
+	if err := xml.Unmarshal(referenceXML, &reference); err != nil {
+		return reference, fmt.Errorf("Invalid KeeShare reference: %s", err)
+	}
+	path, err := base64.StdEncoding.DecodeString(reference.Path)
+	if err != nil {
+		return reference, fmt.Errorf("Invalid KeeShare reference path: %s", err)
+	}
+	password, err := base64.StdEncoding.DecodeString(reference.Password)
+	if err != nil {
+		return reference, fmt.Errorf("Invalid KeeShare reference password: %s", err)
+	}
+	reference.Path = string(path)
+	reference.Password = string(password)
+	return reference, nil
+}
+
+// Opens a KeeShare container, either a plain kdbx export or a (signed) .share zip
+func openKeeShareContainer(containerFile string, password string, trustedSigners []string) (*gokeepasslib.Database, error) {
+	containerBytes, err := os.ReadFile(containerFile)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(strings.ToLower(containerFile), ".share") {
+		containerBytes, err = readSignedContainer(containerBytes, trustedSigners)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return decodeDatabase(bytes.NewReader(containerBytes), password)
+}
+
+// Extracts the kdbx from a .share zip and verifies its signature, if any. Unsigned containers are refused
+// once trusted signers are configured.
+func readSignedContainer(shareBytes []byte, trustedSigners []string) ([]byte, error) {
+	archive, err := zip.NewReader(bytes.NewReader(shareBytes), int64(len(shareBytes)))
+	if err != nil {
+		return nil, err
+	}
+	var containerBytes, signatureBytes []byte
+	for _, file := range archive.File {
+		if file.Name != keeShareContainerName && file.Name != keeShareSignatureName {
+			continue
+		}
+		reader, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return nil, err
+		}
+		if file.Name == keeShareContainerName {
+			containerBytes = data
+		} else {
+			signatureBytes = data
+		}
+	}
+	if containerBytes == nil {
+		return nil, fmt.Errorf("Share container does not contain %s", keeShareContainerName)
+	}
+	if signatureBytes == nil {
+		if len(trustedSigners) > 0 {
+			return nil, fmt.Errorf("KeeShare container is not signed, but `keeshare_trusted_signers` is set")
+		}
+		log.Println("[WARNING] KeeShare container is not signed")
+		return containerBytes, nil
+	}
+	if err := verifyContainerSignature(containerBytes, signatureBytes, trustedSigners); err != nil {
+		return nil, err
+	}
+	return containerBytes, nil
+}
+
+// Verifies the rsa signature of a container with the key embedded with the signature, as keepassxc does. This
+// only shows that the container was not changed since it was signed, anyone able to write the container can
+// sign it with their own key, so the key must also match a trusted signer when they are configured.
+func verifyContainerSignature(containerBytes []byte, signatureBytes []byte, trustedSigners []string) error {
+	signature := keeShareSignature{}
+	if err := xml.Unmarshal(signatureBytes, &signature); err != nil {
+		return fmt.Errorf("Invalid KeeShare signature: %s", err)
+	}
+	signatureHex := strings.TrimSpace(signature.Signature)
+	if !strings.HasPrefix(signatureHex, "rsa|") {
+		return fmt.Errorf("Unsupported KeeShare signature type")
+	}
+	signatureData, err := hex.DecodeString(strings.TrimPrefix(signatureHex, "rsa|"))
+	if err != nil {
+		return fmt.Errorf("Invalid KeeShare signature: %s", err)
+	}
+	keyData, err := base64.StdEncoding.DecodeString(strings.TrimSpace(signature.Key))
+	if err != nil {
+		return fmt.Errorf("Invalid KeeShare signer key: %s", err)
+	}
+	sshKey, err := ssh.ParsePublicKey(keyData)
+	if err != nil {
+		return fmt.Errorf("Invalid KeeShare signer key: %s", err)
+	}
+	cryptoKey, ok := sshKey.(ssh.CryptoPublicKey)
+	if !ok {
+		return fmt.Errorf("Unsupported KeeShare signer key type: %s", sshKey.Type())
+	}
+	rsaKey, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("Unsupported KeeShare signer key type: %s", sshKey.Type())
+	}
+	fingerprint := ssh.FingerprintSHA256(sshKey)
+	if len(trustedSigners) > 0 && !isTrustedSigner(fingerprint, trustedSigners) {
+		return fmt.Errorf("KeeShare container is signed by %q with key %s, which is not in `keeshare_trusted_signers`", signature.Signer, fingerprint)
+	}
+	digest := sha256.Sum256(containerBytes)
+	if err := rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signatureData); err != nil {
+		return fmt.Errorf("KeeShare signature verification failed for signer %q", signature.Signer)
+	}
+	log.Println(fmt.Sprintf("Verified KeeShare container signature from signer %q with key %s", signature.Signer, fingerprint))
+	if len(trustedSigners) == 0 {
+		log.Println(fmt.Sprintf("[WARNING] KeeShare signer key %s is not pinned, set `keeshare_trusted_signers` to only accept containers signed with it", fingerprint))
+	}
+	return nil
+}
+
+// Checks a key fingerprint against the trusted signers, which may be given with or without the
+// SHA256: prefix and base64 padding
+func isTrustedSigner(fingerprint string, trustedSigners []string) bool {
+	for _, trusted := range trustedSigners {
+		trusted = strings.TrimRight(strings.TrimPrefix(strings.TrimSpace(trusted), "SHA256:"), "=")
+		if trusted != "" && "SHA256:"+trusted == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// Merges the contents of the container root group into the import group, returns the offset following the
+// protected values moved into the inner random stream of the database
+func spliceContainer(db *gokeepasslib.Database, streamEnd int64, group *gokeepasslib.Group, container *gokeepasslib.Database) (int64, error) {
+	if len(container.Content.Root.Groups) == 0 {
+		return streamEnd, nil
+	}
+	splice := &keeShareSplice{db: db, container: container, streamEnd: streamEnd, binaryIDs: map[int]int{}}
+	err := splice.mergeGroup(group, container.Content.Root.Groups[0])
+	return splice.streamEnd, err
+}
+
+// Copies entries of a container into the database, the attachments copied so far are kept by container id
+type keeShareSplice struct {
+	db        *gokeepasslib.Database
+	container *gokeepasslib.Database
+	streamEnd int64
+	binaryIDs map[int]int
+}
+
+// Adds the entries and subgroups of the container group missing from the group. Entries and subgroups
+// synchronised previously by keepassxc are already present and are matched by uuid.
+func (s *keeShareSplice) mergeGroup(group *gokeepasslib.Group, containerGroup gokeepasslib.Group) error {
+	existing := map[gokeepasslib.UUID]bool{}
+	for _, entry := range group.Entries {
+		existing[entry.UUID] = true
+	}
+	for _, entry := range containerGroup.Entries {
+		if existing[entry.UUID] {
+			continue
+		}
+		if err := s.copyEntry(&entry); err != nil {
+			return err
+		}
+		group.Entries = append(group.Entries, entry)
+	}
+	for _, containerSubgroup := range containerGroup.Groups {
+		if subgroup := findSubgroup(group, containerSubgroup.UUID); subgroup != nil {
+			if err := s.mergeGroup(subgroup, containerSubgroup); err != nil {
+				return err
+			}
+			continue
+		}
+		subgroup := containerSubgroup
+		subgroup.Entries = nil
+		subgroup.Groups = nil
+		if err := s.mergeGroup(&subgroup, containerSubgroup); err != nil {
+			return err
+		}
+		group.Groups = append(group.Groups, subgroup)
+	}
+	return nil
+}
+
+// Moves the protected values and copies the attachments of a container entry and its history into the database
+func (s *keeShareSplice) copyEntry(entry *gokeepasslib.Entry) error {
+	values := make([]gokeepasslib.ValueData, len(entry.Values))
+	copy(values, entry.Values)
+	for i := range values {
+		streamEnd, err := reprotectValue(s.db, s.streamEnd, s.container, &values[i])
+		if err != nil {
+			return err
+		}
+		s.streamEnd = streamEnd
+	}
+	entry.Values = values
+	binaries := make([]gokeepasslib.BinaryReference, len(entry.Binaries))
+	copy(binaries, entry.Binaries)
+	for i := range binaries {
+		containerID := binaries[i].Value.ID
+		if id, copied := s.binaryIDs[containerID]; copied {
+			binaries[i].Value.ID = id
+			continue
+		}
+		containerBinary := binaries[i].Find(s.container)
+		if containerBinary == nil {
+			return fmt.Errorf("Could not find attachment binary for file: %s", binaries[i].Name)
+		}
+		content, err := containerBinary.GetContentBytes()
+		if err != nil {
+			return err
+		}
+		s.binaryIDs[containerID] = AddBinary(s.db, content)
+		binaries[i].Value.ID = s.binaryIDs[containerID]
+	}
+	entry.Binaries = binaries
+	histories := make([]gokeepasslib.History, len(entry.Histories))
+	for i, history := range entry.Histories {
+		histories[i].Entries = make([]gokeepasslib.Entry, len(history.Entries))
+		copy(histories[i].Entries, history.Entries)
+		for j := range histories[i].Entries {
+			if err := s.copyEntry(&histories[i].Entries[j]); err != nil {
+				return err
+			}
+		}
+	}
+	entry.Histories = histories
+	return nil
+}
+
+// Finds a direct subgroup of the group by its UUID
+func findSubgroup(group *gokeepasslib.Group, groupUUID gokeepasslib.UUID) *gokeepasslib.Group {
+	for i := range group.Groups {
+		if group.Groups[i].UUID.Compare(groupUUID) {
+			return &group.Groups[i]
+		}
+	}
+	return nil
+}
+
+// Adds binary content to the database in the format of its kdbx version and returns the new id
+func AddBinary(db *gokeepasslib.Database, content []byte) int {
+	if db.Header.IsKdbx4() {
+		binaries := &db.Content.InnerHeader.Binaries
+		id := len(*binaries)
+		*binaries = append(*binaries, gokeepasslib.Binary{ID: id, Content: content})
+		return id
+	}
+	return db.Content.Meta.Binaries.Add(content).ID
+}
+
+// Finds a group in the tree by its UUID
+func findGroup(groups []gokeepasslib.Group, groupUUID gokeepasslib.UUID) *gokeepasslib.Group {
+	for i := range groups {
+		if groups[i].UUID.Compare(groupUUID) {
+			return &groups[i]
+		}
+		if group := findGroup(groups[i].Groups, groupUUID); group != nil {
+			return group
+		}
+	}
+	return nil
+}
+
+// Returns the decrypted xml document of the database, skipping the kdbx 4 inner header
+func contentXML(db *gokeepasslib.Database) ([]byte, error) {
+	content := db.Content.RawData
+	if !db.Header.IsKdbx4() {
+		return content, nil
+	}
+	offset := 0
+	for {
+		// each inner header field is a 1 byte type followed by a 4 byte length and data
+		if offset+5 > len(content) {
+			return nil, fmt.Errorf("Invalid kdbx inner header")
+		}
+		fieldType := content[offset]
+		length := int(binary.LittleEndian.Uint32(content[offset+1 : offset+5]))
+		offset += 5 + length
+		if fieldType == gokeepasslib.InnerHeaderTerminator {
+			break
+		}
+	}
+	if offset > len(content) {
+		return nil, fmt.Errorf("Invalid kdbx inner header")
+	}
+	return content[offset:], nil
+}
@@ -0,0 +1,260 @@
+package common
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tobischo/gokeepasslib/v3"
+	"golang.org/x/crypto/ssh"
+)
+
+const keeShareTestPassword = "share-password"
+
+// Uuids of the container entry and subgroup, as keepassxc keeps them when synchronising the import group
+var (
+	keeShareTestEntryUUID    = gokeepasslib.UUID{0x6b, 0x65, 0x65, 0x73, 0x68, 0x61, 0x72, 0x65, 0, 0, 0, 0, 0, 0, 0, 1}
+	keeShareTestSubgroupUUID = gokeepasslib.UUID{0x6b, 0x65, 0x65, 0x73, 0x68, 0x61, 0x72, 0x65, 0, 0, 0, 0, 0, 0, 0, 2}
+	keeShareTestWebUUID      = gokeepasslib.UUID{0x6b, 0x65, 0x65, 0x73, 0x68, 0x61, 0x72, 0x65, 0, 0, 0, 0, 0, 0, 0, 3}
+)
+
+// Export importing the container at containerPath into the group Shared, which holds the synchronised xml.
+// The admin entry puts a protected value of the database ahead of the imported ones in the inner stream.
+func keeShareTestDatabase(containerPath string, synchronised string) string {
+	reference := fmt.Sprintf("<KeeShare><Type><Import/></Type><Path>%s</Path><Password>%s</Password></KeeShare>",
+		base64.StdEncoding.EncodeToString([]byte(containerPath)),
+		base64.StdEncoding.EncodeToString([]byte(keeShareTestPassword)))
+	return fmt.Sprintf(`<?xml version="1.0" encoding="utf-8" standalone="yes"?>
+<KeePassFile>
+	<Root>
+		<Group>
+			<UUID>8+Zf6aKyTbuQxGHLZlMmFA==</UUID>
+			<Name>team</Name>
+			<Entry>
+				<UUID>Ys2ETzQnRMmaKzW8mXxq7A==</UUID>
+				<String><Key>Title</Key><Value>admin</Value></String>
+				<String><Key>Password</Key><Value ProtectInMemory="True">admin-password</Value></String>
+			</Entry>
+			<Group>
+				<UUID>3wO1uCf4RiKmNqPcs0pNzQ==</UUID>
+				<Name>Shared</Name>
+				<CustomData><Item><Key>%s</Key><Value>%s</Value></Item></CustomData>
+				%s
+			</Group>
+		</Group>
+	</Root>
+</KeePassFile>
+`, keeShareReferenceKey, base64.StdEncoding.EncodeToString([]byte(reference)), synchronised)
+}
+
+// Encodes a container with a protected password, a previous password in the history, an attachment and
+// a subgroup
+func keeShareTestContainer(t *testing.T) []byte {
+	db := gokeepasslib.NewDatabase()
+	db.Credentials = gokeepasslib.NewPasswordCredentials(keeShareTestPassword)
+	entry := protectedTestEntry("deploy", map[string]string{"Password": "shared-password"})
+	entry.UUID = keeShareTestEntryUUID
+	previous := protectedTestEntry("deploy", map[string]string{"Password": "shared-previous-password"})
+	previous.UUID = keeShareTestEntryUUID
+	entry.Histories = []gokeepasslib.History{{Entries: []gokeepasslib.Entry{previous}}}
+	attachment := gokeepasslib.BinaryReference{Name: "ca.crt"}
+	attachment.Value.ID = AddBinary(db, []byte("shared certificate"))
+	entry.Binaries = append(entry.Binaries, attachment)
+	web := protectedTestEntry("web", map[string]string{"Password": "web-password"})
+	web.UUID = keeShareTestWebUUID
+	subgroup := gokeepasslib.NewGroup()
+	subgroup.UUID = keeShareTestSubgroupUUID
+	subgroup.Name = "certs"
+	subgroup.Entries = []gokeepasslib.Entry{web}
+	root := gokeepasslib.NewGroup()
+	root.Name = "export"
+	root.Entries = []gokeepasslib.Entry{entry}
+	root.Groups = []gokeepasslib.Group{subgroup}
+	db.Content.Root.Groups = []gokeepasslib.Group{root}
+	if err := db.LockProtectedEntries(); err != nil {
+		t.Fatal(err)
+	}
+	var buffer bytes.Buffer
+	if err := gokeepasslib.NewEncoder(&buffer).Encode(db); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+// Signs the container as keepassxc does, with the public key of the signer embedded in the signature
+func keeShareTestSignature(t *testing.T, key *rsa.PrivateKey, signer string, container []byte) []byte {
+	digest := sha256.Sum256(container)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []byte(fmt.Sprintf("<KeeShare><Signature>rsa|%s</Signature><Certificate><Signer>%s</Signer><Key>%s</Key></Certificate></KeeShare>",
+		hex.EncodeToString(signature), signer, base64.StdEncoding.EncodeToString(publicKey.Marshal())))
+}
+
+func keeShareTestShare(t *testing.T, container []byte, signature []byte) []byte {
+	var buffer bytes.Buffer
+	archive := zip.NewWriter(&buffer)
+	members := []struct {
+		name string
+		data []byte
+	}{{keeShareContainerName, container}, {keeShareSignatureName, signature}}
+	for _, member := range members {
+		if member.data == nil {
+			continue
+		}
+		writer, err := archive.Create(member.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer.Write(member.data)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func keeShareTestFingerprint(t *testing.T, key *rsa.PrivateKey) string {
+	publicKey, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ssh.FingerprintSHA256(publicKey)
+}
+
+func TestOpenDatabaseKeeShare(t *testing.T) {
+	trustedKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreignKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted := keeShareTestFingerprint(t, trustedKey)
+	container := keeShareTestContainer(t)
+	tampered := append([]byte{}, container...)
+	tampered[len(tampered)-1] ^= 0xff
+	signature := keeShareTestSignature(t, trustedKey, "ops", container)
+	testCases := []struct {
+		name           string
+		containerFile  string
+		contents       []byte
+		trustedSigners []string
+		expected       string
+	}{
+		{"kdbx export", "team.kdbx", container, nil, ""},
+		{"signed by a trusted signer", "team.share", keeShareTestShare(t, container, signature), []string{trusted}, ""},
+		// fingerprints are accepted as printed by ssh-keygen and with base64 padding
+		{"trusted signer without prefix", "team.share", keeShareTestShare(t, container, signature), []string{strings.TrimPrefix(trusted, "SHA256:") + "="}, ""},
+		{"unsigned", "team.share", keeShareTestShare(t, container, nil), nil, ""},
+		{"unsigned with trusted signers", "team.share", keeShareTestShare(t, container, nil), []string{trusted}, "is not signed"},
+		// without trusted signers the signature is verified with the embedded key
+		{"signed without trusted signers", "team.share", keeShareTestShare(t, container, signature), nil, ""},
+		{"tampered without trusted signers", "team.share", keeShareTestShare(t, tampered, signature), nil, "signature verification failed"},
+		// the container re-signed by someone else names the trusted signer but embeds their own key
+		{"foreign signer", "team.share", keeShareTestShare(t, container, keeShareTestSignature(t, foreignKey, "ops", container)), []string{trusted}, "which is not in `keeshare_trusted_signers`"},
+		{"tampered container", "team.share", keeShareTestShare(t, tampered, signature), []string{trusted}, "signature verification failed"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, testCase.containerFile), testCase.contents, 0600); err != nil {
+				t.Fatal(err)
+			}
+			keepassFile := filepath.Join(dir, "team.xml")
+			if err := os.WriteFile(keepassFile, []byte(keeShareTestDatabase(testCase.containerFile, "")), 0600); err != nil {
+				t.Fatal(err)
+			}
+			db, _, err := OpenDatabase(keepassFile, "", FormatXML, true, testCase.trustedSigners)
+			if testCase.expected != "" {
+				if err == nil || !strings.Contains(err.Error(), testCase.expected) {
+					t.Fatalf("expected an error containing %q, got %v", testCase.expected, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the entries of the container root group are spliced into the import group
+			attachmentMap, entryMap := AttachmentPaths(db)
+			entry, keyExists := entryMap["/team/Shared/deploy"]
+			if !keyExists {
+				t.Fatalf("expected the container entry in the import group, got %v", entryMap)
+			}
+			// the protected values of the container and the database are decrypted from the same stream
+			expected := map[string]string{
+				"/team/admin":            "admin-password",
+				"/team/Shared/deploy":    "shared-password",
+				"/team/Shared/certs/web": "web-password",
+			}
+			for entryPath, expectedPassword := range expected {
+				password, err := RevealField(db, entryMap[entryPath], "Password")
+				if err != nil || string(password) != expectedPassword {
+					t.Errorf("expected the password of %s, got %q, %v", entryPath, password, err)
+				}
+			}
+			password, err := RevealField(db, entry.Histories[0].Entries[0], "Password")
+			if err != nil || string(password) != "shared-previous-password" {
+				t.Errorf("expected the previous container password, got %q, %v", password, err)
+			}
+			contents, err := ReadAttachment(db, attachmentMap["/team/Shared/deploy-ca.crt"])
+			if err != nil || string(contents) != "shared certificate" {
+				t.Errorf("expected the container attachment, got %q, %v", contents, err)
+			}
+		})
+	}
+}
+
+func TestOpenDatabaseKeeShareSynchronised(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "team.kdbx"), keeShareTestContainer(t), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// keepassxc has already copied the deploy entry and the certs subgroup into the import group
+	synchronised := fmt.Sprintf(`<Entry>
+					<UUID>%s</UUID>
+					<String><Key>Title</Key><Value>deploy</Value></String>
+					<String><Key>Password</Key><Value ProtectInMemory="True">shared-password</Value></String>
+				</Entry>
+				<Group>
+					<UUID>%s</UUID>
+					<Name>certs</Name>
+				</Group>`, base64.StdEncoding.EncodeToString(keeShareTestEntryUUID[:]), base64.StdEncoding.EncodeToString(keeShareTestSubgroupUUID[:]))
+	keepassFile := filepath.Join(dir, "team.xml")
+	if err := os.WriteFile(keepassFile, []byte(keeShareTestDatabase("team.kdbx", synchronised)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, _, err := OpenDatabase(keepassFile, "", FormatXML, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := db.Content.Root.Groups[0].Groups[0]
+	if len(shared.Entries) != 1 || len(shared.Groups) != 1 {
+		t.Fatalf("expected the synchronised entry and subgroup once, got %d entries and %d subgroups", len(shared.Entries), len(shared.Groups))
+	}
+	// the entries missing from a synchronised subgroup are merged into it
+	certs := shared.Groups[0]
+	if len(certs.Entries) != 1 || certs.Entries[0].GetTitle() != "web" {
+		t.Fatalf("expected the web entry in the synchronised subgroup, got %d entries", len(certs.Entries))
+	}
+	password, err := RevealField(db, certs.Entries[0], "Password")
+	if err != nil || string(password) != "web-password" {
+		t.Errorf("expected the container password, got %q, %v", password, err)
+	}
+}
@@ -0,0 +1,229 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+// Key of the meta custom data item holding the policy stored in the database
+const PolicyCustomDataKey = "packer-plugin-keepass/policy"
+
+// An allowlist of group paths, tags and entry uuids for the templates and builds it applies to.
+// Templates and builds are glob patterns, a rule without them applies to every template or build.
+type PolicyRule struct {
+	Templates []string `json:"templates"`
+	Builds    []string `json:"builds"`
+	Groups    []string `json:"groups"`
+	Tags      []string `json:"tags"`
+	UUIDs     []string `json:"uuids"`
+}
+
+type policyDocument struct {
+	Rules []PolicyRule `json:"rules"`
+}
+
+// A policy document and the rules of it applying to the current template and build
+type policySource struct {
+	name  string
+	rules []PolicyRule
+}
+
+// Restricts the entries a template may read. The policy file and the policy stored in the
+// database are both enforced when present, so a template cannot widen the database policy.
+type Policy struct {
+	sources   []policySource
+	template  string
+	buildName string
+	denied    map[string]bool
+}
+
+// Loads the policy file and the policy stored in the database, returns nil if there is neither
+func LoadPolicy(db *gokeepasslib.Database, policyFile string, template string, buildName string) (*Policy, error) {
+	policy := &Policy{template: template, buildName: buildName, denied: map[string]bool{}}
+	if policyFile != "" {
+		contents, err := os.ReadFile(policyFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := policy.addSource(policyFile, contents); err != nil {
+			return nil, err
+		}
+	}
+	for _, item := range db.Content.Meta.CustomData {
+		if item.Key == PolicyCustomDataKey {
+			if err := policy.addSource("database custom data "+PolicyCustomDataKey, []byte(item.Value)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(policy.sources) == 0 {
+		return nil, nil
+	}
+	return policy, nil
+}
+
+func (p *Policy) addSource(name string, contents []byte) error {
+	document := policyDocument{}
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&document); err != nil {
+		return fmt.Errorf("Invalid access policy in %s: %s", name, err)
+	}
+	source := policySource{name: name}
+	for _, rule := range document.Rules {
+		// data sources are evaluated before any build, rules scoped to builds never apply to them
+		if p.buildName == "" && len(rule.Builds) > 0 {
+			continue
+		}
+		if matchesAny(rule.Templates, p.template) && matchesAny(rule.Builds, p.buildName) {
+			source.rules = append(source.rules, rule)
+		}
+	}
+	p.sources = append(p.sources, source)
+	return nil
+}
+
+// Checks whether the value is matched by any of the glob patterns, an empty list matches everything
+func matchesAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matched, err := path.Match(pattern, value); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks whether every policy source allows the entry in the group
+func (p *Policy) Allows(groupPath string, entry gokeepasslib.Entry) bool {
+	if p == nil {
+		return true
+	}
+	entryUUID, _ := FormatUUID(entry.UUID)
+	for _, source := range p.sources {
+		allowed := false
+		for _, rule := range source.rules {
+			if ruleAllows(rule, groupPath, entryUUID, entry) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+func ruleAllows(rule PolicyRule, groupPath string, entryUUID string, entry gokeepasslib.Entry) bool {
+	for _, group := range rule.Groups {
+		// a group allows its subgroups
+		group = strings.TrimSuffix(group, "/")
+		if groupPath == group || strings.HasPrefix(groupPath, group+"/") {
+			return true
+		}
+	}
+	if hasAnyTag(EntryTags(entry), rule.Tags) {
+		return true
+	}
+	for _, allowedUUID := range rule.UUIDs {
+		if entryUUID != "" && strings.EqualFold(strings.ReplaceAll(allowedUUID, "-", ""), entryUUID) {
+			return true
+		}
+	}
+	return false
+}
+
+// Loads the policy and removes the entries outside it from the database, returns nil if there is no policy
+func ApplyPolicy(db *gokeepasslib.Database, policyFile string, template string, buildName string) (*Policy, error) {
+	policy, err := LoadPolicy(db, policyFile, template, buildName)
+	if err != nil {
+		return nil, err
+	}
+	if err := policy.Apply(db); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// Removes the entries outside the policy from the database, so that they are not exposed by the walker
+func (p *Policy) Apply(db *gokeepasslib.Database) error {
+	if p == nil {
+		return nil
+	}
+	// protected values carry their stream offsets and stay valid when entries are removed
+	for i := range db.Content.Root.Groups {
+		p.applyGroup("", &db.Content.Root.Groups[i])
+	}
+	return nil
+}
+
+func (p *Policy) applyGroup(path string, group *gokeepasslib.Group) {
+	groupPath := path + "/" + group.Name
+	entries := []gokeepasslib.Entry{}
+	for _, entry := range group.Entries {
+		if p.Allows(groupPath, entry) {
+			entries = append(entries, entry)
+			continue
+		}
+		p.denied[fmt.Sprintf("%s/%s", groupPath, entry.GetTitle())] = true
+		if entryUUID, err := FormatUUID(entry.UUID); err == nil {
+			p.denied[entryUUID] = true
+		}
+	}
+	group.Entries = entries
+	for i := range group.Groups {
+		p.applyGroup(groupPath, &group.Groups[i])
+	}
+}
+
+// Returns an error if the entry or attachment path refers to an entry removed by the policy,
+// used to explain why a path could not be found
+func (p *Policy) CheckPath(entryOrAttachmentPath string) error {
+	if p == nil {
+		return nil
+	}
+	for denied := range p.denied {
+		if entryOrAttachmentPath == denied || strings.HasPrefix(entryOrAttachmentPath, denied+"-") {
+			return p.deniedError(entryOrAttachmentPath)
+		}
+	}
+	return nil
+}
+
+// Returns an error if an entry may not be written at the path, new entries are checked by their group only
+func (p *Policy) CheckWrite(db *gokeepasslib.Database, entryPath string) error {
+	if p == nil {
+		return nil
+	}
+	groupPath := ""
+	if separator := strings.LastIndex(entryPath, "/"); separator >= 0 {
+		groupPath = entryPath[:separator]
+	}
+	entry := gokeepasslib.Entry{}
+	WalkDatabase(db, nil, func(walkedPath string, walkedEntry gokeepasslib.Entry, depth int) {
+		if walkedPath == entryPath {
+			entry = walkedEntry
+		}
+	})
+	if !p.Allows(groupPath, entry) {
+		return p.deniedError(entryPath)
+	}
+	return nil
+}
+
+func (p *Policy) deniedError(entryOrAttachmentPath string) error {
+	names := []string{}
+	for _, source := range p.sources {
+		names = append(names, source.name)
+	}
+	return fmt.Errorf("Access to \"%s\" is denied by the access policy (%s) for template \"%s\" and build \"%s\".", entryOrAttachmentPath, strings.Join(names, ", "), p.template, p.buildName)
+}
@@ -0,0 +1,198 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+var policyTestUUID = gokeepasslib.UUID{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10}
+
+func policyTestDatabase() *gokeepasslib.Database {
+	prod := walkTestGroup("prod", "db", "api")
+	prod.Entries[0].Tags = "postgres;linux"
+	prod.Groups = []gokeepasslib.Group{walkTestGroup("web", "nginx")}
+	dev := walkTestGroup("dev", "app")
+	dev.Entries[0].UUID = policyTestUUID
+	// a group whose name starts with the name of another group
+	production := walkTestGroup("production", "report")
+	return walkTestDatabase(prod, dev, production)
+}
+
+// Paths of the entries left in the database, without the uuid keys
+func policyTestPaths(db *gokeepasslib.Database) string {
+	paths := []string{}
+	WalkDatabase(db, nil, func(entryPath string, entry gokeepasslib.Entry, depth int) {
+		if strings.HasPrefix(entryPath, "/") {
+			paths = append(paths, entryPath)
+		}
+	})
+	sort.Strings(paths)
+	return strings.Join(paths, " ")
+}
+
+func writePolicyTestFile(t *testing.T, contents string) string {
+	policyFile := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(policyFile, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return policyFile
+}
+
+func TestApplyPolicy(t *testing.T) {
+	testCases := []struct {
+		name      string
+		policy    string
+		template  string
+		buildName string
+		expected  string
+	}{
+		{"group", `{"rules": [{"groups": ["/dev"]}]}`, "", "", "/dev/app"},
+		{"subgroup", `{"rules": [{"groups": ["/prod/web/"]}]}`, "", "", "/prod/web/nginx"},
+		{"group name prefix", `{"rules": [{"groups": ["/prod"]}]}`, "", "", "/prod/api /prod/db /prod/web/nginx"},
+		{"tag", `{"rules": [{"tags": ["postgres"]}]}`, "", "", "/prod/db"},
+		{"uuid", `{"rules": [{"uuids": ["01020304-0506-0708-090a-0b0c0d0e0f10"]}]}`, "", "", "/dev/app"},
+		{"any rule", `{"rules": [{"tags": ["postgres"]}, {"groups": ["/dev"]}]}`, "", "", "/dev/app /prod/db"},
+		{"template", `{"rules": [{"templates": ["web-*"], "groups": ["/prod/web"]}, {"templates": ["db"], "groups": ["/dev"]}]}`, "web-server", "", "/prod/web/nginx"},
+		{"other template", `{"rules": [{"templates": ["web-*"], "groups": ["/prod/web"]}]}`, "db", "", ""},
+		{"build", `{"rules": [{"builds": ["alpine"], "groups": ["/prod"]}, {"groups": ["/dev"]}]}`, "", "alpine", "/dev/app /prod/api /prod/db /prod/web/nginx"},
+		{"other build", `{"rules": [{"builds": ["alpine"], "groups": ["/prod"]}, {"groups": ["/dev"]}]}`, "", "ubuntu", "/dev/app"},
+		// data sources are evaluated before any build, even a wildcard does not match them
+		{"no build", `{"rules": [{"builds": ["*"], "groups": ["/prod"]}, {"groups": ["/dev"]}]}`, "", "", "/dev/app"},
+		{"no build name", `{"rules": [{"builds": ["alpine"], "groups": ["/prod"]}]}`, "", "", ""},
+		{"no rules", `{"rules": []}`, "", "", ""},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			db := policyTestDatabase()
+			policy, err := ApplyPolicy(db, writePolicyTestFile(t, testCase.policy), testCase.template, testCase.buildName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if policy == nil {
+				t.Fatal("expected a policy")
+			}
+			if paths := policyTestPaths(db); paths != testCase.expected {
+				t.Errorf("expected %q, got %q", testCase.expected, paths)
+			}
+		})
+	}
+}
+
+func TestApplyPolicyCustomData(t *testing.T) {
+	db := policyTestDatabase()
+	db.Content.Meta.CustomData = []gokeepasslib.CustomData{{Key: PolicyCustomDataKey, Value: `{"rules": [{"groups": ["/prod"]}]}`}}
+	// the policy file cannot widen the policy stored in the database
+	policyFile := writePolicyTestFile(t, `{"rules": [{"groups": ["/prod/web", "/dev"]}]}`)
+	policy, err := ApplyPolicy(db, policyFile, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paths := policyTestPaths(db); paths != "/prod/web/nginx" {
+		t.Errorf("expected the entries allowed by both policies, got %q", paths)
+	}
+	err = policy.CheckPath("/dev/app-Password")
+	if err == nil || !strings.Contains(err.Error(), "database custom data "+PolicyCustomDataKey) || !strings.Contains(err.Error(), policyFile) {
+		t.Errorf("expected both policies in the error, got %v", err)
+	}
+
+	db = policyTestDatabase()
+	db.Content.Meta.CustomData = []gokeepasslib.CustomData{{Key: PolicyCustomDataKey, Value: `{"rules": [{"tags": ["postgres"]}]}`}}
+	if _, err := ApplyPolicy(db, "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if paths := policyTestPaths(db); paths != "/prod/db" {
+		t.Errorf("expected the entries allowed by the database policy, got %q", paths)
+	}
+}
+
+func TestApplyPolicyNone(t *testing.T) {
+	db := policyTestDatabase()
+	policy, err := ApplyPolicy(db, "", "", "")
+	if err != nil || policy != nil {
+		t.Fatalf("expected no policy, got %v, %v", policy, err)
+	}
+	if err := policy.CheckPath("/dev/app"); err != nil {
+		t.Error(err)
+	}
+	if err := policy.CheckWrite(db, "/dev/app"); err != nil {
+		t.Error(err)
+	}
+	if paths := policyTestPaths(db); paths != "/dev/app /prod/api /prod/db /prod/web/nginx /production/report" {
+		t.Errorf("expected every entry, got %q", paths)
+	}
+}
+
+func TestApplyPolicyInvalid(t *testing.T) {
+	for _, contents := range []string{`{"rules": [{"group": ["/prod"]}]}`, `{"rules": `} {
+		policyFile := writePolicyTestFile(t, contents)
+		if _, err := ApplyPolicy(policyTestDatabase(), policyFile, "", ""); err == nil || !strings.Contains(err.Error(), "Invalid access policy in "+policyFile) {
+			t.Errorf("%s: expected an invalid policy error, got %v", contents, err)
+		}
+	}
+}
+
+func TestPolicyCheckPath(t *testing.T) {
+	db := policyTestDatabase()
+	policy, err := ApplyPolicy(db, writePolicyTestFile(t, `{"rules": [{"groups": ["/prod"]}]}`), "web", "alpine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		path   string
+		denied bool
+	}{
+		{"/dev/app", true},
+		{"/dev/app-Password", true},
+		{"/dev/app-id_rsa", true},
+		{"0102030405060708090A0B0C0D0E0F10-Password", true},
+		{"/production/report-Password", true},
+		// allowed or missing entries are not reported as denied
+		{"/prod/db-Password", false},
+		{"/dev/application-Password", false},
+		{"/dev/missing", false},
+	}
+	for _, testCase := range testCases {
+		err := policy.CheckPath(testCase.path)
+		if !testCase.denied && err != nil {
+			t.Errorf("%s: unexpected error %s", testCase.path, err)
+		}
+		if testCase.denied {
+			expected := "Access to \"" + testCase.path + "\" is denied by the access policy"
+			if err == nil || !strings.Contains(err.Error(), expected) || !strings.Contains(err.Error(), "for template \"web\" and build \"alpine\".") {
+				t.Errorf("%s: expected a denied error, got %v", testCase.path, err)
+			}
+		}
+	}
+}
+
+func TestPolicyCheckWrite(t *testing.T) {
+	db := policyTestDatabase()
+	policy, err := LoadPolicy(db, writePolicyTestFile(t, `{"rules": [{"groups": ["/prod"]}, {"tags": ["writable"]}]}`), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Content.Root.Groups[1].Entries[0].Tags = "writable"
+	testCases := []struct {
+		entryPath string
+		denied    bool
+	}{
+		{"/prod/db", false},
+		// new entries are checked by their group
+		{"/prod/web/new", false},
+		{"/dev/new", true},
+		// existing entries are also allowed by their tags
+		{"/dev/app", false},
+		{"/production/report", true},
+	}
+	for _, testCase := range testCases {
+		err := policy.CheckWrite(db, testCase.entryPath)
+		if testCase.denied != (err != nil) {
+			t.Errorf("%s: expected denied %t, got %v", testCase.entryPath, testCase.denied, err)
+		}
+	}
+}
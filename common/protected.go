@@ -0,0 +1,201 @@
+package common
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/tobischo/gokeepasslib/v3"
+	w "github.com/tobischo/gokeepasslib/v3/wrappers"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/salsa20/salsa"
+)
+
+// Protected values of a database opened by OpenDatabase are never unlocked as a whole. Each one
+// keeps its inner random stream ciphertext, prefixed with its offset in the stream, and is decrypted
+// on its own by RevealValue. The offsets stay valid when entries are filtered or reordered, so the
+// tree can be changed without decrypting any value. Titles are the exception, they make up the
+// entry paths and are decrypted when the database is opened.
+const protectedOffsetSeparator = ":"
+
+// Nonce of the salsa20 inner random stream defined by the kdbx 3 format
+var salsaStreamNonce = [8]byte{0xe8, 0x30, 0x09, 0x4b, 0x97, 0x20, 0x5d, 0x2a}
+
+// Tags every protected value with its offset in the inner random stream, returns the offset
+// following the last value
+func indexProtectedValues(db *gokeepasslib.Database) (int64, error) {
+	if streamID, _ := innerStream(db); streamID == gokeepasslib.NoStreamID {
+		// values are stored as plain text
+		return 0, nil
+	}
+	// the stream follows the order of the xml document, in which a group may list its subgroups
+	// before its entries, the stream manager of gokeepasslib visits the values in that order
+	stream := &offsetStream{}
+	manager := &gokeepasslib.StreamManager{Stream: stream}
+	manager.UnlockProtectedGroups(db.Content.Root.Groups)
+	for i := range db.Content.Root.Groups {
+		if err := revealProtectedTitles(db, &db.Content.Root.Groups[i]); err != nil {
+			return 0, err
+		}
+	}
+	return stream.offset, nil
+}
+
+// Replaces each protected value passed by the stream manager with its offset and ciphertext
+type offsetStream struct {
+	offset int64
+}
+
+func (s *offsetStream) Unpack(payload string) []byte {
+	ciphertext, _ := base64.StdEncoding.DecodeString(payload)
+	tagged := strconv.FormatInt(s.offset, 10) + protectedOffsetSeparator + payload
+	s.offset += int64(len(ciphertext))
+	return []byte(tagged)
+}
+
+// Databases opened by OpenDatabase are never written, so the values are not locked again
+func (s *offsetStream) Pack(payload []byte) string {
+	return string(payload)
+}
+
+// Decrypts the protected titles of all entry versions of the group and its subgroups, so that the
+// entry paths and GetTitle work as for unprotected titles
+func revealProtectedTitles(db *gokeepasslib.Database, group *gokeepasslib.Group) error {
+	for i := range group.Entries {
+		if err := revealProtectedTitle(db, &group.Entries[i]); err != nil {
+			return err
+		}
+	}
+	for i := range group.Groups {
+		if err := revealProtectedTitles(db, &group.Groups[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func revealProtectedTitle(db *gokeepasslib.Database, entry *gokeepasslib.Entry) error {
+	for i := range entry.Values {
+		valueData := &entry.Values[i]
+		if valueData.Key != "Title" || !valueData.Value.Protected.Bool {
+			continue
+		}
+		title, err := RevealValue(db, *valueData)
+		if err != nil {
+			return err
+		}
+		valueData.Value.Content = string(title)
+		valueData.Value.Protected = w.NewBoolWrapper(false)
+	}
+	for i := range entry.Histories {
+		for j := range entry.Histories[i].Entries {
+			if err := revealProtectedTitle(db, &entry.Histories[i].Entries[j]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Decrypts a single value of an entry into a new buffer, which the caller should clear with ZeroBytes after use
+func RevealValue(db *gokeepasslib.Database, valueData gokeepasslib.ValueData) ([]byte, error) {
+	if streamID, _ := innerStream(db); !valueData.Value.Protected.Bool || streamID == gokeepasslib.NoStreamID {
+		return []byte(valueData.Value.Content), nil
+	}
+	separator := strings.Index(valueData.Value.Content, protectedOffsetSeparator)
+	if separator < 0 {
+		return nil, fmt.Errorf("Protected value %s has no stream offset", valueData.Key)
+	}
+	offset, err := strconv.ParseInt(valueData.Value.Content[:separator], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Protected value %s has an invalid stream offset", valueData.Key)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(valueData.Value.Content[separator+1:])
+	if err != nil {
+		return nil, fmt.Errorf("Protected value %s is not valid base64", valueData.Key)
+	}
+	return xorInnerStream(db, ciphertext, offset)
+}
+
+// Moves a protected value of the source database into the inner random stream of the database at
+// the offset, which must follow every value already in the stream. Returns the offset following it.
+func reprotectValue(db *gokeepasslib.Database, offset int64, source *gokeepasslib.Database, valueData *gokeepasslib.ValueData) (int64, error) {
+	if !valueData.Value.Protected.Bool {
+		return offset, nil
+	}
+	plaintext, err := RevealValue(source, *valueData)
+	if err != nil {
+		return offset, err
+	}
+	defer ZeroBytes(plaintext)
+	if streamID, _ := innerStream(db); streamID == gokeepasslib.NoStreamID {
+		valueData.Value.Content = string(plaintext)
+		return offset, nil
+	}
+	ciphertext, err := xorInnerStream(db, plaintext, offset)
+	if err != nil {
+		return offset, err
+	}
+	valueData.Value.Content = strconv.FormatInt(offset, 10) + protectedOffsetSeparator + base64.StdEncoding.EncodeToString(ciphertext)
+	return offset + int64(len(ciphertext)), nil
+}
+
+// Decrypts the value of the field of an entry, returns nil if the entry has no such field
+func RevealField(db *gokeepasslib.Database, entry gokeepasslib.Entry, field string) ([]byte, error) {
+	valueData := entry.Get(field)
+	if valueData == nil {
+		return nil, nil
+	}
+	return RevealValue(db, *valueData)
+}
+
+// Returns the id and key of the inner random stream, kdbx 4 moved them to the inner header
+func innerStream(db *gokeepasslib.Database) (uint32, []byte) {
+	if db.Header.IsKdbx4() {
+		return db.Content.InnerHeader.InnerRandomStreamID, db.Content.InnerHeader.InnerRandomStreamKey
+	}
+	return db.Header.FileHeaders.InnerRandomStreamID, db.Header.FileHeaders.ProtectedStreamKey
+}
+
+// Applies the inner random stream of the database starting at the offset
+func xorInnerStream(db *gokeepasslib.Database, data []byte, offset int64) ([]byte, error) {
+	streamID, streamKey := innerStream(db)
+	// both ciphers have 64 byte blocks, start at the block holding the offset and skip into it
+	skip := int(offset % 64)
+	buffer := make([]byte, skip+len(data))
+	copy(buffer[skip:], data)
+	switch streamID {
+	case gokeepasslib.SalsaStreamID:
+		key := sha256.Sum256(streamKey)
+		var counter [16]byte
+		copy(counter[:8], salsaStreamNonce[:])
+		block := uint64(offset / 64)
+		for i := 0; i < 8; i++ {
+			counter[8+i] = byte(block >> (8 * i))
+		}
+		salsa.XORKeyStream(buffer, buffer, &counter, &key)
+	case gokeepasslib.ChaChaStreamID:
+		hash := sha512.Sum512(streamKey)
+		cipher, err := chacha20.NewUnauthenticatedCipher(hash[:32], hash[32:44])
+		if err != nil {
+			return nil, err
+		}
+		cipher.SetCounter(uint32(offset / 64))
+		cipher.XORKeyStream(buffer, buffer)
+	default:
+		return nil, gokeepasslib.ErrUnsupportedStreamType
+	}
+	// the skipped keystream belongs to the preceding value
+	ZeroBytes(buffer[:skip])
+	return buffer[skip:], nil
+}
+
+// Overwrites a buffer holding decrypted data
+func ZeroBytes(data []byte) {
+	for i := range data {
+		data[i] = 0
+	}
+}
@@ -0,0 +1,280 @@
+package common
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tobischo/gokeepasslib/v3"
+	w "github.com/tobischo/gokeepasslib/v3/wrappers"
+)
+
+const protectedTestPassword = "password"
+
+func protectedTestEntry(title string, values map[string]string) gokeepasslib.Entry {
+	entry := gokeepasslib.NewEntry()
+	entry.Values = append(entry.Values, gokeepasslib.ValueData{Key: "Title", Value: gokeepasslib.V{Content: title}})
+	for key, value := range values {
+		entry.Values = append(entry.Values, gokeepasslib.ValueData{Key: key, Value: gokeepasslib.V{Content: value, Protected: w.NewBoolWrapper(true)}})
+	}
+	return entry
+}
+
+// Encodes a database with protected values spread over groups and history, returns the encoded bytes
+func encodeProtectedTestDatabase(t *testing.T, options ...gokeepasslib.DatabaseOption) []byte {
+	db := gokeepasslib.NewDatabase(options...)
+	db.Credentials = gokeepasslib.NewPasswordCredentials(protectedTestPassword)
+	first := protectedTestEntry("First", map[string]string{"Password": "first-password", "Token": "first-token"})
+	previous := protectedTestEntry("First", map[string]string{"Password": "first-previous-password"})
+	first.Histories = []gokeepasslib.History{{Entries: []gokeepasslib.Entry{previous}}}
+	second := protectedTestEntry("Second", map[string]string{"Password": "second-password"})
+	third := protectedTestEntry("Third", map[string]string{"Password": "third-password", "PIN": "4711"})
+	sub := gokeepasslib.NewGroup()
+	sub.Name = "sub"
+	sub.Entries = []gokeepasslib.Entry{third}
+	root := gokeepasslib.NewGroup()
+	root.Name = "root"
+	root.Entries = []gokeepasslib.Entry{first, second}
+	root.Groups = []gokeepasslib.Group{sub}
+	db.Content.Root.Groups = []gokeepasslib.Group{root}
+	if err := db.LockProtectedEntries(); err != nil {
+		t.Fatal(err)
+	}
+	var buffer bytes.Buffer
+	if err := gokeepasslib.NewEncoder(&buffer).Encode(db); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+// Decodes the database twice, once as OpenDatabase does and once fully unlocked for comparison
+func decodeProtectedTestDatabase(t *testing.T, encoded []byte) (*gokeepasslib.Database, *gokeepasslib.Database) {
+	db, err := decodeDatabase(bytes.NewReader(encoded), protectedTestPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := indexProtectedValues(db); err != nil {
+		t.Fatal(err)
+	}
+	unlocked, err := decodeDatabase(bytes.NewReader(encoded), protectedTestPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unlocked.UnlockProtectedEntries(); err != nil {
+		t.Fatal(err)
+	}
+	return db, unlocked
+}
+
+// Maps the key of every value of every entry version to its content
+func protectedTestValues(db *gokeepasslib.Database) map[string]gokeepasslib.ValueData {
+	values := map[string]gokeepasslib.ValueData{}
+	WalkDatabase(db, nil, func(entryPath string, entry gokeepasslib.Entry, depth int) {
+		if !strings.HasPrefix(entryPath, "/") {
+			return
+		}
+		for n, version := range EntryVersions(entry) {
+			for _, valueData := range version.Values {
+				values[fmt.Sprintf("%s-%s@%d", entryPath, valueData.Key, n)] = valueData
+			}
+		}
+	})
+	return values
+}
+
+func protectedTestDatabases(t *testing.T) map[string][]byte {
+	example, err := os.ReadFile(filepath.Join("..", "example", "example.kdbx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string][]byte{
+		"kdbx3 salsa20":  encodeProtectedTestDatabase(t, gokeepasslib.WithDatabaseKDBXVersion3()),
+		"kdbx4 chacha20": encodeProtectedTestDatabase(t, gokeepasslib.WithDatabaseKDBXVersion4()),
+		"example":        example,
+	}
+}
+
+func TestRevealValue(t *testing.T) {
+	for name, encoded := range protectedTestDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			db, unlocked := decodeProtectedTestDatabase(t, encoded)
+			expected := protectedTestValues(unlocked)
+			values := protectedTestValues(db)
+			if len(values) != len(expected) {
+				t.Fatalf("expected %d values, got %d", len(expected), len(values))
+			}
+			for key, valueData := range values {
+				revealed, err := RevealValue(db, valueData)
+				if err != nil {
+					t.Fatalf("%s: %s", key, err)
+				}
+				if string(revealed) != expected[key].Value.Content {
+					t.Errorf("%s: expected %q, got %q", key, expected[key].Value.Content, revealed)
+				}
+			}
+		})
+	}
+}
+
+func TestRevealValueLeavesOtherValuesProtected(t *testing.T) {
+	for name, encoded := range protectedTestDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			db, unlocked := decodeProtectedTestDatabase(t, encoded)
+			expected := protectedTestValues(unlocked)
+			before := protectedTestValues(db)
+			var requested string
+			for key, valueData := range before {
+				if valueData.Value.Protected.Bool && (requested == "" || key < requested) {
+					requested = key
+				}
+			}
+			if requested == "" {
+				t.Fatal("database has no protected values")
+			}
+			revealed, err := RevealValue(db, before[requested])
+			if err != nil {
+				t.Fatal(err)
+			}
+			ZeroBytes(revealed)
+			for key, valueData := range protectedTestValues(db) {
+				if valueData.Value.Content != before[key].Value.Content {
+					t.Errorf("%s: value changed after revealing %s", key, requested)
+				}
+				if valueData.Value.Protected.Bool && expected[key].Value.Content != "" && strings.Contains(valueData.Value.Content, expected[key].Value.Content) {
+					t.Errorf("%s: protected value is held as plain text", key)
+				}
+			}
+		})
+	}
+}
+
+func TestRevealValueAfterPolicy(t *testing.T) {
+	encoded := encodeProtectedTestDatabase(t, gokeepasslib.WithDatabaseKDBXVersion4())
+	db, unlocked := decodeProtectedTestDatabase(t, encoded)
+	expected := protectedTestValues(unlocked)
+	policyFile := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(policyFile, []byte(`{"rules": [{"groups": ["/root/sub"]}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// removing the entries before the allowed one must not shift the stream offsets
+	if _, err := ApplyPolicy(db, policyFile, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	values := protectedTestValues(db)
+	if len(values) != 3 {
+		t.Fatalf("expected the 3 values of /root/sub/Third, got %d", len(values))
+	}
+	for key, valueData := range values {
+		revealed, err := RevealValue(db, valueData)
+		if err != nil {
+			t.Fatalf("%s: %s", key, err)
+		}
+		if string(revealed) != expected[key].Value.Content {
+			t.Errorf("%s: expected %q, got %q", key, expected[key].Value.Content, revealed)
+		}
+	}
+}
+
+func TestRevealFieldMissing(t *testing.T) {
+	db, _ := decodeProtectedTestDatabase(t, encodeProtectedTestDatabase(t, gokeepasslib.WithDatabaseKDBXVersion3()))
+	entry := db.Content.Root.Groups[0].Entries[1]
+	revealed, err := RevealField(db, entry, "Token")
+	if err != nil || revealed != nil {
+		t.Fatalf("expected no value for a missing field, got %q, %v", revealed, err)
+	}
+}
+
+func TestRevealValueGroupsFirst(t *testing.T) {
+	// keepassxc and other writers may list the subgroups of a group before its entries
+	const groupsFirst = `<Group>
+	<Name>root</Name>
+	<Group>
+		<Name>sub</Name>
+		<Entry><String><Key>Title</Key><Value>Third</Value></String><String><Key>Password</Key><Value Protected="True">third-password</Value></String></Entry>
+	</Group>
+	<Entry><String><Key>Title</Key><Value>First</Value></String><String><Key>Password</Key><Value Protected="True">first-password</Value></String></Entry>
+</Group>`
+	versions := map[string]gokeepasslib.DatabaseOption{
+		"kdbx3 salsa20":  gokeepasslib.WithDatabaseKDBXVersion3(),
+		"kdbx4 chacha20": gokeepasslib.WithDatabaseKDBXVersion4(),
+	}
+	for name, version := range versions {
+		t.Run(name, func(t *testing.T) {
+			db := gokeepasslib.NewDatabase(version)
+			var root gokeepasslib.Group
+			if err := xml.Unmarshal([]byte(groupsFirst), &root); err != nil {
+				t.Fatal(err)
+			}
+			// lock the values in the order of the document, as the database was written
+			manager, err := db.GetStreamManager()
+			if err != nil {
+				t.Fatal(err)
+			}
+			manager.LockProtectedGroups(root.Groups)
+			manager.LockProtectedEntries(root.Entries)
+			db.Content.Root.Groups = []gokeepasslib.Group{root}
+			if _, err := indexProtectedValues(db); err != nil {
+				t.Fatal(err)
+			}
+			_, entryMap := AttachmentPaths(db)
+			for entryPath, expected := range map[string]string{"/root/First": "first-password", "/root/sub/Third": "third-password"} {
+				password, err := RevealField(db, entryMap[entryPath], "Password")
+				if err != nil || string(password) != expected {
+					t.Errorf("%s: expected %q, got %q, %v", entryPath, expected, password, err)
+				}
+			}
+		})
+	}
+}
+
+func TestRevealValueProtectedTitle(t *testing.T) {
+	protectedTitle := func(entry gokeepasslib.Entry, title string) gokeepasslib.Entry {
+		entry.Values[0].Value = gokeepasslib.V{Content: title, Protected: w.NewBoolWrapper(true)}
+		return entry
+	}
+	for name, version := range map[string]gokeepasslib.DatabaseOption{
+		"kdbx3 salsa20":  gokeepasslib.WithDatabaseKDBXVersion3(),
+		"kdbx4 chacha20": gokeepasslib.WithDatabaseKDBXVersion4(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			db := gokeepasslib.NewDatabase(version)
+			db.Credentials = gokeepasslib.NewPasswordCredentials(protectedTestPassword)
+			first := protectedTitle(protectedTestEntry("", map[string]string{"Password": "first-password"}), "Secret Title")
+			previous := protectedTitle(protectedTestEntry("", map[string]string{"Password": "first-previous-password"}), "Secret Title")
+			first.Histories = []gokeepasslib.History{{Entries: []gokeepasslib.Entry{previous}}}
+			second := protectedTestEntry("Second", map[string]string{"Password": "second-password"})
+			root := gokeepasslib.NewGroup()
+			root.Name = "root"
+			root.Entries = []gokeepasslib.Entry{first, second}
+			db.Content.Root.Groups = []gokeepasslib.Group{root}
+			if err := db.LockProtectedEntries(); err != nil {
+				t.Fatal(err)
+			}
+			var buffer bytes.Buffer
+			if err := gokeepasslib.NewEncoder(&buffer).Encode(db); err != nil {
+				t.Fatal(err)
+			}
+			opened, unlocked := decodeProtectedTestDatabase(t, buffer.Bytes())
+			// the entry paths and titles are built from the decrypted title
+			_, entryMap := AttachmentPaths(opened)
+			entry, keyExists := entryMap["/root/Secret Title"]
+			if !keyExists || entry.GetTitle() != "Secret Title" {
+				t.Fatalf("expected the entry under its title, got %v", entryMap)
+			}
+			expected := protectedTestValues(unlocked)
+			for key, valueData := range protectedTestValues(opened) {
+				revealed, err := RevealValue(opened, valueData)
+				if err != nil {
+					t.Fatalf("%s: %s", key, err)
+				}
+				if string(revealed) != expected[key].Value.Content {
+					t.Errorf("%s: expected %q, got %q", key, expected[key].Value.Content, revealed)
+				}
+			}
+		})
+	}
+}
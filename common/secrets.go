@@ -0,0 +1,146 @@
+package common
+
+import (
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// Default minimum length of masked values, shorter values would mask unrelated output
+const DefaultMaskMinLength = 4
+
+// Minimum length of the lines of multi-line values masked on their own, shorter lines such as
+// configuration settings are too common in unrelated output
+const MaskLineMinLength = 16
+
+// Entry fields which are not secret and never masked by default
+var DefaultUnmaskedFields = []string{"Title", "URL"}
+
+// Collects decrypted values and redacts them from the messages written through Ui. The values are also
+// registered with the packer log secret filter, which redacts the log of this plugin process. Packer core
+// and other plugins run in their own processes with their own filters, so the output of other
+// provisioners is not covered.
+type SecretMasker struct {
+	minLength int
+	unmasked  map[string]bool
+
+	mutex   sync.Mutex
+	secrets map[string]bool
+}
+
+// Creates a masker, a zero min length and nil unmasked fields select the defaults
+func NewSecretMasker(minLength int, unmaskedFields []string) *SecretMasker {
+	if minLength <= 0 {
+		minLength = DefaultMaskMinLength
+	}
+	if unmaskedFields == nil {
+		unmaskedFields = DefaultUnmaskedFields
+	}
+	unmasked := map[string]bool{}
+	for _, field := range unmaskedFields {
+		unmasked[strings.ToLower(field)] = true
+	}
+	return &SecretMasker{minLength: minLength, unmasked: unmasked, secrets: map[string]bool{}}
+}
+
+// Masks a secret value regardless of its field, and each longer line of multi-line values as output
+// is usually written line by line
+func (m *SecretMasker) Mask(value string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	value = strings.TrimSpace(value)
+	if len(value) >= m.minLength {
+		m.secrets[value] = true
+		packer.LogSecretFilter.Set(value)
+	}
+	if !strings.Contains(value, "\n") {
+		return
+	}
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		// pem armor lines are not secret and masking them would hide which file is being handled
+		if strings.HasPrefix(line, "-----") || len(line) < MaskLineMinLength || len(line) < m.minLength {
+			continue
+		}
+		m.secrets[line] = true
+		packer.LogSecretFilter.Set(line)
+	}
+}
+
+// Masks the value of an entry field unless the field is unmasked
+func (m *SecretMasker) MaskField(field string, value string) {
+	if !m.unmasked[strings.ToLower(field)] {
+		m.Mask(value)
+	}
+}
+
+// Masks the contents of a text attachment. Binary contents are skipped as they cannot appear in the
+// output verbatim.
+func (m *SecretMasker) MaskAttachment(contents []byte) {
+	if utf8.Valid(contents) {
+		m.Mask(string(contents))
+	}
+}
+
+// Replaces the masked values in a message with <sensitive>, the longest values first so that a value
+// containing another one is replaced as a whole
+func (m *SecretMasker) Filter(message string) string {
+	m.mutex.Lock()
+	secrets := make([]string, 0, len(m.secrets))
+	for secret := range m.secrets {
+		secrets = append(secrets, secret)
+	}
+	m.mutex.Unlock()
+	sort.Slice(secrets, func(i, j int) bool {
+		if len(secrets[i]) != len(secrets[j]) {
+			return len(secrets[i]) > len(secrets[j])
+		}
+		return secrets[i] < secrets[j]
+	})
+	for _, secret := range secrets {
+		message = strings.ReplaceAll(message, secret, "<sensitive>")
+	}
+	return message
+}
+
+// Wraps a ui so that the masked values are redacted from the messages before they are sent to packer,
+// including the output of the commands run with RunCommand
+func (m *SecretMasker) Ui(ui packer.Ui) packer.Ui {
+	return &maskedUi{ui: ui, masker: m}
+}
+
+type maskedUi struct {
+	ui     packer.Ui
+	masker *SecretMasker
+}
+
+func (u *maskedUi) Ask(query string) (string, error) {
+	return u.ui.Ask(u.masker.Filter(query))
+}
+
+func (u *maskedUi) Say(message string) {
+	u.ui.Say(u.masker.Filter(message))
+}
+
+func (u *maskedUi) Message(message string) {
+	u.ui.Message(u.masker.Filter(message))
+}
+
+func (u *maskedUi) Error(message string) {
+	u.ui.Error(u.masker.Filter(message))
+}
+
+func (u *maskedUi) Machine(category string, args ...string) {
+	for i := range args {
+		args[i] = u.masker.Filter(args[i])
+	}
+	u.ui.Machine(category, args...)
+}
+
+func (u *maskedUi) TrackProgress(src string, currentSize, totalSize int64, stream io.ReadCloser) io.ReadCloser {
+	return u.ui.TrackProgress(u.masker.Filter(src), currentSize, totalSize, stream)
+}
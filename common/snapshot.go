@@ -0,0 +1,87 @@
+package common
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+// Reconstructs the database as it was at the as_of time, an empty as_of leaves it untouched.
+// Returns the paths of entries which could not be reconstructed due to truncated history.
+func ApplyAsOf(db *gokeepasslib.Database, asOf string) ([]string, error) {
+	if asOf == "" {
+		return nil, nil
+	}
+	at, err := time.Parse(time.RFC3339, asOf)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid RFC3339 time in `as_of`: %s", asOf)
+	}
+	return SnapshotDatabase(db, at)
+}
+
+// Describes an entry returned by ApplyAsOf, for the data sources to log and the provisioners to show
+func TruncatedHistoryWarning(db *gokeepasslib.Database, entryPath string, asOf string) string {
+	return fmt.Sprintf("Entry %s could not be reconstructed as of %s, its history has been truncated (HistoryMaxItems: %d)", entryPath, asOf, db.Content.Meta.HistoryMaxItems)
+}
+
+// Replaces every entry with its version valid at the given time and hides groups and entries created after it
+func SnapshotDatabase(db *gokeepasslib.Database, at time.Time) ([]string, error) {
+	// protected values carry their stream offsets and stay valid when the entries are replaced
+	truncated := []string{}
+	db.Content.Root.Groups = snapshotGroups("", db.Content.Root.Groups, at, &truncated)
+	return truncated, nil
+}
+
+// Hides the groups created after the given time along with their entries and subgroups
+func snapshotGroups(path string, groups []gokeepasslib.Group, at time.Time, truncated *[]string) []gokeepasslib.Group {
+	kept := []gokeepasslib.Group{}
+	for _, group := range groups {
+		if group.Times.CreationTime != nil && group.Times.CreationTime.Time.After(at) {
+			// group did not exist yet
+			continue
+		}
+		snapshotGroup(path, &group, at, truncated)
+		kept = append(kept, group)
+	}
+	return kept
+}
+
+func snapshotGroup(path string, group *gokeepasslib.Group, at time.Time, truncated *[]string) {
+	groupPath := path + "/" + group.Name
+	entries := []gokeepasslib.Entry{}
+	for _, entry := range group.Entries {
+		if entry.Times.CreationTime != nil && entry.Times.CreationTime.Time.After(at) {
+			// entry did not exist yet
+			continue
+		}
+		version, ok := snapshotEntry(entry, at)
+		if !ok {
+			// the version valid at the time has been removed from the history
+			*truncated = append(*truncated, fmt.Sprintf("%s/%s", groupPath, entry.GetTitle()))
+			continue
+		}
+		entries = append(entries, version)
+	}
+	group.Entries = entries
+	group.Groups = snapshotGroups(groupPath, group.Groups, at, truncated)
+}
+
+// Returns the version of the entry valid at the given time with the history preceding it
+func snapshotEntry(entry gokeepasslib.Entry, at time.Time) (gokeepasslib.Entry, bool) {
+	versions := EntryVersions(entry)
+	for i := len(versions) - 1; i >= 0; i-- {
+		if modificationTime(versions[i]).After(at) {
+			continue
+		}
+		version := versions[i]
+		// history versions carry the uuid of the entry, but keep it explicit for safety
+		version.UUID = entry.UUID
+		version.Histories = nil
+		if i > 0 {
+			version.Histories = []gokeepasslib.History{{Entries: versions[:i]}}
+		}
+		return version, true
+	}
+	return gokeepasslib.Entry{}, false
+}
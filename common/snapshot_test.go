@@ -0,0 +1,83 @@
+package common
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tobischo/gokeepasslib/v3"
+	w "github.com/tobischo/gokeepasslib/v3/wrappers"
+)
+
+func snapshotTestTimes(created string, modified string) gokeepasslib.TimeData {
+	parse := func(value string) *w.TimeWrapper {
+		at, _ := time.Parse(time.RFC3339, value)
+		return &w.TimeWrapper{Formatted: true, Time: at}
+	}
+	times := gokeepasslib.NewTimeData()
+	times.CreationTime = parse(created)
+	times.LastModificationTime = parse(modified)
+	return times
+}
+
+func snapshotTestEntry(title string, password string, created string, modified string) gokeepasslib.Entry {
+	entry := gokeepasslib.NewEntry()
+	entry.Values = []gokeepasslib.ValueData{
+		{Key: "Title", Value: gokeepasslib.V{Content: title}},
+		{Key: "Password", Value: gokeepasslib.V{Content: password}},
+	}
+	entry.Times = snapshotTestTimes(created, modified)
+	return entry
+}
+
+func TestApplyAsOf(t *testing.T) {
+	changed := snapshotTestEntry("changed", "new", "2021-01-01T00:00:00Z", "2021-05-01T00:00:00Z")
+	changed.Histories = []gokeepasslib.History{{Entries: []gokeepasslib.Entry{
+		snapshotTestEntry("changed", "old", "2021-01-01T00:00:00Z", "2021-02-01T00:00:00Z"),
+	}}}
+	// the version valid in march has been removed from the history
+	truncated := snapshotTestEntry("truncated", "new", "2021-01-01T00:00:00Z", "2021-05-01T00:00:00Z")
+	newGroup := walkTestGroup("new")
+	newGroup.Times = snapshotTestTimes("2021-04-01T00:00:00Z", "2021-04-01T00:00:00Z")
+	newGroup.Entries = []gokeepasslib.Entry{snapshotTestEntry("moved", "moved", "2021-01-01T00:00:00Z", "2021-01-01T00:00:00Z")}
+	oldGroup := walkTestGroup("old")
+	oldGroup.Times = snapshotTestTimes("2021-01-01T00:00:00Z", "2021-01-01T00:00:00Z")
+	oldGroup.Entries = []gokeepasslib.Entry{
+		changed,
+		truncated,
+		snapshotTestEntry("created", "later", "2021-04-01T00:00:00Z", "2021-04-01T00:00:00Z"),
+	}
+	root := walkTestGroup("root")
+	root.Times = snapshotTestTimes("2021-01-01T00:00:00Z", "2021-01-01T00:00:00Z")
+	root.Groups = []gokeepasslib.Group{oldGroup, newGroup}
+	db := walkTestDatabase(root)
+
+	truncatedPaths, err := ApplyAsOf(db, "2021-03-01T00:00:00Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(truncatedPaths, " ") != "/root/old/truncated" {
+		t.Fatalf("unexpected truncated entries %v", truncatedPaths)
+	}
+	_, entryMap := AttachmentPaths(db)
+	paths := []string{}
+	for entryPath := range entryMap {
+		if strings.HasPrefix(entryPath, "/") {
+			paths = append(paths, entryPath)
+		}
+	}
+	sort.Strings(paths)
+	// the group created after as_of is hidden with its entries
+	if strings.Join(paths, " ") != "/root/old/changed" {
+		t.Errorf("unexpected entries %v", paths)
+	}
+	changed = entryMap["/root/old/changed"]
+	if password := changed.GetContent("Password"); password != "old" {
+		t.Errorf("expected the version valid at as_of, got %q", password)
+	}
+	expected := "Entry /root/old/truncated could not be reconstructed as of 2021-03-01T00:00:00Z, its history has been truncated (HistoryMaxItems: 10)"
+	if warning := TruncatedHistoryWarning(db, truncatedPaths[0], "2021-03-01T00:00:00Z"); warning != expected {
+		t.Errorf("unexpected warning %q", warning)
+	}
+}
@@ -0,0 +1,42 @@
+package common
+
+import (
+	"strings"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+// Splits the tags of an entry, keepass separates them with semicolons and keepassxc also accepts commas
+func EntryTags(entry gokeepasslib.Entry) []string {
+	return splitTags(entry.Tags)
+}
+
+func splitTags(value string) []string {
+	tags := []string{}
+	for _, tag := range strings.FieldsFunc(value, func(r rune) bool { return r == ';' || r == ',' }) {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// Checks whether an entry has any of the include tags (if given) and none of the exclude tags
+func MatchTags(entry gokeepasslib.Entry, includeTags []string, excludeTags []string) bool {
+	tags := EntryTags(entry)
+	if len(includeTags) > 0 && !hasAnyTag(tags, includeTags) {
+		return false
+	}
+	return !hasAnyTag(tags, excludeTags)
+}
+
+func hasAnyTag(tags []string, wanted []string) bool {
+	for _, tag := range tags {
+		for _, want := range wanted {
+			if strings.EqualFold(tag, strings.TrimSpace(want)) {
+				return true
+			}
+		}
+	}
+	return false
+}
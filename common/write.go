@@ -0,0 +1,309 @@
+package common
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tobischo/gokeepasslib/v3"
+	w "github.com/tobischo/gokeepasslib/v3/wrappers"
+)
+
+// How long to wait for the lock of a database written by another build
+var (
+	lockTimeout       = time.Minute
+	lockRetryInterval = 100 * time.Millisecond
+)
+
+// Lock of a keepass file opened for writing. The lock file next to the keepass file keeps other builds
+// from writing the database until it is saved, the digest detects changes made without taking the lock,
+// such as with the keepass application.
+type DatabaseLock struct {
+	keepassFile string
+	lockFile    string
+	digest      [sha256.Size]byte
+}
+
+// Opens the keepass database file for modification, keeshare containers are not spliced in
+// so that their entries are not written back into the database. Protected values are locked
+// with the inner random stream as expected by the encoder, they cannot be read with RevealValue.
+// The returned lock must be released once the database is saved or discarded.
+func OpenDatabaseForWrite(keepassFile string, keepassPassword string) (*gokeepasslib.Database, *DatabaseLock, error) {
+	lock, err := lockDatabase(keepassFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err := openDatabaseForWrite(lock, keepassPassword)
+	if err != nil {
+		lock.Release()
+		return nil, nil, err
+	}
+	return db, lock, nil
+}
+
+func openDatabaseForWrite(lock *DatabaseLock, keepassPassword string) (*gokeepasslib.Database, error) {
+	keepassFile := lock.keepassFile
+	data, err := os.ReadFile(keepassFile)
+	if err != nil {
+		return nil, err
+	}
+	lock.digest = sha256.Sum256(data)
+	// keepass 1.x databases are mapped to the kdbx model when read, they cannot be written back
+	if isKdbDatabase(data) {
+		return nil, fmt.Errorf("Unable to write to %s, KeePass 1.x databases are read only", keepassFile)
+	}
+	if isXMLDatabase(data) {
+		return nil, fmt.Errorf("Unable to write to %s, KeePass XML exports are read only", keepassFile)
+	}
+	db, err := decodeDatabase(bytes.NewReader(data), keepassPassword)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkWalkLimits(db); err != nil {
+		return nil, err
+	}
+	// gokeepasslib does not model the elements added by kdbx 4.1, saving would drop them
+	details, err := ReadKdbx41Details(db)
+	if err != nil {
+		return nil, err
+	}
+	if !details.Empty() {
+		return nil, fmt.Errorf("Unable to write to %s, saving would drop its KDBX 4.1 group tags, previous parent groups or custom icon names", keepassFile)
+	}
+	return db, nil
+}
+
+// Stores the contents as a named file attachment of the entry at the path, creating the groups and entry if needed.
+// The previous version of an existing entry is kept in its history. Returns the entry uuid and whether it was created.
+func SetAttachment(db *gokeepasslib.Database, entryPath string, name string, contents []byte) (gokeepasslib.UUID, bool, error) {
+	segments := strings.Split(strings.TrimPrefix(entryPath, "/"), "/")
+	if !strings.HasPrefix(entryPath, "/") || len(segments) < 2 || name == "" {
+		return gokeepasslib.UUID{}, false, fmt.Errorf("Invalid attachment path \"%s-%s\", expected /<group>/<entry>-<file name>", entryPath, name)
+	}
+	for _, segment := range segments {
+		if segment == "" {
+			return gokeepasslib.UUID{}, false, fmt.Errorf("Invalid entry path \"%s\", group and entry names must not be empty", entryPath)
+		}
+	}
+	// protected values are re-locked after the tree is modified so that the inner
+	// stream cipher stays consistent with the new set of values
+	if err := db.UnlockProtectedEntries(); err != nil {
+		return gokeepasslib.UUID{}, false, err
+	}
+	now := w.Now()
+	created := false
+	entry := findEntry(db, entryPath)
+	if entry == nil {
+		// only subgroups are created, a database has a single root group
+		var group *gokeepasslib.Group
+		for i := range db.Content.Root.Groups {
+			if db.Content.Root.Groups[i].Name == segments[0] {
+				group = &db.Content.Root.Groups[i]
+				break
+			}
+		}
+		if group == nil {
+			db.LockProtectedEntries()
+			return gokeepasslib.UUID{}, false, fmt.Errorf("Root group \"%s\" does not exist.", segments[0])
+		}
+		for _, groupName := range segments[1 : len(segments)-1] {
+			group = childGroup(&group.Groups, groupName)
+		}
+		title := segments[len(segments)-1]
+		newEntry := gokeepasslib.NewEntry()
+		newEntry.Values = append(newEntry.Values, gokeepasslib.ValueData{Key: "Title", Value: gokeepasslib.V{Content: title}})
+		group.Entries = append(group.Entries, newEntry)
+		entry = &group.Entries[len(group.Entries)-1]
+		created = true
+	} else {
+		pushHistory(entry, db.Content.Meta.HistoryMaxItems)
+		entry.Times.LastModificationTime = &now
+	}
+	id := AddBinary(db, contents)
+	replaced := false
+	for i := range entry.Binaries {
+		if entry.Binaries[i].Name == name {
+			entry.Binaries[i].Value.ID = id
+			replaced = true
+		}
+	}
+	if !replaced {
+		entry.Binaries = append(entry.Binaries, gokeepasslib.NewBinaryReference(name, id))
+	}
+	if err := db.LockProtectedEntries(); err != nil {
+		return gokeepasslib.UUID{}, false, err
+	}
+	return entry.UUID, created, nil
+}
+
+// Finds the first subgroup with the name, appending a new one if there is none
+func childGroup(groups *[]gokeepasslib.Group, name string) *gokeepasslib.Group {
+	for i := range *groups {
+		if (*groups)[i].Name == name {
+			return &(*groups)[i]
+		}
+	}
+	group := gokeepasslib.NewGroup()
+	group.Name = name
+	*groups = append(*groups, group)
+	return &(*groups)[len(*groups)-1]
+}
+
+// Finds the entry at the path as resolved by WalkDatabase, the first of the entries sharing the path.
+// Titles may contain slashes, so the path is matched as a whole rather than split into group names.
+func findEntry(db *gokeepasslib.Database, entryPath string) *gokeepasslib.Entry {
+	var find func(parentPath string, group *gokeepasslib.Group) *gokeepasslib.Entry
+	find = func(parentPath string, group *gokeepasslib.Group) *gokeepasslib.Entry {
+		groupPath := parentPath + "/" + group.Name
+		if !strings.HasPrefix(entryPath, groupPath+"/") {
+			return nil
+		}
+		for i := range group.Entries {
+			if groupPath+"/"+group.Entries[i].GetTitle() == entryPath {
+				return &group.Entries[i]
+			}
+		}
+		for i := range group.Groups {
+			if entry := find(groupPath, &group.Groups[i]); entry != nil {
+				return entry
+			}
+		}
+		return nil
+	}
+	for i := range db.Content.Root.Groups {
+		if entry := find("", &db.Content.Root.Groups[i]); entry != nil {
+			return entry
+		}
+	}
+	return nil
+}
+
+// Appends a copy of the current version of the entry to its history, dropping the oldest versions beyond maxItems
+func pushHistory(entry *gokeepasslib.Entry, maxItems int64) {
+	previous := *entry
+	previous.Histories = nil
+	previous.Values = append([]gokeepasslib.ValueData{}, entry.Values...)
+	previous.Binaries = append([]gokeepasslib.BinaryReference{}, entry.Binaries...)
+	if len(entry.Histories) == 0 {
+		entry.Histories = []gokeepasslib.History{{}}
+	}
+	history := &entry.Histories[0]
+	history.Entries = append(history.Entries, previous)
+	// a negative maximum means the history is unlimited
+	if maxItems >= 0 && int64(len(history.Entries)) > maxItems {
+		history.Entries = history.Entries[int64(len(history.Entries))-maxItems:]
+	}
+}
+
+// Creates the lock file of the keepass file, waiting for the lock of another build to be released
+func lockDatabase(keepassFile string) (*DatabaseLock, error) {
+	lock := &DatabaseLock{keepassFile: keepassFile, lockFile: keepassFile + ".lock"}
+	hostname, _ := os.Hostname()
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		file, err := os.OpenFile(lock.lockFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			// the owner helps to decide whether a lock file was left behind
+			fmt.Fprintf(file, "%d@%s\n", os.Getpid(), hostname)
+			return lock, file.Close()
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("Unable to lock %s: %s", keepassFile, err)
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("Unable to lock %s, the lock file %s exists. Another build is writing the database, or remove the lock file if it was left behind.", keepassFile, lock.lockFile)
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+// Hex encoded SHA-256 digest of the database contents that were opened for writing, for the audit log
+func (l *DatabaseLock) Sha256() string {
+	return hex.EncodeToString(l.digest[:])
+}
+
+// Removes the lock file, releasing a lock more than once has no effect
+func (l *DatabaseLock) Release() {
+	if l.lockFile != "" {
+		os.Remove(l.lockFile)
+		l.lockFile = ""
+	}
+}
+
+// Replaces the seeds, kdf salt and inner random stream key so that neither the key, the iv nor the
+// keystream of protected values of the previous file are reused for the new contents
+func rekeyDatabase(db *gokeepasslib.Database) error {
+	if err := db.UnlockProtectedEntries(); err != nil {
+		return err
+	}
+	headers := db.Header.FileHeaders
+	seeds := [][]byte{headers.MasterSeed, headers.EncryptionIV}
+	if db.Header.IsKdbx4() {
+		seeds = append(seeds, db.Content.InnerHeader.InnerRandomStreamKey)
+		if headers.KdfParameters != nil {
+			seeds = append(seeds, headers.KdfParameters.Salt[:])
+		}
+	} else {
+		seeds = append(seeds, headers.TransformSeed, headers.ProtectedStreamKey, headers.StreamStartBytes)
+	}
+	for _, seed := range seeds {
+		if _, err := rand.Read(seed); err != nil {
+			db.LockProtectedEntries()
+			return err
+		}
+	}
+	return db.LockProtectedEntries()
+}
+
+// Encrypts the database and atomically replaces the locked keepass file with it. The file is not
+// replaced if it was changed since it was opened.
+func SaveDatabase(db *gokeepasslib.Database, lock *DatabaseLock) error {
+	keepassFile := lock.keepassFile
+	if lock.lockFile == "" {
+		return fmt.Errorf("Unable to save %s, its lock was released", keepassFile)
+	}
+	fileInfo, err := os.Stat(keepassFile)
+	if err != nil {
+		return err
+	}
+	if err := rekeyDatabase(db); err != nil {
+		return err
+	}
+	tempFile, err := os.CreateTemp(filepath.Dir(keepassFile), "."+filepath.Base(keepassFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	if err := EncodeDatabase(db, tempFile); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Chmod(fileInfo.Mode()); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Sync(); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	// the lock only keeps out other builds, a change made in the meantime would be lost
+	current, err := os.ReadFile(keepassFile)
+	if err != nil {
+		return err
+	}
+	if sha256.Sum256(current) != lock.digest {
+		return fmt.Errorf("%s was changed since it was opened, saving would overwrite the changes", keepassFile)
+	}
+	// rename within the same directory replaces the file atomically
+	return os.Rename(tempFile.Name(), keepassFile)
+}
@@ -0,0 +1,261 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+func TestSetAttachmentSlashTitle(t *testing.T) {
+	// the title "web/ssl" makes the entry path /a/web/ssl without a group web
+	db := walkTestDatabase(walkTestGroup("a", "web/ssl"))
+	entryUUID, created, err := SetAttachment(db, "/a/web/ssl", "cert.pem", []byte("certificate"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	group := db.Content.Root.Groups[0]
+	if created || entryUUID != group.Entries[0].UUID || len(group.Groups) != 0 {
+		t.Fatalf("expected the existing entry to be updated, got created %t and groups %d", created, len(group.Groups))
+	}
+	if len(group.Entries[0].Binaries) != 1 || len(group.Entries[0].Histories) != 1 {
+		t.Errorf("expected the attachment and a history version, got %d and %d", len(group.Entries[0].Binaries), len(group.Entries[0].Histories))
+	}
+}
+
+func TestSetAttachmentInvalidPath(t *testing.T) {
+	testCases := []struct {
+		entryPath string
+		expected  string
+	}{
+		{"a/entry", "Invalid attachment path"},
+		{"/a", "Invalid attachment path"},
+		{"/a//entry", "must not be empty"},
+		{"/missing/entry", "Root group \"missing\" does not exist."},
+	}
+	for _, testCase := range testCases {
+		db := walkTestDatabase(walkTestGroup("a"))
+		if _, _, err := SetAttachment(db, testCase.entryPath, "file", []byte("contents")); err == nil || !strings.Contains(err.Error(), testCase.expected) {
+			t.Errorf("%s: expected an error containing %q, got %v", testCase.entryPath, testCase.expected, err)
+		}
+	}
+}
+
+func TestSetAttachmentNewEntry(t *testing.T) {
+	db := walkTestDatabase(walkTestGroup("a"))
+	if _, created, err := SetAttachment(db, "/a/b/c/host", "host.key", []byte("host key")); err != nil || !created {
+		t.Fatalf("expected the entry to be created, got %t, %v", created, err)
+	}
+	attachmentsMap, entryMap := AttachmentPaths(db)
+	if _, keyExists := entryMap["/a/b/c/host"]; !keyExists {
+		t.Fatalf("expected the entry and its groups to be created, got %v", entryMap)
+	}
+	contents, err := ReadAttachment(db, attachmentsMap["/a/b/c/host-host.key"])
+	if err != nil || string(contents) != "host key" {
+		t.Errorf("unexpected attachment %q, %v", contents, err)
+	}
+	// a second download replaces the attachment of the same name
+	if _, created, err := SetAttachment(db, "/a/b/c/host", "host.key", []byte("new host key")); err != nil || created {
+		t.Fatalf("expected the entry to be updated, got %t, %v", created, err)
+	}
+	attachmentsMap, entryMap = AttachmentPaths(db)
+	contents, _ = ReadAttachment(db, attachmentsMap["/a/b/c/host-host.key"])
+	if entry := entryMap["/a/b/c/host"]; len(entry.Binaries) != 1 || string(contents) != "new host key" {
+		t.Errorf("expected the attachment to be replaced, got %d attachments and %q", len(entry.Binaries), contents)
+	}
+	if history := EntryVersions(entryMap["/a/b/c/host"]); len(history) != 2 {
+		t.Errorf("expected the previous version in the history, got %d versions", len(history))
+	}
+}
+
+func TestFindEntryFirstOfPath(t *testing.T) {
+	// the entry /a/b/c of group a/b and the entry b/c of group a share the path, the walk visits the entries of a first
+	a := walkTestGroup("a", "b/c")
+	a.Groups = []gokeepasslib.Group{walkTestGroup("b", "c")}
+	db := walkTestDatabase(a)
+	_, entryMap := AttachmentPaths(db)
+	if entry := findEntry(db, "/a/b/c"); entry == nil || entry.UUID != entryMap["/a/b/c"].UUID {
+		t.Errorf("expected the entry resolved by the walk")
+	}
+}
+
+func writeFormatTestDatabase(t *testing.T, db *gokeepasslib.Database) string {
+	keepassFile := filepath.Join(t.TempDir(), "write.kdbx")
+	if err := os.WriteFile(keepassFile, encodeFormatTestDatabase(t, db), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return keepassFile
+}
+
+// Seeds, salt and inner random stream key of a database
+func writeTestKeyMaterial(db *gokeepasslib.Database) map[string][]byte {
+	headers := db.Header.FileHeaders
+	keys := map[string][]byte{"master seed": headers.MasterSeed, "encryption iv": headers.EncryptionIV}
+	if db.Header.IsKdbx4() {
+		keys["kdf salt"] = headers.KdfParameters.Salt[:]
+		keys["inner random stream key"] = db.Content.InnerHeader.InnerRandomStreamKey
+	} else {
+		keys["transform seed"] = headers.TransformSeed
+		keys["protected stream key"] = headers.ProtectedStreamKey
+		keys["stream start bytes"] = headers.StreamStartBytes
+	}
+	return keys
+}
+
+// Opens the database for writing, adds an attachment to the entry and saves it
+func writeTestAttachment(t *testing.T, keepassFile string, name string) {
+	db, lock, err := OpenDatabaseForWrite(keepassFile, formatTestPassword)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer lock.Release()
+	if _, _, err := SetAttachment(db, "/root/Entry", name, []byte(name+" contents")); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := SaveDatabase(db, lock); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSaveDatabaseRoundTrip(t *testing.T) {
+	testCases := []struct {
+		name string
+		db   *gokeepasslib.Database
+	}{
+		{"kdbx 3.1", newFormatTestDatabase(gokeepasslib.WithDatabaseKDBXVersion3())},
+		{"kdbx 4 argon2id", newFormatTestDatabase(gokeepasslib.WithDatabaseKDBXVersion4(), withArgon2id)},
+		{"kdbx 4 aes", newFormatTestDatabase(gokeepasslib.WithDatabaseKDBXVersion4(), withAesCipher, withAesKdf)},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			keepassFile := writeFormatTestDatabase(t, testCase.db)
+			original, err := os.ReadFile(keepassFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeTestAttachment(t, keepassFile, "host.key")
+			if _, err := os.Stat(keepassFile + ".lock"); !os.IsNotExist(err) {
+				t.Errorf("expected the lock file to be removed, got %v", err)
+			}
+			opened, _, err := OpenDatabase(keepassFile, formatTestPassword, "", false, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			attachmentsMap, entryMap := AttachmentPaths(opened)
+			contents, err := ReadAttachment(opened, attachmentsMap["/root/Entry-host.key"])
+			if err != nil || string(contents) != "host.key contents" {
+				t.Errorf("unexpected attachment %q, %v", contents, err)
+			}
+			// the protected values of the entry and its previous version are locked with the new stream key
+			versions := EntryVersions(entryMap["/root/Entry"])
+			if len(versions) != 2 {
+				t.Fatalf("expected the previous version in the history, got %d versions", len(versions))
+			}
+			for _, version := range versions {
+				if password, err := RevealField(opened, version, "Password"); err != nil || string(password) != "secret" {
+					t.Errorf("unexpected password %q, %v", password, err)
+				}
+			}
+			saved, err := os.ReadFile(keepassFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			before, err := decodeDatabase(bytes.NewReader(original), formatTestPassword)
+			if err != nil {
+				t.Fatal(err)
+			}
+			after, err := decodeDatabase(bytes.NewReader(saved), formatTestPassword)
+			if err != nil {
+				t.Fatal(err)
+			}
+			afterKeys := writeTestKeyMaterial(after)
+			for name, key := range writeTestKeyMaterial(before) {
+				if len(key) == 0 || bytes.Equal(key, afterKeys[name]) {
+					t.Errorf("expected a new %s", name)
+				}
+			}
+		})
+	}
+}
+
+func TestSaveDatabaseConcurrent(t *testing.T) {
+	keepassFile := writeFormatTestDatabase(t, newFormatTestDatabase(gokeepasslib.WithDatabaseKDBXVersion4()))
+	var wait sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wait.Add(1)
+		go func(name string) {
+			defer wait.Done()
+			writeTestAttachment(t, keepassFile, name)
+		}(fmt.Sprintf("build-%d.key", i))
+	}
+	wait.Wait()
+	opened, _, err := OpenDatabase(keepassFile, formatTestPassword, "", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each build waits for the lock and writes into the database saved by the previous one
+	_, entryMap := AttachmentPaths(opened)
+	if attachments := entryMap["/root/Entry"].Binaries; len(attachments) != 3 {
+		t.Errorf("expected the attachments of all builds, got %d", len(attachments))
+	}
+}
+
+func TestOpenDatabaseForWriteLocked(t *testing.T) {
+	defer func(timeout time.Duration) { lockTimeout = timeout }(lockTimeout)
+	lockTimeout = 0
+	keepassFile := writeFormatTestDatabase(t, newFormatTestDatabase(gokeepasslib.WithDatabaseKDBXVersion4()))
+	_, lock, err := OpenDatabaseForWrite(keepassFile, formatTestPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := OpenDatabaseForWrite(keepassFile, formatTestPassword); err == nil || !strings.Contains(err.Error(), "Unable to lock") {
+		t.Fatalf("expected the database to be locked, got %v", err)
+	}
+	lock.Release()
+	_, lock, err = OpenDatabaseForWrite(keepassFile, formatTestPassword)
+	if err != nil {
+		t.Fatalf("expected the lock to be released, got %v", err)
+	}
+	lock.Release()
+	// a failed open releases the lock
+	if _, _, err := OpenDatabaseForWrite(keepassFile, "wrong"); err == nil {
+		t.Fatal("expected a wrong password error")
+	}
+	if _, err := os.Stat(keepassFile + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("expected the lock file to be removed, got %v", err)
+	}
+}
+
+func TestSaveDatabaseChanged(t *testing.T) {
+	keepassFile := writeFormatTestDatabase(t, newFormatTestDatabase(gokeepasslib.WithDatabaseKDBXVersion4()))
+	db, lock, err := OpenDatabaseForWrite(keepassFile, formatTestPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Release()
+	// saved with the keepass application in the meantime, which does not know the lock
+	changed := encodeFormatTestDatabase(t, newFormatTestDatabase(gokeepasslib.WithDatabaseKDBXVersion4()))
+	if err := os.WriteFile(keepassFile, changed, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := SetAttachment(db, "/root/Entry", "host.key", []byte("host key")); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveDatabase(db, lock); err == nil || !strings.Contains(err.Error(), "was changed since it was opened") {
+		t.Fatalf("expected the change to be detected, got %v", err)
+	}
+	if current, _ := os.ReadFile(keepassFile); !bytes.Equal(current, changed) {
+		t.Errorf("expected the changed file to be kept")
+	}
+	if files, _ := filepath.Glob(filepath.Join(filepath.Dir(keepassFile), ".*.tmp*")); len(files) != 0 {
+		t.Errorf("expected the temporary file to be removed, got %v", files)
+	}
+}
@@ -0,0 +1,63 @@
+package common
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+// Values of keepass_format, an empty format is detected from the contents of the file
+const (
+	FormatKdbx = "kdbx"
+	FormatXML  = "xml"
+)
+
+// Checks for the start of an unencrypted KeePass 2 xml export
+func isXMLDatabase(data []byte) bool {
+	data = bytes.TrimLeft(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")), " \t\r\n")
+	return bytes.HasPrefix(data, []byte("<?xml")) || bytes.HasPrefix(data, []byte("<KeePassFile"))
+}
+
+// Loads a KeePass 2 xml export into the model of a kdbx 3.1 database
+func decodeXMLDatabase(data []byte) (*gokeepasslib.Database, error) {
+	db := gokeepasslib.NewDatabase(gokeepasslib.WithDatabaseKDBXVersion3())
+	// keepass marks the values to protect with ProtectInMemory in exports, gokeepasslib writes Protected
+	data = bytes.ReplaceAll(data, []byte(` ProtectInMemory="True"`), []byte(` Protected="True"`))
+	if err := checkWellFormedXML(data); err != nil {
+		return nil, fmt.Errorf("Unable to read KeePass XML export: %s", err)
+	}
+	content := &gokeepasslib.DBContent{}
+	if err := xml.Unmarshal(data, content); err != nil {
+		return nil, fmt.Errorf("Unable to read KeePass XML export: %s", err)
+	}
+	if content.Root == nil {
+		return nil, fmt.Errorf("Unable to read KeePass XML export: no Root element")
+	}
+	if content.Meta == nil {
+		content.Meta = gokeepasslib.NewMetaData()
+	}
+	content.RawData = data
+	db.Content = content
+	// the values are plain text in the file, protect them in memory like those of a kdbx database
+	if err := db.LockProtectedEntries(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Reads all tokens of the document, gokeepasslib does not stop unmarshaling groups and entries at a syntax error
+func checkWellFormedXML(data []byte) error {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		_, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+// Trimmed down export as written by KeePass 2 with File > Export > KeePass XML (2.x)
+const xmlTestExport = `<?xml version="1.0" encoding="utf-8" standalone="yes"?>
+<KeePassFile>
+	<Meta>
+		<Generator>KeePass</Generator>
+		<DatabaseName>fixtures</DatabaseName>
+		<Binaries>
+			<Binary ID="0" Compressed="False">Y2VydGlmaWNhdGU=</Binary>
+		</Binaries>
+	</Meta>
+	<Root>
+		<Group>
+			<UUID>8+Zf6aKyTbuQxGHLZlMmFA==</UUID>
+			<Name>ci</Name>
+			<Entry>
+				<UUID>T1ifmgtNQXKSG8ZUuS1Q2A==</UUID>
+				<String><Key>Title</Key><Value>database</Value></String>
+				<String><Key>UserName</Key><Value>postgres</Value></String>
+				<String><Key>Password</Key><Value ProtectInMemory="True">fixture-password</Value></String>
+				<Binary><Key>server.crt</Key><Value Ref="0" /></Binary>
+				<History>
+					<Entry>
+						<UUID>T1ifmgtNQXKSG8ZUuS1Q2A==</UUID>
+						<String><Key>Title</Key><Value>database</Value></String>
+						<String><Key>Password</Key><Value ProtectInMemory="True">previous-password</Value></String>
+					</Entry>
+				</History>
+			</Entry>
+		</Group>
+	</Root>
+</KeePassFile>
+`
+
+func writeXMLTestExport(t *testing.T) string {
+	keepassFile := filepath.Join(t.TempDir(), "fixtures.xml")
+	if err := os.WriteFile(keepassFile, []byte(xmlTestExport), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return keepassFile
+}
+
+func TestOpenDatabaseXML(t *testing.T) {
+	keepassFile := writeXMLTestExport(t)
+	for _, keepassFormat := range []string{"", FormatXML} {
+		db, _, err := OpenDatabase(keepassFile, "", keepassFormat, true, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries := map[string]gokeepasslib.Entry{}
+		WalkDatabase(db, nil, func(entryPath string, entry gokeepasslib.Entry, depth int) {
+			entries[entryPath] = entry
+		})
+		entry, keyExists := entries["/ci/database"]
+		if !keyExists {
+			t.Fatalf("missing entry /ci/database in %v", entries)
+		}
+		if _, keyExists := entries["4F589F9A0B4D4172921BC654B92D50D8"]; !keyExists {
+			t.Errorf("missing entry by uuid in %v", entries)
+		}
+		if entry.GetContent("UserName") != "postgres" {
+			t.Errorf("unexpected user name %q", entry.GetContent("UserName"))
+		}
+		if strings.Contains(entry.GetContent("Password"), "fixture-password") {
+			t.Error("protected value is held as plain text")
+		}
+		password, err := RevealField(db, entry, "Password")
+		if err != nil || string(password) != "fixture-password" {
+			t.Errorf("unexpected password %q, %v", password, err)
+		}
+		previous, ok := EntryPreviousVersion(entry, 1)
+		if !ok {
+			t.Fatal("missing previous version")
+		}
+		if password, err := RevealField(db, previous, "Password"); err != nil || string(password) != "previous-password" {
+			t.Errorf("unexpected previous password %q, %v", password, err)
+		}
+		attachment, err := ReadAttachment(db, entry.Binaries[0])
+		if err != nil || string(attachment) != "certificate" {
+			t.Errorf("unexpected attachment %q, %v", attachment, err)
+		}
+	}
+}
+
+func TestOpenDatabaseXMLRequiresAllowPlaintext(t *testing.T) {
+	keepassFile := writeXMLTestExport(t)
+	for _, keepassFormat := range []string{"", FormatXML} {
+		if _, _, err := OpenDatabase(keepassFile, "password", keepassFormat, false, nil); err == nil || !strings.Contains(err.Error(), "allow_plaintext") {
+			t.Errorf("expected the export to be refused without allow_plaintext, got %v", err)
+		}
+	}
+	// a detected kdbx database still needs the password
+	kdbxFile := writeFormatTestDatabase(t, newFormatTestDatabase(gokeepasslib.WithDatabaseKDBXVersion4()))
+	if _, _, err := OpenDatabase(kdbxFile, "", "", true, nil); err == nil || !strings.Contains(err.Error(), "the `keepass_password` must be provided") {
+		t.Errorf("expected the password to be required, got %v", err)
+	}
+	// an explicit kdbx format never reads plain text
+	if _, _, err := OpenDatabase(keepassFile, "password", FormatKdbx, true, nil); err == nil || !strings.Contains(err.Error(), "Not a KeePass database file") {
+		t.Errorf("expected the export to be read as kdbx, got %v", err)
+	}
+	if _, _, err := OpenDatabaseForWrite(keepassFile, ""); err == nil || !strings.Contains(err.Error(), "read only") {
+		t.Errorf("expected writing to be refused, got %v", err)
+	}
+}
+
+func TestCheckConfigFormat(t *testing.T) {
+	testCases := []struct {
+		keepassPassword string
+		keepassFormat   string
+		allowPlaintext  bool
+		contains        string
+	}{
+		{"password", "", false, ""},
+		{"", "", false, "keepass_password"},
+		{"", FormatKdbx, true, "keepass_password"},
+		// detected when the database is opened
+		{"", "", true, ""},
+		{"", FormatXML, true, ""},
+		{"", FormatXML, false, "allow_plaintext"},
+		{"password", "kdb", false, "keepass_format"},
+	}
+	for _, testCase := range testCases {
+		errs := CheckConfig("fixtures.xml", testCase.keepassPassword, testCase.keepassFormat, testCase.allowPlaintext)
+		if testCase.contains == "" && errs != nil {
+			t.Errorf("%+v: unexpected error %s", testCase, errs)
+		}
+		if testCase.contains != "" && (errs == nil || !strings.Contains(errs.Error(), testCase.contains)) {
+			t.Errorf("%+v: expected an error about %s, got %v", testCase, testCase.contains, errs)
+		}
+	}
+}
+
+func TestDecodeXMLDatabaseMalformed(t *testing.T) {
+	// a mismatched element inside an entry used to loop forever in the gokeepasslib unmarshaler
+	malformed := strings.Replace(xmlTestExport, "<Key>UserName</Key><Value>postgres</Value>", "<Key>UserName</Key><Valu>postgres</Value>", 1)
+	if _, err := decodeXMLDatabase([]byte(malformed)); err == nil || !strings.Contains(err.Error(), "Unable to read KeePass XML export") {
+		t.Fatalf("expected a syntax error, got %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+//go:generate packer-sdc mapstructure-to-hcl2 -type Config,DatasourceOutput
+package attachment
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"packer-plugin-keepass/common"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/hashicorp/packer-plugin-sdk/hcl2helper"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// Default limit on the attachment size as the contents are held in the packer template
+const defaultMaxSize = 1024 * 1024
+
+type Config struct {
+	KeepassFile            string   `mapstructure:"keepass_file" required:"true"`
+	KeepassPassword        string   `mapstructure:"keepass_password" required:"true"`
+	KeepassFormat          string   `mapstructure:"keepass_format"`
+	AllowPlaintext         bool     `mapstructure:"allow_plaintext"`
+	KeeShareTrustedSigners []string `mapstructure:"keeshare_trusted_signers"`
+	AttachmentPath         string   `mapstructure:"attachment_path" required:"true"`
+	MaxSize                int64    `mapstructure:"max_size"`
+	Binary                 bool     `mapstructure:"binary"`
+	AsOf                   string   `mapstructure:"as_of"`
+	MaskMinLength          int      `mapstructure:"mask_min_length"`
+	AuditLog               string   `mapstructure:"audit_log"`
+	PolicyFile             string   `mapstructure:"policy_file"`
+	PolicyTemplate         string   `mapstructure:"policy_template"`
+
+	ctx interpolate.Context
+}
+
+type Datasource struct {
+	config Config
+}
+
+type DatasourceOutput struct {
+	Content       string `mapstructure:"content"`
+	ContentBase64 string `mapstructure:"content_base64"`
+	Sha256        string `mapstructure:"sha256"`
+	Size          int64  `mapstructure:"size"`
+}
+
+func (d *Datasource) ConfigSpec() hcldec.ObjectSpec {
+	return d.config.FlatMapstructure().HCL2Spec()
+}
+
+func (d *Datasource) Configure(raws ...interface{}) error {
+	err := config.Decode(&d.config, nil, raws...)
+	if err != nil {
+		return err
+	}
+	if errs := common.CheckConfig(d.config.KeepassFile, d.config.KeepassPassword, d.config.KeepassFormat, d.config.AllowPlaintext); errs != nil {
+		return errs
+	}
+	var errs *packer.MultiError
+	if d.config.AttachmentPath == "" {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("The `attachment_path` must be provided."))
+	}
+	if d.config.MaxSize < 0 {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("The `max_size` must not be negative."))
+	}
+	if d.config.AsOf != "" {
+		if _, err := time.Parse(time.RFC3339, d.config.AsOf); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("Invalid RFC3339 time in `as_of`: %s", d.config.AsOf))
+		}
+	}
+	if errs != nil {
+		return errs
+	}
+	if d.config.MaxSize == 0 {
+		d.config.MaxSize = defaultMaxSize
+	}
+	return nil
+}
+
+func (d *Datasource) OutputSpec() hcldec.ObjectSpec {
+	return (&DatasourceOutput{}).FlatMapstructure().HCL2Spec()
+}
+
+func (d *Datasource) Execute() (cty.Value, error) {
+	output := DatasourceOutput{}
+	emptyOutput := hcl2helper.HCL2ValueFromConfig(output, d.OutputSpec())
+	db, databaseSha256, err := common.OpenDatabase(d.config.KeepassFile, d.config.KeepassPassword, d.config.KeepassFormat, d.config.AllowPlaintext, d.config.KeeShareTrustedSigners)
+	if err != nil {
+		return emptyOutput, err
+	}
+	truncated, err := common.ApplyAsOf(db, d.config.AsOf)
+	if err != nil {
+		return emptyOutput, err
+	}
+	for _, truncatedPath := range truncated {
+		log.Println("[WARNING] " + common.TruncatedHistoryWarning(db, truncatedPath, d.config.AsOf))
+	}
+	policy, err := common.ApplyPolicy(db, d.config.PolicyFile, d.config.PolicyTemplate, "")
+	if err != nil {
+		return emptyOutput, err
+	}
+	// look up the attachment by the same keys as the attachment provisioner
+	attachmentsMap, entryMap := common.AttachmentPaths(db)
+	attachment, keyExists := attachmentsMap[d.config.AttachmentPath]
+	if !keyExists {
+		if err := policy.CheckPath(d.config.AttachmentPath); err != nil {
+			return emptyOutput, err
+		}
+		return emptyOutput, fmt.Errorf("File attachment \"%s\" does not exist.", d.config.AttachmentPath)
+	}
+	// the size is checked before the whole attachment is decoded
+	attachmentBytes, err := common.ReadAttachmentLimited(db, attachment, d.config.MaxSize)
+	if err == common.ErrAttachmentTooLarge {
+		return emptyOutput, fmt.Errorf("File attachment \"%s\" exceeds the max_size of %d bytes.", d.config.AttachmentPath, d.config.MaxSize)
+	}
+	if err != nil {
+		return emptyOutput, err
+	}
+	// the outputs hold their own copies of the contents
+	defer common.ZeroBytes(attachmentBytes)
+	// hcl strings must be valid UTF-8, binary attachments are only available as content_base64
+	if !d.config.Binary && !utf8.Valid(attachmentBytes) {
+		return emptyOutput, fmt.Errorf("File attachment \"%s\" is not valid UTF-8 text, set `binary = true` to only return it as `content_base64`.", d.config.AttachmentPath)
+	}
+	auditLog, err := common.NewAuditLog(d.config.AuditLog, d.config.KeepassFile, databaseSha256, "data.keepass-attachment", "")
+	if err != nil {
+		return emptyOutput, err
+	}
+	auditLog.Read(db, common.AttachmentEntry(entryMap, d.config.AttachmentPath, attachment), "", attachment.Name)
+	if err := auditLog.Flush(); err != nil {
+		return emptyOutput, fmt.Errorf("Unable to write audit log: %s", err)
+	}
+	digest := sha256.Sum256(attachmentBytes)
+	// register the contents with the log secret filter of the plugin process
+	masker := common.NewSecretMasker(d.config.MaskMinLength, nil)
+	masker.Mask(d.config.KeepassPassword)
+	masker.MaskAttachment(attachmentBytes)
+	if !d.config.Binary {
+		output.Content = string(attachmentBytes)
+	}
+	output.ContentBase64 = base64.StdEncoding.EncodeToString(attachmentBytes)
+	masker.Mask(output.ContentBase64)
+	output.Sha256 = hex.EncodeToString(digest[:])
+	output.Size = int64(len(attachmentBytes))
+	return hcl2helper.HCL2ValueFromConfig(output, d.OutputSpec()), nil
+}
@@ -0,0 +1,108 @@
+package attachment
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"packer-plugin-keepass/testharness"
+)
+
+// A PKCS#12 keystore header, not valid UTF-8
+var attachmentTestBinary = []byte{0x30, 0x82, 0x0a, 0x5e, 0x02, 0x01, 0x03, 0xff, 0xfe}
+
+func attachmentTestDatabase(t *testing.T) string {
+	db := testharness.NewDatabase()
+	db.Entry("/example/Sample Entry").
+		Attach("test.txt", []byte("text attachment\n")).
+		Attach("keystore.p12", attachmentTestBinary)
+	return db.WriteFile(t, "attachment.kdbx")
+}
+
+func TestDatasourceExecute(t *testing.T) {
+	testCases := []struct {
+		attachmentPath string
+		binary         bool
+		contents       []byte
+		content        string
+	}{
+		{"/example/Sample Entry-test.txt", false, []byte("text attachment\n"), "text attachment\n"},
+		// binary attachments are only returned as base64
+		{"/example/Sample Entry-keystore.p12", true, attachmentTestBinary, ""},
+		{"/example/Sample Entry-test.txt", true, []byte("text attachment\n"), ""},
+	}
+	keepassFile := attachmentTestDatabase(t)
+	for _, testCase := range testCases {
+		t.Run(testCase.attachmentPath, func(t *testing.T) {
+			var d Datasource
+			if err := d.Configure(map[string]interface{}{
+				"keepass_file":     keepassFile,
+				"keepass_password": testharness.Password,
+				"attachment_path":  testCase.attachmentPath,
+				"binary":           testCase.binary,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			output, err := d.Execute()
+			if err != nil {
+				t.Fatal(err)
+			}
+			digest := sha256.Sum256(testCase.contents)
+			if content := output.GetAttr("content").AsString(); content != testCase.content {
+				t.Errorf("expected content %q, got %q", testCase.content, content)
+			}
+			if contentBase64 := output.GetAttr("content_base64").AsString(); contentBase64 != base64.StdEncoding.EncodeToString(testCase.contents) {
+				t.Errorf("unexpected content_base64 %q", contentBase64)
+			}
+			if sha := output.GetAttr("sha256").AsString(); sha != hex.EncodeToString(digest[:]) {
+				t.Errorf("unexpected sha256 %q", sha)
+			}
+			if size, _ := output.GetAttr("size").AsBigFloat().Int64(); size != int64(len(testCase.contents)) {
+				t.Errorf("expected size %d, got %d", len(testCase.contents), size)
+			}
+		})
+	}
+}
+
+func TestDatasourceExecuteErrors(t *testing.T) {
+	testCases := []struct {
+		name     string
+		config   map[string]interface{}
+		expected string
+	}{
+		{"missing attachment", map[string]interface{}{"attachment_path": "/example/Sample Entry-missing.txt"}, "File attachment \"/example/Sample Entry-missing.txt\" does not exist."},
+		{"max size", map[string]interface{}{"attachment_path": "/example/Sample Entry-test.txt", "max_size": 4}, "File attachment \"/example/Sample Entry-test.txt\" exceeds the max_size of 4 bytes."},
+		{"binary", map[string]interface{}{"attachment_path": "/example/Sample Entry-keystore.p12"}, "File attachment \"/example/Sample Entry-keystore.p12\" is not valid UTF-8 text, set `binary = true`"},
+	}
+	keepassFile := attachmentTestDatabase(t)
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.config["keepass_file"] = keepassFile
+			testCase.config["keepass_password"] = testharness.Password
+			var d Datasource
+			if err := d.Configure(testCase.config); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := d.Execute(); err == nil || !strings.Contains(err.Error(), testCase.expected) {
+				t.Errorf("expected an error containing %q, got %v", testCase.expected, err)
+			}
+		})
+	}
+}
+
+func TestDatasourceConfigure(t *testing.T) {
+	var d Datasource
+	err := d.Configure(map[string]interface{}{
+		"keepass_file":     "example.kdbx",
+		"keepass_password": testharness.Password,
+		"max_size":         -1,
+		"as_of":            "yesterday",
+	})
+	for _, expected := range []string{"The `attachment_path` must be provided.", "The `max_size` must not be negative.", "Invalid RFC3339 time in `as_of`"} {
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected an error containing %q, got %v", expected, err)
+		}
+	}
+}
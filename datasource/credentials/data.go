@@ -5,9 +5,13 @@ import (
 	"fmt"
 	"log"
 	"packer-plugin-keepass/common"
+	"path"
+	"strings"
+	"time"
 
 	"github.com/hashicorp/hcl/v2/hcldec"
 	"github.com/hashicorp/packer-plugin-sdk/hcl2helper"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
 	"github.com/hashicorp/packer-plugin-sdk/template/config"
 	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
 	"github.com/tobischo/gokeepasslib/v3"
@@ -15,8 +19,22 @@ import (
 )
 
 type Config struct {
-	KeepassFile     string `mapstructure:"keepass_file" required:"true"`
-	KeepassPassword string `mapstructure:"keepass_password" required:"true"`
+	KeepassFile            string   `mapstructure:"keepass_file" required:"true"`
+	KeepassPassword        string   `mapstructure:"keepass_password" required:"true"`
+	KeepassFormat          string   `mapstructure:"keepass_format"`
+	AllowPlaintext         bool     `mapstructure:"allow_plaintext"`
+	KeeShareTrustedSigners []string `mapstructure:"keeshare_trusted_signers"`
+	IncludeHistory         bool     `mapstructure:"include_history"`
+	HistoryAt              []string `mapstructure:"history_at"`
+	AsOf                   string   `mapstructure:"as_of"`
+	Keys                   []string `mapstructure:"keys"`
+	IncludeTags            []string `mapstructure:"include_tags"`
+	ExcludeTags            []string `mapstructure:"exclude_tags"`
+	MaskMinLength          int      `mapstructure:"mask_min_length"`
+	UnmaskedFields         []string `mapstructure:"unmasked_fields"`
+	AuditLog               string   `mapstructure:"audit_log"`
+	PolicyFile             string   `mapstructure:"policy_file"`
+	PolicyTemplate         string   `mapstructure:"policy_template"`
 
 	ctx interpolate.Context
 }
@@ -38,7 +56,22 @@ func (d *Datasource) Configure(raws ...interface{}) error {
 	if err != nil {
 		return err
 	}
-	if errs := common.CheckConfig(d.config.KeepassFile, d.config.KeepassPassword); errs != nil {
+	if errs := common.CheckConfig(d.config.KeepassFile, d.config.KeepassPassword, d.config.KeepassFormat, d.config.AllowPlaintext); errs != nil {
+		return errs
+	}
+	// check that the history_at times are valid RFC3339 timestamps
+	var errs *packer.MultiError
+	for _, historyAt := range d.config.HistoryAt {
+		if _, err := time.Parse(time.RFC3339, historyAt); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("Invalid RFC3339 time in `history_at`: %s", historyAt))
+		}
+	}
+	if d.config.AsOf != "" {
+		if _, err := time.Parse(time.RFC3339, d.config.AsOf); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("Invalid RFC3339 time in `as_of`: %s", d.config.AsOf))
+		}
+	}
+	if errs != nil {
 		return errs
 	}
 	return nil
@@ -48,25 +81,137 @@ func (d *Datasource) OutputSpec() hcldec.ObjectSpec {
 	return (&DatasourceOutput{}).FlatMapstructure().HCL2Spec()
 }
 
-func (d *Datasource) Execute() (cty.Value, error) {
+func (d *Datasource) Execute() (value cty.Value, err error) {
 	output := DatasourceOutput{}
 	emptyOutput := hcl2helper.HCL2ValueFromConfig(output, d.OutputSpec())
-	db, err := common.OpenDatabase(d.config.KeepassFile, d.config.KeepassPassword)
+	db, databaseSha256, err := common.OpenDatabase(d.config.KeepassFile, d.config.KeepassPassword, d.config.KeepassFormat, d.config.AllowPlaintext, d.config.KeeShareTrustedSigners)
+	if err != nil {
+		return emptyOutput, err
+	}
+	auditLog, err := common.NewAuditLog(d.config.AuditLog, d.config.KeepassFile, databaseSha256, "data.keepass-credentials", "")
+	if err != nil {
+		return emptyOutput, err
+	}
+	// record the values read before a failing step as well
+	defer auditLog.FlushOnReturn(&err)
+	// reconstruct the database as it was at the as_of time
+	truncated, err := common.ApplyAsOf(db, d.config.AsOf)
+	if err != nil {
+		return emptyOutput, err
+	}
+	for _, entryPath := range truncated {
+		log.Println("[WARNING] " + common.TruncatedHistoryWarning(db, entryPath, d.config.AsOf))
+	}
+	// only expose the entries allowed by the access policy
+	// data sources are evaluated before any build, so rules scoped to builds do not apply
+	policy, err := common.ApplyPolicy(db, d.config.PolicyFile, d.config.PolicyTemplate, "")
 	if err != nil {
 		return emptyOutput, err
 	}
-	db.UnlockProtectedEntries()
+	// register the decrypted values with the log secret filter of the plugin process
+	masker := common.NewSecretMasker(d.config.MaskMinLength, d.config.UnmaskedFields)
+	masker.Mask(d.config.KeepassPassword)
 	// walk the database tree and create map of entry values
-	credentials := map[string]string{}
+	collector := &valueCollector{
+		db:          db,
+		keys:        d.config.Keys,
+		masker:      masker,
+		auditLog:    auditLog,
+		credentials: map[string]string{},
+	}
 	entryCallback := func(entryPath string, entry gokeepasslib.Entry, depth int) {
-		for _, valueData := range entry.Values {
-			// entry value data keys are guaranteed by keepass to be unique
-			key := fmt.Sprintf("%s-%s", entryPath, valueData.Key)
-			credentials[key] = valueData.Value.Content
-			log.Println(fmt.Sprintf("(value) %s", key))
+		if !common.MatchTags(entry, d.config.IncludeTags, d.config.ExcludeTags) {
+			return
+		}
+		collector.addValues(entryPath, entry, "", entry)
+		// tags are stored outside of the entry values, a string field of the same name takes precedence
+		tagsKey := fmt.Sprintf("%s-Tags", entryPath)
+		if _, keyExists := collector.credentials[tagsKey]; !keyExists && entry.Tags != "" && entry.Get("Tags") == nil && collector.requested(tagsKey) {
+			collector.credentials[tagsKey] = entry.Tags
+			log.Println(fmt.Sprintf("(value) %s", tagsKey))
+			if strings.HasPrefix(entryPath, "/") {
+				auditLog.Read(db, entry, "Tags", "")
+			}
+		}
+		if d.config.IncludeHistory {
+			// previous versions keyed by their age, 1 being the version before the current one
+			versions := common.EntryVersions(entry)
+			for n := 1; n < len(versions); n++ {
+				collector.addValues(entryPath, entry, fmt.Sprintf("@%d", n), versions[len(versions)-1-n])
+			}
+		}
+		for _, historyAt := range d.config.HistoryAt {
+			// versions valid at a point in time keyed by the time as written in the config
+			at, _ := time.Parse(time.RFC3339, historyAt)
+			if version, ok := common.EntryVersionAt(entry, at); ok {
+				collector.addValues(entryPath, entry, "@"+historyAt, version)
+			}
 		}
 	}
-	common.WalkDatabase(db, nil, entryCallback)
-	output.Map = credentials
+	if err := common.WalkDatabase(db, nil, entryCallback); err != nil {
+		return emptyOutput, err
+	}
+	if collector.err != nil {
+		return emptyOutput, collector.err
+	}
+	// keys requested without wildcards fail if the policy removed their entry
+	for _, key := range d.config.Keys {
+		if _, keyExists := collector.credentials[key]; keyExists || strings.ContainsAny(key, `*?[\`) {
+			continue
+		}
+		if err := policy.CheckPath(key); err != nil {
+			return emptyOutput, err
+		}
+	}
+	output.Map = collector.credentials
 	return hcl2helper.HCL2ValueFromConfig(output, d.OutputSpec()), nil
 }
+
+// Collects the requested values of the walked entries, decrypting them one at a time
+type valueCollector struct {
+	db          *gokeepasslib.Database
+	keys        []string
+	masker      *common.SecretMasker
+	auditLog    *common.AuditLog
+	credentials map[string]string
+	err         error
+}
+
+// Checks whether a map key matches the keys option, all keys are requested if it is not set
+func (c *valueCollector) requested(key string) bool {
+	if len(c.keys) == 0 {
+		return true
+	}
+	for _, pattern := range c.keys {
+		if matched, err := path.Match(pattern, key); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds the values of an entry version to the map with the version suffix
+func (c *valueCollector) addValues(entryPath string, entry gokeepasslib.Entry, suffix string, version gokeepasslib.Entry) {
+	for _, valueData := range version.Values {
+		// entry value data keys are guaranteed by keepass to be unique
+		key := fmt.Sprintf("%s-%s%s", entryPath, valueData.Key, suffix)
+		if !c.requested(key) {
+			continue
+		}
+		value, err := common.RevealValue(c.db, valueData)
+		if err != nil {
+			if c.err == nil {
+				c.err = fmt.Errorf("Unable to decrypt %s: %s", key, err)
+			}
+			continue
+		}
+		c.credentials[key] = string(value)
+		common.ZeroBytes(value)
+		c.masker.MaskField(valueData.Key, c.credentials[key])
+		log.Println(fmt.Sprintf("(value) %s", key))
+		// entries are walked by path and by uuid, audit them once
+		if strings.HasPrefix(entryPath, "/") {
+			c.auditLog.Read(c.db, entry, valueData.Key+suffix, "")
+		}
+	}
+}
@@ -10,8 +10,22 @@ import (
 // FlatConfig is an auto-generated flat version of Config.
 // Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
 type FlatConfig struct {
-	KeepassFile     *string `mapstructure:"keepass_file" required:"true" cty:"keepass_file" hcl:"keepass_file"`
-	KeepassPassword *string `mapstructure:"keepass_password" required:"true" cty:"keepass_password" hcl:"keepass_password"`
+	KeepassFile            *string  `mapstructure:"keepass_file" required:"true" cty:"keepass_file" hcl:"keepass_file"`
+	KeepassPassword        *string  `mapstructure:"keepass_password" required:"true" cty:"keepass_password" hcl:"keepass_password"`
+	KeepassFormat          *string  `mapstructure:"keepass_format" cty:"keepass_format" hcl:"keepass_format"`
+	AllowPlaintext         *bool    `mapstructure:"allow_plaintext" cty:"allow_plaintext" hcl:"allow_plaintext"`
+	KeeShareTrustedSigners []string `mapstructure:"keeshare_trusted_signers" cty:"keeshare_trusted_signers" hcl:"keeshare_trusted_signers"`
+	IncludeHistory         *bool    `mapstructure:"include_history" cty:"include_history" hcl:"include_history"`
+	HistoryAt              []string `mapstructure:"history_at" cty:"history_at" hcl:"history_at"`
+	AsOf                   *string  `mapstructure:"as_of" cty:"as_of" hcl:"as_of"`
+	Keys                   []string `mapstructure:"keys" cty:"keys" hcl:"keys"`
+	IncludeTags            []string `mapstructure:"include_tags" cty:"include_tags" hcl:"include_tags"`
+	ExcludeTags            []string `mapstructure:"exclude_tags" cty:"exclude_tags" hcl:"exclude_tags"`
+	MaskMinLength          *int     `mapstructure:"mask_min_length" cty:"mask_min_length" hcl:"mask_min_length"`
+	UnmaskedFields         []string `mapstructure:"unmasked_fields" cty:"unmasked_fields" hcl:"unmasked_fields"`
+	AuditLog               *string  `mapstructure:"audit_log" cty:"audit_log" hcl:"audit_log"`
+	PolicyFile             *string  `mapstructure:"policy_file" cty:"policy_file" hcl:"policy_file"`
+	PolicyTemplate         *string  `mapstructure:"policy_template" cty:"policy_template" hcl:"policy_template"`
 }
 
 // FlatMapstructure returns a new FlatConfig.
@@ -26,8 +40,22 @@ func (*Config) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec }
 // The decoded values from this spec will then be applied to a FlatConfig.
 func (*FlatConfig) HCL2Spec() map[string]hcldec.Spec {
 	s := map[string]hcldec.Spec{
-		"keepass_file":     &hcldec.AttrSpec{Name: "keepass_file", Type: cty.String, Required: false},
-		"keepass_password": &hcldec.AttrSpec{Name: "keepass_password", Type: cty.String, Required: false},
+		"keepass_file":             &hcldec.AttrSpec{Name: "keepass_file", Type: cty.String, Required: false},
+		"keepass_password":         &hcldec.AttrSpec{Name: "keepass_password", Type: cty.String, Required: false},
+		"keepass_format":           &hcldec.AttrSpec{Name: "keepass_format", Type: cty.String, Required: false},
+		"allow_plaintext":          &hcldec.AttrSpec{Name: "allow_plaintext", Type: cty.Bool, Required: false},
+		"keeshare_trusted_signers": &hcldec.AttrSpec{Name: "keeshare_trusted_signers", Type: cty.List(cty.String), Required: false},
+		"include_history":          &hcldec.AttrSpec{Name: "include_history", Type: cty.Bool, Required: false},
+		"history_at":               &hcldec.AttrSpec{Name: "history_at", Type: cty.List(cty.String), Required: false},
+		"as_of":                    &hcldec.AttrSpec{Name: "as_of", Type: cty.String, Required: false},
+		"keys":                     &hcldec.AttrSpec{Name: "keys", Type: cty.List(cty.String), Required: false},
+		"include_tags":             &hcldec.AttrSpec{Name: "include_tags", Type: cty.List(cty.String), Required: false},
+		"exclude_tags":             &hcldec.AttrSpec{Name: "exclude_tags", Type: cty.List(cty.String), Required: false},
+		"mask_min_length":          &hcldec.AttrSpec{Name: "mask_min_length", Type: cty.Number, Required: false},
+		"unmasked_fields":          &hcldec.AttrSpec{Name: "unmasked_fields", Type: cty.List(cty.String), Required: false},
+		"audit_log":                &hcldec.AttrSpec{Name: "audit_log", Type: cty.String, Required: false},
+		"policy_file":              &hcldec.AttrSpec{Name: "policy_file", Type: cty.String, Required: false},
+		"policy_template":          &hcldec.AttrSpec{Name: "policy_template", Type: cty.String, Required: false},
 	}
 	return s
 }
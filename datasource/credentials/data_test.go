@@ -0,0 +1,138 @@
+package credentials
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"packer-plugin-keepass/testharness"
+
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+func TestDatasourceIncludeHistory(t *testing.T) {
+	var d Datasource
+	if err := d.Configure(map[string]interface{}{
+		"keepass_file":     testharness.Seed(t, filepath.Join("..", "..", "seed", "test-fixtures", "example.yaml")),
+		"keepass_password": testharness.Password,
+		"include_history":  true,
+		"keys":             []string{"/example/Sample Entry-Password*"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	output, err := d.Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials := map[string]string{}
+	for key, value := range output.GetAttr("map").AsValueMap() {
+		credentials[key] = value.AsString()
+	}
+	// versions are numbered by their age, the history of the seed is written oldest first
+	expected := map[string]string{
+		"/example/Sample Entry-Password":   "Password",
+		"/example/Sample Entry-Password@1": "second",
+		"/example/Sample Entry-Password@2": "first",
+	}
+	if len(credentials) != len(expected) {
+		t.Errorf("expected %d values, got %v", len(expected), credentials)
+	}
+	for key, value := range expected {
+		if credentials[key] != value {
+			t.Errorf("%s: expected %q, got %q", key, value, credentials[key])
+		}
+	}
+}
+
+func TestDatasourceDetectedXMLExport(t *testing.T) {
+	keepassFile := filepath.Join(t.TempDir(), "fixtures.xml")
+	export := `<?xml version="1.0" encoding="utf-8" standalone="yes"?>
+<KeePassFile>
+	<Root>
+		<Group>
+			<UUID>8+Zf6aKyTbuQxGHLZlMmFA==</UUID>
+			<Name>ci</Name>
+			<Entry>
+				<UUID>T1ifmgtNQXKSG8ZUuS1Q2A==</UUID>
+				<String><Key>Title</Key><Value>database</Value></String>
+				<String><Key>Password</Key><Value ProtectInMemory="True">ci-fixture-7f3d9a</Value></String>
+			</Entry>
+		</Group>
+	</Root>
+</KeePassFile>
+`
+	if err := os.WriteFile(keepassFile, []byte(export), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// neither keepass_format nor keepass_password are set
+	var d Datasource
+	if err := d.Configure(map[string]interface{}{
+		"keepass_file":    keepassFile,
+		"allow_plaintext": true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	output, err := d.Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password := output.GetAttr("map").AsValueMap()["/ci/database-Password"].AsString(); password != "ci-fixture-7f3d9a" {
+		t.Errorf("unexpected password %q", password)
+	}
+	// the value is redacted from the plugin log
+	if filtered := packer.LogSecretFilter.FilterString("ci-fixture-7f3d9a"); filtered != "<sensitive>" {
+		t.Errorf("expected the value to be registered with the log secret filter, got %q", filtered)
+	}
+}
+
+func TestDatasourcePolicy(t *testing.T) {
+	db := testharness.NewDatabase()
+	db.Entry("/prod/db", "Password", "prod-password")
+	db.Entry("/dev/db", "Password", "dev-password")
+	keepassFile := db.WriteFile(t, "policy.kdbx")
+	policyFile := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(policyFile, []byte(`{"rules": [{"groups": ["/prod"]}, {"builds": ["*"], "groups": ["/dev"]}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		keys     []string
+		expected string
+	}{
+		// denied entries are left out of wildcard keys
+		{[]string{"/*/db-Password"}, "/prod/db-Password"},
+		// rules scoped to builds do not apply to data sources
+		{[]string{"/prod/db-Password", "/dev/db-Password"}, "Access to \"/dev/db-Password\" is denied by the access policy"},
+		{[]string{"/dev/missing-Password"}, ""},
+	}
+	for _, testCase := range testCases {
+		t.Run(strings.Join(testCase.keys, " "), func(t *testing.T) {
+			var d Datasource
+			if err := d.Configure(map[string]interface{}{
+				"keepass_file":     keepassFile,
+				"keepass_password": testharness.Password,
+				"policy_file":      policyFile,
+				"keys":             testCase.keys,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			output, err := d.Execute()
+			if strings.HasPrefix(testCase.expected, "Access") {
+				if err == nil || !strings.Contains(err.Error(), testCase.expected) {
+					t.Errorf("expected an error containing %q, got %v", testCase.expected, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys := []string{}
+			for key := range output.GetAttr("map").AsValueMap() {
+				keys = append(keys, key)
+			}
+			if strings.Join(keys, " ") != testCase.expected {
+				t.Errorf("expected %q, got %v", testCase.expected, keys)
+			}
+		})
+	}
+}
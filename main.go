@@ -2,11 +2,19 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"os"
+	attachmentDatasource "packer-plugin-keepass/datasource/attachment"
 	"packer-plugin-keepass/datasource/credentials"
 	"packer-plugin-keepass/provisioner/attachment"
+	"packer-plugin-keepass/provisioner/cleanup"
+	"packer-plugin-keepass/provisioner/env"
 	"packer-plugin-keepass/provisioner/listing"
+	"packer-plugin-keepass/provisioner/secretsdir"
+	"packer-plugin-keepass/provisioner/sshkey"
+	"packer-plugin-keepass/seed"
 
+	"github.com/hashicorp/packer-plugin-sdk/packer"
 	"github.com/hashicorp/packer-plugin-sdk/plugin"
 	"github.com/hashicorp/packer-plugin-sdk/version"
 )
@@ -26,10 +34,22 @@ var (
 )
 
 func main() {
+	// build test databases from a spec instead of serving the plugin
+	if len(os.Args) > 1 && os.Args[1] == "seed" {
+		os.Exit(seed.Run(os.Args[2:], os.Stdout, os.Stderr))
+	}
+	// redact the decrypted values from the plugin log, which packer copies into its own log
+	packer.LogSecretFilter.SetOutput(os.Stderr)
+	log.SetOutput(&packer.LogSecretFilter)
 	pps := plugin.NewSet()
 	pps.RegisterDatasource("credentials", new(credentials.Datasource))
+	pps.RegisterDatasource("attachment", new(attachmentDatasource.Datasource))
 	pps.RegisterProvisioner("attachment", new(attachment.Provisioner))
 	pps.RegisterProvisioner("listing", new(listing.Provisioner))
+	pps.RegisterProvisioner("ssh-key", new(sshkey.Provisioner))
+	pps.RegisterProvisioner("env", new(env.Provisioner))
+	pps.RegisterProvisioner("secrets-dir", new(secretsdir.Provisioner))
+	pps.RegisterProvisioner("cleanup", new(cleanup.Provisioner))
 	pps.SetVersion(PluginVersion)
 	err := pps.Run()
 	if err != nil {
@@ -0,0 +1,86 @@
+package attachment
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	"packer-plugin-keepass/common"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+// File names and modes of the pem files converted from a pkcs#12 attachment
+var pemFiles = []struct {
+	name string
+	mode uint32
+}{
+	{"cert.pem", 0644},
+	{"chain.pem", 0644},
+	{"key.pem", 0600},
+}
+
+// DER encoded object identifier of PBES2 (1.2.840.113549.1.5.13), the password based encryption of modern
+// pkcs#12 archives which golang.org/x/crypto/pkcs12 cannot decrypt
+var pbes2OID = []byte{0x06, 0x09, 0x2a, 0x86, 0x48, 0x86, 0xf7, 0x0d, 0x01, 0x05, 0x0d}
+
+// Decodes a pkcs#12 archive into the pem encoded certificate, chain and pkcs#8 private key
+func convertPKCS12ToPEM(pfxData []byte, password string) (map[string][]byte, error) {
+	blocks, err := pkcs12.ToPEM(pfxData, password)
+	if _, notImplemented := err.(pkcs12.NotImplementedError); notImplemented && bytes.Contains(pfxData, pbes2OID) {
+		return nil, fmt.Errorf("Unable to decode PKCS#12 attachment: it is encrypted with PBES2 (AES), as exported by OpenSSL 3 and Windows, which is not supported. Export it with the legacy encryption instead, e.g. `openssl pkcs12 -export -legacy` or TripleDES-SHA1 on Windows.")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode PKCS#12 attachment: %s", err)
+	}
+	var privateKey crypto.Signer
+	certificates := []*x509.Certificate{}
+	for _, block := range blocks {
+		switch block.Type {
+		case "PRIVATE KEY":
+			if privateKey != nil {
+				return nil, fmt.Errorf("PKCS#12 attachment contains more than one private key")
+			}
+			if privateKey = common.ParsePrivateKey(block.Bytes); privateKey == nil {
+				return nil, fmt.Errorf("Unsupported private key in PKCS#12 attachment")
+			}
+		case "CERTIFICATE":
+			certificate, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			certificates = append(certificates, certificate)
+		}
+	}
+	if privateKey == nil || len(certificates) == 0 {
+		return nil, fmt.Errorf("PKCS#12 attachment must contain a private key and a certificate")
+	}
+	// the leaf certificate is the one matching the private key, the others form the chain
+	publicKey, ok := privateKey.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok {
+		return nil, fmt.Errorf("Unsupported private key in PKCS#12 attachment")
+	}
+	var certPEM, chainPEM bytes.Buffer
+	for _, certificate := range certificates {
+		block := &pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw}
+		if certPEM.Len() == 0 && publicKey.Equal(certificate.PublicKey) {
+			pem.Encode(&certPEM, block)
+		} else {
+			pem.Encode(&chainPEM, block)
+		}
+	}
+	if certPEM.Len() == 0 {
+		return nil, fmt.Errorf("PKCS#12 attachment does not contain a certificate matching its private key")
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]byte{
+		"cert.pem":  certPEM.Bytes(),
+		"chain.pem": chainPEM.Bytes(),
+		"key.pem":   pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+	}, nil
+}
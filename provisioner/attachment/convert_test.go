@@ -0,0 +1,90 @@
+package attachment
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"packer-plugin-keepass/common"
+)
+
+const convertTestPassword = "pfx-password"
+
+func readConvertFixture(t *testing.T, name string) []byte {
+	data, err := os.ReadFile(filepath.Join("test-fixtures", "pkcs12", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// Returns the der encoded blocks of a pem file
+func convertTestBlocks(t *testing.T, data []byte) [][]byte {
+	blocks := [][]byte{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return blocks
+		}
+		blocks = append(blocks, block.Bytes)
+	}
+}
+
+func TestConvertPKCS12ToPEM(t *testing.T) {
+	// written by openssl pkcs12 -export -legacy from cert.pem, key.pem and ca.pem
+	pemBytes, err := convertPKCS12ToPEM(readConvertFixture(t, "legacy.p12"), convertTestPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, fixture := range map[string]string{"cert.pem": "cert.pem", "chain.pem": "ca.pem"} {
+		expected := convertTestBlocks(t, readConvertFixture(t, fixture))
+		actual := convertTestBlocks(t, pemBytes[name])
+		if len(actual) != len(expected) || !bytes.Equal(actual[0], expected[0]) {
+			t.Errorf("%s: expected the certificate of %s, got:\n%s", name, fixture, pemBytes[name])
+		}
+	}
+	keyBlocks := convertTestBlocks(t, pemBytes["key.pem"])
+	if len(keyBlocks) != 1 {
+		t.Fatalf("expected a single key, got:\n%s", pemBytes["key.pem"])
+	}
+	if _, err := x509.ParsePKCS8PrivateKey(keyBlocks[0]); err != nil {
+		t.Errorf("expected a PKCS#8 key: %s", err)
+	}
+	expectedKey := common.ParsePrivateKey(convertTestBlocks(t, readConvertFixture(t, "key.pem"))[0])
+	if key := common.ParsePrivateKey(keyBlocks[0]); key == nil || !key.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(expectedKey.Public()) {
+		t.Errorf("expected the key of key.pem")
+	}
+	// the converted files are accepted by the certificate checks
+	bundle := common.ParseCertificateBundle(append(append(append([]byte{}, pemBytes["chain.pem"]...), pemBytes["cert.pem"]...), pemBytes["key.pem"]...))
+	if bundle == nil || len(bundle.Certificates) != 2 || len(bundle.PrivateKeys) != 1 || bundle.Leaf(bundle.PrivateKeys[0]) == nil {
+		t.Errorf("expected the leaf to match the converted key")
+	}
+}
+
+func TestConvertPKCS12ToPEMErrors(t *testing.T) {
+	testCases := []struct {
+		name     string
+		fixture  string
+		password string
+		expected string
+	}{
+		{"wrong password", "legacy.p12", "wrong", "Unable to decode PKCS#12 attachment: pkcs12: decryption password incorrect"},
+		// written by openssl 3 with its defaults, AES-256-CBC and an HMAC-SHA256 mac
+		{"pbes2", "aes.p12", convertTestPassword, "it is encrypted with PBES2 (AES), as exported by OpenSSL 3 and Windows, which is not supported"},
+		{"not pkcs12", "cert.pem", convertTestPassword, "Unable to decode PKCS#12 attachment"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			_, err := convertPKCS12ToPEM(readConvertFixture(t, testCase.fixture), testCase.password)
+			if err == nil || !strings.Contains(err.Error(), testCase.expected) {
+				t.Errorf("expected an error containing %q, got %v", testCase.expected, err)
+			}
+		})
+	}
+}
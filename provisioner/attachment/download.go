@@ -0,0 +1,99 @@
+package attachment
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"packer-plugin-keepass/common"
+
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+// Download a file from the guest and save it as a file attachment in the keepass database
+func (p *Provisioner) Download(ui packer.Ui, communicator packer.Communicator, keepassFile string, keepassPassword string, attachmentPath string, source string) error {
+	// other builds wait for the lock until the database is saved, so that no download is lost
+	db, lock, err := common.OpenDatabaseForWrite(keepassFile, keepassPassword)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+	p.auditLog, err = common.NewAuditLog(p.auditLogPath, keepassFile, lock.Sha256(), "provisioner.keepass-attachment", p.config.PackerBuildName)
+	if err != nil {
+		return err
+	}
+	entryPath, name, err := splitAttachmentPath(db, attachmentPath)
+	if err != nil {
+		return err
+	}
+	// the policy is checked without removing entries, as the database is written back
+	policy, err := common.LoadPolicy(db, p.policyFile, p.config.PolicyTemplate, p.config.PackerBuildName)
+	if err != nil {
+		return err
+	}
+	if err := policy.CheckWrite(db, entryPath); err != nil {
+		return err
+	}
+	ui.Say(fmt.Sprintf("Downloading %s => %s", source, attachmentPath))
+	var contents bytes.Buffer
+	if err := communicator.Download(source, &contents); err != nil {
+		ui.Error(fmt.Sprintf("Download failed: %s", err))
+		return err
+	}
+	// the database holds its own copy of the contents once it is encoded
+	defer common.ZeroBytes(contents.Bytes())
+	p.masker.MaskAttachment(contents.Bytes())
+	if err := p.checkCertificates(name, contents.Bytes()); err != nil {
+		ui.Error(fmt.Sprintf("Download failed: %s", err))
+		return err
+	}
+	entryUUID, created, err := common.SetAttachment(db, entryPath, name, contents.Bytes())
+	if err != nil {
+		return err
+	}
+	if created {
+		ui.Say(fmt.Sprintf("Created entry %s", entryPath))
+	}
+	if err := common.SaveDatabase(db, lock); err != nil {
+		return fmt.Errorf("Unable to save %s: %s", keepassFile, err)
+	}
+	p.auditLog.Write(entryPath, entryUUID, name)
+	return nil
+}
+
+// Split an attachment path into the entry path and file name. Existing attachments and entries
+// are matched first as both titles and file names may contain dashes, otherwise the last dash
+// of the path separates the new entry title from the file name.
+func splitAttachmentPath(db *gokeepasslib.Database, attachmentPath string) (string, string, error) {
+	attachmentsMap, entryMap := common.AttachmentPaths(db)
+	if attachment, keyExists := attachmentsMap[attachmentPath]; keyExists && strings.HasPrefix(attachmentPath, "/") {
+		return strings.TrimSuffix(attachmentPath, "-"+attachment.Name), attachment.Name, nil
+	}
+	entryPath := ""
+	for path := range entryMap {
+		if strings.HasPrefix(path, "/") && strings.HasPrefix(attachmentPath, path+"-") && len(path) > len(entryPath) {
+			entryPath = path
+		}
+	}
+	if entryPath != "" {
+		return entryPath, strings.TrimPrefix(attachmentPath, entryPath+"-"), nil
+	}
+	separator := strings.LastIndex(attachmentPath, "-")
+	if separator <= strings.LastIndex(attachmentPath, "/") || separator == len(attachmentPath)-1 {
+		return "", "", fmt.Errorf("Invalid attachment path \"%s\", expected /<group>/<entry>-<file name>", attachmentPath)
+	}
+	return attachmentPath[:separator], attachmentPath[separator+1:], nil
+}
+
+// Check that attachment_path and source config are provided
+func checkDownloadConfig(attachmentPath string, source string) *packer.MultiError {
+	var errs *packer.MultiError
+	if attachmentPath == "" {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("The `attachment_path` must be provided."))
+	}
+	if source == "" {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("The `source` must be provided."))
+	}
+	return errs
+}
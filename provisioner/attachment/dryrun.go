@@ -0,0 +1,94 @@
+package attachment
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"packer-plugin-keepass/common"
+
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// Stands in for the communicator with dry_run, the uploads and commands are planned instead of made
+// so that the destinations are resolved exactly as for a real upload
+type dryRunCommunicator struct {
+	steps []string
+}
+
+// A planned upload with the size and SHA-256 digest of the contents
+func (c *dryRunCommunicator) plan(path string, contents []byte, mode os.FileMode) {
+	digest := sha256.Sum256(contents)
+	c.steps = append(c.steps, fmt.Sprintf("upload %s (%d bytes, mode %04o, sha256 %s)", path, len(contents), mode, hex.EncodeToString(digest[:])))
+}
+
+func (c *dryRunCommunicator) Start(ctx context.Context, cmd *packer.RemoteCmd) error {
+	c.steps = append(c.steps, "run    "+cmd.Command)
+	cmd.SetExited(0)
+	return nil
+}
+
+func (c *dryRunCommunicator) Upload(path string, reader io.Reader, fileInfo *os.FileInfo) error {
+	contents, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	defer common.ZeroBytes(contents)
+	var mode os.FileMode
+	if fileInfo != nil && *fileInfo != nil {
+		mode = (*fileInfo).Mode().Perm()
+	}
+	c.plan(path, contents, mode)
+	return nil
+}
+
+// Plans each file below src, with the contents of src itself uploaded into dst if it ends with a slash
+func (c *dryRunCommunicator) UploadDir(dst string, src string, exclude []string) error {
+	base := src
+	if !strings.HasSuffix(src, "/") {
+		base = filepath.Dir(src)
+	}
+	return filepath.Walk(src, func(localPath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		relative, err := filepath.Rel(base, localPath)
+		if err != nil {
+			return err
+		}
+		contents, err := os.ReadFile(localPath)
+		if err != nil {
+			return err
+		}
+		defer common.ZeroBytes(contents)
+		c.plan(strings.TrimSuffix(dst, "/")+"/"+filepath.ToSlash(relative), contents, info.Mode().Perm())
+		return nil
+	})
+}
+
+func (c *dryRunCommunicator) Download(path string, writer io.Writer) error {
+	return fmt.Errorf("Downloads are not planned by dry_run")
+}
+
+func (c *dryRunCommunicator) DownloadDir(src string, dst string, exclude []string) error {
+	return fmt.Errorf("Downloads are not planned by dry_run")
+}
+
+// Print the planned uploads and commands, followed by the steps skipped after the upload
+func (p *Provisioner) printDryRun(ui packer.Ui, planned *dryRunCommunicator) {
+	ui.Say("Planned steps:")
+	for _, step := range planned.steps {
+		ui.Say(treeSpacer + step)
+	}
+	if p.config.Verify {
+		ui.Say(treeSpacer + "verify the SHA-256 digest of each uploaded file on the guest")
+	}
+	if p.config.Ephemeral {
+		ui.Say(treeSpacer + "record the uploaded files in the ephemeral manifest")
+	}
+}
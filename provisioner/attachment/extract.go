@@ -0,0 +1,172 @@
+package attachment
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Default limits guarding against archive bombs
+const (
+	defaultExtractMaxSize = 100 * 1024 * 1024
+	extractMaxFiles       = 10000
+)
+
+// A regular file extracted from an archive attachment
+type archiveFile struct {
+	path     string
+	mode     os.FileMode
+	contents []byte
+}
+
+// Tracks the extracted size and file count against the limits
+type extractLimits struct {
+	maxSize int64
+	size    int64
+	files   int
+}
+
+// Extracts a zip, tar or gzip compressed tar archive in memory
+func extractArchive(data []byte, maxSize int64) ([]archiveFile, error) {
+	limits := &extractLimits{maxSize: maxSize}
+	switch {
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")) || bytes.HasPrefix(data, []byte("PK\x05\x06")):
+		return extractZip(data, limits)
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return extractTar(reader, limits)
+	case len(data) > 262 && string(data[257:262]) == "ustar":
+		return extractTar(bytes.NewReader(data), limits)
+	default:
+		return nil, fmt.Errorf("Attachment is not a zip, tar or tar.gz archive")
+	}
+}
+
+func extractZip(data []byte, limits *extractLimits) ([]archiveFile, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	files := []archiveFile{}
+	for _, file := range archive.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		if !file.Mode().IsRegular() {
+			return nil, fmt.Errorf("Archive member \"%s\" is not a regular file", file.Name)
+		}
+		filePath, err := cleanArchivePath(file.Name)
+		if err != nil {
+			return nil, err
+		}
+		reader, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		contents, err := limits.read(file.Name, reader)
+		reader.Close()
+		if err != nil {
+			return nil, err
+		}
+		mode := file.Mode().Perm()
+		if mode == 0 {
+			// archives created on windows carry no unix permissions
+			mode = 0644
+		}
+		files = append(files, archiveFile{path: filePath, mode: mode, contents: contents})
+	}
+	return files, nil
+}
+
+func extractTar(reader io.Reader, limits *extractLimits) ([]archiveFile, error) {
+	archive := tar.NewReader(reader)
+	files := []archiveFile{}
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir, tar.TypeXGlobalHeader:
+			continue
+		case tar.TypeReg, tar.TypeRegA:
+		default:
+			return nil, fmt.Errorf("Archive member \"%s\" is not a regular file", header.Name)
+		}
+		filePath, err := cleanArchivePath(header.Name)
+		if err != nil {
+			return nil, err
+		}
+		contents, err := limits.read(header.Name, archive)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, archiveFile{path: filePath, mode: os.FileMode(header.Mode).Perm(), contents: contents})
+	}
+	return files, nil
+}
+
+// Reads an archive member while enforcing the size and file count limits on the actual bytes read
+func (l *extractLimits) read(name string, reader io.Reader) ([]byte, error) {
+	l.files++
+	if l.files > extractMaxFiles {
+		return nil, fmt.Errorf("Archive contains more than %d files", extractMaxFiles)
+	}
+	contents, err := ioutil.ReadAll(io.LimitReader(reader, l.maxSize-l.size+1))
+	if err != nil {
+		return nil, err
+	}
+	l.size += int64(len(contents))
+	if l.size > l.maxSize {
+		return nil, fmt.Errorf("Archive extracts to more than the extract_max_size of %d bytes at \"%s\"", l.maxSize, name)
+	}
+	return contents, nil
+}
+
+// Rejects absolute paths, paths escaping the destination directory and paths naming the directory itself
+func cleanArchivePath(name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(name, "/") || (len(name) > 1 && name[1] == ':') {
+		return "", fmt.Errorf("Archive member \"%s\" has an absolute path", name)
+	}
+	cleaned := path.Clean(name)
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("Archive member \"%s\" escapes the destination directory", name)
+	}
+	// such as "./" or "a/..", which would be uploaded over the destination directory
+	if cleaned == "." {
+		return "", fmt.Errorf("Archive member \"%s\" has no file name", name)
+	}
+	return cleaned, nil
+}
+
+// Returns the sorted unique parent directories of the extracted files
+func archiveDirs(files []archiveFile) []string {
+	dirSet := map[string]bool{}
+	for _, file := range files {
+		for dir := path.Dir(file.path); dir != "."; dir = path.Dir(dir) {
+			dirSet[dir] = true
+		}
+	}
+	dirs := []string{}
+	for dir := range dirSet {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
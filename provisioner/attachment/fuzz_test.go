@@ -0,0 +1,71 @@
+//go:build go1.18
+// +build go1.18
+
+package attachment
+
+import (
+	"io"
+	"log"
+	"testing"
+
+	"packer-plugin-keepass/common"
+	"packer-plugin-keepass/testharness"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+// Database with titles and file names which make attachment paths ambiguous
+func fuzzTestDatabase() *gokeepasslib.Database {
+	db := testharness.NewDatabase()
+	db.Entry("/example/Sample Entry", "Password", "Password").Attach("id_rsa", []byte("key"))
+	db.Entry("/example/a-b").Attach("c", []byte("first"))
+	db.Entry("/example/a").Attach("b-c", []byte("second"))
+	db.Entry("/example/x-slash-y").Attach("z", []byte("slash"))
+	db.Entry("/example/x/y")
+	built := db.Build()
+	// titles may contain slashes, the entry shares its path with the one of the group x
+	for i, entry := range built.Content.Root.Groups[0].Entries {
+		if entry.GetTitle() == "x-slash-y" {
+			built.Content.Root.Groups[0].Entries[i].Values[0].Value.Content = "x/y"
+		}
+	}
+	return built
+}
+
+// Run with: go test ./provisioner/attachment -fuzz FuzzSplitAttachmentPath
+func FuzzSplitAttachmentPath(f *testing.F) {
+	for _, attachmentPath := range []string{"/example/Sample Entry-id_rsa", "/example/a-b-c", "/example/x/y-z", "/example/x/y-new", "/example/new-file", "/new/entry-file", "-", "/example/-"} {
+		f.Add(attachmentPath)
+	}
+	log.SetOutput(io.Discard)
+	f.Fuzz(func(t *testing.T, attachmentPath string) {
+		db := fuzzTestDatabase()
+		entryPath, name, err := splitAttachmentPath(db, attachmentPath)
+		if err != nil {
+			return
+		}
+		if entryPath+"-"+name != attachmentPath {
+			t.Fatalf("%q split into %q and %q", attachmentPath, entryPath, name)
+		}
+		if _, _, err := common.SetAttachment(db, entryPath, name, []byte("written")); err != nil {
+			return
+		}
+		// the written attachment is found by the path it was downloaded to
+		attachmentsMap, entryMap := common.AttachmentPaths(db)
+		attachment, keyExists := attachmentsMap[attachmentPath]
+		if !keyExists {
+			t.Fatalf("%q is not an attachment path after writing to entry %q file %q", attachmentPath, entryPath, name)
+		}
+		contents, err := common.ReadAttachment(db, attachment)
+		if err != nil || string(contents) != "written" {
+			t.Fatalf("%q resolves to %q instead of the written attachment, %v", attachmentPath, contents, err)
+		}
+		found := false
+		for _, reference := range common.AttachmentEntry(entryMap, attachmentPath, attachment).Binaries {
+			found = found || (reference.Name == name && reference.Value.ID == attachment.Value.ID)
+		}
+		if !found {
+			t.Fatalf("%q does not resolve to the entry holding the attachment", attachmentPath)
+		}
+	})
+}
@@ -0,0 +1,134 @@
+package attachment
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"packer-plugin-keepass/common"
+	attachmentDatasource "packer-plugin-keepass/datasource/attachment"
+	"packer-plugin-keepass/datasource/credentials"
+	"packer-plugin-keepass/seed"
+	"packer-plugin-keepass/testharness"
+
+	"github.com/tobischo/gokeepasslib/v3"
+	"gopkg.in/yaml.v2"
+)
+
+// Pieces of the names of the random databases, chosen to make map keys ambiguous
+var propertyTestNames = []string{"a", "b", "-", "/", " ", "é", "x-y", "Password", "1"}
+
+func propertyTestName(r *rand.Rand) string {
+	name := ""
+	for i := 0; i < 1+r.Intn(3); i++ {
+		name += propertyTestNames[r.Intn(len(propertyTestNames))]
+	}
+	return name
+}
+
+// Writes a random database of groups, entries and attachments with odd names
+func propertyTestDatabase(t *testing.T, r *rand.Rand) string {
+	spec := seed.Spec{Version: "3.1", Password: testharness.Password, KDF: seed.KDF{Rounds: 1}}
+	var group func(level int) seed.Group
+	group = func(level int) seed.Group {
+		built := seed.Group{Name: propertyTestName(r), UUID: fmt.Sprintf("%032x", r.Uint64())}
+		for i := 0; i < r.Intn(4); i++ {
+			entry := seed.Entry{Title: propertyTestName(r), UUID: fmt.Sprintf("%016x%016x", r.Uint64(), r.Uint64())}
+			entry.Fields = append(entry.Fields, yaml.MapItem{Key: propertyTestName(r), Value: propertyTestName(r)})
+			for j := 0; j < r.Intn(3); j++ {
+				entry.Attachments = append(entry.Attachments, seed.Attachment{Name: propertyTestName(r), Content: propertyTestName(r)})
+			}
+			built.Entries = append(built.Entries, entry)
+		}
+		for i := 0; level < 3 && i < r.Intn(3); i++ {
+			built.Groups = append(built.Groups, group(level+1))
+		}
+		return built
+	}
+	spec.Groups = []seed.Group{group(0)}
+	keepassFile := filepath.Join(t.TempDir(), "property.kdbx")
+	if err := spec.Write("", keepassFile); err != nil {
+		t.Fatal(err)
+	}
+	return keepassFile
+}
+
+// Every key of the credentials data source names an entry found by the attachment provisioner, and every
+// attachment found by the attachment provisioner is uploaded with the contents of the attachment data source
+func TestPropertyDatasourceKeysResolve(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 25; i++ {
+		keepassFile := propertyTestDatabase(t, r)
+		config := map[string]interface{}{"keepass_file": keepassFile, "keepass_password": testharness.Password}
+		db, _, err := common.OpenDatabase(keepassFile, testharness.Password, "", false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		attachmentsMap, entryMap := common.AttachmentPaths(db)
+
+		var datasource credentials.Datasource
+		if err := datasource.Configure(config); err != nil {
+			t.Fatal(err)
+		}
+		output, err := datasource.Execute()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, value := range output.GetAttr("map").AsValueMap() {
+			if !propertyTestResolves(db, entryMap, key, value.AsString()) {
+				t.Errorf("database %d: key %q is not the value of an entry found by the attachment provisioner", i, key)
+			}
+		}
+
+		for attachmentPath := range attachmentsMap {
+			var attachment attachmentDatasource.Datasource
+			if err := attachment.Configure(config, map[string]interface{}{"attachment_path": attachmentPath}); err != nil {
+				t.Fatal(err)
+			}
+			output, err := attachment.Execute()
+			if err != nil {
+				t.Fatalf("database %d: %q: %s", i, attachmentPath, err)
+			}
+			var p Provisioner
+			if err := p.Prepare(config, map[string]interface{}{"attachment_path": attachmentPath, "destination": "/tmp/attachment"}); err != nil {
+				t.Fatal(err)
+			}
+			communicator := &testharness.Communicator{}
+			if err := p.Provision(context.Background(), &testharness.Ui{}, communicator, nil); err != nil {
+				t.Fatalf("database %d: %q: %s", i, attachmentPath, err)
+			}
+			if len(communicator.Uploads) != 1 || string(communicator.Uploads[0].Data) != output.GetAttr("content").AsString() {
+				t.Errorf("database %d: %q uploads differ from the data source contents:\n%s", i, attachmentPath, communicator.Plan())
+			}
+		}
+	}
+}
+
+// Checks whether the key is an entry path or uuid key of the entry map followed by a field of the entry with the value
+func propertyTestResolves(db *gokeepasslib.Database, entryMap map[string]gokeepasslib.Entry, key string, value string) bool {
+	for separator := strings.Index(key, "-"); separator >= 0; separator = nextIndex(key, "-", separator) {
+		entry, keyExists := entryMap[key[:separator]]
+		if !keyExists {
+			continue
+		}
+		field := key[separator+1:]
+		if field == "Tags" && entry.Tags == value {
+			return true
+		}
+		if revealed, err := common.RevealField(db, entry, field); err == nil && string(revealed) == value {
+			return true
+		}
+	}
+	return false
+}
+
+func nextIndex(s string, substr string, previous int) int {
+	next := strings.Index(s[previous+1:], substr)
+	if next < 0 {
+		return -1
+	}
+	return previous + 1 + next
+}
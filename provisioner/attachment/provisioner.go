@@ -3,14 +3,17 @@
 package attachment
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"packer-plugin-keepass/common"
 
 	"github.com/hashicorp/hcl/v2/hcldec"
+	packercommon "github.com/hashicorp/packer-plugin-sdk/common"
 	"github.com/hashicorp/packer-plugin-sdk/packer"
 	"github.com/hashicorp/packer-plugin-sdk/template/config"
 	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
@@ -18,16 +21,51 @@ import (
 )
 
 type Config struct {
-	KeepassFile     string `mapstructure:"keepass_file" required:"true"`
-	KeepassPassword string `mapstructure:"keepass_password" required:"true"`
-	AttachmentPath  string `mapstructure:"attachment_path" required:"true"`
-	Destination     string `mapstructure:"destination" required:"true"`
+	packercommon.PackerConfig `mapstructure:",squash"`
+
+	KeepassFile            string   `mapstructure:"keepass_file" required:"true"`
+	KeepassPassword        string   `mapstructure:"keepass_password" required:"true"`
+	KeepassFormat          string   `mapstructure:"keepass_format"`
+	AllowPlaintext         bool     `mapstructure:"allow_plaintext"`
+	KeeShareTrustedSigners []string `mapstructure:"keeshare_trusted_signers"`
+	AttachmentPath         string   `mapstructure:"attachment_path" required:"true"`
+	Destination            string   `mapstructure:"destination" required:"true"`
+	AsOf                   string   `mapstructure:"as_of"`
+	MinCertValidity        string   `mapstructure:"min_cert_validity"`
+	Convert                string   `mapstructure:"convert"`
+	PasswordField          string   `mapstructure:"password_field"`
+	Extract                bool     `mapstructure:"extract"`
+	ExtractMaxSize         int64    `mapstructure:"extract_max_size"`
+	Verify                 bool     `mapstructure:"verify"`
+	Ephemeral              bool     `mapstructure:"ephemeral"`
+	EphemeralManifest      string   `mapstructure:"ephemeral_manifest"`
+	DryRun                 bool     `mapstructure:"dry_run"`
+	GuestOSType            string   `mapstructure:"guest_os_type"`
+	Direction              string   `mapstructure:"direction"`
+	Source                 string   `mapstructure:"source"`
+	MaskMinLength          int      `mapstructure:"mask_min_length"`
+	UnmaskedFields         []string `mapstructure:"unmasked_fields"`
+	AuditLog               string   `mapstructure:"audit_log"`
+	PolicyFile             string   `mapstructure:"policy_file"`
+	PolicyTemplate         string   `mapstructure:"policy_template"`
 
 	ctx interpolate.Context
 }
 
 type Provisioner struct {
-	config Config
+	config          Config
+	minCertValidity time.Duration
+	policyFile      string
+	auditLogPath    string
+	uploaded        []uploadedFile
+	masker          *common.SecretMasker
+	auditLog        *common.AuditLog
+}
+
+// A file uploaded to the guest and the SHA-256 digest of its contents
+type uploadedFile struct {
+	path   string
+	sha256 string
 }
 
 func (p *Provisioner) ConfigSpec() hcldec.ObjectSpec {
@@ -47,7 +85,7 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 
 var treeSpacer = "    "
 
-func (p *Provisioner) Provision(_ context.Context, ui packer.Ui, communicator packer.Communicator, generatedData map[string]interface{}) error {
+func (p *Provisioner) Provision(ctx context.Context, ui packer.Ui, communicator packer.Communicator, generatedData map[string]interface{}) (err error) {
 	keepassFile, err := interpolate.Render(p.config.KeepassFile, &p.config.ctx)
 	if err != nil {
 		return fmt.Errorf("Error interpolating keepass_file: %s", err)
@@ -56,6 +94,10 @@ func (p *Provisioner) Provision(_ context.Context, ui packer.Ui, communicator pa
 	if err != nil {
 		return fmt.Errorf("Error interpolating keepass_password: %s", err)
 	}
+	keepassFormat, err := interpolate.Render(p.config.KeepassFormat, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating keepass_format: %s", err)
+	}
 	attachmentPath, err := interpolate.Render(p.config.AttachmentPath, &p.config.ctx)
 	if err != nil {
 		return fmt.Errorf("Error interpolating attachment_path: %s", err)
@@ -64,56 +106,189 @@ func (p *Provisioner) Provision(_ context.Context, ui packer.Ui, communicator pa
 	if err != nil {
 		return fmt.Errorf("Error interpolating destination: %s", err)
 	}
+	source, err := interpolate.Render(p.config.Source, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating source: %s", err)
+	}
 	// check that the keepass_file and keepass_password config have been provided
-	if errs := common.CheckConfig(keepassFile, keepassPassword); errs != nil {
+	if errs := common.CheckConfig(keepassFile, keepassPassword, keepassFormat, p.config.AllowPlaintext); errs != nil {
 		return errs
 	}
+	p.auditLogPath, err = interpolate.Render(p.config.AuditLog, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating audit_log: %s", err)
+	}
+	p.policyFile, err = interpolate.Render(p.config.PolicyFile, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating policy_file: %s", err)
+	}
+	// the audit log is created once the database is opened, record the attachments read before a
+	// failing step as well
+	p.auditLog = nil
+	defer func() { p.auditLog.FlushOnReturn(&err) }()
+	// redact the contents of attachments from the output of this provisioner
+	p.masker = common.NewSecretMasker(p.config.MaskMinLength, p.config.UnmaskedFields)
+	ui = p.masker.Ui(ui)
+	p.masker.Mask(keepassPassword)
+	if p.config.Direction != "" && p.config.Direction != "upload" && p.config.Direction != "download" {
+		return fmt.Errorf("Unsupported `direction` \"%s\", must be \"upload\" or \"download\".", p.config.Direction)
+	}
+	minCertValidity, err := interpolate.Render(p.config.MinCertValidity, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating min_cert_validity: %s", err)
+	}
+	p.minCertValidity = 0
+	if minCertValidity != "" {
+		p.minCertValidity, err = time.ParseDuration(minCertValidity)
+		if err != nil {
+			return fmt.Errorf("Invalid duration in `min_cert_validity`: %s", minCertValidity)
+		}
+	}
+	if p.config.Direction == "download" {
+		if errs := checkDownloadConfig(attachmentPath, source); errs != nil {
+			return errs
+		}
+		if p.config.Convert != "" || p.config.Extract || p.config.AsOf != "" || p.config.Verify || p.config.Ephemeral || p.config.DryRun {
+			return fmt.Errorf("The `convert`, `extract`, `as_of`, `verify`, `ephemeral` and `dry_run` options cannot be used with `direction = \"download\"`.")
+		}
+		return p.Download(ui, communicator, keepassFile, keepassPassword, attachmentPath, source)
+	}
 	// check that the attachment_path and destination config have been provided
 	if errs := checkAttachmentConfig(attachmentPath, destination); errs != nil {
 		return errs
 	}
-	db, err := common.OpenDatabase(keepassFile, keepassPassword)
+	if p.config.Convert != "" && p.config.Convert != "pem" {
+		return fmt.Errorf("Unsupported `convert` format \"%s\", only \"pem\" is supported.", p.config.Convert)
+	}
+	if p.config.Extract && p.config.Convert != "" {
+		return fmt.Errorf("The `extract` and `convert` options cannot be combined.")
+	}
+	if p.config.GuestOSType != "" && p.config.GuestOSType != "unix" && p.config.GuestOSType != "windows" {
+		return fmt.Errorf("Unsupported `guest_os_type` \"%s\", must be \"unix\" or \"windows\".", p.config.GuestOSType)
+	}
+	asOf, err := interpolate.Render(p.config.AsOf, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating as_of: %s", err)
+	}
+	db, databaseSha256, err := common.OpenDatabase(keepassFile, keepassPassword, keepassFormat, p.config.AllowPlaintext, p.config.KeeShareTrustedSigners)
+	if err != nil {
+		return err
+	}
+	p.auditLog, err = common.NewAuditLog(p.auditLogPath, keepassFile, databaseSha256, "provisioner.keepass-attachment", p.config.PackerBuildName)
+	if err != nil {
+		return err
+	}
+	// reconstruct the database as it was at the as_of time
+	truncated, err := common.ApplyAsOf(db, asOf)
+	if err != nil {
+		return err
+	}
+	for _, entryPath := range truncated {
+		ui.Say(common.TruncatedHistoryWarning(db, entryPath, asOf))
+	}
+	policy, err := common.ApplyPolicy(db, p.policyFile, p.config.PolicyTemplate, p.config.PackerBuildName)
 	if err != nil {
 		return err
 	}
 	// generate map of file attachments
-	attachmentsMap := map[string]gokeepasslib.BinaryReference{}
-	entryMap := map[string]gokeepasslib.Entry{}
-	entryCallback := func(entryPath string, entry gokeepasslib.Entry, depth int) {
-		entryMap[entryPath] = entry
-		for _, attachment := range entry.Binaries {
-			entryAttachmentPath := fmt.Sprintf("%s-%s", entryPath, attachment.Name)
-			attachmentsMap[entryAttachmentPath] = attachment
+	attachmentsMap, entryMap := common.AttachmentPaths(db)
+	if _, keyExists := attachmentsMap[attachmentPath]; !keyExists {
+		if _, keyExists := entryMap[attachmentPath]; !keyExists {
+			if err := policy.CheckPath(attachmentPath); err != nil {
+				return err
+			}
+		}
+	}
+	p.uploaded = nil
+	if p.config.DryRun {
+		// the attachments are read and converted as for an upload, but the guest is never contacted
+		ui.Say("Dry run, nothing is uploaded to the guest")
+		planned := &dryRunCommunicator{}
+		if err := p.upload(ctx, ui, planned, db, attachmentPath, destination, attachmentsMap, entryMap); err != nil {
+			return err
+		}
+		p.printDryRun(ui, planned)
+		return nil
+	}
+	if err := p.upload(ctx, ui, communicator, db, attachmentPath, destination, attachmentsMap, entryMap); err != nil {
+		return err
+	}
+	if p.config.Verify {
+		if err := p.verifyUploads(ctx, ui, communicator); err != nil {
+			return err
 		}
 	}
-	common.WalkDatabase(db, nil, entryCallback)
+	if p.config.Ephemeral {
+		if err := p.recordEphemeral(ctx, ui, communicator); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Upload the attachment path according to the conversion options
+func (p *Provisioner) upload(ctx context.Context, ui packer.Ui, communicator packer.Communicator, db *gokeepasslib.Database, attachmentPath string, destination string, attachmentsMap map[string]gokeepasslib.BinaryReference, entryMap map[string]gokeepasslib.Entry) error {
+	if p.config.Convert == "pem" {
+		attachment, keyExists := attachmentsMap[attachmentPath]
+		if !keyExists {
+			return fmt.Errorf("File attachment \"%s\" does not exist, `convert` requires a single file attachment.", attachmentPath)
+		}
+		entry := common.AttachmentEntry(entryMap, attachmentPath, attachment)
+		if err := p.UploadConvertedAttachment(ui, communicator, db, entry, attachment, destination); err != nil {
+			return err
+		}
+		p.auditLog.Read(db, entry, p.passwordField(), attachment.Name)
+		return nil
+	}
+	if p.config.Extract {
+		attachment, keyExists := attachmentsMap[attachmentPath]
+		if !keyExists {
+			return fmt.Errorf("File attachment \"%s\" does not exist, `extract` requires a single file attachment.", attachmentPath)
+		}
+		if err := p.UploadExtractedAttachment(ctx, ui, communicator, db, attachment, destination); err != nil {
+			return err
+		}
+		p.auditLog.Read(db, common.AttachmentEntry(entryMap, attachmentPath, attachment), "", attachment.Name)
+		return nil
+	}
 	if _, keyExists := attachmentsMap[attachmentPath]; keyExists {
 		// if the specified attachmentPath is in the attachmentsMap, upload the attachment
 		attachment := attachmentsMap[attachmentPath]
 		// if the destination is a directory, append with the attachment file name
-		if strings.HasSuffix(p.config.Destination, "/") {
-			p.config.Destination = p.config.Destination + attachment.Name
+		if strings.HasSuffix(destination, "/") {
+			destination = destination + attachment.Name
+		}
+		if err := p.UploadAttachment(ui, communicator, db, attachment, destination); err != nil {
+			return err
 		}
-		return p.UploadAttachment(ui, communicator, db, attachment)
+		p.auditLog.Read(db, common.AttachmentEntry(entryMap, attachmentPath, attachment), "", attachment.Name)
+		return nil
 	} else if _, keyExists := entryMap[attachmentPath]; keyExists {
 		// if the specified attachmentPath is an entry root path, upload all attachments within
 		entry := entryMap[attachmentPath]
 		attachmentsCount := len(entry.Binaries)
 		ui.Say(fmt.Sprintf("Uploading %d attachments from entry %s", attachmentsCount, attachmentPath))
-		return p.UploadAttachments(ui, communicator, db, entry.Binaries)
+		if err := p.UploadAttachments(ui, communicator, db, entry.Binaries, destination); err != nil {
+			return err
+		}
+		for _, attachment := range entry.Binaries {
+			p.auditLog.Read(db, entry, "", attachment.Name)
+		}
+		return nil
 	} else {
 		return fmt.Errorf("File attachment \"%s\" does not exist.", attachmentPath)
 	}
 }
 
 // Upload a single file attachment to the destination path using a temp file
-func (p *Provisioner) UploadAttachment(ui packer.Ui, communicator packer.Communicator, db *gokeepasslib.Database, attachment gokeepasslib.BinaryReference) error {
-	// retrieve the attachment object
-	attachmentBinary := attachment.Find(db)
-	if attachmentBinary == nil {
-		return fmt.Errorf("Could not find attachment binary for file: %s", attachment.Name)
+func (p *Provisioner) UploadAttachment(ui packer.Ui, communicator packer.Communicator, db *gokeepasslib.Database, attachment gokeepasslib.BinaryReference, destination string) error {
+	// retrieve a copy of the attachment contents, cleared once uploaded
+	attachmentBytes, err := common.ReadAttachment(db, attachment)
+	if err != nil {
+		return err
 	}
-	ui.Say(fmt.Sprintf("Uploading %s => %s", attachment.Name, p.config.Destination))
+	defer common.ZeroBytes(attachmentBytes)
+	ui.Say(fmt.Sprintf("Uploading %s => %s", attachment.Name, destination))
 	// create temp file for the attachment contents
 	attachmentTempFile, err := os.CreateTemp(os.TempDir(), "keepass-attachment")
 	if err != nil {
@@ -121,32 +296,33 @@ func (p *Provisioner) UploadAttachment(ui packer.Ui, communicator packer.Communi
 	}
 	defer attachmentTempFile.Close()
 	defer os.Remove(attachmentTempFile.Name())
-	attachmentBytes, err := attachmentBinary.GetContentBytes()
+	p.masker.MaskAttachment(attachmentBytes)
+	if err := p.checkCertificates(attachment.Name, attachmentBytes); err != nil {
+		ui.Error(fmt.Sprintf("Upload failed: %s", err))
+		return err
+	}
+	// write attachment bytes to temp file and seek back to start for reading
+	attachmentTempFile.Write(attachmentBytes)
+	attachmentTempFile.Seek(0, 0)
+	attachmentTempFileInfo, err := attachmentTempFile.Stat()
 	if err != nil {
 		return err
-	} else {
-		// write attachment bytes to temp file and seek back to start for reading
-		attachmentTempFile.Write(attachmentBytes)
-		attachmentTempFile.Seek(0, 0)
-		attachmentTempFileInfo, err := attachmentTempFile.Stat()
-		if err != nil {
-			return err
-		}
-		attachmentTempFileReader := ui.TrackProgress(attachment.Name, 0, attachmentTempFileInfo.Size(), attachmentTempFile)
-		defer attachmentTempFileReader.Close()
-		if err = communicator.Upload(p.config.Destination, attachmentTempFileReader, &attachmentTempFileInfo); err != nil {
-			if strings.Contains(err.Error(), "Error restoring file") {
-				ui.Error(fmt.Sprintf("Upload failed: %s; this can occur when your file destination is a folder without a trailing slash.", err))
-			}
-			ui.Error(fmt.Sprintf("Upload failed: %s", err))
-			return err
+	}
+	attachmentTempFileReader := ui.TrackProgress(attachment.Name, 0, attachmentTempFileInfo.Size(), attachmentTempFile)
+	defer attachmentTempFileReader.Close()
+	if err = communicator.Upload(destination, attachmentTempFileReader, &attachmentTempFileInfo); err != nil {
+		if strings.Contains(err.Error(), "Error restoring file") {
+			ui.Error(fmt.Sprintf("Upload failed: %s; this can occur when your file destination is a folder without a trailing slash.", err))
 		}
-		return nil
+		ui.Error(fmt.Sprintf("Upload failed: %s", err))
+		return err
 	}
+	p.recordUpload(destination, attachmentBytes)
+	return nil
 }
 
 // Upload entry file attachment(s) to the destination path using a temp dir
-func (p *Provisioner) UploadAttachments(ui packer.Ui, communicator packer.Communicator, db *gokeepasslib.Database, attachments []gokeepasslib.BinaryReference) error {
+func (p *Provisioner) UploadAttachments(ui packer.Ui, communicator packer.Communicator, db *gokeepasslib.Database, attachments []gokeepasslib.BinaryReference, destination string) error {
 	// create temp dir to hold file attachments
 	attachmentsTempDir, err := os.MkdirTemp(os.TempDir(), "keepass-attachments")
 	if err != nil {
@@ -155,8 +331,7 @@ func (p *Provisioner) UploadAttachments(ui packer.Ui, communicator packer.Commun
 	// write each file attachment as a temp file
 	for _, attachment := range attachments {
 		// retrieve the attachment object
-		attachmentBinary := attachment.Find(db)
-		if attachmentBinary == nil {
+		if attachment.Find(db) == nil {
 			ui.Error(fmt.Sprintf("[WARNING] Could not find attachment binary for file: %s, skipping", attachment.Name))
 			continue
 		}
@@ -166,25 +341,169 @@ func (p *Provisioner) UploadAttachments(ui packer.Ui, communicator packer.Commun
 			return err
 		}
 		// write attachment contents to temp file
-		attachmentBytes, err := attachmentBinary.GetContentBytes()
+		attachmentBytes, err := common.ReadAttachment(db, attachment)
 		if err != nil {
 			return err
 		} else {
+			p.masker.MaskAttachment(attachmentBytes)
+			if err := p.checkCertificates(attachment.Name, attachmentBytes); err != nil {
+				common.ZeroBytes(attachmentBytes)
+				attachmentFile.Close()
+				os.RemoveAll(attachmentsTempDir)
+				ui.Error(fmt.Sprintf("Upload failed: %s", err))
+				return err
+			}
 			_, err := attachmentFile.Write(attachmentBytes)
 			if err != nil {
+				common.ZeroBytes(attachmentBytes)
 				return err
 			}
 		}
 		attachmentFile.Close()
 		ui.Say(fmt.Sprintf("File: %s", attachment.Name))
+		p.recordUpload(strings.TrimSuffix(destination, "/")+"/"+attachment.Name, attachmentBytes)
+		common.ZeroBytes(attachmentBytes)
 	}
 	// upload dir
-	err = communicator.UploadDir(p.config.Destination, attachmentsTempDir+"/", nil)
+	err = communicator.UploadDir(destination, attachmentsTempDir+"/", nil)
 	// cleanup temp dir and contents
 	os.RemoveAll(attachmentsTempDir)
+	if err != nil {
+		p.uploaded = nil
+	}
 	return err
 }
 
+// Convert a pkcs#12 file attachment and upload the pem files to the destination directory
+func (p *Provisioner) UploadConvertedAttachment(ui packer.Ui, communicator packer.Communicator, db *gokeepasslib.Database, entry gokeepasslib.Entry, attachment gokeepasslib.BinaryReference, destination string) error {
+	attachmentBytes, err := common.ReadAttachment(db, attachment)
+	if err != nil {
+		return err
+	}
+	defer common.ZeroBytes(attachmentBytes)
+	// only the password value is decrypted, the other values of the entry stay protected
+	password, err := common.RevealField(db, entry, p.passwordField())
+	if err != nil {
+		return err
+	}
+	defer common.ZeroBytes(password)
+	p.masker.MaskField(p.passwordField(), string(password))
+	pemBytes, err := convertPKCS12ToPEM(attachmentBytes, string(password))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, pemFile := range pemFiles {
+			common.ZeroBytes(pemBytes[pemFile.name])
+		}
+	}()
+	for _, pemFile := range pemFiles {
+		p.masker.MaskAttachment(pemBytes[pemFile.name])
+	}
+	if err := p.checkCertificates(attachment.Name, bytes.Join([][]byte{pemBytes["cert.pem"], pemBytes["chain.pem"], pemBytes["key.pem"]}, nil)); err != nil {
+		ui.Error(fmt.Sprintf("Upload failed: %s", err))
+		return err
+	}
+	if !strings.HasSuffix(destination, "/") {
+		destination = destination + "/"
+	}
+	for _, pemFile := range pemFiles {
+		ui.Say(fmt.Sprintf("Uploading %s (%s) => %s%s", attachment.Name, pemFile.name, destination, pemFile.name))
+		if err := common.UploadBytes(communicator, destination+pemFile.name, pemBytes[pemFile.name], os.FileMode(pemFile.mode)); err != nil {
+			ui.Error(fmt.Sprintf("Upload failed: %s", err))
+			return err
+		}
+		p.recordUpload(destination+pemFile.name, pemBytes[pemFile.name])
+	}
+	return nil
+}
+
+// Extract an archive file attachment in memory and upload its files to the destination directory
+func (p *Provisioner) UploadExtractedAttachment(ctx context.Context, ui packer.Ui, communicator packer.Communicator, db *gokeepasslib.Database, attachment gokeepasslib.BinaryReference, destination string) error {
+	attachmentBytes, err := common.ReadAttachment(db, attachment)
+	if err != nil {
+		return err
+	}
+	defer common.ZeroBytes(attachmentBytes)
+	maxSize := p.config.ExtractMaxSize
+	if maxSize <= 0 {
+		maxSize = defaultExtractMaxSize
+	}
+	files, err := extractArchive(attachmentBytes, maxSize)
+	if err != nil {
+		return fmt.Errorf("Unable to extract %s: %s", attachment.Name, err)
+	}
+	defer func() {
+		for _, file := range files {
+			common.ZeroBytes(file.contents)
+		}
+	}()
+	if !strings.HasSuffix(destination, "/") {
+		destination = destination + "/"
+	}
+	ui.Say(fmt.Sprintf("Extracting %d files from %s => %s", len(files), attachment.Name, destination))
+	// create the destination directory tree before uploading the files into it
+	dirs := []string{destination}
+	for _, dir := range archiveDirs(files) {
+		dirs = append(dirs, destination+dir)
+	}
+	if err := common.RunCommand(ctx, ui, communicator, p.mkdirCommand(dirs)); err != nil {
+		return err
+	}
+	for _, file := range files {
+		p.masker.MaskAttachment(file.contents)
+		if err := p.checkCertificates(file.path, file.contents); err != nil {
+			ui.Error(fmt.Sprintf("Upload failed: %s", err))
+			return err
+		}
+		ui.Say(fmt.Sprintf("File: %s (%04o)", file.path, file.mode))
+		if err := common.UploadBytes(communicator, destination+file.path, file.contents, file.mode); err != nil {
+			ui.Error(fmt.Sprintf("Upload failed: %s", err))
+			return err
+		}
+		p.recordUpload(destination+file.path, file.contents)
+	}
+	return nil
+}
+
+// Command creating the directories and their parents on the guest, existing directories are kept
+func (p *Provisioner) mkdirCommand(dirs []string) string {
+	quoted := []string{}
+	if p.config.GuestOSType == "windows" {
+		for _, dir := range dirs {
+			quoted = append(quoted, common.PowershellQuote(dir))
+		}
+		return common.PowershellCommand(fmt.Sprintf("New-Item -ItemType Directory -Force -Path %s | Out-Null", strings.Join(quoted, ",")))
+	}
+	for _, dir := range dirs {
+		quoted = append(quoted, common.ShellQuote(dir))
+	}
+	return "mkdir -p " + strings.Join(quoted, " ")
+}
+
+// Value of the entry holding the pkcs#12 password
+func (p *Provisioner) passwordField() string {
+	if p.config.PasswordField == "" {
+		return "Password"
+	}
+	return p.config.PasswordField
+}
+
+// Check the certificates within an attachment when min_cert_validity is set
+func (p *Provisioner) checkCertificates(name string, attachmentBytes []byte) error {
+	if p.minCertValidity == 0 {
+		return nil
+	}
+	bundle := common.ParseCertificateBundle(attachmentBytes)
+	if bundle == nil {
+		return nil
+	}
+	if err := bundle.Check(p.minCertValidity, time.Now()); err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	return nil
+}
+
 // Check that attachment_path and destination config are provided
 func checkAttachmentConfig(attachmentPath string, destination string) *packer.MultiError {
 	var errs *packer.MultiError
@@ -10,10 +10,39 @@ import (
 // FlatConfig is an auto-generated flat version of Config.
 // Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
 type FlatConfig struct {
-	KeepassFile     *string `mapstructure:"keepass_file" required:"true" cty:"keepass_file" hcl:"keepass_file"`
-	KeepassPassword *string `mapstructure:"keepass_password" required:"true" cty:"keepass_password" hcl:"keepass_password"`
-	AttachmentPath  *string `mapstructure:"attachment_path" required:"true" cty:"attachment_path" hcl:"attachment_path"`
-	Destination     *string `mapstructure:"destination" required:"true" cty:"destination" hcl:"destination"`
+	PackerBuildName        *string           `mapstructure:"packer_build_name" cty:"packer_build_name" hcl:"packer_build_name"`
+	PackerBuilderType      *string           `mapstructure:"packer_builder_type" cty:"packer_builder_type" hcl:"packer_builder_type"`
+	PackerCoreVersion      *string           `mapstructure:"packer_core_version" cty:"packer_core_version" hcl:"packer_core_version"`
+	PackerDebug            *bool             `mapstructure:"packer_debug" cty:"packer_debug" hcl:"packer_debug"`
+	PackerForce            *bool             `mapstructure:"packer_force" cty:"packer_force" hcl:"packer_force"`
+	PackerOnError          *string           `mapstructure:"packer_on_error" cty:"packer_on_error" hcl:"packer_on_error"`
+	PackerUserVars         map[string]string `mapstructure:"packer_user_variables" cty:"packer_user_variables" hcl:"packer_user_variables"`
+	PackerSensitiveVars    []string          `mapstructure:"packer_sensitive_variables" cty:"packer_sensitive_variables" hcl:"packer_sensitive_variables"`
+	KeepassFile            *string           `mapstructure:"keepass_file" required:"true" cty:"keepass_file" hcl:"keepass_file"`
+	KeepassPassword        *string           `mapstructure:"keepass_password" required:"true" cty:"keepass_password" hcl:"keepass_password"`
+	KeepassFormat          *string           `mapstructure:"keepass_format" cty:"keepass_format" hcl:"keepass_format"`
+	AllowPlaintext         *bool             `mapstructure:"allow_plaintext" cty:"allow_plaintext" hcl:"allow_plaintext"`
+	KeeShareTrustedSigners []string          `mapstructure:"keeshare_trusted_signers" cty:"keeshare_trusted_signers" hcl:"keeshare_trusted_signers"`
+	AttachmentPath         *string           `mapstructure:"attachment_path" required:"true" cty:"attachment_path" hcl:"attachment_path"`
+	Destination            *string           `mapstructure:"destination" required:"true" cty:"destination" hcl:"destination"`
+	AsOf                   *string           `mapstructure:"as_of" cty:"as_of" hcl:"as_of"`
+	MinCertValidity        *string           `mapstructure:"min_cert_validity" cty:"min_cert_validity" hcl:"min_cert_validity"`
+	Convert                *string           `mapstructure:"convert" cty:"convert" hcl:"convert"`
+	PasswordField          *string           `mapstructure:"password_field" cty:"password_field" hcl:"password_field"`
+	Extract                *bool             `mapstructure:"extract" cty:"extract" hcl:"extract"`
+	ExtractMaxSize         *int64            `mapstructure:"extract_max_size" cty:"extract_max_size" hcl:"extract_max_size"`
+	Verify                 *bool             `mapstructure:"verify" cty:"verify" hcl:"verify"`
+	Ephemeral              *bool             `mapstructure:"ephemeral" cty:"ephemeral" hcl:"ephemeral"`
+	EphemeralManifest      *string           `mapstructure:"ephemeral_manifest" cty:"ephemeral_manifest" hcl:"ephemeral_manifest"`
+	DryRun                 *bool             `mapstructure:"dry_run" cty:"dry_run" hcl:"dry_run"`
+	GuestOSType            *string           `mapstructure:"guest_os_type" cty:"guest_os_type" hcl:"guest_os_type"`
+	Direction              *string           `mapstructure:"direction" cty:"direction" hcl:"direction"`
+	Source                 *string           `mapstructure:"source" cty:"source" hcl:"source"`
+	MaskMinLength          *int              `mapstructure:"mask_min_length" cty:"mask_min_length" hcl:"mask_min_length"`
+	UnmaskedFields         []string          `mapstructure:"unmasked_fields" cty:"unmasked_fields" hcl:"unmasked_fields"`
+	AuditLog               *string           `mapstructure:"audit_log" cty:"audit_log" hcl:"audit_log"`
+	PolicyFile             *string           `mapstructure:"policy_file" cty:"policy_file" hcl:"policy_file"`
+	PolicyTemplate         *string           `mapstructure:"policy_template" cty:"policy_template" hcl:"policy_template"`
 }
 
 // FlatMapstructure returns a new FlatConfig.
@@ -28,10 +57,39 @@ func (*Config) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec }
 // The decoded values from this spec will then be applied to a FlatConfig.
 func (*FlatConfig) HCL2Spec() map[string]hcldec.Spec {
 	s := map[string]hcldec.Spec{
-		"keepass_file":     &hcldec.AttrSpec{Name: "keepass_file", Type: cty.String, Required: false},
-		"keepass_password": &hcldec.AttrSpec{Name: "keepass_password", Type: cty.String, Required: false},
-		"attachment_path":  &hcldec.AttrSpec{Name: "attachment_path", Type: cty.String, Required: false},
-		"destination":      &hcldec.AttrSpec{Name: "destination", Type: cty.String, Required: false},
+		"packer_build_name":          &hcldec.AttrSpec{Name: "packer_build_name", Type: cty.String, Required: false},
+		"packer_builder_type":        &hcldec.AttrSpec{Name: "packer_builder_type", Type: cty.String, Required: false},
+		"packer_core_version":        &hcldec.AttrSpec{Name: "packer_core_version", Type: cty.String, Required: false},
+		"packer_debug":               &hcldec.AttrSpec{Name: "packer_debug", Type: cty.Bool, Required: false},
+		"packer_force":               &hcldec.AttrSpec{Name: "packer_force", Type: cty.Bool, Required: false},
+		"packer_on_error":            &hcldec.AttrSpec{Name: "packer_on_error", Type: cty.String, Required: false},
+		"packer_user_variables":      &hcldec.AttrSpec{Name: "packer_user_variables", Type: cty.Map(cty.String), Required: false},
+		"packer_sensitive_variables": &hcldec.AttrSpec{Name: "packer_sensitive_variables", Type: cty.List(cty.String), Required: false},
+		"keepass_file":               &hcldec.AttrSpec{Name: "keepass_file", Type: cty.String, Required: false},
+		"keepass_password":           &hcldec.AttrSpec{Name: "keepass_password", Type: cty.String, Required: false},
+		"keepass_format":             &hcldec.AttrSpec{Name: "keepass_format", Type: cty.String, Required: false},
+		"allow_plaintext":            &hcldec.AttrSpec{Name: "allow_plaintext", Type: cty.Bool, Required: false},
+		"keeshare_trusted_signers":   &hcldec.AttrSpec{Name: "keeshare_trusted_signers", Type: cty.List(cty.String), Required: false},
+		"attachment_path":            &hcldec.AttrSpec{Name: "attachment_path", Type: cty.String, Required: false},
+		"destination":                &hcldec.AttrSpec{Name: "destination", Type: cty.String, Required: false},
+		"as_of":                      &hcldec.AttrSpec{Name: "as_of", Type: cty.String, Required: false},
+		"min_cert_validity":          &hcldec.AttrSpec{Name: "min_cert_validity", Type: cty.String, Required: false},
+		"convert":                    &hcldec.AttrSpec{Name: "convert", Type: cty.String, Required: false},
+		"password_field":             &hcldec.AttrSpec{Name: "password_field", Type: cty.String, Required: false},
+		"extract":                    &hcldec.AttrSpec{Name: "extract", Type: cty.Bool, Required: false},
+		"extract_max_size":           &hcldec.AttrSpec{Name: "extract_max_size", Type: cty.Number, Required: false},
+		"verify":                     &hcldec.AttrSpec{Name: "verify", Type: cty.Bool, Required: false},
+		"ephemeral":                  &hcldec.AttrSpec{Name: "ephemeral", Type: cty.Bool, Required: false},
+		"ephemeral_manifest":         &hcldec.AttrSpec{Name: "ephemeral_manifest", Type: cty.String, Required: false},
+		"dry_run":                    &hcldec.AttrSpec{Name: "dry_run", Type: cty.Bool, Required: false},
+		"guest_os_type":              &hcldec.AttrSpec{Name: "guest_os_type", Type: cty.String, Required: false},
+		"direction":                  &hcldec.AttrSpec{Name: "direction", Type: cty.String, Required: false},
+		"source":                     &hcldec.AttrSpec{Name: "source", Type: cty.String, Required: false},
+		"mask_min_length":            &hcldec.AttrSpec{Name: "mask_min_length", Type: cty.Number, Required: false},
+		"unmasked_fields":            &hcldec.AttrSpec{Name: "unmasked_fields", Type: cty.List(cty.String), Required: false},
+		"audit_log":                  &hcldec.AttrSpec{Name: "audit_log", Type: cty.String, Required: false},
+		"policy_file":                &hcldec.AttrSpec{Name: "policy_file", Type: cty.String, Required: false},
+		"policy_template":            &hcldec.AttrSpec{Name: "policy_template", Type: cty.String, Required: false},
 	}
 	return s
 }
@@ -0,0 +1,67 @@
+package attachment
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"packer-plugin-keepass/common"
+
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+)
+
+// Record an uploaded file with the digest of its local contents
+func (p *Provisioner) recordUpload(path string, contents []byte) {
+	digest := sha256.Sum256(contents)
+	p.uploaded = append(p.uploaded, uploadedFile{path: path, sha256: hex.EncodeToString(digest[:])})
+}
+
+// Compute the SHA-256 digest of each uploaded file on the guest and compare it with the local digest
+func (p *Provisioner) verifyUploads(ctx context.Context, ui packer.Ui, communicator packer.Communicator) error {
+	for _, file := range p.uploaded {
+		output, err := common.RunCommandOutput(ctx, communicator, p.checksumCommand(file.path))
+		if err != nil {
+			ui.Error(fmt.Sprintf("Verification failed: %s", err))
+			return err
+		}
+		fields := strings.Fields(output)
+		actual := ""
+		if len(fields) > 0 {
+			actual = strings.ToLower(fields[0])
+		}
+		if actual != file.sha256 {
+			err := fmt.Errorf("Checksum mismatch for %s: expected sha256 %s, got %q", file.path, file.sha256, actual)
+			ui.Error(fmt.Sprintf("Verification failed: %s", err))
+			return err
+		}
+		ui.Say(fmt.Sprintf("Verified %s (sha256 %s)", file.path, file.sha256))
+	}
+	return nil
+}
+
+// Add the uploaded files to the ephemeral manifest on the guest, from which keepass-cleanup removes them
+func (p *Provisioner) recordEphemeral(ctx context.Context, ui packer.Ui, communicator packer.Communicator) error {
+	manifest, err := interpolate.Render(p.config.EphemeralManifest, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating ephemeral_manifest: %s", err)
+	}
+	manifest = common.EphemeralManifest(manifest, p.config.GuestOSType)
+	paths := []string{}
+	for _, file := range p.uploaded {
+		paths = append(paths, file.path)
+	}
+	ui.Say(fmt.Sprintf("Recording %d ephemeral files in %s", len(paths), manifest))
+	return common.RecordEphemeral(ctx, ui, communicator, manifest, p.config.GuestOSType, paths)
+}
+
+// Command printing the SHA-256 digest of a file on the guest
+func (p *Provisioner) checksumCommand(path string) string {
+	if p.config.GuestOSType == "windows" {
+		return common.PowershellCommand(fmt.Sprintf("(Get-FileHash -Algorithm SHA256 -LiteralPath %s).Hash", common.PowershellQuote(path)))
+	}
+	quoted := common.ShellQuote(path)
+	return fmt.Sprintf("sha256sum %s 2>/dev/null || shasum -a 256 %s", quoted, quoted)
+}
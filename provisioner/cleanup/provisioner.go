@@ -0,0 +1,107 @@
+//go:generate packer-sdc mapstructure-to-hcl2 -type Config
+
+package cleanup
+
+import (
+	"context"
+	"fmt"
+
+	"packer-plugin-keepass/common"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+	packercommon "github.com/hashicorp/packer-plugin-sdk/common"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+)
+
+type Config struct {
+	packercommon.PackerConfig `mapstructure:",squash"`
+
+	EphemeralManifest string `mapstructure:"ephemeral_manifest"`
+	GuestOSType       string `mapstructure:"guest_os_type"`
+	Shred             bool   `mapstructure:"shred"`
+
+	ctx interpolate.Context
+}
+
+type Provisioner struct {
+	config Config
+}
+
+func (p *Provisioner) ConfigSpec() hcldec.ObjectSpec {
+	return p.config.FlatMapstructure().HCL2Spec()
+}
+
+func (p *Provisioner) Prepare(raws ...interface{}) error {
+	err := config.Decode(&p.config, &config.DecodeOpts{
+		Interpolate:        true,
+		InterpolateContext: &p.config.ctx,
+	}, raws...)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (p *Provisioner) Provision(ctx context.Context, ui packer.Ui, communicator packer.Communicator, generatedData map[string]interface{}) error {
+	manifest, err := interpolate.Render(p.config.EphemeralManifest, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating ephemeral_manifest: %s", err)
+	}
+	if p.config.GuestOSType != "" && p.config.GuestOSType != "unix" && p.config.GuestOSType != "windows" {
+		return fmt.Errorf("Unsupported `guest_os_type` \"%s\", must be \"unix\" or \"windows\".", p.config.GuestOSType)
+	}
+	manifest = common.EphemeralManifest(manifest, p.config.GuestOSType)
+	paths, err := common.ReadEphemeral(ctx, communicator, manifest, p.config.GuestOSType)
+	if err != nil {
+		ui.Error(fmt.Sprintf("Unable to read the ephemeral manifest %s: %s", manifest, err))
+		return err
+	}
+	if len(paths) == 0 {
+		ui.Say(fmt.Sprintf("No ephemeral files recorded in %s", manifest))
+		return nil
+	}
+	action := "Removing"
+	if p.config.Shred {
+		action = "Shredding"
+	}
+	ui.Say(fmt.Sprintf("%s %d ephemeral files recorded in %s", action, len(paths), manifest))
+	// every file is attempted so that a single failure does not leave the others behind
+	var errs *packer.MultiError
+	for _, path := range paths {
+		if err := common.RunCommand(ctx, ui, communicator, p.removeCommand(path)); err != nil {
+			ui.Error(fmt.Sprintf("Removal failed: %s: %s", path, err))
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("Unable to remove ephemeral file %s: %s", path, err))
+			continue
+		}
+		ui.Say(fmt.Sprintf("Removed %s", path))
+	}
+	if errs != nil {
+		// the manifest is kept so that the cleanup can be retried
+		return errs
+	}
+	if err := common.RunCommand(ctx, ui, communicator, p.removeCommand(manifest)); err != nil {
+		return fmt.Errorf("Unable to remove the ephemeral manifest %s: %s", manifest, err)
+	}
+	return nil
+}
+
+// Command removing a file on the guest, which fails if the file still exists afterwards. A file which
+// no longer exists counts as removed. Shredding overwrites the contents before the file is unlinked.
+func (p *Provisioner) removeCommand(path string) string {
+	if p.config.GuestOSType == "windows" {
+		literalPath := common.PowershellQuote(path)
+		script := fmt.Sprintf("Remove-Item -Force -LiteralPath %[1]s -ErrorAction SilentlyContinue; if (Test-Path -LiteralPath %[1]s) { exit 1 }", literalPath)
+		if p.config.Shred {
+			script = fmt.Sprintf("if (Test-Path -LiteralPath %[1]s -PathType Leaf) { $f = Get-Item -Force -LiteralPath %[1]s; [IO.File]::WriteAllBytes($f.FullName, (New-Object byte[] $f.Length)) }; ", literalPath) + script
+		}
+		return common.PowershellCommand(script)
+	}
+	quoted := common.ShellQuote(path)
+	command := fmt.Sprintf("rm -f -- %[1]s && test ! -e %[1]s", quoted)
+	if p.config.Shred {
+		command = fmt.Sprintf("if [ -f %[1]s ] && [ ! -L %[1]s ]; then shred -z -u -- %[1]s; fi && ", quoted) + command
+	}
+	return command
+}
@@ -0,0 +1,137 @@
+package cleanup
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"packer-plugin-keepass/common"
+	"packer-plugin-keepass/testharness"
+)
+
+// Runs the commands in a local shell, so that the files of the test directory stand in for the guest
+func runLocally(t *testing.T) func(string) (string, int) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+	return func(command string) (string, int) {
+		output, err := exec.Command("sh", "-c", command).Output()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return string(output), exitErr.ExitCode()
+		}
+		return string(output), 0
+	}
+}
+
+func cleanupTestFiles(t *testing.T, dir string, names ...string) []string {
+	paths := []string{}
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("secret"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func TestProvisionCleanup(t *testing.T) {
+	for _, shred := range []bool{false, true} {
+		dir := t.TempDir()
+		manifest := filepath.Join(dir, "manifest")
+		paths := cleanupTestFiles(t, dir, "token", "it's a\nlicense.key")
+		communicator := &testharness.Communicator{Respond: runLocally(t)}
+		ui := &testharness.Ui{}
+		// uploads of two provisioners, the second one uploading a file again
+		if err := common.RecordEphemeral(context.Background(), ui, communicator, manifest, "", paths); err != nil {
+			t.Fatal(err)
+		}
+		if err := common.RecordEphemeral(context.Background(), ui, communicator, manifest, "", paths[:1]); err != nil {
+			t.Fatal(err)
+		}
+		var p Provisioner
+		if err := p.Prepare(map[string]interface{}{"ephemeral_manifest": manifest, "shred": shred}); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Provision(context.Background(), ui, communicator, nil); err != nil {
+			t.Fatalf("shred %t: %s\n%s", shred, err, ui.Output())
+		}
+		for _, path := range append(paths, manifest) {
+			if _, err := os.Lstat(path); !os.IsNotExist(err) {
+				t.Errorf("shred %t: expected %q to be removed, got %v", shred, path, err)
+			}
+		}
+		if count := strings.Count(ui.Output(), "Removed "); count != 2 {
+			t.Errorf("shred %t: expected 2 files to be removed once each:\n%s", shred, ui.Output())
+		}
+	}
+}
+
+func TestProvisionCleanupWithoutManifest(t *testing.T) {
+	var p Provisioner
+	if err := p.Prepare(map[string]interface{}{"ephemeral_manifest": filepath.Join(t.TempDir(), "manifest")}); err != nil {
+		t.Fatal(err)
+	}
+	ui := &testharness.Ui{}
+	if err := p.Provision(context.Background(), ui, &testharness.Communicator{Respond: runLocally(t)}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(ui.Output(), "No ephemeral files recorded") {
+		t.Errorf("unexpected output:\n%s", ui.Output())
+	}
+}
+
+func TestProvisionCleanupFailure(t *testing.T) {
+	dir := t.TempDir()
+	manifest := filepath.Join(dir, "manifest")
+	paths := cleanupTestFiles(t, dir, "kept", "removed")
+	local := runLocally(t)
+	communicator := &testharness.Communicator{Respond: func(command string) (string, int) {
+		// the guest refuses to remove the first file
+		if strings.HasPrefix(command, "rm -f -- "+common.ShellQuote(paths[0])) {
+			return "", 1
+		}
+		return local(command)
+	}}
+	ui := &testharness.Ui{}
+	if err := common.RecordEphemeral(context.Background(), ui, communicator, manifest, "", paths); err != nil {
+		t.Fatal(err)
+	}
+	var p Provisioner
+	if err := p.Prepare(map[string]interface{}{"ephemeral_manifest": manifest}); err != nil {
+		t.Fatal(err)
+	}
+	err := p.Provision(context.Background(), ui, communicator, nil)
+	if err == nil || !strings.Contains(err.Error(), "Unable to remove ephemeral file "+paths[0]) {
+		t.Fatalf("expected the removal to fail, got %v", err)
+	}
+	if _, err := os.Stat(paths[1]); !os.IsNotExist(err) {
+		t.Errorf("expected the other file to be removed, got %v", err)
+	}
+	if _, err := os.Stat(manifest); err != nil {
+		t.Errorf("expected the manifest to be kept for a retry, got %v", err)
+	}
+}
+
+func TestProvisionCleanupWindows(t *testing.T) {
+	var p Provisioner
+	if err := p.Prepare(map[string]interface{}{"guest_os_type": "windows", "shred": true}); err != nil {
+		t.Fatal(err)
+	}
+	communicator := &testharness.Communicator{Respond: func(command string) (string, int) {
+		if strings.Contains(command, "Get-Content") {
+			return base64.StdEncoding.EncodeToString([]byte("C:/app/it's.key")) + "\r\n", 0
+		}
+		return "", 0
+	}}
+	if err := p.Provision(context.Background(), &testharness.Ui{}, communicator, nil); err != nil {
+		t.Fatal(err)
+	}
+	testharness.Golden(t, "cleanup-windows", communicator.Plan())
+}
@@ -0,0 +1,264 @@
+//go:generate packer-sdc mapstructure-to-hcl2 -type Config
+
+package env
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"packer-plugin-keepass/common"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+	packercommon "github.com/hashicorp/packer-plugin-sdk/common"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+	"github.com/tobischo/gokeepasslib/v3"
+	"github.com/zclconf/go-cty/cty"
+)
+
+type Config struct {
+	packercommon.PackerConfig `mapstructure:",squash"`
+
+	KeepassFile            string            `mapstructure:"keepass_file" required:"true"`
+	KeepassPassword        string            `mapstructure:"keepass_password" required:"true"`
+	KeepassFormat          string            `mapstructure:"keepass_format"`
+	AllowPlaintext         bool              `mapstructure:"allow_plaintext"`
+	KeeShareTrustedSigners []string          `mapstructure:"keeshare_trusted_signers"`
+	Env                    map[string]string `mapstructure:"env" required:"true"`
+	Destination            string            `mapstructure:"destination" required:"true"`
+	Format                 string            `mapstructure:"format"`
+	Export                 bool              `mapstructure:"export"`
+	User                   string            `mapstructure:"user"`
+	UseSudo                bool              `mapstructure:"use_sudo"`
+	AsOf                   string            `mapstructure:"as_of"`
+	MaskMinLength          int               `mapstructure:"mask_min_length"`
+	UnmaskedFields         []string          `mapstructure:"unmasked_fields"`
+	AuditLog               string            `mapstructure:"audit_log"`
+	PolicyFile             string            `mapstructure:"policy_file"`
+	PolicyTemplate         string            `mapstructure:"policy_template"`
+
+	ctx interpolate.Context
+}
+
+type Provisioner struct {
+	config Config
+}
+
+func (p *Provisioner) ConfigSpec() hcldec.ObjectSpec {
+	spec := p.config.FlatMapstructure().HCL2Spec()
+	// the variables are written as a block, env { NAME = "<key>" }, like the environment of other provisioners
+	spec["env"] = &hcldec.BlockAttrsSpec{TypeName: "env", ElementType: cty.String}
+	return spec
+}
+
+func (p *Provisioner) Prepare(raws ...interface{}) error {
+	err := config.Decode(&p.config, &config.DecodeOpts{
+		Interpolate:        true,
+		InterpolateContext: &p.config.ctx,
+	}, raws...)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (p *Provisioner) Provision(ctx context.Context, ui packer.Ui, communicator packer.Communicator, generatedData map[string]interface{}) (err error) {
+	keepassFile, err := interpolate.Render(p.config.KeepassFile, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating keepass_file: %s", err)
+	}
+	keepassPassword, err := interpolate.Render(p.config.KeepassPassword, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating keepass_password: %s", err)
+	}
+	keepassFormat, err := interpolate.Render(p.config.KeepassFormat, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating keepass_format: %s", err)
+	}
+	keys := map[string]string{}
+	for name, key := range p.config.Env {
+		keys[name], err = interpolate.Render(key, &p.config.ctx)
+		if err != nil {
+			return fmt.Errorf("Error interpolating env %s: %s", name, err)
+		}
+	}
+	destination, err := interpolate.Render(p.config.Destination, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating destination: %s", err)
+	}
+	user, err := interpolate.Render(p.config.User, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating user: %s", err)
+	}
+	asOf, err := interpolate.Render(p.config.AsOf, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating as_of: %s", err)
+	}
+	auditLogPath, err := interpolate.Render(p.config.AuditLog, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating audit_log: %s", err)
+	}
+	policyFile, err := interpolate.Render(p.config.PolicyFile, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating policy_file: %s", err)
+	}
+	// check that the keepass_file and keepass_password config have been provided
+	if errs := common.CheckConfig(keepassFile, keepassPassword, keepassFormat, p.config.AllowPlaintext); errs != nil {
+		return errs
+	}
+	// check that the variables, destination and format are valid
+	if errs := p.checkEnvConfig(keys, destination, user); errs != nil {
+		return errs
+	}
+	db, databaseSha256, err := common.OpenDatabase(keepassFile, keepassPassword, keepassFormat, p.config.AllowPlaintext, p.config.KeeShareTrustedSigners)
+	if err != nil {
+		return err
+	}
+	truncated, err := common.ApplyAsOf(db, asOf)
+	if err != nil {
+		return err
+	}
+	for _, truncatedPath := range truncated {
+		ui.Say(common.TruncatedHistoryWarning(db, truncatedPath, asOf))
+	}
+	policy, err := common.ApplyPolicy(db, policyFile, p.config.PolicyTemplate, p.config.PackerBuildName)
+	if err != nil {
+		return err
+	}
+	auditLog, err := common.NewAuditLog(auditLogPath, keepassFile, databaseSha256, "provisioner.keepass-env", p.config.PackerBuildName)
+	if err != nil {
+		return err
+	}
+	// record the values read before a failing step as well
+	defer auditLog.FlushOnReturn(&err)
+	// redact the values from the output of this provisioner
+	masker := common.NewSecretMasker(p.config.MaskMinLength, p.config.UnmaskedFields)
+	ui = masker.Ui(ui)
+	masker.Mask(keepassPassword)
+	_, entryMap := common.AttachmentPaths(db)
+	names := []string{}
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	variables := []variable{}
+	defer func() {
+		for _, v := range variables {
+			common.ZeroBytes(v.value)
+		}
+	}()
+	for _, name := range names {
+		entry, field, ok := resolveKey(entryMap, keys[name])
+		if !ok {
+			if err := policy.CheckPath(keys[name]); err != nil {
+				return err
+			}
+			return fmt.Errorf("Entry field \"%s\" of %s does not exist.", keys[name], name)
+		}
+		value, err := revealKey(db, entry, field)
+		if err != nil {
+			return fmt.Errorf("Unable to decrypt %s: %s", keys[name], err)
+		}
+		variables = append(variables, variable{name: name, value: value})
+		masker.MaskField(field, string(value))
+		auditLog.Read(db, entry, field, "")
+		ui.Say(fmt.Sprintf("%s <= %s", name, keys[name]))
+	}
+	contents, err := renderEnvironmentFile(p.format(), p.config.Export, variables)
+	if err != nil {
+		return err
+	}
+	defer common.ZeroBytes(contents)
+	ui.Say(fmt.Sprintf("Uploading %s environment file with %d variables => %s", p.format(), len(variables), destination))
+	if err := common.UploadBytes(communicator, destination, contents, 0600); err != nil {
+		ui.Error(fmt.Sprintf("Upload failed: %s", err))
+		return err
+	}
+	if user != "" {
+		command := fmt.Sprintf("chown %s: %s", common.ShellQuote(user), common.ShellQuote(destination))
+		if err := common.RunCommand(ctx, ui, communicator, p.sudo(command)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Resolves a key of the credentials data source, <path-to-entry>/<title>-<field> or <uuid>-<field>,
+// to the entry and field. Titles and fields may contain dashes, the longest entry path holding the
+// field is taken.
+func resolveKey(entryMap map[string]gokeepasslib.Entry, key string) (gokeepasslib.Entry, string, bool) {
+	for separator := strings.LastIndex(key, "-"); separator > 0; separator = strings.LastIndex(key[:separator], "-") {
+		entry, keyExists := entryMap[key[:separator]]
+		if !keyExists {
+			continue
+		}
+		field := key[separator+1:]
+		if entry.Get(field) != nil || (field == "Tags" && entry.Tags != "") {
+			return entry, field, true
+		}
+	}
+	return gokeepasslib.Entry{}, "", false
+}
+
+// Decrypts the value of the field, the tags are stored outside of the entry values and a string
+// field of the same name takes precedence
+func revealKey(db *gokeepasslib.Database, entry gokeepasslib.Entry, field string) ([]byte, error) {
+	if field == "Tags" && entry.Get("Tags") == nil {
+		return []byte(entry.Tags), nil
+	}
+	return common.RevealField(db, entry, field)
+}
+
+func (p *Provisioner) format() string {
+	if p.config.Format == "" {
+		return formatDotenv
+	}
+	return p.config.Format
+}
+
+func (p *Provisioner) sudo(command string) string {
+	if p.config.UseSudo {
+		return "sudo " + command
+	}
+	return command
+}
+
+// Check that the variables and destination are provided and that the format supports the options
+func (p *Provisioner) checkEnvConfig(keys map[string]string, destination string, user string) *packer.MultiError {
+	var errs *packer.MultiError
+	if len(keys) == 0 {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("The `env` must be provided."))
+	}
+	names := []string{}
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !variableNamePattern.MatchString(name) {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("Invalid variable name \"%s\" in `env`, must be letters, digits and underscores not starting with a digit.", name))
+		}
+		if keys[name] == "" {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("The key of %s in `env` must be provided.", name))
+		}
+	}
+	if destination == "" {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("The `destination` must be provided."))
+	}
+	switch p.format() {
+	case formatDotenv:
+	case formatSystemd, formatPowershell:
+		if p.config.Export {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("The `export` option requires `format = \"dotenv\"`."))
+		}
+	default:
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("Unsupported `format` \"%s\", must be \"dotenv\", \"systemd\" or \"powershell\".", p.config.Format))
+	}
+	if p.format() == formatPowershell && user != "" {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("The `user` option cannot be used with `format = \"powershell\"`."))
+	}
+	return errs
+}
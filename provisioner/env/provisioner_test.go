@@ -0,0 +1,179 @@
+package env
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"packer-plugin-keepass/testharness"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+)
+
+func envTestDatabase(t *testing.T) string {
+	db := testharness.NewDatabase()
+	db.Entry("/prod/db", "UserName", "app", "Password", `it's "$ecret"`+"\\`").
+		Tags("postgres")
+	db.Entry("/prod/api-key", "Password", "line one\nline two", "client-id", "‘quoted’")
+	return db.WriteFile(t, "env.kdbx")
+}
+
+var envTestVariables = map[string]interface{}{
+	"DB_USER":     "/prod/db-UserName",
+	"DB_PASSWORD": "/prod/db-Password",
+	"DB_TAGS":     "/prod/db-Tags",
+	"API_KEY":     "/prod/api-key-Password",
+	"CLIENT_ID":   "/prod/api-key-client-id",
+}
+
+func TestProvisionEnv(t *testing.T) {
+	testCases := []struct {
+		name   string
+		config map[string]interface{}
+	}{
+		{"env-dotenv", map[string]interface{}{"destination": "/etc/profile.d/app.sh", "export": true}},
+		{"env-systemd", map[string]interface{}{"destination": "/etc/default/app", "format": "systemd", "user": "app", "use_sudo": true}},
+		{"env-powershell", map[string]interface{}{"destination": "C:/app/env.ps1", "format": "powershell"}},
+	}
+	keepassFile := envTestDatabase(t)
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.config["keepass_file"] = keepassFile
+			testCase.config["keepass_password"] = testharness.Password
+			testCase.config["env"] = envTestVariables
+			var p Provisioner
+			if err := p.Prepare(testCase.config); err != nil {
+				t.Fatal(err)
+			}
+			ui := &testharness.Ui{}
+			communicator := &testharness.Communicator{}
+			if err := p.Provision(context.Background(), ui, communicator, nil); err != nil {
+				t.Fatalf("%s\n%s", err, ui.Output())
+			}
+			destination := testCase.config["destination"].(string)
+			testharness.Golden(t, testCase.name, communicator.Plan()+"---\n"+string(communicator.Files[destination]))
+		})
+	}
+}
+
+func TestProvisionEnvMasksOutput(t *testing.T) {
+	var p Provisioner
+	config := map[string]interface{}{
+		"keepass_file":     envTestDatabase(t),
+		"keepass_password": testharness.Password,
+		"env":              envTestVariables,
+		"destination":      "/etc/default/app",
+		"user":             "app",
+	}
+	if err := p.Prepare(config); err != nil {
+		t.Fatal(err)
+	}
+	ui := &testharness.Ui{}
+	// a guest command echoing a value, as a debug script might
+	communicator := &testharness.Communicator{Respond: func(command string) (string, int) {
+		return "DB_PASSWORD=it's \"$ecret\"\\`\n", 0
+	}}
+	if err := p.Provision(context.Background(), ui, communicator, nil); err != nil {
+		t.Fatalf("%s\n%s", err, ui.Output())
+	}
+	if strings.Contains(ui.Output(), "$ecret") || !strings.Contains(ui.Output(), "DB_PASSWORD=<sensitive>") {
+		t.Errorf("expected the value to be redacted:\n%s", ui.Output())
+	}
+	// values shorter than mask_min_length, such as the user name, are shown
+	if !strings.Contains(ui.Output(), "DB_USER <= /prod/db-UserName") {
+		t.Errorf("unexpected output:\n%s", ui.Output())
+	}
+}
+
+func TestProvisionEnvAuditLogOnFailure(t *testing.T) {
+	auditLog := filepath.Join(t.TempDir(), "audit.log")
+	keepassFile := envTestDatabase(t)
+	var p Provisioner
+	config := map[string]interface{}{
+		"keepass_file":     keepassFile,
+		"keepass_password": testharness.Password,
+		"env":              map[string]interface{}{"DB_PASSWORD": "/prod/db-Password"},
+		"destination":      "/etc/default/app",
+		"user":             "app",
+		"audit_log":        auditLog,
+	}
+	if err := p.Prepare(config); err != nil {
+		t.Fatal(err)
+	}
+	// the values are decrypted and uploaded before the chown fails
+	communicator := &testharness.Communicator{Respond: func(command string) (string, int) { return "", 1 }}
+	if err := p.Provision(context.Background(), &testharness.Ui{}, communicator, nil); err == nil {
+		t.Fatal("expected the chown to fail")
+	}
+	contents, err := os.ReadFile(auditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(contents)), "\n"); len(lines) != 1 || !strings.Contains(lines[0], `"entry_path":"/prod/db","field":"Password"`) {
+		t.Errorf("expected the read value in the audit log, got:\n%s", contents)
+	}
+	// the digest is that of the contents the database was opened from
+	database, err := os.ReadFile(keepassFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(database)
+	if !strings.Contains(string(contents), `"database_sha256":"`+hex.EncodeToString(digest[:])+`"`) {
+		t.Errorf("expected the database digest in the audit log, got:\n%s", contents)
+	}
+}
+
+func TestProvisionEnvErrors(t *testing.T) {
+	testCases := []struct {
+		name     string
+		config   map[string]interface{}
+		expected string
+	}{
+		{"missing env", map[string]interface{}{"destination": "/etc/default/app"}, "The `env` must be provided."},
+		{"variable name", map[string]interface{}{"env": map[string]interface{}{"DB-PASSWORD": "/prod/db-Password"}, "destination": "/etc/default/app"}, "Invalid variable name \"DB-PASSWORD\""},
+		{"format", map[string]interface{}{"env": envTestVariables, "destination": "/etc/default/app", "format": "yaml"}, "Unsupported `format` \"yaml\""},
+		{"export", map[string]interface{}{"env": envTestVariables, "destination": "/etc/default/app", "format": "systemd", "export": true}, "The `export` option requires"},
+		{"missing field", map[string]interface{}{"env": map[string]interface{}{"DB_HOST": "/prod/db-Host"}, "destination": "/etc/default/app"}, "Entry field \"/prod/db-Host\" of DB_HOST does not exist."},
+	}
+	keepassFile := envTestDatabase(t)
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.config["keepass_file"] = keepassFile
+			testCase.config["keepass_password"] = testharness.Password
+			var p Provisioner
+			if err := p.Prepare(testCase.config); err != nil {
+				t.Fatal(err)
+			}
+			communicator := &testharness.Communicator{}
+			err := p.Provision(context.Background(), &testharness.Ui{}, communicator, nil)
+			if err == nil || !strings.Contains(err.Error(), testCase.expected) {
+				t.Errorf("expected an error containing %q, got %v", testCase.expected, err)
+			}
+			if len(communicator.Uploads) > 0 {
+				t.Errorf("expected no uploads, got %s", communicator.Plan())
+			}
+		})
+	}
+}
+
+func TestConfigSpecEnvBlock(t *testing.T) {
+	file, diags := hclsyntax.ParseConfig([]byte("env {\n  DB_PASSWORD = \"/prod/db-Password\"\n}\n"), "env.pkr.hcl", hcl.Pos{Line: 1, Column: 1})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	var p Provisioner
+	value, diags := hcldec.Decode(file.Body, p.ConfigSpec(), nil)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	if key := value.GetAttr("env").Index(cty.StringVal("DB_PASSWORD")); key.AsString() != "/prod/db-Password" {
+		t.Errorf("unexpected env %#v", value.GetAttr("env"))
+	}
+}
@@ -0,0 +1,63 @@
+package env
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"packer-plugin-keepass/common"
+)
+
+// Formats of the environment file
+const (
+	formatDotenv     = "dotenv"
+	formatSystemd    = "systemd"
+	formatPowershell = "powershell"
+)
+
+// Names accepted by posix shells, systemd and powershell alike
+var variableNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// A variable of the environment file and its decrypted value
+type variable struct {
+	name  string
+	value []byte
+}
+
+// Renders the variables in the format, the caller should clear the result with ZeroBytes after use
+func renderEnvironmentFile(format string, export bool, variables []variable) ([]byte, error) {
+	var buffer bytes.Buffer
+	if format == formatPowershell {
+		// windows powershell reads scripts without a byte order mark in the legacy code page
+		buffer.WriteString("\ufeff")
+	}
+	for _, v := range variables {
+		if bytes.IndexByte(v.value, 0) >= 0 {
+			return nil, fmt.Errorf("The value of %s contains a NUL byte, which cannot be stored in an environment variable.", v.name)
+		}
+		switch format {
+		case formatDotenv:
+			if export {
+				buffer.WriteString("export ")
+			}
+			buffer.WriteString(v.name + "=" + common.ShellQuote(string(v.value)) + "\n")
+		case formatSystemd:
+			buffer.WriteString(v.name + "=" + systemdQuote(v.value) + "\n")
+		case formatPowershell:
+			buffer.WriteString("$env:" + v.name + " = " + common.PowershellQuote(string(v.value)) + "\r\n")
+		default:
+			return nil, fmt.Errorf("Unsupported `format` \"%s\", must be \"dotenv\", \"systemd\" or \"powershell\".", format)
+		}
+	}
+	return buffer.Bytes(), nil
+}
+
+// Backslash escapes removed by systemd within double quotes, the dollar sign is escaped as systemd
+// expands variable references in environment files
+var systemdReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "`", "\\`", `$`, `\$`)
+
+// Quotes a value in double quotes, systemd keeps newlines within quotes
+func systemdQuote(value []byte) string {
+	return `"` + systemdReplacer.Replace(string(value)) + `"`
+}
@@ -9,6 +9,7 @@ import (
 	"strings"
 
 	"github.com/hashicorp/hcl/v2/hcldec"
+	packercommon "github.com/hashicorp/packer-plugin-sdk/common"
 	"github.com/hashicorp/packer-plugin-sdk/packer"
 	"github.com/hashicorp/packer-plugin-sdk/template/config"
 	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
@@ -16,8 +17,18 @@ import (
 )
 
 type Config struct {
-	KeepassFile     string `mapstructure:"keepass_file" required:"true"`
-	KeepassPassword string `mapstructure:"keepass_password" required:"true"`
+	packercommon.PackerConfig `mapstructure:",squash"`
+
+	KeepassFile            string   `mapstructure:"keepass_file" required:"true"`
+	KeepassPassword        string   `mapstructure:"keepass_password" required:"true"`
+	KeepassFormat          string   `mapstructure:"keepass_format"`
+	AllowPlaintext         bool     `mapstructure:"allow_plaintext"`
+	KeeShareTrustedSigners []string `mapstructure:"keeshare_trusted_signers"`
+	AsOf                   string   `mapstructure:"as_of"`
+	IncludeTags            []string `mapstructure:"include_tags"`
+	ExcludeTags            []string `mapstructure:"exclude_tags"`
+	PolicyFile             string   `mapstructure:"policy_file"`
+	PolicyTemplate         string   `mapstructure:"policy_template"`
 
 	ctx interpolate.Context
 }
@@ -52,36 +63,90 @@ func (p *Provisioner) Provision(_ context.Context, ui packer.Ui, _ packer.Commun
 	if err != nil {
 		return fmt.Errorf("Error interpolating keepass_password: %s", err)
 	}
+	keepassFormat, err := interpolate.Render(p.config.KeepassFormat, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating keepass_format: %s", err)
+	}
 	// check that the keepass_file and keepass_password config have been provided
-	if errs := common.CheckConfig(keepassFile, keepassPassword); errs != nil {
+	if errs := common.CheckConfig(keepassFile, keepassPassword, keepassFormat, p.config.AllowPlaintext); errs != nil {
 		return errs
 	}
-	db, err := common.OpenDatabase(keepassFile, keepassPassword)
+	asOf, err := interpolate.Render(p.config.AsOf, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating as_of: %s", err)
+	}
+	db, _, err := common.OpenDatabase(keepassFile, keepassPassword, keepassFormat, p.config.AllowPlaintext, p.config.KeeShareTrustedSigners)
+	if err != nil {
+		return err
+	}
+	// reconstruct the database as it was at the as_of time
+	truncated, err := common.ApplyAsOf(db, asOf)
+	if err != nil {
+		return err
+	}
+	for _, entryPath := range truncated {
+		ui.Say(common.TruncatedHistoryWarning(db, entryPath, asOf))
+	}
+	policyFile, err := interpolate.Render(p.config.PolicyFile, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating policy_file: %s", err)
+	}
+	// only list the entries allowed by the access policy
+	if _, err := common.ApplyPolicy(db, policyFile, p.config.PolicyTemplate, p.config.PackerBuildName); err != nil {
+		return err
+	}
+	// group tags were added by kdbx 4.1 and are read from the database xml
+	details, err := common.ReadKdbx41Details(db)
 	if err != nil {
 		return err
 	}
 	ui.Say(fmt.Sprintf("Credentials and attachments listing for: %s", keepassFile))
 	// walk database and print tree listing of groups and entries
 	groupCallback := func(groupPath string, group gokeepasslib.Group, depth int) {
+		tags := ""
+		if groupTags := details.GroupTags[group.UUID]; len(groupTags) > 0 {
+			tags = fmt.Sprintf(" [%s]", strings.Join(groupTags, ", "))
+		}
 		if depth == 0 {
-			ui.Say(fmt.Sprintf("%s(root)  %s", strings.Repeat(treeSpacer, depth), groupPath))
+			ui.Say(fmt.Sprintf("%s(root)  %s%s", strings.Repeat(treeSpacer, depth), groupPath, tags))
 		} else {
-			ui.Say(fmt.Sprintf("%s(group) %s", strings.Repeat(treeSpacer, depth), groupPath))
+			ui.Say(fmt.Sprintf("%s(group) %s%s", strings.Repeat(treeSpacer, depth), groupPath, tags))
 		}
 	}
 	entryCallback := func(entryPath string, entry gokeepasslib.Entry, depth int) {
-		ui.Say(fmt.Sprintf("%s(entry) %s", strings.Repeat(treeSpacer, depth), entryPath))
+		if !common.MatchTags(entry, p.config.IncludeTags, p.config.ExcludeTags) {
+			return
+		}
+		tags := common.EntryTags(entry)
+		if len(tags) > 0 {
+			ui.Say(fmt.Sprintf("%s(entry) %s [%s]", strings.Repeat(treeSpacer, depth), entryPath, strings.Join(tags, ", ")))
+		} else {
+			ui.Say(fmt.Sprintf("%s(entry) %s", strings.Repeat(treeSpacer, depth), entryPath))
+		}
 		for _, valueData := range entry.Values {
 			// entry value data keys are guaranteed by keepass to be unique
 			key := fmt.Sprintf("%s-%s", entryPath, valueData.Key)
 			ui.Say(fmt.Sprintf("%s(value) %s", strings.Repeat(treeSpacer, depth+1), key))
 		}
+		if len(tags) > 0 && entry.Get("Tags") == nil {
+			ui.Say(fmt.Sprintf("%s(value) %s-Tags", strings.Repeat(treeSpacer, depth+1), entryPath))
+		}
 		for _, attachment := range entry.Binaries {
 			// attachment names are guaranteed by keepass to be unique
 			key := fmt.Sprintf("%s-%s", entryPath, attachment.Name)
 			ui.Say(fmt.Sprintf("%s(file)  %s", strings.Repeat(treeSpacer, depth+1), key))
+			// describe the certificates within pem or der attachments
+			attachmentBytes, err := common.ReadAttachment(db, attachment)
+			if err != nil {
+				continue
+			}
+			if bundle := common.ParseCertificateBundle(attachmentBytes); bundle != nil {
+				for _, certificate := range bundle.Certificates {
+					ui.Say(fmt.Sprintf("%s(cert)  %s", strings.Repeat(treeSpacer, depth+2), common.DescribeCertificate(certificate)))
+				}
+			}
+			common.ZeroBytes(attachmentBytes)
 		}
 	}
-	common.WalkDatabase(db, groupCallback, entryCallback)
-	return nil
+	return common.WalkDatabase(db, groupCallback, entryCallback)
 }
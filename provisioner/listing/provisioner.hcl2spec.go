@@ -10,8 +10,24 @@ import (
 // FlatConfig is an auto-generated flat version of Config.
 // Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
 type FlatConfig struct {
-	KeepassFile     *string `mapstructure:"keepass_file" required:"true" cty:"keepass_file" hcl:"keepass_file"`
-	KeepassPassword *string `mapstructure:"keepass_password" required:"true" cty:"keepass_password" hcl:"keepass_password"`
+	PackerBuildName        *string           `mapstructure:"packer_build_name" cty:"packer_build_name" hcl:"packer_build_name"`
+	PackerBuilderType      *string           `mapstructure:"packer_builder_type" cty:"packer_builder_type" hcl:"packer_builder_type"`
+	PackerCoreVersion      *string           `mapstructure:"packer_core_version" cty:"packer_core_version" hcl:"packer_core_version"`
+	PackerDebug            *bool             `mapstructure:"packer_debug" cty:"packer_debug" hcl:"packer_debug"`
+	PackerForce            *bool             `mapstructure:"packer_force" cty:"packer_force" hcl:"packer_force"`
+	PackerOnError          *string           `mapstructure:"packer_on_error" cty:"packer_on_error" hcl:"packer_on_error"`
+	PackerUserVars         map[string]string `mapstructure:"packer_user_variables" cty:"packer_user_variables" hcl:"packer_user_variables"`
+	PackerSensitiveVars    []string          `mapstructure:"packer_sensitive_variables" cty:"packer_sensitive_variables" hcl:"packer_sensitive_variables"`
+	KeepassFile            *string           `mapstructure:"keepass_file" required:"true" cty:"keepass_file" hcl:"keepass_file"`
+	KeepassPassword        *string           `mapstructure:"keepass_password" required:"true" cty:"keepass_password" hcl:"keepass_password"`
+	KeepassFormat          *string           `mapstructure:"keepass_format" cty:"keepass_format" hcl:"keepass_format"`
+	AllowPlaintext         *bool             `mapstructure:"allow_plaintext" cty:"allow_plaintext" hcl:"allow_plaintext"`
+	KeeShareTrustedSigners []string          `mapstructure:"keeshare_trusted_signers" cty:"keeshare_trusted_signers" hcl:"keeshare_trusted_signers"`
+	AsOf                   *string           `mapstructure:"as_of" cty:"as_of" hcl:"as_of"`
+	IncludeTags            []string          `mapstructure:"include_tags" cty:"include_tags" hcl:"include_tags"`
+	ExcludeTags            []string          `mapstructure:"exclude_tags" cty:"exclude_tags" hcl:"exclude_tags"`
+	PolicyFile             *string           `mapstructure:"policy_file" cty:"policy_file" hcl:"policy_file"`
+	PolicyTemplate         *string           `mapstructure:"policy_template" cty:"policy_template" hcl:"policy_template"`
 }
 
 // FlatMapstructure returns a new FlatConfig.
@@ -26,8 +42,24 @@ func (*Config) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec }
 // The decoded values from this spec will then be applied to a FlatConfig.
 func (*FlatConfig) HCL2Spec() map[string]hcldec.Spec {
 	s := map[string]hcldec.Spec{
-		"keepass_file":     &hcldec.AttrSpec{Name: "keepass_file", Type: cty.String, Required: false},
-		"keepass_password": &hcldec.AttrSpec{Name: "keepass_password", Type: cty.String, Required: false},
+		"packer_build_name":          &hcldec.AttrSpec{Name: "packer_build_name", Type: cty.String, Required: false},
+		"packer_builder_type":        &hcldec.AttrSpec{Name: "packer_builder_type", Type: cty.String, Required: false},
+		"packer_core_version":        &hcldec.AttrSpec{Name: "packer_core_version", Type: cty.String, Required: false},
+		"packer_debug":               &hcldec.AttrSpec{Name: "packer_debug", Type: cty.Bool, Required: false},
+		"packer_force":               &hcldec.AttrSpec{Name: "packer_force", Type: cty.Bool, Required: false},
+		"packer_on_error":            &hcldec.AttrSpec{Name: "packer_on_error", Type: cty.String, Required: false},
+		"packer_user_variables":      &hcldec.AttrSpec{Name: "packer_user_variables", Type: cty.Map(cty.String), Required: false},
+		"packer_sensitive_variables": &hcldec.AttrSpec{Name: "packer_sensitive_variables", Type: cty.List(cty.String), Required: false},
+		"keepass_file":               &hcldec.AttrSpec{Name: "keepass_file", Type: cty.String, Required: false},
+		"keepass_password":           &hcldec.AttrSpec{Name: "keepass_password", Type: cty.String, Required: false},
+		"keepass_format":             &hcldec.AttrSpec{Name: "keepass_format", Type: cty.String, Required: false},
+		"allow_plaintext":            &hcldec.AttrSpec{Name: "allow_plaintext", Type: cty.Bool, Required: false},
+		"keeshare_trusted_signers":   &hcldec.AttrSpec{Name: "keeshare_trusted_signers", Type: cty.List(cty.String), Required: false},
+		"as_of":                      &hcldec.AttrSpec{Name: "as_of", Type: cty.String, Required: false},
+		"include_tags":               &hcldec.AttrSpec{Name: "include_tags", Type: cty.List(cty.String), Required: false},
+		"exclude_tags":               &hcldec.AttrSpec{Name: "exclude_tags", Type: cty.List(cty.String), Required: false},
+		"policy_file":                &hcldec.AttrSpec{Name: "policy_file", Type: cty.String, Required: false},
+		"policy_template":            &hcldec.AttrSpec{Name: "policy_template", Type: cty.String, Required: false},
 	}
 	return s
 }
@@ -0,0 +1,450 @@
+//go:generate packer-sdc mapstructure-to-hcl2 -type Config
+
+package secretsdir
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"packer-plugin-keepass/common"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+	packercommon "github.com/hashicorp/packer-plugin-sdk/common"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+type Config struct {
+	packercommon.PackerConfig `mapstructure:",squash"`
+
+	KeepassFile            string            `mapstructure:"keepass_file" required:"true"`
+	KeepassPassword        string            `mapstructure:"keepass_password" required:"true"`
+	KeepassFormat          string            `mapstructure:"keepass_format"`
+	AllowPlaintext         bool              `mapstructure:"allow_plaintext"`
+	KeeShareTrustedSigners []string          `mapstructure:"keeshare_trusted_signers"`
+	EntryPath              string            `mapstructure:"entry_path"`
+	GroupPath              string            `mapstructure:"group_path"`
+	IncludeTags            []string          `mapstructure:"include_tags"`
+	ExcludeTags            []string          `mapstructure:"exclude_tags"`
+	Destination            string            `mapstructure:"destination" required:"true"`
+	Fields                 []string          `mapstructure:"fields"`
+	Attachments            []string          `mapstructure:"attachments"`
+	SkipAttachments        bool              `mapstructure:"skip_attachments"`
+	Filenames              map[string]string `mapstructure:"filenames"`
+	FileMode               string            `mapstructure:"file_mode"`
+	DirMode                string            `mapstructure:"dir_mode"`
+	Atomic                 bool              `mapstructure:"atomic"`
+	User                   string            `mapstructure:"user"`
+	UseSudo                bool              `mapstructure:"use_sudo"`
+	AsOf                   string            `mapstructure:"as_of"`
+	MaskMinLength          int               `mapstructure:"mask_min_length"`
+	UnmaskedFields         []string          `mapstructure:"unmasked_fields"`
+	AuditLog               string            `mapstructure:"audit_log"`
+	PolicyFile             string            `mapstructure:"policy_file"`
+	PolicyTemplate         string            `mapstructure:"policy_template"`
+
+	ctx interpolate.Context
+}
+
+type Provisioner struct {
+	config Config
+}
+
+// A file of the secrets directory, the key is the field or attachment name relative to the selection
+type secretFile struct {
+	key        string
+	name       string
+	entry      gokeepasslib.Entry
+	field      string
+	attachment *gokeepasslib.BinaryReference
+	contents   []byte
+}
+
+// Name of the data directory of the atomic layout, replaced by a symlink swap on every update
+const dataDir = "..data"
+
+// Time of the update naming the timestamped directory of the atomic layout
+var now = time.Now
+
+// Characters allowed in file names by default, like the keys of a kubernetes secret
+var unsafeFilenameCharacters = regexp.MustCompile(`[^-._A-Za-z0-9]`)
+
+func (p *Provisioner) ConfigSpec() hcldec.ObjectSpec {
+	return p.config.FlatMapstructure().HCL2Spec()
+}
+
+func (p *Provisioner) Prepare(raws ...interface{}) error {
+	err := config.Decode(&p.config, &config.DecodeOpts{
+		Interpolate:        true,
+		InterpolateContext: &p.config.ctx,
+	}, raws...)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (p *Provisioner) Provision(ctx context.Context, ui packer.Ui, communicator packer.Communicator, generatedData map[string]interface{}) (err error) {
+	keepassFile, err := interpolate.Render(p.config.KeepassFile, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating keepass_file: %s", err)
+	}
+	keepassPassword, err := interpolate.Render(p.config.KeepassPassword, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating keepass_password: %s", err)
+	}
+	keepassFormat, err := interpolate.Render(p.config.KeepassFormat, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating keepass_format: %s", err)
+	}
+	entryPath, err := interpolate.Render(p.config.EntryPath, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating entry_path: %s", err)
+	}
+	groupPath, err := interpolate.Render(p.config.GroupPath, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating group_path: %s", err)
+	}
+	destination, err := interpolate.Render(p.config.Destination, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating destination: %s", err)
+	}
+	user, err := interpolate.Render(p.config.User, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating user: %s", err)
+	}
+	asOf, err := interpolate.Render(p.config.AsOf, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating as_of: %s", err)
+	}
+	auditLogPath, err := interpolate.Render(p.config.AuditLog, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating audit_log: %s", err)
+	}
+	policyFile, err := interpolate.Render(p.config.PolicyFile, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating policy_file: %s", err)
+	}
+	// check that the keepass_file and keepass_password config have been provided
+	if errs := common.CheckConfig(keepassFile, keepassPassword, keepassFormat, p.config.AllowPlaintext); errs != nil {
+		return errs
+	}
+	// check that the selection and destination have been provided and the modes are valid
+	if errs := p.checkSecretsDirConfig(entryPath, groupPath, destination); errs != nil {
+		return errs
+	}
+	fileMode, _ := parseMode(p.config.FileMode, 0600)
+	dirMode, _ := parseMode(p.config.DirMode, 0700)
+	destination = strings.TrimSuffix(destination, "/")
+	db, databaseSha256, err := common.OpenDatabase(keepassFile, keepassPassword, keepassFormat, p.config.AllowPlaintext, p.config.KeeShareTrustedSigners)
+	if err != nil {
+		return err
+	}
+	truncated, err := common.ApplyAsOf(db, asOf)
+	if err != nil {
+		return err
+	}
+	for _, truncatedPath := range truncated {
+		ui.Say(common.TruncatedHistoryWarning(db, truncatedPath, asOf))
+	}
+	policy, err := common.ApplyPolicy(db, policyFile, p.config.PolicyTemplate, p.config.PackerBuildName)
+	if err != nil {
+		return err
+	}
+	auditLog, err := common.NewAuditLog(auditLogPath, keepassFile, databaseSha256, "provisioner.keepass-secrets-dir", p.config.PackerBuildName)
+	if err != nil {
+		return err
+	}
+	// record the values read before a failing step as well
+	defer auditLog.FlushOnReturn(&err)
+	// redact the values and attachments from the output of this provisioner
+	masker := common.NewSecretMasker(p.config.MaskMinLength, p.config.UnmaskedFields)
+	ui = masker.Ui(ui)
+	masker.Mask(keepassPassword)
+	files, err := p.selectFiles(db, policy, entryPath, groupPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, file := range files {
+			common.ZeroBytes(file.contents)
+		}
+	}()
+	// fields without a value are skipped once decrypted
+	written := []secretFile{}
+	for i := range files {
+		if files[i].attachment != nil {
+			files[i].contents, err = common.ReadAttachment(db, *files[i].attachment)
+			if err != nil {
+				return err
+			}
+			masker.MaskAttachment(files[i].contents)
+			auditLog.Read(db, files[i].entry, "", files[i].attachment.Name)
+			written = append(written, files[i])
+			continue
+		}
+		files[i].contents, err = common.RevealField(db, files[i].entry, files[i].field)
+		if err != nil {
+			return fmt.Errorf("Unable to decrypt %s: %s", files[i].key, err)
+		}
+		if len(files[i].contents) == 0 {
+			continue
+		}
+		masker.MaskField(files[i].field, string(files[i].contents))
+		auditLog.Read(db, files[i].entry, files[i].field, "")
+		written = append(written, files[i])
+	}
+
+	// files are written to a new timestamped directory with the atomic layout, then published by swapping the data symlink
+	uploadDir := destination
+	if p.config.Atomic {
+		uploadDir = destination + "/" + now().UTC().Format("..2006_01_02_15_04_05.000000000")
+	}
+	ui.Say(fmt.Sprintf("Writing %d secrets => %s", len(written), destination))
+	dirs := common.ShellQuote(destination)
+	if uploadDir != destination {
+		dirs += " " + common.ShellQuote(uploadDir)
+	}
+	mkdir := fmt.Sprintf("mkdir -p %[1]s && chmod %04[2]o %[1]s", dirs, dirMode)
+	if p.config.UseSudo {
+		// the files are uploaded as the user of the communicator, which is given the directories created with sudo,
+		// its ids are expanded before sudo runs
+		mkdir = p.sudo("sh -c "+common.ShellQuote(mkdir)) + " && " + p.sudo(`chown "$(id -u):$(id -g)" `+dirs)
+	}
+	if err := common.RunCommand(ctx, ui, communicator, mkdir); err != nil {
+		return err
+	}
+	for _, file := range written {
+		ui.Say(fmt.Sprintf("File: %s <= %s", file.name, file.key))
+		if err := common.UploadBytes(communicator, uploadDir+"/"+file.name, file.contents, fileMode); err != nil {
+			ui.Error(fmt.Sprintf("Upload failed: %s", err))
+			return err
+		}
+	}
+	if p.config.Atomic {
+		if err := common.RunCommand(ctx, ui, communicator, p.sudo("sh -c "+common.ShellQuote(swapScript(destination, path.Base(uploadDir), written, user)))); err != nil {
+			return err
+		}
+	} else if user != "" {
+		if err := common.RunCommand(ctx, ui, communicator, p.sudo(fmt.Sprintf("chown -R %s: %s", common.ShellQuote(user), common.ShellQuote(destination)))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Selects the fields and attachments of the entry or of the entries within the group and names their files,
+// the contents are read once the selection is complete
+func (p *Provisioner) selectFiles(db *gokeepasslib.Database, policy *common.Policy, entryPath string, groupPath string) ([]secretFile, error) {
+	files := []secretFile{}
+	addEntry := func(prefix string, entry gokeepasslib.Entry) {
+		for _, valueData := range entry.Values {
+			if !p.selectedField(valueData) {
+				continue
+			}
+			files = append(files, secretFile{key: prefix + valueData.Key, entry: entry, field: valueData.Key})
+		}
+		if p.config.SkipAttachments {
+			return
+		}
+		for i := range entry.Binaries {
+			if matchesAny(p.config.Attachments, entry.Binaries[i].Name) {
+				files = append(files, secretFile{key: prefix + entry.Binaries[i].Name, entry: entry, attachment: &entry.Binaries[i]})
+			}
+		}
+	}
+	if entryPath != "" {
+		_, entryMap := common.AttachmentPaths(db)
+		entry, keyExists := entryMap[entryPath]
+		if !keyExists {
+			if err := policy.CheckPath(entryPath); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("Entry \"%s\" does not exist.", entryPath)
+		}
+		addEntry("", entry)
+	} else {
+		groupPath = strings.TrimSuffix(groupPath, "/")
+		groupExists := false
+		groupCallback := func(walkedPath string, group gokeepasslib.Group, depth int) {
+			groupExists = groupExists || walkedPath == groupPath
+		}
+		entryCallback := func(walkedPath string, entry gokeepasslib.Entry, depth int) {
+			// entries are walked by path and by uuid, select them by path once
+			if strings.HasPrefix(walkedPath, groupPath+"/") && common.MatchTags(entry, p.config.IncludeTags, p.config.ExcludeTags) {
+				addEntry(strings.TrimPrefix(walkedPath, groupPath+"/")+"-", entry)
+			}
+		}
+		if err := common.WalkDatabase(db, groupCallback, entryCallback); err != nil {
+			return nil, err
+		}
+		if !groupExists {
+			return nil, fmt.Errorf("Group \"%s\" does not exist.", groupPath)
+		}
+	}
+	if err := p.nameFiles(files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// Fields are selected by the fields patterns, the title only if it is named explicitly
+func (p *Provisioner) selectedField(valueData gokeepasslib.ValueData) bool {
+	if len(p.config.Fields) == 0 {
+		return valueData.Key != "Title"
+	}
+	if valueData.Key == "Title" {
+		for _, field := range p.config.Fields {
+			if field == "Title" {
+				return true
+			}
+		}
+		return false
+	}
+	return matchesAny(p.config.Fields, valueData.Key)
+}
+
+// Names the files from the filenames mapping or the key with unsafe characters replaced
+func (p *Provisioner) nameFiles(files []secretFile) error {
+	keys := map[string]bool{}
+	names := map[string]string{}
+	for i := range files {
+		keys[files[i].key] = true
+		name, mapped := p.config.Filenames[files[i].key]
+		if !mapped {
+			name = unsafeFilenameCharacters.ReplaceAllString(files[i].key, "_")
+			// names starting with two dots are reserved for the atomic layout
+			if strings.HasPrefix(name, "..") {
+				name = "_" + name[1:]
+			}
+		}
+		if err := checkFilename(name); err != nil {
+			return fmt.Errorf("Invalid file name \"%s\" for %s: %s", name, files[i].key, err)
+		}
+		if other, exists := names[name]; exists {
+			return fmt.Errorf("Duplicate file name \"%s\" for %s and %s, map one of them with `filenames`.", name, other, files[i].key)
+		}
+		names[name] = files[i].key
+		files[i].name = name
+	}
+	mappedKeys := []string{}
+	for key := range p.config.Filenames {
+		mappedKeys = append(mappedKeys, key)
+	}
+	sort.Strings(mappedKeys)
+	for _, key := range mappedKeys {
+		if !keys[key] {
+			return fmt.Errorf("The `filenames` key \"%s\" does not match a selected field or attachment.", key)
+		}
+	}
+	return nil
+}
+
+func checkFilename(name string) error {
+	switch {
+	case name == "" || name == "." || name == "..":
+		return fmt.Errorf("not a file name")
+	case strings.Contains(name, "/"):
+		return fmt.Errorf("must not contain a slash")
+	case strings.HasPrefix(name, ".."):
+		return fmt.Errorf("names starting with two dots are reserved for the atomic layout")
+	}
+	return nil
+}
+
+// Shell script publishing the timestamped directory by swapping the data symlink, each file is a symlink
+// into the data directory. The previous directory and the links of its files not written again are removed.
+func swapScript(destination string, timestampDir string, files []secretFile, user string) string {
+	lines := []string{
+		"set -e",
+		"cd " + common.ShellQuote(destination),
+	}
+	if user != "" {
+		lines = append(lines, fmt.Sprintf("chown -R %s: %s", common.ShellQuote(user), common.ShellQuote(timestampDir)))
+	}
+	lines = append(lines,
+		fmt.Sprintf("old=$(readlink %s 2>/dev/null || true)", dataDir),
+		fmt.Sprintf("ln -sfn %s %s_tmp", common.ShellQuote(timestampDir), dataDir),
+		// mv -T (gnu, busybox 1.32) and mv -h (bsd) rename over the link instead of moving into the directory
+		// it points to, older busybox versions lack both and the link is replaced by removing it first
+		fmt.Sprintf("mv -Tf %[1]s_tmp %[1]s 2>/dev/null || mv -hf %[1]s_tmp %[1]s 2>/dev/null || { rm -f %[1]s && mv -f %[1]s_tmp %[1]s; }", dataDir),
+	)
+	links := []string{dataDir}
+	for _, file := range files {
+		lines = append(lines, fmt.Sprintf("ln -sfn %s %s", common.ShellQuote(dataDir+"/"+file.name), common.ShellQuote(file.name)))
+		links = append(links, common.ShellQuote(file.name))
+	}
+	if user != "" {
+		lines = append(lines, fmt.Sprintf("chown -h %s: . %s", common.ShellQuote(user), strings.Join(links, " ")))
+	}
+	// only the links of previous files no longer written are removed, other symlinks in the destination are kept
+	lines = append(lines, fmt.Sprintf(`case "$old" in ..[0-9]*) if [ "$old" != %s ]; then `+
+		`for f in "./$old"/* "./$old"/.[!.]*; do [ -e "$f" ] || continue; f=${f##*/}; `+
+		`if [ -L "$f" ] && [ ! -e "$f" ] && [ "$(readlink "$f")" = "%s/$f" ]; then rm -f "./$f"; fi; done; `+
+		`rm -rf "./$old"; fi;; esac`, common.ShellQuote(timestampDir), dataDir))
+	return strings.Join(lines, "; ")
+}
+
+func matchesAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matched, err := path.Match(pattern, value); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Parses an octal file mode, the default is used if it is not set
+func parseMode(mode string, defaultMode os.FileMode) (os.FileMode, error) {
+	if mode == "" {
+		return defaultMode, nil
+	}
+	parsed, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || parsed > 0777 {
+		return 0, fmt.Errorf("not an octal file mode")
+	}
+	return os.FileMode(parsed), nil
+}
+
+func (p *Provisioner) sudo(command string) string {
+	if p.config.UseSudo {
+		return "sudo " + command
+	}
+	return command
+}
+
+// Check that one selection and the destination are provided and that the modes are valid
+func (p *Provisioner) checkSecretsDirConfig(entryPath string, groupPath string, destination string) *packer.MultiError {
+	var errs *packer.MultiError
+	if (entryPath == "") == (groupPath == "") {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("One of `entry_path` or `group_path` must be provided."))
+	}
+	if entryPath != "" && (len(p.config.IncludeTags) > 0 || len(p.config.ExcludeTags) > 0) {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("The `include_tags` and `exclude_tags` options require `group_path`."))
+	}
+	if destination == "" {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("The `destination` must be provided."))
+	}
+	if _, err := parseMode(p.config.FileMode, 0600); err != nil {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("Invalid `file_mode` \"%s\": %s", p.config.FileMode, err))
+	}
+	if _, err := parseMode(p.config.DirMode, 0700); err != nil {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("Invalid `dir_mode` \"%s\": %s", p.config.DirMode, err))
+	}
+	if p.config.SkipAttachments && len(p.config.Attachments) > 0 {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("The `attachments` and `skip_attachments` options cannot be combined."))
+	}
+	return errs
+}
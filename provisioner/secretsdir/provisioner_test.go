@@ -0,0 +1,170 @@
+package secretsdir
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"packer-plugin-keepass/common"
+	"packer-plugin-keepass/testharness"
+)
+
+func secretsDirTestDatabase(t *testing.T) string {
+	db := testharness.NewDatabase()
+	db.Entry("/prod/db", "UserName", "app", "Password", "secret", "URL", "").
+		Attach("ca.pem", []byte("-----BEGIN CERTIFICATE-----\n")).
+		Tags("postgres")
+	db.Entry("/prod/web/api token", "Password", "token").
+		Attach("license.key", []byte("license"))
+	db.Entry("/prod/legacy", "Password", "old").
+		Tags("deprecated")
+	return db.WriteFile(t, "secrets-dir.kdbx")
+}
+
+func TestProvisionSecretsDir(t *testing.T) {
+	defer func(previous func() time.Time) { now = previous }(now)
+	now = func() time.Time { return time.Date(2021, 6, 1, 12, 30, 0, 0, time.UTC) }
+	testCases := []struct {
+		name   string
+		config map[string]interface{}
+	}{
+		{"secrets-dir-entry", map[string]interface{}{"entry_path": "/prod/db", "destination": "/run/secrets/db/"}},
+		{"secrets-dir-group", map[string]interface{}{
+			"group_path":   "/prod",
+			"exclude_tags": []string{"deprecated"},
+			"destination":  "/run/secrets",
+			"fields":       []string{"Pass*"},
+			"filenames":    map[string]string{"db-Password": "db_password"},
+			"file_mode":    "0440",
+			"dir_mode":     "0750",
+		}},
+		{"secrets-dir-atomic", map[string]interface{}{
+			"entry_path":       "/prod/db",
+			"destination":      "/etc/app/secrets",
+			"skip_attachments": true,
+			"atomic":           true,
+			"user":             "app",
+			"use_sudo":         true,
+		}},
+	}
+	keepassFile := secretsDirTestDatabase(t)
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.config["keepass_file"] = keepassFile
+			testCase.config["keepass_password"] = testharness.Password
+			var p Provisioner
+			if err := p.Prepare(testCase.config); err != nil {
+				t.Fatal(err)
+			}
+			ui := &testharness.Ui{}
+			communicator := &testharness.Communicator{}
+			if err := p.Provision(context.Background(), ui, communicator, nil); err != nil {
+				t.Fatalf("%s\n%s", err, ui.Output())
+			}
+			testharness.Golden(t, testCase.name, communicator.Plan())
+		})
+	}
+}
+
+func TestProvisionSecretsDirErrors(t *testing.T) {
+	testCases := []struct {
+		name     string
+		config   map[string]interface{}
+		expected string
+	}{
+		{"selection", map[string]interface{}{"entry_path": "/prod/db", "group_path": "/prod", "destination": "/run/secrets"}, "One of `entry_path` or `group_path` must be provided."},
+		{"file mode", map[string]interface{}{"entry_path": "/prod/db", "destination": "/run/secrets", "file_mode": "rw"}, "Invalid `file_mode` \"rw\""},
+		{"missing group", map[string]interface{}{"group_path": "/staging", "destination": "/run/secrets"}, "Group \"/staging\" does not exist."},
+		{"duplicate name", map[string]interface{}{"entry_path": "/prod/db", "destination": "/run/secrets", "filenames": map[string]string{"UserName": "Password"}}, "Duplicate file name \"Password\""},
+		{"unmatched mapping", map[string]interface{}{"entry_path": "/prod/db", "destination": "/run/secrets", "filenames": map[string]string{"Token": "token"}}, "The `filenames` key \"Token\" does not match"},
+		{"reserved name", map[string]interface{}{"entry_path": "/prod/db", "destination": "/run/secrets", "filenames": map[string]string{"Password": "..data"}}, "reserved for the atomic layout"},
+	}
+	keepassFile := secretsDirTestDatabase(t)
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.config["keepass_file"] = keepassFile
+			testCase.config["keepass_password"] = testharness.Password
+			var p Provisioner
+			if err := p.Prepare(testCase.config); err != nil {
+				t.Fatal(err)
+			}
+			communicator := &testharness.Communicator{}
+			err := p.Provision(context.Background(), &testharness.Ui{}, communicator, nil)
+			if err == nil || !strings.Contains(err.Error(), testCase.expected) {
+				t.Errorf("expected an error containing %q, got %v", testCase.expected, err)
+			}
+			if len(communicator.Commands) > 0 || len(communicator.Uploads) > 0 {
+				t.Errorf("expected no communicator calls, got %s", communicator.Plan())
+			}
+		})
+	}
+}
+
+// Runs the swap script twice in a local directory, the second update replaces the files of the first
+func TestSwapScript(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+	mv, err := exec.LookPath("mv")
+	if err != nil {
+		t.Skip("mv is not available")
+	}
+	// an mv without -T as on busybox, bsd or macos guests
+	withoutT := t.TempDir()
+	wrapper := "#!/bin/sh\ncase \"$1\" in -T*) echo \"mv: invalid option -- 'T'\" >&2; exit 1;; esac\nexec " + common.ShellQuote(mv) + " \"$@\"\n"
+	if err := os.WriteFile(filepath.Join(withoutT, "mv"), []byte(wrapper), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, path := range map[string]string{"mv -T": os.Getenv("PATH"), "mv without -T": withoutT + string(os.PathListSeparator) + os.Getenv("PATH")} {
+		t.Run(name, func(t *testing.T) {
+			destination := t.TempDir()
+			// a dangling symlink of the user is not one of the files of the provisioner
+			if err := os.Symlink("missing", filepath.Join(destination, "user-link")); err != nil {
+				t.Fatal(err)
+			}
+			update := func(timestampDir string, contents map[string]string) {
+				files := []secretFile{}
+				for name, data := range contents {
+					if err := os.MkdirAll(filepath.Join(destination, timestampDir), 0700); err != nil {
+						t.Fatal(err)
+					}
+					if err := os.WriteFile(filepath.Join(destination, timestampDir, name), []byte(data), 0600); err != nil {
+						t.Fatal(err)
+					}
+					files = append(files, secretFile{name: name})
+				}
+				command := exec.Command("sh", "-c", swapScript(destination, timestampDir, files, ""))
+				command.Env = append(os.Environ(), "PATH="+path)
+				if output, err := command.CombinedOutput(); err != nil {
+					t.Fatalf("%s: %s", err, output)
+				}
+			}
+			update("..2021_06_01_12_30_00.000000000", map[string]string{"Password": "first", "UserName": "app", "db password": "first", ".env": "A=1"})
+			update("..2021_06_01_12_31_00.000000000", map[string]string{"Password": "second", "ca.pem": "ca"})
+
+			entries, err := os.ReadDir(destination)
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := []string{}
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+			sort.Strings(names)
+			if strings.Join(names, " ") != "..2021_06_01_12_31_00.000000000 ..data Password ca.pem user-link" {
+				t.Errorf("unexpected directory contents %q", names)
+			}
+			if target, err := os.Readlink(filepath.Join(destination, "..data")); err != nil || target != "..2021_06_01_12_31_00.000000000" {
+				t.Errorf("unexpected data link %q %v", target, err)
+			}
+			if data, err := os.ReadFile(filepath.Join(destination, "Password")); err != nil || string(data) != "second" {
+				t.Errorf("unexpected contents %q %v", data, err)
+			}
+		})
+	}
+}
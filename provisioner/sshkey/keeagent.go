@@ -0,0 +1,146 @@
+package sshkey
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Name of the attachment holding the KeeAgent / KeePassXC SSH agent settings of an entry
+const keeAgentSettingsName = "KeeAgent.settings"
+
+// Subset of the KeeAgent entry settings describing where the private key is stored
+type keeAgentSettings struct {
+	AllowUseOfSshKey bool `xml:"AllowUseOfSshKey"`
+	Location         struct {
+		SelectedType   string `xml:"SelectedType"`
+		AttachmentName string `xml:"AttachmentName"`
+		FileName       string `xml:"FileName"`
+	} `xml:"Location"`
+}
+
+// Parses the KeeAgent settings xml, which KeeAgent and KeePassXC write as UTF-16
+func parseKeeAgentSettings(data []byte) (*keeAgentSettings, error) {
+	data = decodeUTF16(data)
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	// the contents have already been converted to UTF-8 regardless of the declared encoding
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	settings := &keeAgentSettings{}
+	if err := decoder.Decode(settings); err != nil {
+		return nil, fmt.Errorf("Invalid %s: %s", keeAgentSettingsName, err)
+	}
+	return settings, nil
+}
+
+// Converts UTF-16 data with a byte order mark to UTF-8, other data is returned unchanged
+func decodeUTF16(data []byte) []byte {
+	if len(data) < 2 {
+		return data
+	}
+	var order binary.ByteOrder
+	switch {
+	case data[0] == 0xFF && data[1] == 0xFE:
+		order = binary.LittleEndian
+	case data[0] == 0xFE && data[1] == 0xFF:
+		order = binary.BigEndian
+	default:
+		// strip a UTF-8 byte order mark if present
+		return bytes.TrimPrefix(data, []byte{0xEF, 0xBB, 0xBF})
+	}
+	units := make([]uint16, 0, len(data)/2)
+	for i := 2; i+1 < len(data); i += 2 {
+		units = append(units, order.Uint16(data[i:]))
+	}
+	return []byte(string(utf16.Decode(units)))
+}
+
+// Parses a private key, decrypting it with the passphrase when it is encrypted. The passphrase is
+// only revealed for encrypted keys. Returns the key and whether it was encrypted.
+func parsePrivateKey(keyBytes []byte, revealPassphrase func() ([]byte, error)) (interface{}, bool, error) {
+	key, err := ssh.ParseRawPrivateKey(keyBytes)
+	if err == nil {
+		return key, false, nil
+	}
+	if _, ok := err.(*ssh.PassphraseMissingError); !ok {
+		return nil, false, err
+	}
+	passphrase, err := revealPassphrase()
+	if err != nil {
+		return nil, true, err
+	}
+	key, err = ssh.ParseRawPrivateKeyWithPassphrase(keyBytes, passphrase)
+	if err != nil {
+		return nil, true, fmt.Errorf("Unable to decrypt private key with the entry password: %s", err)
+	}
+	return key, true, nil
+}
+
+// Encodes a decrypted private key in a format accepted by OpenSSH
+func marshalPrivateKey(key interface{}, comment string) ([]byte, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}), nil
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+	case *ed25519.PrivateKey:
+		return marshalEd25519PrivateKey(*k, comment)
+	case ed25519.PrivateKey:
+		return marshalEd25519PrivateKey(k, comment)
+	default:
+		return nil, fmt.Errorf("Unsupported private key type %T", key)
+	}
+}
+
+// Encodes an ed25519 key in the unencrypted openssh-key-v1 format, the only format OpenSSH reads it from
+func marshalEd25519PrivateKey(key ed25519.PrivateKey, comment string) ([]byte, error) {
+	publicKey := key.Public().(ed25519.PublicKey)
+	var check [4]byte
+	if _, err := rand.Read(check[:]); err != nil {
+		return nil, err
+	}
+	checkValue := binary.BigEndian.Uint32(check[:])
+	private := struct {
+		Check1  uint32
+		Check2  uint32
+		KeyType string
+		Public  []byte
+		Private []byte
+		Comment string
+	}{checkValue, checkValue, ssh.KeyAlgoED25519, publicKey, key, comment}
+	privateBlock := ssh.Marshal(private)
+	// pad the private block to the cipher block size of 8 with 1, 2, 3...
+	for i := 1; len(privateBlock)%8 != 0; i++ {
+		privateBlock = append(privateBlock, byte(i))
+	}
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	envelope := struct {
+		CipherName   string
+		KdfName      string
+		KdfOptions   string
+		NumKeys      uint32
+		PublicKey    []byte
+		PrivateBlock []byte
+	}{"none", "none", "", 1, sshPublicKey.Marshal(), privateBlock}
+	data := append([]byte("openssh-key-v1\x00"), ssh.Marshal(envelope)...)
+	return pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: data}), nil
+}
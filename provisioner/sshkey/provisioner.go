@@ -0,0 +1,316 @@
+//go:generate packer-sdc mapstructure-to-hcl2 -type Config
+
+package sshkey
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"packer-plugin-keepass/common"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/hcl/v2/hcldec"
+	packercommon "github.com/hashicorp/packer-plugin-sdk/common"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+	"github.com/tobischo/gokeepasslib/v3"
+	"golang.org/x/crypto/ssh"
+)
+
+type Config struct {
+	packercommon.PackerConfig `mapstructure:",squash"`
+
+	KeepassFile            string   `mapstructure:"keepass_file" required:"true"`
+	KeepassPassword        string   `mapstructure:"keepass_password" required:"true"`
+	KeepassFormat          string   `mapstructure:"keepass_format"`
+	AllowPlaintext         bool     `mapstructure:"allow_plaintext"`
+	KeeShareTrustedSigners []string `mapstructure:"keeshare_trusted_signers"`
+	EntryPath              string   `mapstructure:"entry_path" required:"true"`
+	User                   string   `mapstructure:"user"`
+	PrivateKeyDestination  string   `mapstructure:"private_key_destination"`
+	PublicKey              bool     `mapstructure:"public_key"`
+	AuthorizedKeys         bool     `mapstructure:"authorized_keys"`
+	UseSudo                bool     `mapstructure:"use_sudo"`
+	AsOf                   string   `mapstructure:"as_of"`
+	MaskMinLength          int      `mapstructure:"mask_min_length"`
+	UnmaskedFields         []string `mapstructure:"unmasked_fields"`
+	AuditLog               string   `mapstructure:"audit_log"`
+	PolicyFile             string   `mapstructure:"policy_file"`
+	PolicyTemplate         string   `mapstructure:"policy_template"`
+
+	ctx interpolate.Context
+}
+
+// Names the temporary file holding the public key on the guest
+var newUUID = uuid.NewString
+
+type Provisioner struct {
+	config Config
+}
+
+func (p *Provisioner) ConfigSpec() hcldec.ObjectSpec {
+	return p.config.FlatMapstructure().HCL2Spec()
+}
+
+func (p *Provisioner) Prepare(raws ...interface{}) error {
+	err := config.Decode(&p.config, &config.DecodeOpts{
+		Interpolate:        true,
+		InterpolateContext: &p.config.ctx,
+	}, raws...)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (p *Provisioner) Provision(ctx context.Context, ui packer.Ui, communicator packer.Communicator, generatedData map[string]interface{}) (err error) {
+	keepassFile, err := interpolate.Render(p.config.KeepassFile, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating keepass_file: %s", err)
+	}
+	keepassPassword, err := interpolate.Render(p.config.KeepassPassword, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating keepass_password: %s", err)
+	}
+	keepassFormat, err := interpolate.Render(p.config.KeepassFormat, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating keepass_format: %s", err)
+	}
+	entryPath, err := interpolate.Render(p.config.EntryPath, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating entry_path: %s", err)
+	}
+	user, err := interpolate.Render(p.config.User, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating user: %s", err)
+	}
+	privateKeyDestination, err := interpolate.Render(p.config.PrivateKeyDestination, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating private_key_destination: %s", err)
+	}
+	asOf, err := interpolate.Render(p.config.AsOf, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating as_of: %s", err)
+	}
+	auditLogPath, err := interpolate.Render(p.config.AuditLog, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating audit_log: %s", err)
+	}
+	policyFile, err := interpolate.Render(p.config.PolicyFile, &p.config.ctx)
+	if err != nil {
+		return fmt.Errorf("Error interpolating policy_file: %s", err)
+	}
+	// check that the keepass_file and keepass_password config have been provided
+	if errs := common.CheckConfig(keepassFile, keepassPassword, keepassFormat, p.config.AllowPlaintext); errs != nil {
+		return errs
+	}
+	// check that the entry and at least one install target have been provided
+	if errs := p.checkSSHKeyConfig(entryPath, user, privateKeyDestination); errs != nil {
+		return errs
+	}
+	db, databaseSha256, err := common.OpenDatabase(keepassFile, keepassPassword, keepassFormat, p.config.AllowPlaintext, p.config.KeeShareTrustedSigners)
+	if err != nil {
+		return err
+	}
+	auditLog, err := common.NewAuditLog(auditLogPath, keepassFile, databaseSha256, "provisioner.keepass-ssh-key", p.config.PackerBuildName)
+	if err != nil {
+		return err
+	}
+	// record the key read before a failing upload as well
+	defer auditLog.FlushOnReturn(&err)
+	truncated, err := common.ApplyAsOf(db, asOf)
+	if err != nil {
+		return err
+	}
+	for _, truncatedPath := range truncated {
+		ui.Say(common.TruncatedHistoryWarning(db, truncatedPath, asOf))
+	}
+	policy, err := common.ApplyPolicy(db, policyFile, p.config.PolicyTemplate, p.config.PackerBuildName)
+	if err != nil {
+		return err
+	}
+	_, entryMap := common.AttachmentPaths(db)
+	entry, keyExists := entryMap[entryPath]
+	if !keyExists {
+		if err := policy.CheckPath(entryPath); err != nil {
+			return err
+		}
+		return fmt.Errorf("Entry \"%s\" does not exist.", entryPath)
+	}
+	privateKeyBytes, keyAttachmentName, err := readEntryPrivateKey(db, entry, keepassFile)
+	if err != nil {
+		return err
+	}
+	defer common.ZeroBytes(privateKeyBytes)
+	auditLog.Read(db, entry, "", keeAgentSettingsName)
+	if keyAttachmentName != "" {
+		auditLog.Read(db, entry, "", keyAttachmentName)
+	}
+	// redact the key and its passphrase from the output of this provisioner
+	masker := common.NewSecretMasker(p.config.MaskMinLength, p.config.UnmaskedFields)
+	ui = masker.Ui(ui)
+	masker.Mask(keepassPassword)
+	masker.MaskAttachment(privateKeyBytes)
+	// the passphrase is only decrypted for encrypted keys, the other values of the entry stay protected
+	var passphrase []byte
+	defer func() { common.ZeroBytes(passphrase) }()
+	privateKey, encrypted, err := parsePrivateKey(privateKeyBytes, func() ([]byte, error) {
+		revealed, err := common.RevealField(db, entry, "Password")
+		passphrase = revealed
+		masker.MaskField("Password", string(revealed))
+		return revealed, err
+	})
+	if err != nil {
+		return err
+	}
+	if encrypted {
+		auditLog.Read(db, entry, "Password", "")
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		return err
+	}
+	comment := entry.GetTitle()
+	publicKeyLine := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))) + " " + comment + "\n"
+	ui.Say(fmt.Sprintf("SSH key %s from entry %s", ssh.FingerprintSHA256(signer.PublicKey()), entryPath))
+
+	if privateKeyDestination != "" {
+		// the guest has no access to the entry password, so install encrypted keys decrypted
+		if encrypted {
+			decryptedKeyBytes, err := marshalPrivateKey(privateKey, comment)
+			if err != nil {
+				return err
+			}
+			defer common.ZeroBytes(decryptedKeyBytes)
+			masker.MaskAttachment(decryptedKeyBytes)
+			privateKeyBytes = decryptedKeyBytes
+		}
+		ui.Say(fmt.Sprintf("Uploading private key => %s", privateKeyDestination))
+		if err := common.UploadBytes(communicator, privateKeyDestination, privateKeyBytes, 0600); err != nil {
+			return err
+		}
+		installed := []string{privateKeyDestination}
+		if p.config.PublicKey {
+			ui.Say(fmt.Sprintf("Uploading public key => %s.pub", privateKeyDestination))
+			if err := common.UploadBytes(communicator, privateKeyDestination+".pub", []byte(publicKeyLine), 0644); err != nil {
+				return err
+			}
+			installed = append(installed, privateKeyDestination+".pub")
+		}
+		if user != "" {
+			quoted := []string{}
+			for _, path := range installed {
+				quoted = append(quoted, common.ShellQuote(path))
+			}
+			command := fmt.Sprintf("chmod 600 %s && chown %s: %s", quoted[0], common.ShellQuote(user), strings.Join(quoted, " "))
+			if err := common.RunCommand(ctx, ui, communicator, p.sudo(command)); err != nil {
+				return err
+			}
+		}
+	}
+	if p.config.AuthorizedKeys {
+		ui.Say(fmt.Sprintf("Adding public key to authorized_keys of %s", user))
+		if err := p.installAuthorizedKey(ctx, ui, communicator, user, publicKeyLine); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reads the private key referenced by the KeeAgent settings of the entry and the name of its attachment, if any
+func readEntryPrivateKey(db *gokeepasslib.Database, entry gokeepasslib.Entry, keepassFile string) ([]byte, string, error) {
+	attachments := map[string]gokeepasslib.BinaryReference{}
+	for _, attachment := range entry.Binaries {
+		attachments[attachment.Name] = attachment
+	}
+	settingsAttachment, keyExists := attachments[keeAgentSettingsName]
+	if !keyExists {
+		return nil, "", fmt.Errorf("Entry \"%s\" does not have a %s attachment.", entry.GetTitle(), keeAgentSettingsName)
+	}
+	settingsBytes, err := common.ReadAttachment(db, settingsAttachment)
+	if err != nil {
+		return nil, "", err
+	}
+	settings, err := parseKeeAgentSettings(settingsBytes)
+	common.ZeroBytes(settingsBytes)
+	if err != nil {
+		return nil, "", err
+	}
+	// the key is only used when the ssh agent use is enabled for the entry, as keeagent and keepassxc do
+	if !settings.AllowUseOfSshKey {
+		return nil, "", fmt.Errorf("Entry \"%s\" does not allow the use of its SSH key, enable it in the SSH agent settings of the entry.", entry.GetTitle())
+	}
+	switch strings.ToLower(settings.Location.SelectedType) {
+	case "attachment":
+		keyAttachment, keyExists := attachments[settings.Location.AttachmentName]
+		if !keyExists {
+			return nil, "", fmt.Errorf("File attachment \"%s\" referenced by %s does not exist.", settings.Location.AttachmentName, keeAgentSettingsName)
+		}
+		keyBytes, err := common.ReadAttachment(db, keyAttachment)
+		return keyBytes, keyAttachment.Name, err
+	case "file":
+		// relative key file paths are resolved against the database location
+		keyFile := settings.Location.FileName
+		if !filepath.IsAbs(keyFile) {
+			keyFile = filepath.Join(filepath.Dir(keepassFile), keyFile)
+		}
+		keyBytes, err := ioutil.ReadFile(keyFile)
+		return keyBytes, "", err
+	default:
+		return nil, "", fmt.Errorf("Unsupported key location type \"%s\" in %s.", settings.Location.SelectedType, keeAgentSettingsName)
+	}
+}
+
+// Appends the public key to the authorized_keys file of the user unless it is already present
+func (p *Provisioner) installAuthorizedKey(ctx context.Context, ui packer.Ui, communicator packer.Communicator, user string, publicKeyLine string) (err error) {
+	tempFile := fmt.Sprintf("/tmp/keepass-authorized-key-%s", newUUID())
+	// the temporary file is also removed when the upload or the script fails
+	defer func() {
+		if removeErr := common.RunCommand(ctx, ui, communicator, p.sudo("rm -f "+common.ShellQuote(tempFile))); err == nil {
+			err = removeErr
+		}
+	}()
+	if err := common.UploadBytes(communicator, tempFile, []byte(publicKeyLine), 0644); err != nil {
+		return err
+	}
+	script := strings.Join([]string{
+		"set -e",
+		fmt.Sprintf("home=$(getent passwd %s | cut -d: -f6)", common.ShellQuote(user)),
+		`test -n "$home"`,
+		`mkdir -p "$home/.ssh"`,
+		fmt.Sprintf(`grep -qxF -f %[1]s "$home/.ssh/authorized_keys" 2>/dev/null || cat %[1]s >> "$home/.ssh/authorized_keys"`, common.ShellQuote(tempFile)),
+		`chmod 700 "$home/.ssh"`,
+		`chmod 600 "$home/.ssh/authorized_keys"`,
+		fmt.Sprintf(`chown %s: "$home/.ssh" "$home/.ssh/authorized_keys"`, common.ShellQuote(user)),
+	}, "; ")
+	return common.RunCommand(ctx, ui, communicator, p.sudo("sh -c "+common.ShellQuote(script)))
+}
+
+func (p *Provisioner) sudo(command string) string {
+	if p.config.UseSudo {
+		return "sudo " + command
+	}
+	return command
+}
+
+// Check that the entry_path and an install target are provided
+func (p *Provisioner) checkSSHKeyConfig(entryPath string, user string, privateKeyDestination string) *packer.MultiError {
+	var errs *packer.MultiError
+	if entryPath == "" {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("The `entry_path` must be provided."))
+	}
+	if privateKeyDestination == "" && !p.config.AuthorizedKeys {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("One of `private_key_destination` or `authorized_keys` must be provided."))
+	}
+	if p.config.PublicKey && privateKeyDestination == "" {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("The `public_key` option requires `private_key_destination`."))
+	}
+	if p.config.AuthorizedKeys && user == "" {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("The `user` must be provided with `authorized_keys`."))
+	}
+	return errs
+}
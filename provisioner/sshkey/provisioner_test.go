@@ -0,0 +1,300 @@
+package sshkey
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"packer-plugin-keepass/testharness"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const sshKeyTestPassphrase = "key-passphrase"
+
+// Settings as written by keepassxc, in UTF-16 with a byte order mark
+func sshKeyTestSettings(allowUse bool, keyAttachment string) []byte {
+	allow := "false"
+	if allowUse {
+		allow = "true"
+	}
+	settings := `<?xml version="1.0" encoding="UTF-16"?>
+<EntrySettings xmlns:xsd="http://www.w3.org/2001/XMLSchema" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+  <AllowUseOfSshKey>` + allow + `</AllowUseOfSshKey>
+  <Location>
+    <SelectedType>attachment</SelectedType>
+    <AttachmentName>` + keyAttachment + `</AttachmentName>
+    <SaveAttachmentToTempFile>false</SaveAttachmentToTempFile>
+    <FileName />
+  </Location>
+</EntrySettings>`
+	units := utf16.Encode([]rune(settings))
+	data := make([]byte, 2+2*len(units))
+	data[0], data[1] = 0xFF, 0xFE
+	for i, unit := range units {
+		binary.LittleEndian.PutUint16(data[2+2*i:], unit)
+	}
+	return data
+}
+
+func sshKeyTestDatabase(t *testing.T) (string, ssh.PublicKey, ssh.PublicKey) {
+	// a fixed seed keeps the public key, and with it the authorized_keys plan, stable
+	ed25519Key := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{7}, ed25519.SeedSize))
+	ed25519Bytes, err := marshalEd25519PrivateKey(ed25519Key, "deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// legacy PEM encryption, as written by older ssh-keygen versions
+	encrypted, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), []byte(sshKeyTestPassphrase), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := testharness.NewDatabase()
+	db.Entry("/ssh/deploy", "UserName", "deploy").
+		Attach(keeAgentSettingsName, sshKeyTestSettings(true, "id_ed25519")).
+		Attach("id_ed25519", ed25519Bytes)
+	db.Entry("/ssh/legacy", "Password", sshKeyTestPassphrase).
+		Attach(keeAgentSettingsName, sshKeyTestSettings(true, "id_rsa")).
+		Attach("id_rsa", pem.EncodeToMemory(encrypted))
+	db.Entry("/ssh/disabled").
+		Attach(keeAgentSettingsName, sshKeyTestSettings(false, "id_ed25519")).
+		Attach("id_ed25519", ed25519Bytes)
+	ed25519Public, err := ssh.NewPublicKey(ed25519Key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPublic, err := ssh.NewPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db.WriteFile(t, "ssh-key.kdbx"), ed25519Public, rsaPublic
+}
+
+func TestMarshalPrivateKey(t *testing.T) {
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name      string
+		key       interface{}
+		publicKey interface{}
+	}{
+		{"ed25519", ed25519Key, ed25519Key.Public()},
+		{"ed25519 pointer", &ed25519Key, ed25519Key.Public()},
+		{"rsa", rsaKey, &rsaKey.PublicKey},
+		{"ecdsa", ecdsaKey, &ecdsaKey.PublicKey},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			marshaled, err := marshalPrivateKey(testCase.key, "comment")
+			if err != nil {
+				t.Fatal(err)
+			}
+			signer, err := ssh.ParsePrivateKey(marshaled)
+			if err != nil {
+				t.Fatalf("OpenSSH format not accepted: %s\n%s", err, marshaled)
+			}
+			expected, err := ssh.NewPublicKey(testCase.publicKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(signer.PublicKey().Marshal(), expected.Marshal()) {
+				t.Errorf("expected public key %s, got %s", ssh.FingerprintSHA256(expected), ssh.FingerprintSHA256(signer.PublicKey()))
+			}
+		})
+	}
+	if _, err := marshalPrivateKey("not a key", ""); err == nil {
+		t.Error("expected an unsupported key type error")
+	}
+}
+
+func TestProvisionSSHKeyAuthorizedKeys(t *testing.T) {
+	defer func(previous func() string) { newUUID = previous }(newUUID)
+	newUUID = func() string { return "00000000-0000-0000-0000-000000000000" }
+	keepassFile, _, _ := sshKeyTestDatabase(t)
+	var p Provisioner
+	config := map[string]interface{}{
+		"keepass_file":     keepassFile,
+		"keepass_password": testharness.Password,
+		"entry_path":       "/ssh/deploy",
+		"user":             "deploy",
+		"authorized_keys":  true,
+		"use_sudo":         true,
+	}
+	if err := p.Prepare(config); err != nil {
+		t.Fatal(err)
+	}
+	ui := &testharness.Ui{}
+	communicator := &testharness.Communicator{}
+	if err := p.Provision(context.Background(), ui, communicator, nil); err != nil {
+		t.Fatalf("%s\n%s", err, ui.Output())
+	}
+	testharness.Golden(t, "ssh-key-authorized-keys", communicator.Plan()+"---\n"+string(communicator.Files["/tmp/keepass-authorized-key-00000000-0000-0000-0000-000000000000"]))
+}
+
+// The temporary file holding the public key is removed when the authorized_keys script fails
+func TestProvisionSSHKeyAuthorizedKeysFailure(t *testing.T) {
+	defer func(previous func() string) { newUUID = previous }(newUUID)
+	newUUID = func() string { return "00000000-0000-0000-0000-000000000000" }
+	keepassFile, _, _ := sshKeyTestDatabase(t)
+	var p Provisioner
+	config := map[string]interface{}{
+		"keepass_file":     keepassFile,
+		"keepass_password": testharness.Password,
+		"entry_path":       "/ssh/deploy",
+		"user":             "missing",
+		"authorized_keys":  true,
+	}
+	if err := p.Prepare(config); err != nil {
+		t.Fatal(err)
+	}
+	communicator := &testharness.Communicator{Respond: func(command string) (string, int) {
+		if strings.HasPrefix(command, "sh -c") {
+			return "", 1
+		}
+		return "", 0
+	}}
+	if err := p.Provision(context.Background(), &testharness.Ui{}, communicator, nil); err == nil {
+		t.Fatal("expected the authorized_keys script to fail")
+	}
+	expected := "rm -f '/tmp/keepass-authorized-key-00000000-0000-0000-0000-000000000000'"
+	if len(communicator.Commands) != 2 || communicator.Commands[1] != expected {
+		t.Errorf("expected the temporary file to be removed, got %q", communicator.Commands)
+	}
+}
+
+func TestParsePrivateKeyPassphrase(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+	encrypted, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), []byte(sshKeyTestPassphrase), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name      string
+		keyBytes  []byte
+		encrypted bool
+	}{
+		{"unencrypted", plain, false},
+		{"encrypted", pem.EncodeToMemory(encrypted), true},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			revealed := false
+			_, encrypted, err := parsePrivateKey(testCase.keyBytes, func() ([]byte, error) {
+				revealed = true
+				return []byte(sshKeyTestPassphrase), nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the entry password is only decrypted for encrypted keys
+			if encrypted != testCase.encrypted || revealed != testCase.encrypted {
+				t.Errorf("expected encrypted and revealed to be %t, got %t and %t", testCase.encrypted, encrypted, revealed)
+			}
+		})
+	}
+}
+
+func TestProvisionSSHKeyPrivateKey(t *testing.T) {
+	keepassFile, ed25519Public, rsaPublic := sshKeyTestDatabase(t)
+	testCases := []struct {
+		entryPath string
+		publicKey ssh.PublicKey
+	}{
+		{"/ssh/deploy", ed25519Public},
+		// the encrypted key is installed decrypted, the guest does not know the entry password
+		{"/ssh/legacy", rsaPublic},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.entryPath, func(t *testing.T) {
+			var p Provisioner
+			config := map[string]interface{}{
+				"keepass_file":            keepassFile,
+				"keepass_password":        testharness.Password,
+				"entry_path":              testCase.entryPath,
+				"private_key_destination": "/home/deploy/.ssh/id_key",
+				"public_key":              true,
+				"user":                    "deploy",
+			}
+			if err := p.Prepare(config); err != nil {
+				t.Fatal(err)
+			}
+			ui := &testharness.Ui{}
+			communicator := &testharness.Communicator{}
+			if err := p.Provision(context.Background(), ui, communicator, nil); err != nil {
+				t.Fatalf("%s\n%s", err, ui.Output())
+			}
+			signer, err := ssh.ParsePrivateKey(communicator.Files["/home/deploy/.ssh/id_key"])
+			if err != nil {
+				t.Fatalf("uploaded private key not accepted: %s", err)
+			}
+			if !bytes.Equal(signer.PublicKey().Marshal(), testCase.publicKey.Marshal()) {
+				t.Errorf("expected key %s, got %s", ssh.FingerprintSHA256(testCase.publicKey), ssh.FingerprintSHA256(signer.PublicKey()))
+			}
+			publicKey, comment, _, _, err := ssh.ParseAuthorizedKey(communicator.Files["/home/deploy/.ssh/id_key.pub"])
+			if err != nil || !bytes.Equal(publicKey.Marshal(), testCase.publicKey.Marshal()) || comment != strings.TrimPrefix(testCase.entryPath, "/ssh/") {
+				t.Errorf("unexpected public key file %q, %v", communicator.Files["/home/deploy/.ssh/id_key.pub"], err)
+			}
+			for _, upload := range communicator.Uploads {
+				if (upload.Path == "/home/deploy/.ssh/id_key" && upload.Mode != 0600) || (upload.Path == "/home/deploy/.ssh/id_key.pub" && upload.Mode != 0644) {
+					t.Errorf("unexpected mode %04o of %s", upload.Mode, upload.Path)
+				}
+			}
+			if len(communicator.Commands) != 1 || communicator.Commands[0] != "chmod 600 '/home/deploy/.ssh/id_key' && chown 'deploy': '/home/deploy/.ssh/id_key' '/home/deploy/.ssh/id_key.pub'" {
+				t.Errorf("unexpected commands %q", communicator.Commands)
+			}
+			if strings.Contains(ui.Output(), "PRIVATE KEY") {
+				t.Errorf("private key in the output:\n%s", ui.Output())
+			}
+		})
+	}
+}
+
+func TestProvisionSSHKeyNotAllowed(t *testing.T) {
+	keepassFile, _, _ := sshKeyTestDatabase(t)
+	var p Provisioner
+	config := map[string]interface{}{
+		"keepass_file":            keepassFile,
+		"keepass_password":        testharness.Password,
+		"entry_path":              "/ssh/disabled",
+		"private_key_destination": "/home/deploy/.ssh/id_ed25519",
+	}
+	if err := p.Prepare(config); err != nil {
+		t.Fatal(err)
+	}
+	communicator := &testharness.Communicator{}
+	err := p.Provision(context.Background(), &testharness.Ui{}, communicator, nil)
+	if err == nil || !strings.Contains(err.Error(), "does not allow the use of its SSH key") {
+		t.Fatalf("expected the key use to be refused, got %v", err)
+	}
+	if len(communicator.Uploads) != 0 {
+		t.Errorf("expected no uploads, got:\n%s", communicator.Plan())
+	}
+}
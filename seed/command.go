@@ -0,0 +1,68 @@
+package seed
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"packer-plugin-keepass/common"
+)
+
+const usage = `Usage: packer-plugin-keepass seed [-output file.kdbx] [-password password] spec.yaml
+
+Builds a keepass database from the groups and entries of a YAML or JSON spec.
+`
+
+// Runs the seed subcommand and returns the exit code
+func Run(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("seed", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		flags.PrintDefaults()
+	}
+	outputFile := flags.String("output", "", "Database file to write, defaults to the spec file with a .kdbx extension")
+	password := flags.String("password", "", "Password of the database, overrides the password of the spec")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	specFile := flags.Arg(0)
+	if *outputFile == "" {
+		*outputFile = strings.TrimSuffix(specFile, filepath.Ext(specFile)) + ".kdbx"
+	}
+	if err := Seed(specFile, *outputFile, *password); err != nil {
+		fmt.Fprintln(stderr, err.Error())
+		return 1
+	}
+	data, err := os.ReadFile(*outputFile)
+	if err != nil {
+		fmt.Fprintln(stderr, err.Error())
+		return 1
+	}
+	format, err := common.ReadDatabaseFormat(data)
+	if err != nil {
+		fmt.Fprintln(stderr, err.Error())
+		return 1
+	}
+	fmt.Fprintf(stdout, "Wrote %s: %s\n", *outputFile, format)
+	return 0
+}
+
+// Builds the database described by the spec file and writes it to the output file
+func Seed(specFile string, outputFile string, password string) error {
+	spec, err := ReadSpec(specFile)
+	if err != nil {
+		return err
+	}
+	if password != "" {
+		spec.Password = password
+	}
+	return spec.Write(filepath.Dir(specFile), outputFile)
+}
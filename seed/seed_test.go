@@ -0,0 +1,198 @@
+package seed
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"packer-plugin-keepass/common"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+func seedTestRun(t *testing.T, specFile string) (string, string) {
+	t.Helper()
+	keepassFile := filepath.Join(t.TempDir(), "seed.kdbx")
+	var stdout, stderr bytes.Buffer
+	if code := Run([]string{"-output", keepassFile, specFile}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr.String())
+	}
+	return keepassFile, stdout.String()
+}
+
+func seedTestEntry(t *testing.T, keepassFile string, entryPath string) (*gokeepasslib.Database, gokeepasslib.Entry) {
+	t.Helper()
+	db, _, err := common.OpenDatabase(keepassFile, "password", "", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, entryMap := common.AttachmentPaths(db)
+	entry, keyExists := entryMap[entryPath]
+	if !keyExists {
+		t.Fatalf("missing entry %s", entryPath)
+	}
+	return db, entry
+}
+
+func TestSeedYAML(t *testing.T) {
+	keepassFile, output := seedTestRun(t, filepath.Join("test-fixtures", "example.yaml"))
+	if !strings.Contains(output, "KDBX 4.0 (cipher ChaCha20, KDF Argon2id)") {
+		t.Errorf("unexpected output %q", output)
+	}
+	info, err := os.Stat(keepassFile)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600, got %v %v", info, err)
+	}
+	db, entry := seedTestEntry(t, keepassFile, "/example/Sample Entry")
+	for field, expected := range map[string]string{"UserName": "User Name", "Password": "Password", "URL": "https://keepass.info/", "Notes": "secret notes"} {
+		value, err := common.RevealField(db, entry, field)
+		if err != nil || string(value) != expected {
+			t.Errorf("%s: expected %q, got %q %v", field, expected, value, err)
+		}
+	}
+	for field, protected := range map[string]bool{"UserName": false, "Password": true, "Notes": true} {
+		if entry.Get(field).Value.Protected.Bool != protected {
+			t.Errorf("%s: expected protected %t", field, protected)
+		}
+	}
+	if tags := common.EntryTags(entry); strings.Join(tags, ",") != "linux,ssh" {
+		t.Errorf("unexpected tags %v", tags)
+	}
+	attachmentsMap, _ := common.AttachmentPaths(db)
+	for key, expected := range map[string]string{"/example/Sample Entry-id_ed25519.pub": "ssh-ed25519 AAAA\n", "/example/Sample Entry-note.txt": "inline attachment"} {
+		contents, err := common.ReadAttachment(db, attachmentsMap[key])
+		if err != nil || string(contents) != expected {
+			t.Errorf("%s: expected %q, got %q %v", key, expected, contents, err)
+		}
+	}
+	versions := common.EntryVersions(entry)
+	if len(versions) != 3 {
+		t.Fatalf("expected 3 versions, got %d", len(versions))
+	}
+	for i, expected := range []string{"first", "second", "Password"} {
+		value, err := common.RevealField(db, versions[i], "Password")
+		if err != nil || string(value) != expected {
+			t.Errorf("version %d: expected %q, got %q %v", i, expected, value, err)
+		}
+	}
+	if modified := versions[2].Times.LastModificationTime.Time; !modified.Equal(time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected modification time %s", modified)
+	}
+	// uuids derived from the path are those of the testharness builder
+	digest := sha256.Sum256([]byte("entry:/example/Sample Entry"))
+	if !bytes.Equal(entry.UUID[:], digest[:16]) {
+		t.Errorf("unexpected uuid %x", entry.UUID)
+	}
+
+	db, administrator := seedTestEntry(t, keepassFile, "0123456789ABCDEF0123456789ABCDEF")
+	if administrator.GetTitle() != "Administrator" {
+		t.Errorf("unexpected entry %s for the uuid", administrator.GetTitle())
+	}
+	if !administrator.Times.Expires.Bool || !administrator.Times.ExpiryTime.Time.Equal(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected expiry, got %v", administrator.Times.ExpiryTime)
+	}
+	if password := administrator.Get("Password"); password.Value.Protected.Bool || password.Value.Content != "secret" {
+		t.Errorf("expected an unprotected password, got %+v", password.Value)
+	}
+}
+
+func TestSeedJSON(t *testing.T) {
+	keepassFile, output := seedTestRun(t, filepath.Join("test-fixtures", "example.json"))
+	if !strings.Contains(output, "KDBX 3.1 (cipher AES-256, KDF AES-KDF)") {
+		t.Errorf("unexpected output %q", output)
+	}
+	db, entry := seedTestEntry(t, keepassFile, "/example/Sample Entry")
+	if value, err := common.RevealField(db, entry, "Password"); err != nil || string(value) != "Password" {
+		t.Errorf("unexpected password %q %v", value, err)
+	}
+}
+
+func TestSeedStableUUIDs(t *testing.T) {
+	specFile := filepath.Join("test-fixtures", "example.yaml")
+	first, _ := seedTestRun(t, specFile)
+	second, _ := seedTestRun(t, specFile)
+	_, firstEntry := seedTestEntry(t, first, "/example/Sample Entry")
+	_, secondEntry := seedTestEntry(t, second, "/example/Sample Entry")
+	if firstEntry.UUID != secondEntry.UUID {
+		t.Errorf("uuids differ between runs: %x %x", firstEntry.UUID, secondEntry.UUID)
+	}
+	spec, err := ReadSpec(specFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec.Namespace = "other"
+	db, err := spec.Build("test-fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Content.Root.Groups[0].Entries[0].UUID == firstEntry.UUID {
+		t.Error("expected the namespace to change the uuids")
+	}
+}
+
+func TestSeedFormats(t *testing.T) {
+	testCases := []struct {
+		expected string
+		spec     Spec
+	}{
+		{"KDBX 3.1 (cipher AES-256, KDF AES-KDF)", Spec{Version: "3.1", KDF: KDF{Rounds: 1}}},
+		{"KDBX 3.1 (cipher ChaCha20, KDF AES-KDF)", Spec{Version: "3.1", Cipher: "chacha20", KDF: KDF{Rounds: 1}}},
+		{"KDBX 4.0 (cipher ChaCha20, KDF Argon2d)", Spec{KDF: KDF{Iterations: 1, MemoryKiB: 1024}}},
+		{"KDBX 4.0 (cipher AES-256, KDF Argon2id)", Spec{Cipher: "aes-256", KDF: KDF{Type: "argon2id", Iterations: 1, MemoryKiB: 1024}}},
+		{"KDBX 4.0 (cipher AES-256, KDF AES-KDF)", Spec{Cipher: "aes-256", KDF: KDF{Type: "aes-kdf", Rounds: 1}}},
+		{"KDBX 4.1 (cipher ChaCha20, KDF Argon2id)", Spec{Version: "4.1", KDF: KDF{Type: "argon2id", Iterations: 1, MemoryKiB: 1024}}},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.expected, func(t *testing.T) {
+			spec := testCase.spec
+			spec.Password = "password"
+			spec.Groups = []Group{{Name: "example", Entries: []Entry{{Title: "Entry"}}}}
+			keepassFile := filepath.Join(t.TempDir(), "format.kdbx")
+			if err := spec.Write("", keepassFile); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(keepassFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			format, err := common.ReadDatabaseFormat(data)
+			if err != nil || format.String() != testCase.expected {
+				t.Errorf("expected %s, got %s %v", testCase.expected, format, err)
+			}
+			seedTestEntry(t, keepassFile, "/example/Entry")
+		})
+	}
+}
+
+func TestSeedErrors(t *testing.T) {
+	testCases := []struct {
+		name     string
+		spec     string
+		expected string
+	}{
+		{"unknown setting", "password: p\ncolor: blue\n", "field color not found"},
+		{"password", "groups: []\n", "The password must be provided"},
+		{"version", "password: p\nversion: \"5.0\"\n", "Unsupported version"},
+		{"kdf", "password: p\nversion: \"3.1\"\nkdf: {type: argon2d}\n", "Unsupported kdf"},
+		{"duplicate uuid", "password: p\ngroups: [{name: a, entries: [{title: x}, {title: x}]}]\n", "Duplicate uuid of entry /a/x"},
+		{"attachment", "password: p\ngroups: [{name: a, entries: [{title: x, attachments: [{name: f}]}]}]\n", "must have either a file or content"},
+		{"field", "password: p\ngroups: [{name: a, entries: [{title: x, fields: {Password: {secret: true}}}]}]\n", "unknown setting secret"},
+		{"time", "password: p\ngroups: [{name: a, expires: tomorrow}]\n", "Invalid RFC3339 time: tomorrow"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			specFile := filepath.Join(t.TempDir(), "spec.yaml")
+			if err := os.WriteFile(specFile, []byte(testCase.spec), 0644); err != nil {
+				t.Fatal(err)
+			}
+			err := Seed(specFile, filepath.Join(t.TempDir(), "seed.kdbx"), "")
+			if err == nil || !strings.Contains(err.Error(), testCase.expected) {
+				t.Errorf("expected an error containing %q, got %v", testCase.expected, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,443 @@
+// Package seed builds keepass databases from a declarative YAML or JSON spec, for test fixtures.
+package seed
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"packer-plugin-keepass/common"
+
+	"github.com/google/uuid"
+	"github.com/tobischo/gokeepasslib/v3"
+	w "github.com/tobischo/gokeepasslib/v3/wrappers"
+	"gopkg.in/yaml.v2"
+)
+
+// Time of all groups and entries which do not set their own, so that the fixtures are reproducible
+var DefaultTime = time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type Spec struct {
+	Version     string  `yaml:"version"`
+	Password    string  `yaml:"password"`
+	Cipher      string  `yaml:"cipher"`
+	KDF         KDF     `yaml:"kdf"`
+	Compression *bool   `yaml:"compression"`
+	Namespace   string  `yaml:"namespace"`
+	Time        string  `yaml:"time"`
+	Groups      []Group `yaml:"groups"`
+}
+
+type KDF struct {
+	Type        string `yaml:"type"`
+	Rounds      uint64 `yaml:"rounds"`
+	Iterations  uint64 `yaml:"iterations"`
+	MemoryKiB   uint64 `yaml:"memory_kib"`
+	Parallelism uint32 `yaml:"parallelism"`
+}
+
+type Group struct {
+	Name    string  `yaml:"name"`
+	UUID    string  `yaml:"uuid"`
+	Expires string  `yaml:"expires"`
+	Groups  []Group `yaml:"groups"`
+	Entries []Entry `yaml:"entries"`
+}
+
+// Fields map keys to a string, or to a map with the value and whether it is protected.
+// History holds the previous versions of the entry, oldest first.
+type Entry struct {
+	Title       string        `yaml:"title"`
+	UUID        string        `yaml:"uuid"`
+	Fields      yaml.MapSlice `yaml:"fields"`
+	Tags        []string      `yaml:"tags"`
+	Expires     string        `yaml:"expires"`
+	Modified    string        `yaml:"modified"`
+	Attachments []Attachment  `yaml:"attachments"`
+	History     []Entry       `yaml:"history"`
+}
+
+// The contents are read from the file, relative to the spec, or given inline
+type Attachment struct {
+	Name    string `yaml:"name"`
+	File    string `yaml:"file"`
+	Content string `yaml:"content"`
+}
+
+// Fields protected unless the spec says otherwise, as in the default keepass memory protection
+var defaultProtectedFields = map[string]bool{"Password": true}
+
+// Reads a spec file, JSON specs are read as YAML
+func ReadSpec(specFile string) (*Spec, error) {
+	data, err := os.ReadFile(specFile)
+	if err != nil {
+		return nil, err
+	}
+	spec := &Spec{}
+	if err := yaml.UnmarshalStrict(data, spec); err != nil {
+		return nil, fmt.Errorf("Unable to parse %s: %s", specFile, err)
+	}
+	return spec, nil
+}
+
+// Builds the database described by the spec, attachment files are relative to baseDir.
+// Protected values are unlocked, as expected by EncodeDatabase after LockProtectedEntries.
+func (s *Spec) Build(baseDir string) (*gokeepasslib.Database, error) {
+	builder := &builder{spec: s, baseDir: baseDir, uuids: map[gokeepasslib.UUID]string{}}
+	var err error
+	if builder.time, err = parseTime(s.Time, DefaultTime.Format(time.RFC3339)); err != nil {
+		return nil, err
+	}
+	db, err := s.newDatabase()
+	if err != nil {
+		return nil, err
+	}
+	builder.db = db
+	db.Content.Root.Groups = nil
+	for _, group := range s.Groups {
+		built, err := builder.group("", group)
+		if err != nil {
+			return nil, err
+		}
+		db.Content.Root.Groups = append(db.Content.Root.Groups, built)
+	}
+	return db, nil
+}
+
+// Builds the database and writes it encrypted to the output file
+func (s *Spec) Write(baseDir string, outputFile string) error {
+	db, err := s.Build(baseDir)
+	if err != nil {
+		return err
+	}
+	if err := db.LockProtectedEntries(); err != nil {
+		return err
+	}
+	var buffer bytes.Buffer
+	if err := common.EncodeDatabase(db, &buffer); err != nil {
+		return err
+	}
+	return os.WriteFile(outputFile, buffer.Bytes(), 0600)
+}
+
+// Creates an empty database with the version, cipher and kdf of the spec
+func (s *Spec) newDatabase() (*gokeepasslib.Database, error) {
+	var db *gokeepasslib.Database
+	switch s.Version {
+	case "3.1":
+		db = gokeepasslib.NewDatabase(gokeepasslib.WithDatabaseKDBXVersion3())
+	case "", "4.0", "4.1":
+		db = gokeepasslib.NewDatabase(gokeepasslib.WithDatabaseKDBXVersion4())
+		if s.Version == "4.1" {
+			signature := *db.Header.Signature
+			signature.MinorVersion = 1
+			db.Header.Signature = &signature
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported version \"%s\", must be 3.1, 4.0 or 4.1", s.Version)
+	}
+	if s.Password == "" {
+		return nil, fmt.Errorf("The password must be provided")
+	}
+	db.Credentials = gokeepasslib.NewPasswordCredentials(s.Password)
+	headers := db.Header.FileHeaders
+	switch s.Cipher {
+	case "":
+	case "aes-256":
+		headers.CipherID = gokeepasslib.CipherAES
+		headers.EncryptionIV = make([]byte, 16)
+	case "chacha20":
+		headers.CipherID = gokeepasslib.CipherChaCha20
+		headers.EncryptionIV = make([]byte, 12)
+	default:
+		return nil, fmt.Errorf("Unsupported cipher \"%s\", must be aes-256 or chacha20", s.Cipher)
+	}
+	if _, err := rand.Read(headers.EncryptionIV); err != nil {
+		return nil, err
+	}
+	if s.Compression != nil && !*s.Compression {
+		headers.CompressionFlags = gokeepasslib.NoCompressionFlag
+	}
+	if !db.Header.IsKdbx4() {
+		if s.KDF.Type != "" && s.KDF.Type != "aes-kdf" {
+			return nil, fmt.Errorf("Unsupported kdf \"%s\" for version 3.1, must be aes-kdf", s.KDF.Type)
+		}
+		if s.KDF.Rounds > 0 {
+			headers.TransformRounds = s.KDF.Rounds
+		}
+		return db, nil
+	}
+	parameters := headers.KdfParameters
+	switch s.KDF.Type {
+	case "", "argon2d":
+	case "argon2id":
+		parameters.UUID = common.KdfArgon2id
+	case "aes-kdf":
+		parameters = &gokeepasslib.KdfParameters{UUID: gokeepasslib.KdfAES4, Rounds: 6000}
+		if _, err := rand.Read(parameters.Salt[:]); err != nil {
+			return nil, err
+		}
+		if s.KDF.Rounds > 0 {
+			parameters.Rounds = s.KDF.Rounds
+		}
+		headers.KdfParameters = parameters
+		return db, nil
+	default:
+		return nil, fmt.Errorf("Unsupported kdf \"%s\", must be aes-kdf, argon2d or argon2id", s.KDF.Type)
+	}
+	if s.KDF.Iterations > 0 {
+		parameters.Iterations = s.KDF.Iterations
+	}
+	if s.KDF.MemoryKiB > 0 {
+		parameters.Memory = s.KDF.MemoryKiB * 1024
+	}
+	if s.KDF.Parallelism > 0 {
+		parameters.Parallelism = s.KDF.Parallelism
+	}
+	return db, nil
+}
+
+type builder struct {
+	spec    *Spec
+	baseDir string
+	db      *gokeepasslib.Database
+	time    time.Time
+	// paths of the groups and entries by uuid, to report duplicates
+	uuids map[gokeepasslib.UUID]string
+}
+
+func (b *builder) group(parentPath string, group Group) (gokeepasslib.Group, error) {
+	groupPath := parentPath + "/" + group.Name
+	built := gokeepasslib.NewGroup()
+	if group.Name == "" {
+		return built, fmt.Errorf("Group in %s has no name", parentPath+"/")
+	}
+	built.Name = group.Name
+	var err error
+	if built.UUID, err = b.uuid("group", groupPath, group.UUID); err != nil {
+		return built, err
+	}
+	if built.Times, err = b.times(groupPath, "", group.Expires); err != nil {
+		return built, err
+	}
+	for _, entry := range group.Entries {
+		builtEntry, err := b.entry(groupPath, entry)
+		if err != nil {
+			return built, err
+		}
+		built.Entries = append(built.Entries, builtEntry)
+	}
+	for _, child := range group.Groups {
+		builtChild, err := b.group(groupPath, child)
+		if err != nil {
+			return built, err
+		}
+		built.Groups = append(built.Groups, builtChild)
+	}
+	return built, nil
+}
+
+func (b *builder) entry(groupPath string, entry Entry) (gokeepasslib.Entry, error) {
+	entryPath := groupPath + "/" + entry.Title
+	built := gokeepasslib.NewEntry()
+	if entry.Title == "" {
+		return built, fmt.Errorf("Entry in %s has no title", groupPath)
+	}
+	var err error
+	if built.UUID, err = b.uuid("entry", entryPath, entry.UUID); err != nil {
+		return built, err
+	}
+	for _, version := range entry.History {
+		if version.Title == "" {
+			version.Title = entry.Title
+		}
+		if len(version.History) > 0 {
+			return built, fmt.Errorf("Entry %s: history versions cannot have a history", entryPath)
+		}
+		previous, err := b.version(entryPath, version)
+		if err != nil {
+			return built, err
+		}
+		previous.UUID = built.UUID
+		if len(built.Histories) == 0 {
+			built.Histories = []gokeepasslib.History{{}}
+		}
+		built.Histories[0].Entries = append(built.Histories[0].Entries, previous)
+	}
+	current, err := b.version(entryPath, entry)
+	if err != nil {
+		return built, err
+	}
+	current.UUID = built.UUID
+	current.Histories = built.Histories
+	return current, nil
+}
+
+// Builds the values, tags, times and attachments of a version of an entry
+func (b *builder) version(entryPath string, entry Entry) (gokeepasslib.Entry, error) {
+	built := gokeepasslib.NewEntry()
+	var err error
+	if built.Times, err = b.times(entryPath, entry.Modified, entry.Expires); err != nil {
+		return built, err
+	}
+	built.Values = append(built.Values, gokeepasslib.ValueData{Key: "Title", Value: gokeepasslib.V{Content: entry.Title}})
+	for _, field := range entry.Fields {
+		key := fmt.Sprint(field.Key)
+		if key == "Title" {
+			return built, fmt.Errorf("Entry %s: the Title is taken from the title of the entry", entryPath)
+		}
+		value, protected, err := fieldValue(key, field.Value)
+		if err != nil {
+			return built, fmt.Errorf("Entry %s: %s", entryPath, err)
+		}
+		valueData := gokeepasslib.ValueData{Key: key, Value: gokeepasslib.V{Content: value}}
+		if protected {
+			valueData.Value.Protected = w.NewBoolWrapper(true)
+		}
+		built.Values = append(built.Values, valueData)
+	}
+	for _, tag := range entry.Tags {
+		if built.Tags != "" {
+			built.Tags += ";"
+		}
+		built.Tags += tag
+	}
+	for _, attachment := range entry.Attachments {
+		contents, err := b.attachment(attachment)
+		if err != nil {
+			return built, fmt.Errorf("Entry %s: %s", entryPath, err)
+		}
+		built.Binaries = append(built.Binaries, gokeepasslib.NewBinaryReference(attachment.Name, common.AddBinary(b.db, contents)))
+	}
+	return built, nil
+}
+
+// Returns the value of a field and whether it is protected
+func fieldValue(key string, value interface{}) (string, bool, error) {
+	switch typed := value.(type) {
+	case yaml.MapSlice:
+		var content string
+		protected := defaultProtectedFields[key]
+		for _, item := range typed {
+			switch item.Key {
+			case "value":
+				content = fmt.Sprint(item.Value)
+			case "protected":
+				flag, ok := item.Value.(bool)
+				if !ok {
+					return "", false, fmt.Errorf("protected of field %s must be true or false", key)
+				}
+				protected = flag
+			default:
+				return "", false, fmt.Errorf("unknown setting %v of field %s, must be value or protected", item.Key, key)
+			}
+		}
+		return content, protected, nil
+	case nil:
+		return "", defaultProtectedFields[key], nil
+	default:
+		return fmt.Sprint(typed), defaultProtectedFields[key], nil
+	}
+}
+
+func (b *builder) attachment(attachment Attachment) ([]byte, error) {
+	if attachment.Name == "" {
+		return nil, fmt.Errorf("attachment has no name")
+	}
+	if (attachment.File == "") == (attachment.Content == "") {
+		return nil, fmt.Errorf("attachment %s must have either a file or content", attachment.Name)
+	}
+	if attachment.Content != "" {
+		return []byte(attachment.Content), nil
+	}
+	attachmentFile := attachment.File
+	if !filepath.IsAbs(attachmentFile) {
+		attachmentFile = filepath.Join(b.baseDir, attachmentFile)
+	}
+	return os.ReadFile(attachmentFile)
+}
+
+// Parses the uuid given in the spec, or derives it from the path and namespace so that uuid keys are stable.
+// Without a namespace the uuids are those of the testharness database builder.
+func (b *builder) uuid(kind string, itemPath string, value string) (gokeepasslib.UUID, error) {
+	result := gokeepasslib.UUID{}
+	if value != "" {
+		parsed, err := uuid.Parse(value)
+		if err != nil {
+			return result, fmt.Errorf("Invalid uuid of %s %s: %s", kind, itemPath, err)
+		}
+		copy(result[:], parsed[:])
+	} else {
+		result = DeterministicUUID(b.spec.Namespace, kind, itemPath)
+	}
+	if other, keyExists := b.uuids[result]; keyExists {
+		return result, fmt.Errorf("Duplicate uuid of %s %s and %s, set a uuid to tell them apart", kind, itemPath, other)
+	}
+	b.uuids[result] = itemPath
+	return result, nil
+}
+
+// Derives a stable uuid from the kind ("group" or "entry") and path of an item in the namespace, so that
+// uuid keys do not change between runs. Shared with the testharness database builder, which uses no namespace.
+func DeterministicUUID(namespace string, kind string, itemPath string) gokeepasslib.UUID {
+	seed := kind + ":" + itemPath
+	if namespace != "" {
+		seed = namespace + "/" + seed
+	}
+	digest := sha256.Sum256([]byte(seed))
+	result := gokeepasslib.UUID{}
+	copy(result[:], digest[:])
+	return result
+}
+
+// Times of a group or entry created and last modified at the given times, kdbx 4 stores them as base64
+// seconds rather than formatted. Shared with the testharness database builder.
+func FixedTimes(db *gokeepasslib.Database, created time.Time, modified time.Time) gokeepasslib.TimeData {
+	formatted := !db.Header.IsKdbx4()
+	times := gokeepasslib.NewTimeData()
+	times.CreationTime = &w.TimeWrapper{Formatted: formatted, Time: created}
+	times.LastModificationTime = &w.TimeWrapper{Formatted: formatted, Time: modified}
+	times.LastAccessTime = &w.TimeWrapper{Formatted: formatted, Time: modified}
+	times.LocationChanged = &w.TimeWrapper{Formatted: formatted, Time: created}
+	times.ExpiryTime = &w.TimeWrapper{Formatted: formatted, Time: created}
+	return times
+}
+
+// Times of a group or entry, the expiry is only enabled when the spec sets it
+func (b *builder) times(itemPath string, modified string, expires string) (gokeepasslib.TimeData, error) {
+	modifiedTime, err := parseTime(modified, "")
+	if err != nil {
+		return gokeepasslib.NewTimeData(), fmt.Errorf("%s: %s", itemPath, err)
+	}
+	if modifiedTime.IsZero() {
+		modifiedTime = b.time
+	}
+	times := FixedTimes(b.db, b.time, modifiedTime)
+	if expires != "" {
+		expiryTime, err := parseTime(expires, "")
+		if err != nil {
+			return times, fmt.Errorf("%s: %s", itemPath, err)
+		}
+		times.ExpiryTime.Time = expiryTime
+		times.Expires = w.NewBoolWrapper(true)
+	}
+	return times, nil
+}
+
+func parseTime(value string, defaultValue string) (time.Time, error) {
+	if value == "" {
+		value = defaultValue
+	}
+	if value == "" {
+		return time.Time{}, nil
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid RFC3339 time: %s", value)
+	}
+	return parsed.UTC(), nil
+}
@@ -0,0 +1,130 @@
+package testharness
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// A file uploaded to the guest
+type Upload struct {
+	Path string
+	Data []byte
+	Mode os.FileMode
+}
+
+// Implements packer.Communicator by recording the commands and uploads instead of running them.
+// Uploaded files are kept in Files, keyed by their path on the guest, and are served to Download.
+type Communicator struct {
+	Commands []string
+	Uploads  []Upload
+	Files    map[string][]byte
+	// Returns the standard output and exit status of a command, commands succeed without output if nil
+	Respond func(command string) (string, int)
+
+	mutex sync.Mutex
+	plan  []string
+}
+
+func (c *Communicator) Start(ctx context.Context, cmd *packer.RemoteCmd) error {
+	c.mutex.Lock()
+	c.Commands = append(c.Commands, cmd.Command)
+	c.plan = append(c.plan, "run    "+cmd.Command)
+	respond := c.Respond
+	c.mutex.Unlock()
+	stdout, exitStatus := "", 0
+	if respond != nil {
+		stdout, exitStatus = respond(cmd.Command)
+	}
+	go func() {
+		if cmd.Stdout != nil && stdout != "" {
+			io.Copy(cmd.Stdout, strings.NewReader(stdout))
+		}
+		cmd.SetExited(exitStatus)
+	}()
+	return nil
+}
+
+func (c *Communicator) Upload(path string, reader io.Reader, fileInfo *os.FileInfo) error {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	var mode os.FileMode
+	if fileInfo != nil && *fileInfo != nil {
+		mode = (*fileInfo).Mode().Perm()
+	}
+	c.record(Upload{Path: path, Data: data, Mode: mode})
+	return nil
+}
+
+// Records each file below src, with the contents of src itself uploaded into dst if it ends with a slash
+func (c *Communicator) UploadDir(dst string, src string, exclude []string) error {
+	base := src
+	if !strings.HasSuffix(src, "/") {
+		base = filepath.Dir(src)
+	}
+	return filepath.Walk(src, func(localPath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		relative, err := filepath.Rel(base, localPath)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(localPath)
+		if err != nil {
+			return err
+		}
+		c.record(Upload{Path: strings.TrimSuffix(dst, "/") + "/" + filepath.ToSlash(relative), Data: data, Mode: info.Mode().Perm()})
+		return nil
+	})
+}
+
+func (c *Communicator) Download(path string, writer io.Writer) error {
+	c.mutex.Lock()
+	data, keyExists := c.Files[path]
+	c.mutex.Unlock()
+	if !keyExists {
+		return fmt.Errorf("No such file on the guest: %s", path)
+	}
+	_, err := writer.Write(data)
+	return err
+}
+
+func (c *Communicator) DownloadDir(src string, dst string, exclude []string) error {
+	return fmt.Errorf("DownloadDir is not supported by the test communicator")
+}
+
+func (c *Communicator) record(upload Upload) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.Uploads = append(c.Uploads, upload)
+	if c.Files == nil {
+		c.Files = map[string][]byte{}
+	}
+	c.Files[upload.Path] = upload.Data
+	digest := sha256.Sum256(upload.Data)
+	c.plan = append(c.plan, fmt.Sprintf("upload %s %04o %d sha256:%s", upload.Path, upload.Mode, len(upload.Data), hex.EncodeToString(digest[:])))
+}
+
+// Describes the commands and uploads in the order they were made, one per line, with the mode,
+// size and SHA-256 digest of each upload. The files of a directory are in the order of the walk.
+func (c *Communicator) Plan() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var plan bytes.Buffer
+	for _, line := range c.plan {
+		plan.WriteString(line + "\n")
+	}
+	return plan.String()
+}
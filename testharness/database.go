@@ -0,0 +1,177 @@
+// Package testharness runs the provisioners and data sources in process, against databases
+// built in memory, a recording communicator and a capturing ui.
+package testharness
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"packer-plugin-keepass/common"
+	"packer-plugin-keepass/seed"
+
+	"github.com/tobischo/gokeepasslib/v3"
+	w "github.com/tobischo/gokeepasslib/v3/wrappers"
+)
+
+// Master password of the databases written by the builder
+const Password = "password"
+
+// Creation and modification time of all groups and entries, so that builds are reproducible
+var Time = seed.DefaultTime
+
+// Builds a keepass database from entry paths, groups are created as needed in the order they are referenced
+type Database struct {
+	options []gokeepasslib.DatabaseOption
+	root    *group
+}
+
+type group struct {
+	name    string
+	path    string
+	groups  []*group
+	entries []*Entry
+}
+
+// An entry of the database under construction
+type Entry struct {
+	path        string
+	values      []gokeepasslib.ValueData
+	tags        string
+	attachments []attachment
+}
+
+type attachment struct {
+	name     string
+	contents []byte
+}
+
+// Creates a database builder, a kdbx 4 database is written unless a version option is given
+func NewDatabase(options ...gokeepasslib.DatabaseOption) *Database {
+	return &Database{options: options, root: &group{}}
+}
+
+// Adds an entry at the path, such as /example/Sample Entry, with the key and value pairs as its
+// values. The Title is taken from the path and the Password value is protected.
+func (d *Database) Entry(entryPath string, keyValues ...string) *Entry {
+	dir, title := entryPath[:strings.LastIndex(entryPath, "/")], entryPath[strings.LastIndex(entryPath, "/")+1:]
+	parent := d.group(dir)
+	entry := &Entry{path: entryPath}
+	entry.values = append(entry.values, gokeepasslib.ValueData{Key: "Title", Value: gokeepasslib.V{Content: title}})
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		valueData := gokeepasslib.ValueData{Key: keyValues[i], Value: gokeepasslib.V{Content: keyValues[i+1]}}
+		if keyValues[i] == "Password" {
+			valueData.Value.Protected = w.NewBoolWrapper(true)
+		}
+		entry.values = append(entry.values, valueData)
+	}
+	parent.entries = append(parent.entries, entry)
+	return entry
+}
+
+// Adds a file attachment to the entry
+func (e *Entry) Attach(name string, contents []byte) *Entry {
+	e.attachments = append(e.attachments, attachment{name: name, contents: contents})
+	return e
+}
+
+// Sets the tags of the entry
+func (e *Entry) Tags(tags ...string) *Entry {
+	e.tags = strings.Join(tags, ";")
+	return e
+}
+
+// Finds or creates the group at the path
+func (d *Database) group(groupPath string) *group {
+	current := d.root
+	for _, name := range strings.Split(strings.Trim(groupPath, "/"), "/") {
+		var next *group
+		for _, child := range current.groups {
+			if child.name == name {
+				next = child
+			}
+		}
+		if next == nil {
+			next = &group{name: name, path: current.path + "/" + name}
+			current.groups = append(current.groups, next)
+		}
+		current = next
+	}
+	return current
+}
+
+// Returns the gokeepasslib model of the database, with protected values unlocked
+func (d *Database) Build() *gokeepasslib.Database {
+	db := gokeepasslib.NewDatabase(d.options...)
+	db.Credentials = gokeepasslib.NewPasswordCredentials(Password)
+	if db.Header.IsKdbx4() {
+		// keep the tests fast
+		db.Header.FileHeaders.KdfParameters.Memory = 1024 * 1024
+		db.Header.FileHeaders.KdfParameters.Iterations = 1
+	} else {
+		db.Header.FileHeaders.TransformRounds = 1
+	}
+	db.Content.Root.Groups = nil
+	for _, child := range d.root.groups {
+		db.Content.Root.Groups = append(db.Content.Root.Groups, d.buildGroup(db, child))
+	}
+	return db
+}
+
+func (d *Database) buildGroup(db *gokeepasslib.Database, source *group) gokeepasslib.Group {
+	built := gokeepasslib.NewGroup()
+	built.UUID = seed.DeterministicUUID("", "group", source.path)
+	built.Name = source.name
+	built.Times = seed.FixedTimes(db, Time, Time)
+	for _, entry := range source.entries {
+		builtEntry := gokeepasslib.NewEntry()
+		builtEntry.UUID = seed.DeterministicUUID("", "entry", entry.path)
+		builtEntry.Times = seed.FixedTimes(db, Time, Time)
+		builtEntry.Values = append([]gokeepasslib.ValueData{}, entry.values...)
+		builtEntry.Tags = entry.tags
+		for _, attachment := range entry.attachments {
+			builtEntry.Binaries = append(builtEntry.Binaries, gokeepasslib.NewBinaryReference(attachment.name, common.AddBinary(db, attachment.contents)))
+		}
+		built.Entries = append(built.Entries, builtEntry)
+	}
+	for _, child := range source.groups {
+		built.Groups = append(built.Groups, d.buildGroup(db, child))
+	}
+	return built
+}
+
+// Encodes the database with the Password
+func (d *Database) Bytes(t testing.TB) []byte {
+	t.Helper()
+	db := d.Build()
+	if err := db.LockProtectedEntries(); err != nil {
+		t.Fatal(err)
+	}
+	var buffer bytes.Buffer
+	if err := gokeepasslib.NewEncoder(&buffer).Encode(db); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+// Writes the encoded database to a file in a temporary directory of the test and returns its path
+func (d *Database) WriteFile(t testing.TB, name string) string {
+	t.Helper()
+	keepassFile := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(keepassFile, d.Bytes(t), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return keepassFile
+}
+
+// Builds the database of a seed spec file into a temporary directory of the test and returns its path
+func Seed(t testing.TB, specFile string) string {
+	t.Helper()
+	keepassFile := filepath.Join(t.TempDir(), strings.TrimSuffix(filepath.Base(specFile), filepath.Ext(specFile))+".kdbx")
+	if err := seed.Seed(specFile, keepassFile, ""); err != nil {
+		t.Fatal(err)
+	}
+	return keepassFile
+}
@@ -0,0 +1,32 @@
+package testharness
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "Update the golden files of the tests")
+
+// Compares the output with test-fixtures/<name>.golden, which is rewritten when run with -update
+func Golden(t testing.TB, name string, actual string) {
+	t.Helper()
+	goldenFile := filepath.Join("test-fixtures", name+".golden")
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(goldenFile), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(goldenFile, []byte(actual), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	expected, err := os.ReadFile(goldenFile)
+	if err != nil {
+		t.Fatalf("Unable to read %s, run the test with -update to create it: %s", goldenFile, err)
+	}
+	if string(expected) != actual {
+		t.Errorf("Output does not match %s, run the test with -update if the change is intended\n--- expected\n%s--- actual\n%s", goldenFile, expected, actual)
+	}
+}
@@ -0,0 +1,74 @@
+package testharness
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Implements packer.Ui by capturing the output, each line prefixed with the method that wrote it
+type Ui struct {
+	// Answers returned by Ask in order
+	Answers []string
+
+	mutex sync.Mutex
+	lines []string
+}
+
+func (u *Ui) Ask(query string) (string, error) {
+	u.write("ask", query)
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if len(u.Answers) == 0 {
+		return "", fmt.Errorf("No answer for: %s", query)
+	}
+	answer := u.Answers[0]
+	u.Answers = u.Answers[1:]
+	return answer, nil
+}
+
+func (u *Ui) Say(message string) {
+	u.write("say", message)
+}
+
+func (u *Ui) Message(message string) {
+	u.write("message", message)
+}
+
+func (u *Ui) Error(message string) {
+	u.write("error", message)
+}
+
+func (u *Ui) Machine(category string, args ...string) {
+	u.write("machine", strings.Join(append([]string{category}, args...), ","))
+}
+
+// Progress is not tracked, the stream is returned as is
+func (u *Ui) TrackProgress(src string, currentSize, totalSize int64, stream io.ReadCloser) io.ReadCloser {
+	return stream
+}
+
+func (u *Ui) write(kind string, message string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	for _, line := range strings.Split(message, "\n") {
+		u.lines = append(u.lines, fmt.Sprintf("%s: %s", kind, line))
+	}
+}
+
+// Returns the captured lines
+func (u *Ui) Lines() []string {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return append([]string{}, u.lines...)
+}
+
+// Returns the captured output, one line per line written
+func (u *Ui) Output() string {
+	lines := u.Lines()
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}